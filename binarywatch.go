@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exitReplaced is the exit status of a daemon that exits because its
+// executable was replaced, such as by go install. The next request
+// starts the new one.
+const exitReplaced = 3
+
+// binaryCheckInterval is how often an idle daemon checks whether its
+// executable was replaced.
+const binaryCheckInterval = 10 * time.Second
+
+// binaryRecheck is how long the requests that follow a check reuse its
+// result rather than checking again.
+const binaryRecheck = time.Second
+
+// A binaryWatch detects the replacement of an executable on disk: by a
+// different file renamed into place, or by writing over it.
+type binaryWatch struct {
+	path    string
+	orig    os.FileInfo
+	recheck time.Duration
+
+	mu       sync.Mutex
+	checked  time.Time
+	replaced bool
+}
+
+// newBinaryWatch returns a binaryWatch for the executable at path, as
+// it is now, or nil if it can't be found.
+func newBinaryWatch(path string, recheck time.Duration) *binaryWatch {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return &binaryWatch{path: path, orig: fi, recheck: recheck}
+}
+
+// Replaced reports whether the executable was replaced, looking at it
+// at most once per w.recheck. Once replaced, it stays replaced.
+func (w *binaryWatch) Replaced() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.replaced || time.Since(w.checked) < w.recheck {
+		return w.replaced
+	}
+	w.checked = time.Now()
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		// It may be missing for a moment while it is replaced.
+		return false
+	}
+	w.replaced = !os.SameFile(fi, w.orig) || !fi.ModTime().Equal(w.orig.ModTime()) || fi.Size() != w.orig.Size()
+	return w.replaced
+}
+
+// watchBinary makes the daemon exit once w reports its executable
+// replaced, checked every binaryCheckInterval and at the start of each
+// request, by s.begin.
+func (s *Server) watchBinary(w *binaryWatch) {
+	s.binary = w
+	go func() {
+		for !w.Replaced() {
+			time.Sleep(binaryCheckInterval)
+		}
+		s.exitReplaced()
+	}()
+}
+
+// begin records the start of a request, which lasts until the returned
+// func is called. Once the executable is replaced, new requests wait
+// for the daemon to exit, and are retried by their clients with the
+// new one.
+func (s *Server) begin() (end func()) {
+	if s.binary != nil && s.binary.Replaced() {
+		s.exitReplaced()
+	}
+	s.requests.RLock()
+	return s.requests.RUnlock
+}
+
+// replyDelay is how long the daemon waits after serving the requests
+// in flight before exiting, to let the replies reach the clients. It
+// is replaced by tests.
+var replyDelay = time.Second
+
+// exitReplaced makes the daemon exit with exitReplaced. It first stops
+// accepting connections, so that new clients start the new daemon
+// rather than wait for this one, and exits once the requests in flight
+// are served and a refresh of the reference index in progress is
+// saved.
+func (s *Server) exitReplaced() {
+	s.exitOnce.Do(func() {
+		go func() {
+			log.Printf("%s was replaced; exiting once the requests in flight are served", s.binary.path)
+			if s.lis != nil {
+				s.lis.Close()
+			}
+			s.requests.Lock()
+			refIndexMu.Lock()
+			time.Sleep(replyDelay)
+			exitClosed(exitReplaced)
+		}()
+	})
+}
+
+// exitClosed exits with code once the listener of the daemon was
+// closed, which removed its unix socket. A new daemon may have written
+// its pid file since, so it is only removed if it is still this one's.
+// It is replaced by tests.
+var exitClosed = func(code int) {
+	pidFile := getDaemonPidPath()
+	if data, err := ioutil.ReadFile(pidFile); err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		_ = os.Remove(pidFile)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBinaryWatch(t *testing.T) {
+	dir := t.TempDir()
+
+	exe := filepath.Join(dir, "gocode")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(name, contents string, mtime time.Time) {
+		t.Helper()
+		if err := ioutil.WriteFile(name, []byte(contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	install := func(contents string, mtime time.Time) {
+		t.Helper()
+		// As go install does, through a file renamed into place.
+		tmp := filepath.Join(dir, "gocode.tmp")
+		write(tmp, contents, mtime)
+		if err := os.Rename(tmp, exe); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(exe, "old binary", mtime)
+	if w := newBinaryWatch(filepath.Join(dir, "missing"), 0); w != nil {
+		t.Errorf("watching a missing executable")
+	}
+	w := newBinaryWatch(exe, 0)
+	if w.Replaced() {
+		t.Fatal("replaced before anything happened")
+	}
+
+	// Being replaced, it may be missing for a moment.
+	if err := os.Rename(exe, exe+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Replaced() {
+		t.Error("replaced while missing")
+	}
+
+	// Another file, even of the same size and time. The old one is
+	// kept, so that its inode isn't reused.
+	install("new binary", mtime)
+	if !w.Replaced() {
+		t.Error("not replaced by another file")
+	}
+	// It stays replaced.
+	write(exe, "old binary", mtime)
+	if !w.Replaced() {
+		t.Error("no longer replaced")
+	}
+
+	// Written over.
+	w = newBinaryWatch(exe, 0)
+	write(exe, "new binary", mtime.Add(time.Minute))
+	if !w.Replaced() {
+		t.Error("not replaced by writing over it")
+	}
+
+	// Requests reuse the result of a recent check.
+	w = newBinaryWatch(exe, time.Hour)
+	if w.Replaced() {
+		t.Fatal("replaced before anything happened")
+	}
+	install("newer binary", mtime)
+	if w.Replaced() {
+		t.Error("checked again within the recheck interval")
+	}
+	w.checked = time.Time{}
+	if !w.Replaced() {
+		t.Error("not replaced once checked again")
+	}
+}
+
+func TestExitReplaced(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	s := &Server{binary: &binaryWatch{path: "gocode"}, lis: lis}
+
+	defer func(orig time.Duration) { replyDelay = orig }(replyDelay)
+	replyDelay = 0
+	exited := make(chan int, 1)
+	defer func(orig func(int)) { exitClosed = orig }(exitClosed)
+	exitClosed = func(code int) {
+		// Release what the exit path holds, which the process
+		// would by exiting.
+		refIndexMu.Unlock()
+		exited <- code
+	}
+
+	end := s.begin()
+	s.exitReplaced()
+
+	// New connections are refused while the request in flight is
+	// served.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still accepting connections")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-exited:
+		t.Fatal("exited before the request in flight was served")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	end()
+	select {
+	case code := <-exited:
+		if code != exitReplaced {
+			t.Errorf("exited with %d, want %d", code, exitReplaced)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't exit once the request was served")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+// canonicalTTL is how long the resolved spelling of a directory is
+// reused before its symlinks are resolved again.
+const canonicalTTL = time.Minute
+
+// canonicalDirs caches the directories of the files of requests with
+// their symlinks resolved.
+var canonicalDirs = struct {
+	sync.Mutex
+	m map[string]canonicalDir
+}{m: make(map[string]canonicalDir)}
+
+type canonicalDir struct {
+	dir      string
+	resolved time.Time
+}
+
+// evalSymlinks is filepath.EvalSymlinks, replaced by tests.
+var evalSymlinks = filepath.EvalSymlinks
+
+// canonicalFilename returns filename with the symlinks of its
+// directory resolved, so that a file reached through a symlinked
+// project root is keyed, by the server and the caches, like the same
+// file reached directly. The file itself isn't resolved, as a symlinked
+// file belongs to the package of the directory it is linked from. It
+// returns filename if the directory can't be resolved.
+func canonicalFilename(filename string) string {
+	if filename == "" || !filepath.IsAbs(filename) {
+		return filename
+	}
+	dir, file := filepath.Split(filename)
+	dir = filepath.Clean(dir)
+
+	canonicalDirs.Lock()
+	c, ok := canonicalDirs.m[dir]
+	canonicalDirs.Unlock()
+	if ok && time.Since(c.resolved) < canonicalTTL {
+		return filepath.Join(c.dir, file)
+	}
+
+	// Resolving symlinks may stat a slow file system, such as a
+	// network mount, so other requests aren't held up meanwhile.
+	real, err := evalSymlinks(dir)
+	if err != nil {
+		return filename
+	}
+	canonicalDirs.Lock()
+	if len(canonicalDirs.m) >= 1000 {
+		canonicalDirs.m = make(map[string]canonicalDir)
+	}
+	canonicalDirs.m[dir] = canonicalDir{real, time.Now()}
+	canonicalDirs.Unlock()
+	return filepath.Join(real, file)
+}
+
+// pathSpelling maps the canonical directory of a request's file back
+// to the directory as the client spelled it. The paths in responses,
+// the positions of the package's declarations and diagnostics, are in
+// that directory.
+type pathSpelling struct {
+	canon, orig string
+}
+
+// newPathSpelling returns the spelling of orig, a filename sent by a
+// client, whose canonical form is canon.
+func newPathSpelling(orig, canon string) pathSpelling {
+	o, c := filepath.Dir(orig), filepath.Dir(canon)
+	if o == c {
+		return pathSpelling{}
+	}
+	return pathSpelling{canon: c, orig: o}
+}
+
+// restore returns s, which may contain canonical paths, such as a
+// position or a diagnostic, with the canonical directory spelled as
+// the client did.
+func (p pathSpelling) restore(s string) string {
+	if p.canon == "" {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, p.canon)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(p.canon)
+		b.WriteString(s[:i])
+		if end == len(s) || s[end] == filepath.Separator || strings.IndexByte(":; ", s[end]) >= 0 {
+			b.WriteString(p.orig)
+		} else {
+			// Only a prefix of another element.
+			b.WriteString(p.canon)
+		}
+		s = s[end:]
+	}
+}
+
+// restoreResult spells the paths of r as the client did.
+func (p pathSpelling) restoreResult(r *suggest.Result) {
+	p.restoreCandidates(r.Candidates)
+	for i, d := range r.Diagnostics {
+		r.Diagnostics[i] = p.restore(d)
+	}
+}
+
+// restoreCandidates spells the positions of candidates as the client
+// did.
+func (p pathSpelling) restoreCandidates(candidates []suggest.Candidate) {
+	if p.canon == "" {
+		return
+	}
+	for i := range candidates {
+		candidates[i].Pos = p.restore(candidates[i].Pos)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newSymlinkedRoot writes files below a temporary directory, and
+// returns the directory with its symlinks resolved and a symlink to it.
+func newSymlinkedRoot(t *testing.T, files map[string]string) (real, link string) {
+	t.Helper()
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	real = filepath.Join(tmp, "work", "proj")
+	for name, src := range files {
+		name = filepath.Join(real, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link = filepath.Join(tmp, "src")
+	if err := os.Symlink(real, link); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	return real, link
+}
+
+func TestCanonicalFilename(t *testing.T) {
+	real, link := newSymlinkedRoot(t, map[string]string{"p/p.go": "package p\n"})
+
+	for _, test := range []struct{ filename, want string }{
+		{filepath.Join(link, "p", "p.go"), filepath.Join(real, "p", "p.go")},
+		{filepath.Join(real, "p", "p.go"), filepath.Join(real, "p", "p.go")},
+		// Unsaved files are resolved too.
+		{filepath.Join(link, "p", "new.go"), filepath.Join(real, "p", "new.go")},
+		{filepath.Join(link, "missing", "x.go"), filepath.Join(link, "missing", "x.go")},
+		{"relative.go", "relative.go"},
+	} {
+		if got := canonicalFilename(test.filename); got != test.want {
+			t.Errorf("canonicalFilename(%q) = %q, want %q", test.filename, got, test.want)
+		}
+	}
+
+	sp := newPathSpelling(filepath.Join(link, "p", "p.go"), filepath.Join(real, "p", "p.go"))
+	pdir := filepath.Join(real, "p")
+	for in, want := range map[string]string{
+		filepath.Join(pdir, "p.go") + ":3:6":              filepath.Join(link, "p", "p.go") + ":3:6",
+		"found packages p (p.go) and q (q.go) in " + pdir: "found packages p (p.go) and q (q.go) in " + filepath.Join(link, "p"),
+		filepath.Join(real, "p2", "p.go") + ":1:1":        filepath.Join(real, "p2", "p.go") + ":1:1",
+		filepath.Join(real, "other", "o.go") + ":1:1":     filepath.Join(real, "other", "o.go") + ":1:1",
+	} {
+		if got := sp.restore(in); got != want {
+			t.Errorf("restore(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCanonicalFilenameSlowResolve(t *testing.T) {
+	real, link := newSymlinkedRoot(t, map[string]string{"p/p.go": "package p\n", "q/q.go": "package q\n"})
+	cached := filepath.Join(link, "p", "p.go")
+	canonicalFilename(cached)
+
+	// While the directory of q is resolved, that of p, already
+	// resolved, is still served.
+	defer func(orig func(string) (string, error)) { evalSymlinks = orig }(evalSymlinks)
+	resolving, unblock := make(chan bool), make(chan bool)
+	evalSymlinks = func(dir string) (string, error) {
+		resolving <- true
+		<-unblock
+		return filepath.EvalSymlinks(dir)
+	}
+	done := make(chan string)
+	go func() { done <- canonicalFilename(filepath.Join(link, "q", "q.go")) }()
+	<-resolving
+	if got, want := canonicalFilename(cached), filepath.Join(real, "p", "p.go"); got != want {
+		t.Errorf("canonicalFilename(%q) = %q, want %q", cached, got, want)
+	}
+	close(unblock)
+	if got, want := <-done, filepath.Join(real, "q", "q.go"); got != want {
+		t.Errorf("slow resolution: got %q, want %q", got, want)
+	}
+}
+
+func TestSymlinkedRoot(t *testing.T) {
+	const src = "package p\n\nfunc Alpha() {}\n\nfunc f() {\n\tAl\n}\n"
+	real, link := newSymlinkedRoot(t, map[string]string{
+		"p/p.go":     src,
+		"p/other.go": "package p\n\nfunc Also() {}\n",
+	})
+
+	s := Server{}
+	complete := func(filename string, generation int64, outline bool) *AutoCompleteReply {
+		req := AutoCompleteRequest{
+			Filename:   filename,
+			Data:       []byte(src),
+			Cursor:     strings.Index(src, "Al\n") + 2,
+			Diff:       true,
+			Generation: generation,
+			Outline:    outline,
+		}
+		var res AutoCompleteReply
+		if err := s.AutoComplete(&req, &res); err != nil {
+			t.Fatal(err)
+		}
+		return &res
+	}
+
+	// The state of the file is shared by both spellings: the
+	// second response is a delta against the first.
+	first := complete(filepath.Join(real, "p", "p.go"), 0, false)
+	if len(first.Candidates) != 2 {
+		t.Fatalf("got candidates %v, want Also and Alpha", first.Candidates)
+	}
+	second := complete(filepath.Join(link, "p", "p.go"), first.Generation, false)
+	if second.Delta == nil {
+		t.Errorf("the request through the symlink got no delta against the previous one")
+	}
+
+	// Positions are spelled as the client did.
+	res := complete(filepath.Join(link, "p", "p.go"), 0, true)
+	if len(res.Candidates) == 0 {
+		t.Fatal("no outline")
+	}
+	for _, c := range res.Candidates {
+		if !strings.HasPrefix(c.Pos, filepath.Join(link, "p")+string(filepath.Separator)) {
+			t.Errorf("%s: got position %s, want it below %s", c.Name, c.Pos, link)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/build"
@@ -9,12 +10,15 @@ import (
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"runtime/debug"
 
 	"github.com/mdempsky/gocode/internal/cache"
+	"github.com/mdempsky/gocode/internal/fswalk"
 	"github.com/mdempsky/gocode/internal/suggest"
 )
 
@@ -35,8 +39,12 @@ func doClient() {
 	if flag.NArg() > 0 {
 		command = flag.Arg(0)
 		switch command {
-		case "autocomplete", "exit":
+		case "autocomplete", "outline", "imports", "warm", "warm-std", "stats", "reload", "exit":
 			// these are valid commands
+		case "schema":
+			// doesn't need the server
+			cmdSchema()
+			return
 		case "close":
 			// "close" is an alias for "exit"
 			command = "exit"
@@ -47,30 +55,29 @@ func doClient() {
 	}
 
 	// client
-	var client *rpc.Client
+	var client *daemon
 	if *g_sock != "none" {
 		addr := *g_addr
 		if *g_sock == "unix" {
 			addr = getSocketPath()
 		}
+		client = &daemon{
+			network: *g_sock,
+			addr:    addr,
+			retry:   *g_retry && command != "exit",
+			start:   tryStartServer,
+			logFile: getDaemonLogPath(),
+			pidFile: getDaemonPidPath(),
+		}
 
 		var err error
-		client, err = rpc.Dial(*g_sock, addr)
+		client.Client, err = rpc.Dial(*g_sock, addr)
 		if err != nil {
 			if command == "exit" {
 				log.Fatal(err)
 			}
-
-			if *g_sock == "unix" {
-				_ = os.Remove(addr)
-			}
-			err = tryStartServer()
-			if err != nil {
-				log.Fatalf("Failed to start server: %s\n", err)
-			}
-			client, err = tryToConnect(*g_sock, addr)
-			if err != nil {
-				log.Fatalf("Failed to connect to %q: %s\n", addr, err)
+			if err := client.restart(); err != nil {
+				log.Fatal(err)
 			}
 		}
 		defer client.Close()
@@ -79,6 +86,18 @@ func doClient() {
 	switch command {
 	case "autocomplete":
 		cmdAutoComplete(client)
+	case "outline":
+		cmdOutline(client)
+	case "imports":
+		cmdImports(client)
+	case "warm":
+		cmdWarm(client)
+	case "warm-std":
+		cmdWarmStd(client)
+	case "stats":
+		cmdStats(client)
+	case "reload":
+		cmdReload(client)
 	case "exit":
 		cmdExit(client)
 	}
@@ -86,9 +105,33 @@ func doClient() {
 
 func tryStartServer() error {
 	path := get_executable_filename()
-	args := []string{os.Args[0], "-s", "-sock", *g_sock, "-addr", *g_addr}
+	args := []string{os.Args[0], "-s", "-sock", *g_sock, "-addr", *g_addr,
+		"-install-concurrency", strconv.Itoa(*g_install_concurrency),
+		"-go-env-ttl", g_go_env_ttl.String(),
+		"-symlinks", *g_symlinks}
+	if !*g_exit_when_replaced {
+		args = append(args, "-exit-when-replaced=false")
+	}
+	if *g_sandbox_root != "" {
+		root, _ := filepath.Abs(*g_sandbox_root)
+		args = append(args, "-sandbox-root", root)
+	}
 	if *g_cache {
 		args = append(args, "-cache")
+		if *g_cache_max_bytes > 0 {
+			args = append(args, "-cache-max-bytes", strconv.FormatInt(*g_cache_max_bytes, 10))
+		}
+	}
+	if *g_ref_index != "" {
+		root, _ := filepath.Abs(*g_ref_index)
+		args = append(args, "-ref-index", root)
+	}
+	if *g_preload != "" {
+		preload, _ := filepath.Abs(*g_preload)
+		args = append(args, "-preload", preload)
+		if *g_fallback_to_source {
+			args = append(args, "-fallback-to-source")
+		}
 	}
 	cwd, _ := os.Getwd()
 
@@ -97,16 +140,15 @@ func tryStartServer() error {
 	if err != nil {
 		return err
 	}
-	stdout, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
-	if err != nil {
-		return err
-	}
-	stderr, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	// The log is shown if the daemon dies while serving a request,
+	// including what the previous daemon wrote before it died.
+	logFile, err := openDaemonLog(getDaemonLogPath())
 	if err != nil {
 		return err
 	}
+	defer logFile.Close()
 
-	procattr := os.ProcAttr{Dir: cwd, Env: os.Environ(), Files: []*os.File{stdin, stdout, stderr}}
+	procattr := os.ProcAttr{Dir: cwd, Env: os.Environ(), Files: []*os.File{stdin, logFile, logFile}}
 	p, err := os.StartProcess(path, args, &procattr)
 	if err != nil {
 		return err
@@ -115,6 +157,19 @@ func tryStartServer() error {
 	return p.Release()
 }
 
+// maxDaemonLogBytes is the size beyond which the log of the previous
+// daemons is moved to a ".1" file when a daemon starts.
+const maxDaemonLogBytes = 1 << 20
+
+// openDaemonLog opens the daemon log at path for a new daemon to
+// append to.
+func openDaemonLog(path string) (*os.File, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Size() > maxDaemonLogBytes {
+		os.Rename(path, path+".1")
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
 func tryToConnect(network, address string) (*rpc.Client, error) {
 	start := time.Now()
 	for {
@@ -126,36 +181,337 @@ func tryToConnect(network, address string) (*rpc.Client, error) {
 	}
 }
 
-func cmdAutoComplete(c *rpc.Client) {
+func cmdAutoComplete(c *daemon) {
 	var req AutoCompleteRequest
 	req.Filename, req.Data, req.Cursor = prepareFilenameDataCursor()
-	req.Context = cache.PackContext(&build.Default)
+	req.Cursors = prepareCursors(req.Data)
+	callAutoComplete(c, &req)
+}
+
+func cmdOutline(c *daemon) {
+	var req AutoCompleteRequest
+	req.Filename, req.Data, _ = prepareFilenameDataCursor()
+	req.Cursor = len(req.Data)
+	req.Outline = true
+	callAutoComplete(c, &req)
+}
+
+func callAutoComplete(c *daemon, req *AutoCompleteRequest) {
+	f, err := lookupFormatter(*g_format)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req.Context = packContext(filepath.Dir(req.Filename))
 	req.Source = *g_source
 	req.Builtin = *g_builtin
 	req.IgnoreCase = *g_ignore_case
 	req.UnimportedPackages = *g_unimported_packages
 	req.FallbackToSource = *g_fallback_to_source
+	req.Skeletons = *g_skeletons
+	req.TypeHints = *g_type_hints
+	req.Details = *g_details
+	req.CgoInternals = *g_cgo_internals
+	req.Snippets = *g_snippets
+	req.QualifiedTypes = *g_qualified_types
+	req.Indent = *g_indent
+	req.LineWidth = *g_line_width
+	req.Explain = *g_explain
+	req.NamesOnly = *g_names_only
+	req.GoVersions = *g_go_versions
+	req.HideUnexportedPromotions = *g_hide_unexported_promotions
+	req.EmbedPatterns = *g_embed_patterns
+	if *g_allowed_packages != "" {
+		req.AllowedPackages = strings.Split(*g_allowed_packages, ",")
+	}
+	req.CallHints = *g_call_hints
+	req.InsertParens = *g_insert_parens
+	req.Implementers = *g_implementers
+	req.PackageDoc = *g_package_doc
+	req.IndexOnlyLines = *g_index_only_lines
+	req.MaxChainLinks = *g_max_chain_links
+	req.CheckCache = *g_check_cache
+	req.ReferenceWeight = *g_ref_weight
+	switch *g_sort {
+	case "kind":
+	case "position":
+		req.SortByPosition = true
+	default:
+		log.Fatalf("unknown -sort %q", *g_sort)
+	}
+	req.Prefix = *g_prefix
+	req.MarkUnaddressable = *g_mark_unaddressable
+	req.MaxResponseBytes = *g_max_response_bytes
+	req.Deadline = *g_deadline
+	req.Loader = *g_loader
+	req.Refresh = *g_refresh
+	req.NoGb = *g_no_gb
+	req.ExportDirs = exportDirs()
+	if *g_diff_generation >= 0 && *g_format == "json" {
+		req.Diff, req.Generation = true, *g_diff_generation
+	}
 
 	var res AutoCompleteReply
+	if c == nil {
+		s := Server{refs: openRefIndex()}
+		if s.refs != nil {
+			if _, err := s.refs.Refresh(); err != nil {
+				log.Printf("ref index: %v", err)
+			}
+		}
+		err = s.AutoComplete(req, &res)
+	} else {
+		err = c.Call("Server.AutoComplete", req, &res)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(req.Cursors) > 0 {
+		// One result set per cursor, in order.
+		for i, r := range res.Results {
+			if r.Err != "" {
+				log.Printf("cursor %d: %s", req.Cursors[i], r.Err)
+			}
+			if err := f.Format(os.Stdout, suggest.Response{
+				Candidates:  r.Candidates,
+				Len:         r.Len,
+				Replace:     r.Replace,
+				Status:      suggest.Status{OperandValues: r.OperandValues, Truncated: r.Truncated},
+				Diagnostics: r.Diagnostics,
+				Rejections:  r.Rejections,
+			}); err != nil {
+				log.Fatal(err)
+			}
+			os.Stdout.WriteString("\n")
+		}
+		return
+	}
+	resp := suggest.Response{
+		Candidates: res.Candidates,
+		Len:        res.Len,
+		Replace:    res.Replace,
+		Status: suggest.Status{
+			Truncated:     res.Truncated,
+			Partial:       res.Partial,
+			PackageDoc:    res.PackageDoc,
+			OperandValues: res.OperandValues,
+		},
+		Diff:       req.Diff,
+		Generation: res.Generation,
+		Delta:      res.Delta,
+
+		Diagnostics: res.Diagnostics,
+		Rejections:  res.Rejections,
+	}
+	if *g_format != "json" {
+		for _, d := range resp.Diagnostics {
+			log.Print(d)
+		}
+		for _, r := range resp.Rejections {
+			log.Printf("left out %s %s.%s: %s", r.Class, r.PkgPath, r.Name, r.Reason)
+		}
+		if resp.Truncated {
+			log.Printf("only the first %d candidates fit in -max-response-bytes", len(res.Candidates))
+		}
+		if resp.Partial {
+			log.Printf("imports took longer than -deadline, candidates may be missing")
+		}
+	}
+	if err := f.Format(os.Stdout, resp); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func cmdSchema() {
+	b, err := suggest.Schema(reflect.TypeOf(AutoCompleteRequest{}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
+
+func cmdImports(c *daemon) {
+	if flag.NArg() != 2 {
+		log.Fatal("usage: gocode imports <path>")
+	}
+	var req ImportsRequest
+	req.Filename, _ = filepath.Abs(flag.Arg(1))
+	req.Context = packContext(filepath.Dir(req.Filename))
+	req.ExportDirs = exportDirs()
+	req.NoGb = *g_no_gb
+	var res ImportsReply
+	if err := callServer(c, "Imports", &req, &res); err != nil {
+		log.Fatal(err)
+	}
+	json.NewEncoder(os.Stdout).Encode(res)
+}
+
+// cmdWarm imports into the cache every package imported by the Go
+// files in a directory, or in a directory tree if it ends in "/...",
+// that isn't already cached. It prints the status of the imports of
+// each file as a line of json.
+func cmdWarm(c *daemon) {
+	if flag.NArg() != 2 {
+		log.Fatal("usage: gocode warm <dir>[/...]")
+	}
+	dir, recursive := flag.Arg(1), false
+	if strings.HasSuffix(dir, "/...") {
+		dir, recursive = strings.TrimSuffix(dir, "/..."), true
+	}
+	dir, _ = filepath.Abs(dir)
+
+	var files []string
+	err := fswalk.WalkPackages(dir, symlinkPolicy(), *g_walk_ignored, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".go") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := packContext(dir)
+	enc := json.NewEncoder(os.Stdout)
+	for _, file := range files {
+		req := ImportsRequest{Filename: file, Context: ctx, ExportDirs: exportDirs(), NoGb: *g_no_gb}
+		var res ImportsReply
+		if err := callServer(c, "Imports", &req, &res); err != nil {
+			log.Printf("%s: %v", file, err)
+			continue
+		}
+		warm := WarmRequest{
+			Filename:         file,
+			Context:          ctx,
+			ExportDirs:       req.ExportDirs,
+			NoGb:             req.NoGb,
+			FallbackToSource: *g_fallback_to_source,
+		}
+		for _, imp := range res.Imports {
+			if imp.Status == cache.StatusStale || imp.Status == cache.StatusSource {
+				warm.Paths = append(warm.Paths, imp.Path)
+			}
+		}
+		if len(warm.Paths) > 0 {
+			var warmed ImportsReply
+			if err := callServer(c, "Warm", &warm, &warmed); err != nil {
+				log.Printf("%s: %v", file, err)
+				continue
+			}
+			res = mergeImports(res, warmed)
+		}
+		enc.Encode(res)
+	}
+}
+
+// mergeImports replaces the statuses in res with those in warmed.
+func mergeImports(res, warmed ImportsReply) ImportsReply {
+	byPath := make(map[string]ImportStatus)
+	for _, imp := range warmed.Imports {
+		byPath[imp.Path] = imp
+	}
+	for i, imp := range res.Imports {
+		if w, ok := byPath[imp.Path]; ok {
+			res.Imports[i] = w
+		}
+	}
+	return res
+}
+
+// callServer calls the named Server method, in process if c is nil.
+func callServer(c *daemon, method string, req, res interface{}) error {
+	if c != nil {
+		return c.Call("Server."+method, req, res)
+	}
+	s := Server{cache: *g_cache}
+	switch method {
+	case "Imports":
+		return s.Imports(req.(*ImportsRequest), res.(*ImportsReply))
+	case "Warm":
+		return s.Warm(req.(*WarmRequest), res.(*ImportsReply))
+	}
+	return fmt.Errorf("unknown method %s", method)
+}
+
+// packContext returns the build context sent to the server for the
+// files of dir, with the mappings of -extra-src-dirs, and then those
+// of the workspace of dir, which a mapping of the same prefix given
+// with -extra-src-dirs overrides.
+func packContext(dir string) cache.PackedContext {
+	ctx := cache.PackContext(&build.Default)
+	if *g_extra_src_dirs != "" {
+		dirs, err := cache.ParseSrcDirs(*g_extra_src_dirs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctx.ExtraSrcDirs = dirs
+	}
+	dirs, err := cache.WorkspaceSrcDirs(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx.ExtraSrcDirs = append(ctx.ExtraSrcDirs, dirs...)
+	return ctx
+}
+
+func exportDirs() []string {
+	if *g_export_dirs == "" {
+		return nil
+	}
+	return filepath.SplitList(*g_export_dirs)
+}
+
+// symlinkPolicy returns the policy set by -symlinks.
+func symlinkPolicy() fswalk.Policy {
+	p, err := fswalk.ParsePolicy(*g_symlinks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+func cmdStats(c *daemon) {
+	var req StatsRequest
+	var res StatsReply
 	var err error
 	if c == nil {
 		s := Server{}
-		err = s.AutoComplete(&req, &res)
+		err = s.Stats(&req, &res)
 	} else {
-		err = c.Call("Server.AutoComplete", &req, &res)
+		err = c.Call("Server.Stats", &req, &res)
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	json.NewEncoder(os.Stdout).Encode(res)
+}
 
-	fmt := suggest.Formatters[*g_format]
-	if fmt == nil {
-		fmt = suggest.NiceFormat
+func cmdReload(c *daemon) {
+	var req ReloadRequest
+	var res ReloadReply
+	var err error
+	if c == nil {
+		s := Server{}
+		err = s.Reload(&req, &res)
+	} else {
+		err = c.Call("Server.Reload", &req, &res)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
-	fmt(os.Stdout, res.Candidates, res.Len)
 }
 
-func cmdExit(c *rpc.Client) {
+func cmdExit(c *daemon) {
 	if c == nil {
 		return
 	}
@@ -184,7 +540,11 @@ func prepareFilenameDataCursor() (string, []byte, int) {
 	offset := ""
 	switch flag.NArg() {
 	case 2:
-		offset = flag.Arg(1)
+		if flag.Arg(0) == "outline" {
+			filename = flag.Arg(1)
+		} else {
+			offset = flag.Arg(1)
+		}
 	case 3:
 		filename = flag.Arg(1) // Override default filename
 		offset = flag.Arg(2)
@@ -194,6 +554,24 @@ func prepareFilenameDataCursor() (string, []byte, int) {
 		filename, _ = filepath.Abs(filename)
 	}
 
+	return filename, file, parseOffset(file, offset)
+}
+
+// prepareCursors returns the cursors of a multi-cursor request, given
+// as a comma-separated offset list (e.g., "12,c40,97"), or nil.
+func prepareCursors(file []byte) []int {
+	offsets := strings.Split(flag.Arg(flag.NArg()-1), ",")
+	if len(offsets) < 2 {
+		return nil
+	}
+	cursors := make([]int, len(offsets))
+	for i, offset := range offsets {
+		cursors[i] = parseOffset(file, offset)
+	}
+	return cursors
+}
+
+func parseOffset(file []byte, offset string) int {
 	cursor := -1
 	if offset != "" {
 		if offset[0] == 'c' || offset[0] == 'C' {
@@ -203,6 +581,5 @@ func prepareFilenameDataCursor() (string, []byte, int) {
 			cursor, _ = strconv.Atoi(offset)
 		}
 	}
-
-	return filename, file, cursor
+	return cursor
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// daemonLogLines is the number of lines of the daemon's log shown when
+// the connection to it fails.
+const daemonLogLines = 10
+
+// daemon is a connection to the gocode daemon.
+type daemon struct {
+	*rpc.Client
+	network, addr string
+
+	// retry allows one restart of the daemon, and retry of the
+	// call, after the connection fails.
+	retry bool
+	start func() error // starts a new daemon
+
+	logFile string // the daemon's stdout and stderr
+	pidFile string // the daemon's process id
+}
+
+// restart starts a new daemon and connects to it.
+func (d *daemon) restart() error {
+	if d.network == "unix" {
+		_ = os.Remove(d.addr)
+	}
+	if err := d.start(); err != nil {
+		return fmt.Errorf("Failed to start server: %s", err)
+	}
+	c, err := tryToConnect(d.network, d.addr)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to %q: %s", d.addr, err)
+	}
+	d.Client = c
+	return nil
+}
+
+// Call is like rpc.Client.Call, but if the connection to the daemon
+// fails, as when the daemon is killed while serving the call, it
+// restarts the daemon and retries the call once, if d.retry is set.
+// Otherwise, the error is a *daemonError describing the daemon.
+func (d *daemon) Call(method string, args, reply interface{}) error {
+	err := d.Client.Call(method, args, reply)
+	if !isConnError(err) {
+		return err
+	}
+	if d.retry {
+		d.retry = false
+		d.Client.Close()
+		if rerr := d.restart(); rerr != nil {
+			return d.failure(fmt.Errorf("%v; restarting: %v", err, rerr))
+		}
+		err = d.Client.Call(method, args, reply)
+		if !isConnError(err) {
+			return err
+		}
+	}
+	return d.failure(err)
+}
+
+// isConnError reports whether err is a failure of the connection
+// rather than an error returned by the daemon.
+func isConnError(err error) bool {
+	switch err.(type) {
+	case nil, rpc.ServerError:
+		return false
+	case *net.OpError:
+		return true
+	}
+	return err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// daemonError describes a daemon whose connection failed.
+type daemonError struct {
+	Addr    string
+	Pid     int // 0 if unknown
+	LogFile string
+	Log     []string // the last lines of LogFile
+	Err     error
+}
+
+func (e *daemonError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "gocode daemon at %s", e.Addr)
+	if e.Pid != 0 {
+		fmt.Fprintf(&buf, " (pid %d)", e.Pid)
+	}
+	fmt.Fprintf(&buf, " failed: %v", e.Err)
+	if len(e.Log) > 0 {
+		fmt.Fprintf(&buf, "\nlast lines of %s:", e.LogFile)
+		for _, line := range e.Log {
+			fmt.Fprintf(&buf, "\n\t%s", line)
+		}
+	}
+	return buf.String()
+}
+
+// failure returns a *daemonError for the failed connection to d.
+func (d *daemon) failure(err error) error {
+	e := &daemonError{Addr: d.addr, LogFile: d.logFile, Err: err}
+	if data, err := ioutil.ReadFile(d.pidFile); err == nil {
+		e.Pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if data, err := ioutil.ReadFile(d.logFile); err == nil {
+		lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		if len(lines) > daemonLogLines {
+			lines = lines[len(lines)-daemonLogLines:]
+		}
+		if len(lines) > 1 || lines[0] != "" {
+			e.Log = lines
+		}
+	}
+	return e
+}
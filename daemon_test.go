@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type echoServer struct{}
+
+func (echoServer) Echo(req *string, res *string) error {
+	*res = *req
+	return nil
+}
+
+// dyingDaemon listens on addr, and closes the first connection it
+// accepts after reading the request, as a daemon killed between
+// accepting a request and replying to it would.
+func dyingDaemon(t *testing.T, addr string) {
+	t.Helper()
+	lis, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer lis.Close()
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 512))
+		conn.Close()
+	}()
+}
+
+// echoDaemon starts a daemon on addr serving echoServer.
+func echoDaemon(addr string) error {
+	lis, err := net.Listen("unix", addr)
+	if err != nil {
+		return err
+	}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Server", echoServer{}); err != nil {
+		return err
+	}
+	go srv.Accept(lis)
+	return nil
+}
+
+func TestDaemonDies(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs unix sockets")
+	}
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "daemon.log")
+	pidFile := filepath.Join(dir, "daemon.pid")
+	if err := ioutil.WriteFile(logFile, []byte("starting\nfatal error: runtime: out of memory\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pidFile, []byte("4242\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, retry := range []bool{true, false} {
+		addr := filepath.Join(dir, "sock")
+		dyingDaemon(t, addr)
+		client, err := rpc.Dial("unix", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		starts := 0
+		d := &daemon{
+			Client:  client,
+			network: "unix",
+			addr:    addr,
+			retry:   retry,
+			start: func() error {
+				starts++
+				return echoDaemon(addr)
+			},
+			logFile: logFile,
+			pidFile: pidFile,
+		}
+
+		req, res := "hello", ""
+		err = d.Call("Server.Echo", &req, &res)
+		d.Close()
+		os.Remove(addr)
+		if retry {
+			if err != nil || res != req || starts != 1 {
+				t.Errorf("with retry: got %q, %v after %d restarts, want %q after 1", res, err, starts, req)
+			}
+			continue
+		}
+
+		if starts != 0 {
+			t.Errorf("without retry: restarted %d times", starts)
+		}
+		derr, ok := err.(*daemonError)
+		if !ok {
+			t.Fatalf("without retry: got error %v, want a *daemonError", err)
+		}
+		if derr.Addr != addr || derr.Pid != 4242 {
+			t.Errorf("without retry: got daemon %s pid %d, want %s pid 4242", derr.Addr, derr.Pid, addr)
+		}
+		if msg := err.Error(); !strings.Contains(msg, addr) || !strings.Contains(msg, "out of memory") {
+			t.Errorf("without retry: error %q lacks the socket or the log", msg)
+		}
+	}
+}
+
+// testDaemonEnv is set in the environment of the daemons started by
+// tests, which are the test binary itself.
+const testDaemonEnv = "GOCODE_TEST_DAEMON"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testDaemonEnv) != "" {
+		fmt.Fprintln(os.Stderr, "test daemon started")
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestStartServerKeepsLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the socket path is under TMPDIR on unix only")
+	}
+	t.Setenv("TMPDIR", t.TempDir())
+	t.Setenv(testDaemonEnv, "1")
+	logFile := getDaemonLogPath()
+	const crash = "fatal error: runtime: out of memory\n"
+	if err := ioutil.WriteFile(logFile, []byte(crash), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The daemon started is the test binary, which exits at once.
+	if err := tryStartServer(); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ = ioutil.ReadFile(logFile)
+		if strings.Contains(string(data), "test daemon started") {
+			break
+		}
+	}
+	if !strings.HasPrefix(string(data), crash) || !strings.Contains(string(data), "test daemon started") {
+		t.Errorf("got log %q, want the crash followed by the new daemon's output", data)
+	}
+}
@@ -0,0 +1,168 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Candidate is a completion candidate.
+type Candidate struct {
+	// ID identifies the symbol of the candidate. It is derived from
+	// the path of the declaring package, the receiver type of a
+	// method and the name only, so it is the same in every response,
+	// also from different daemons, until the symbol is renamed or
+	// moved. Fields and local declarations with the same name in a
+	// package share an ID. The symbols of the package being completed
+	// are identified by its import path, as when imported elsewhere.
+	ID string `json:"id,omitempty"`
+
+	// PkgPath and Type are left out when empty, such as the PkgPath
+	// of a local symbol, the Type of a package, or both with names
+	// only.
+	Class    string `json:"class"`
+	PkgPath  string `json:"package,omitempty"`
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Receiver string `json:"receiver,omitempty"`
+	Pos      string `json:"pos,omitempty"`
+	Origin   string `json:"origin,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+
+	// ArgsCount, ResultsCount and CallableNoArgs describe the
+	// signature of a func candidate. They are only set if requested.
+	ArgsCount      int  `json:"args_count,omitempty"`
+	ResultsCount   int  `json:"results_count,omitempty"`
+	CallableNoArgs bool `json:"callable_no_args,omitempty"`
+
+	// Label is the text to display, InsertText the text to insert,
+	// with "$1" marking where the arguments of a call go, and
+	// FilterText the text to match against what was typed. Each is
+	// only set if it isn't Name, such as for a call with parentheses,
+	// when requested; Name is used otherwise.
+	Label      string `json:"label,omitempty"`
+	InsertText string `json:"insert_text,omitempty"`
+	FilterText string `json:"filter_text,omitempty"`
+
+	// Unaddressable marks a method with a pointer receiver that
+	// can't be called on the operand, because it isn't addressable.
+	Unaddressable bool `json:"unaddressable,omitempty"`
+
+	// Constraint marks a type candidate that can be used as a type
+	// parameter constraint: an interface, possibly with type elements.
+	Constraint bool `json:"constraint,omitempty"`
+
+	// Const is the value of a const candidate, if it is known.
+	Const *ConstValue `json:"const,omitempty"`
+
+	// Implements is set on a type candidate that implements the
+	// interface expected at the cursor: "value" if its values do,
+	// "pointer" if only pointers to it do. InsertText is then the
+	// expression making such a value, such as "&T{}".
+	Implements string `json:"implements,omitempty"`
+
+	// Importable marks an import candidate, a directory proposed in
+	// the path of an import spec, that holds an importable package:
+	// buildable Go files of a package other than main.
+	Importable bool `json:"importable,omitempty"`
+
+	// Alias is set on an import candidate whose package name is
+	// taken by another import of the file, and Import is then the
+	// import spec to write instead of the path alone, such as
+	// `storageclient "cloud.google.com/go/storage/client"`. Import
+	// is also set on the members of a package that isn't imported,
+	// to the spec importing it, such as `"strings"`.
+	Alias  string `json:"alias,omitempty"`
+	Import string `json:"import,omitempty"`
+
+	// GoVersion is the go directive of the go.mod of the module
+	// declaring the candidate, such as "1.21", when requested, if
+	// it isn't in the standard library and the module has one.
+	GoVersion string `json:"go_version,omitempty"`
+
+	// Explain tells why the candidate is proposed where it is
+	// listed, when requested.
+	Explain *Explanation `json:"explain,omitempty"`
+}
+
+// Suggestion returns the text to insert for output formats without
+// placeholders: InsertText up to "$1", if it isn't Name, and otherwise
+// Name, followed by "()" or "(" for a func.
+func (c Candidate) Suggestion() string {
+	if c.InsertText != "" && c.InsertText != c.Name {
+		if i := strings.Index(c.InsertText, "$1"); i >= 0 {
+			return c.InsertText[:i]
+		}
+		return c.InsertText
+	}
+	switch {
+	case c.Class != "func":
+		return c.Name
+	case strings.HasPrefix(c.Type, "func()"):
+		return c.Name + "()"
+	default:
+		return c.Name + "("
+	}
+}
+
+func (c Candidate) String() string {
+	label := c.label()
+	if c.Class == "func" {
+		return fmt.Sprintf("%s %s%s", c.Class, label, strings.TrimPrefix(c.Type, "func"))
+	}
+	return fmt.Sprintf("%s %s %s", c.Class, label, c.Type)
+}
+
+// label returns c.Label, or c.Name for a candidate made without one.
+func (c Candidate) label() string {
+	if c.Label == "" {
+		return c.Name
+	}
+	return c.Label
+}
+
+// ConstValue describes the value of a const candidate.
+type ConstValue struct {
+	Value string `json:"value"` // at most 64 characters
+	Typed bool   `json:"typed"` // false for untyped constants
+}
+
+// Explanation tells why a candidate is proposed where it is listed. It
+// is only set when requested. It holds every input of the order of the
+// candidates: they aren't ranked by the proximity of their declaration
+// to the cursor, and deprecated symbols aren't hidden, so neither is
+// reported.
+type Explanation struct {
+	// Match is how the candidate matches the identifier typed:
+	// "prefix", "ignore-case", or "class" if the identifier is the
+	// name of a class, such as "func", which proposes the whole
+	// class.
+	Match string `json:"match"`
+
+	// FitsContext is set if the candidate fits the context of the
+	// cursor best, such as the key type of a map being indexed, or a
+	// callable after "defer". Such candidates are listed first.
+	FitsContext bool `json:"fits_context,omitempty"`
+
+	// References is how many times the candidate is referred to in
+	// the workspace, and Rank the rank derived from it, which orders
+	// the candidates of a class.
+	References int `json:"references,omitempty"`
+	Rank       int `json:"rank,omitempty"`
+}
+
+// Delta describes how to turn one candidate list into another. It lets
+// diff mode responses carry only the changes while the user keeps
+// typing the same identifier.
+type Delta struct {
+	// Removed holds indices into the old list, in increasing order.
+	Removed []int `json:"removed,omitempty"`
+	// Added holds candidates new to the list, in increasing order
+	// of their index in the new list.
+	Added []AddedCandidate `json:"added,omitempty"`
+}
+
+// AddedCandidate is a candidate inserted at Index of the new list.
+type AddedCandidate struct {
+	Index int `json:"index"`
+	Candidate
+}
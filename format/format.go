@@ -0,0 +1,69 @@
+// Package format defines the completion responses of gocode, as
+// written by its output formats. Formatter plugins, loaded with
+// -f=plugin:path, implement Formatter with these types.
+package format
+
+import "io"
+
+// Response is a completion response, as written by a Formatter.
+type Response struct {
+	Candidates []Candidate
+	Len        int   // the length of the identifier being completed
+	Replace    Range // the identifier the candidates replace
+	Status
+
+	// Diagnostics describe problems of the file that completion
+	// works around.
+	Diagnostics []string
+
+	// Rejections are the symbols matching the identifier being
+	// completed that aren't proposed.
+	Rejections []Rejection
+
+	// Diff is set for a diff mode request. If Delta is non-nil, it
+	// applies to the candidates of the previous response and
+	// Candidates is ignored.
+	Diff       bool
+	Generation int64
+	Delta      *Delta
+}
+
+// A Formatter writes responses in some output format.
+type Formatter interface {
+	Format(w io.Writer, res Response) error
+}
+
+// FormatterFunc adapts an ordinary function to a Formatter.
+type FormatterFunc func(w io.Writer, res Response) error
+
+func (f FormatterFunc) Format(w io.Writer, res Response) error {
+	return f(w, res)
+}
+
+// Status describes a response beyond its candidates: how complete it
+// is, and the doc summary of the package whose members are proposed.
+type Status struct {
+	Truncated  bool // the candidates were cut to the response size limit
+	Partial    bool // the candidates were computed before all imports finished
+	PackageDoc string
+
+	// OperandValues is the number of values of a multi-valued
+	// operand, whose first value's members are proposed.
+	OperandValues int
+}
+
+// Range is a range of byte offsets in the buffer, End excluded.
+type Range struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// A Rejection is a symbol whose name starts with the identifier typed,
+// ignoring case, that isn't proposed, and why. Rejections are only
+// collected when requested.
+type Rejection struct {
+	Name    string `json:"name"`
+	PkgPath string `json:"package"`
+	Class   string `json:"class"`
+	Reason  string `json:"reason"`
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mdempsky/gocode/format"
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+// pluginFormatPrefix introduces the path of a formatter plugin in -f.
+const pluginFormatPrefix = "plugin:"
+
+// pluginFormatterSymbol is the name of the variable a formatter plugin
+// exports. Its type is format.Formatter, or any type whose pointer
+// implements format.Formatter, such as format.FormatterFunc.
+const pluginFormatterSymbol = "Formatter"
+
+// lookupFormatter returns the formatter for the -f flag: a registered
+// format, the Formatter loaded from the plugin named by a plugin:path
+// value, or the nice format if the name is unknown.
+func lookupFormatter(name string) (format.Formatter, error) {
+	if strings.HasPrefix(name, pluginFormatPrefix) {
+		path := strings.TrimPrefix(name, pluginFormatPrefix)
+		f, err := loadFormatterPlugin(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading formatter plugin %s: %v", path, err)
+		}
+		return f, nil
+	}
+	if f := suggest.Formatters[name]; f != nil {
+		return f, nil
+	}
+	return suggest.NiceFormat, nil
+}
+
+// pluginFormatter returns the Formatter in the value of the exported
+// symbol of a formatter plugin.
+func pluginFormatter(sym interface{}) (format.Formatter, error) {
+	switch f := sym.(type) {
+	case *format.Formatter:
+		if *f == nil {
+			return nil, fmt.Errorf("%s is nil", pluginFormatterSymbol)
+		}
+		return *f, nil
+	case format.Formatter:
+		return f, nil
+	}
+	return nil, fmt.Errorf("%s has type %T, which does not implement format.Formatter", pluginFormatterSymbol, sym)
+}
@@ -0,0 +1,23 @@
+// +build linux,cgo darwin,cgo freebsd,cgo
+
+package main
+
+import (
+	"plugin"
+
+	"github.com/mdempsky/gocode/format"
+)
+
+// loadFormatterPlugin opens the Go plugin at path and returns the
+// Formatter it exports.
+func loadFormatterPlugin(path string) (format.Formatter, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(pluginFormatterSymbol)
+	if err != nil {
+		return nil, err
+	}
+	return pluginFormatter(sym)
+}
@@ -0,0 +1,16 @@
+// +build !linux,!darwin,!freebsd !cgo
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/mdempsky/gocode/format"
+)
+
+// loadFormatterPlugin fails: Go plugins are only supported on linux,
+// darwin and freebsd, with cgo.
+func loadFormatterPlugin(path string) (format.Formatter, error) {
+	return nil, fmt.Errorf("formatter plugins are not supported on %s/%s or without cgo; use one of the built-in formats", runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFormatterPlugin(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("formatter plugins are only tested on linux")
+	}
+	if testing.Short() {
+		t.Skip("builds gocode and a plugin")
+	}
+	if out, err := exec.Command("go", "env", "CGO_ENABLED").Output(); err != nil || strings.TrimSpace(string(out)) != "1" {
+		t.Skip("plugins need cgo")
+	}
+	dir := t.TempDir()
+
+	gocode := filepath.Join(dir, "gocode")
+	so := filepath.Join(dir, "formatplugin.so")
+	for _, args := range [][]string{
+		{"build", "-o", gocode, "."},
+		{"build", "-buildmode=plugin", "-o", so, "./testdata/formatplugin"},
+	} {
+		if out, err := exec.Command("go", args...).CombinedOutput(); err != nil {
+			t.Fatalf("go %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	src := filepath.Join(dir, "p.go")
+	data := "package p\n\nfunc f() {\n\tvar abc int\n\t_ = ab\n}\n"
+	if err := ioutil.WriteFile(src, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cursor := strings.Index(data, "ab\n") + len("ab")
+	cmd := exec.Command(gocode, "-sock", "none", "-f", "plugin:"+so, "-in", src, "autocomplete", src, "c"+strconv.Itoa(cursor))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("gocode: %v\n%s", err, out)
+	}
+	if got, want := string(out), "abc\tvar\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	out, err = exec.Command(gocode, "-sock", "none", "-f", "plugin:"+filepath.Join(dir, "missing.so"), "-in", src, "autocomplete", src, "c0").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "loading formatter plugin") {
+		t.Errorf("missing plugin: got err %v, output %q", err, out)
+	}
+}
@@ -1,5 +1,10 @@
 module github.com/mdempsky/gocode
 
-go 1.12
+go 1.25.0
 
-require golang.org/x/tools v0.0.0-20190318005222-63e6ed9258fa
+require (
+	golang.org/x/sync v0.20.0
+	golang.org/x/tools v0.44.0
+)
+
+require golang.org/x/mod v0.35.0 // indirect
@@ -5,21 +5,65 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 var (
-	g_is_server           = flag.Bool("s", false, "run a server instead of a client")
-	g_cache               = flag.Bool("cache", false, "use the cache importer")
-	g_format              = flag.String("f", "nice", "output format (vim | emacs | nice | csv | json)")
-	g_input               = flag.String("in", "", "use this file instead of stdin input")
-	g_sock                = flag.String("sock", defaultSocketType, "socket type (unix | tcp | none)")
-	g_addr                = flag.String("addr", "127.0.0.1:37373", "address for tcp socket")
-	g_debug               = flag.Bool("debug", false, "enable server-side debug mode")
-	g_source              = flag.Bool("source", false, "use source importer")
-	g_builtin             = flag.Bool("builtin", false, "propose completions for built-in functions and types")
-	g_ignore_case         = flag.Bool("ignore-case", false, "do case-insensitive matching")
-	g_unimported_packages = flag.Bool("unimported-packages", false, "propose completions for standard library packages not explicitly imported")
-	g_fallback_to_source  = flag.Bool("fallback-to-source", false, "if importing a package fails, fallback to the source importer")
+	g_is_server                  = flag.Bool("s", false, "run a server instead of a client")
+	g_cache                      = flag.Bool("cache", false, "use the cache importer")
+	g_format                     = flag.String("f", "nice", "output format (vim | emacs | nice | csv | json), or plugin:path for a Go plugin exporting a format.Formatter named Formatter")
+	g_input                      = flag.String("in", "", "use this file instead of stdin input")
+	g_sock                       = flag.String("sock", defaultSocketType, "socket type (unix | tcp | none)")
+	g_addr                       = flag.String("addr", "127.0.0.1:37373", "address for tcp socket")
+	g_debug                      = flag.Bool("debug", false, "enable server-side debug mode")
+	g_source                     = flag.Bool("source", false, "use source importer")
+	g_builtin                    = flag.Bool("builtin", false, "propose completions for built-in functions and types")
+	g_ignore_case                = flag.Bool("ignore-case", false, "do case-insensitive matching")
+	g_unimported_packages        = flag.Bool("unimported-packages", false, "propose completions for standard library packages not explicitly imported")
+	g_fallback_to_source         = flag.Bool("fallback-to-source", false, "if importing a package fails, fallback to the source importer")
+	g_skeletons                  = flag.Bool("skeletons", false, "propose func main and test function skeletons in an empty file or right after the package clause")
+	g_type_hints                 = flag.Bool("type-hints", false, "also propose members of the type an interface value is later asserted to")
+	g_details                    = flag.Bool("details", false, "summarize the declaration of type candidates in their detail, e.g. \"struct with 2 fields\"")
+	g_cgo_internals              = flag.Bool("cgo-internals", false, "propose identifiers generated by cgo, such as _Ctype_int (for debugging)")
+	g_snippets                   = flag.Bool("snippets", false, "where a value of a struct type is expected, propose a composite literal of the type with a placeholder for each field (json format)")
+	g_indent                     = flag.String("indent", "", "with -snippets, the indentation of the lines of snippets broken by -line-width, relative to the cursor's line (default a tab, as gofmt)")
+	g_line_width                 = flag.Int("line-width", 0, "with -snippets, break snippets such as struct literals into several lines if they would make the cursor's line wider than this many columns, tabs being 8 wide (0 to never break them)")
+	g_qualified_types            = flag.Bool("qualified-types", false, "qualify the types of other packages in candidates by import path, e.g. github.com/foo/bar.Type, rather than by package name")
+	g_explain                    = flag.Bool("explain", false, "explain why each candidate is proposed where it is listed, and list the matching symbols left out with the reason (json format, for debugging)")
+	g_allowed_packages           = flag.String("allowed-packages", "", "comma-separated import paths, or path/... patterns, of the only packages whose symbols are proposed, besides the package being completed and the predeclared ones")
+	g_names_only                 = flag.Bool("names-only", false, "only report the name and class of candidates, leaving out packages, types, positions and details, for clients fetching them lazily")
+	g_hide_unexported_promotions = flag.Bool("hide-unexported-promotions", false, "after a selector, leave out the fields and methods of other packages' types promoted through their unexported embedded fields, which Go allows selecting")
+	g_go_versions                = flag.Bool("go-versions", false, "report the go directive of the go.mod of the module declaring each candidate of another package, such as 1.21 (json format)")
+	g_embed_patterns             = flag.Bool("embed-patterns", false, "in the patterns of a //go:embed directive, propose the files and directories of the package directory")
+	g_call_hints                 = flag.Bool("call-hints", false, "report the number of arguments and results of func candidates (json format)")
+	g_insert_parens              = flag.Bool("insert-parens", false, "set the insert text of func candidates to a call, unless a func value is expected (json format)")
+	g_mark_unaddressable         = flag.Bool("mark-unaddressable", false, "also propose pointer-receiver methods of values that aren't addressable, marked as unaddressable (json format)")
+	g_implementers               = flag.Bool("implementers", false, "where an interface value is expected, propose the types implementing it first, with insert text such as &T{} (json format)")
+	g_package_doc                = flag.Bool("package-doc", false, "when completing the members of a package, also return its doc summary (json format)")
+	g_sort                       = flag.String("sort", "kind", "order of the candidates: by class and name, or by declaration position for those of the current package, as for outline (kind | position)")
+	g_max_chain_links            = flag.Int("max-chain-links", 256, "refuse, with a diagnostic, to complete the members of a selector chain longer than this many links, such as a.b().c[i].d (0 for no limit)")
+	g_index_only_lines           = flag.Int("index-only-lines", 0, "only type-check generated files of the package longer than this many lines if a candidate may be declared in them (0 to always type-check them)")
+	g_ref_weight                 = flag.Float64("ref-weight", 1, "with -ref-index, rank candidates within their class by this weight times the log2 of how often they are referred to in the workspace (0 to sort by name)")
+	g_check_cache                = flag.Bool("check-cache", false, "reuse the type-checked package while the file, cursor and other files of the package are unchanged (best with -cache)")
+	g_prefix                     = flag.String("prefix", "", "match candidates against this text instead of the identifier before the cursor, if the text before the cursor ends with it")
+	g_max_response_bytes         = flag.Int("max-response-bytes", 1<<20, "maximum size of the candidate list as json; only the best candidates that fit are returned (0 for no limit)")
+	g_deadline                   = flag.Duration("deadline", 0, "return the candidates computable without pending imports after this long, and finish the imports in the background (0 for no deadline)")
+	g_diff_generation            = flag.Int64("diff", -1, "diff mode for -f=json: generation of the previous response, or 0 to start")
+	g_preload                    = flag.String("preload", "", "with -cache, file listing import paths, one per line, that the server imports at startup and keeps cached")
+	g_cache_max_bytes            = flag.Int64("cache-max-bytes", 0, "with -cache, approximately bound the estimated memory taken by the packages the server caches to this many bytes, evicting the least recently used ones first (0 for no bound besides their number)")
+	g_exit_when_replaced         = flag.Bool("exit-when-replaced", true, "make the server exit once its executable is replaced, such as by go install, so that the next request starts the new one")
+	g_go_env_ttl                 = flag.Duration("go-env-ttl", time.Minute, "how long the server caches the output of go env")
+	g_install_concurrency        = flag.Int("install-concurrency", 2, "maximum number of concurrent go install and go list -export commands run by the server")
+	g_refresh                    = flag.Bool("refresh", false, "with -cache, re-import the packages needed by this request instead of using cached ones")
+	g_extra_src_dirs             = flag.String("extra-src-dirs", "", "with -cache, list of prefix=dir mappings of import paths to directories of packages outside of GOPATH and modules, such as generated ones, imported from source before looking anywhere else, in addition to those of the \"extra-src-dirs\" list of the .gocode.json of the workspace, relative to it; the longest matching prefix wins")
+	g_export_dirs                = flag.String("export-dirs", "", "with -cache, list of directories searched for export data (.a files laid out by import path) before the standard locations")
+	g_symlinks                   = flag.String("symlinks", "default", "whether directory walks, such as warm's and -ref-index's, and the server's vendor lookups follow symbolic links (default | skip | follow); by default, lookups follow them and walks don't")
+	g_ref_index                  = flag.String("ref-index", "", "workspace directory whose references to the exported symbols of packages the server counts in the background, for -ref-weight; the counts are saved in the user cache directory")
+	g_walk_ignored               = flag.Bool("walk-ignored", false, "also walk directories the go tool ignores, testdata and those starting with . or _, in directory walks such as warm's")
+	g_sandbox_root               = flag.String("sandbox-root", "", "confine the server's reads to this directory, GOROOT and export data in the build and module caches; packages outside of it are unavailable unless they have export data")
+	g_retry                      = flag.Bool("retry", true, "if the daemon dies while serving a request, restart it and retry the request once")
+	g_no_gb                      = flag.Bool("no-gb", false, "don't detect gb projects; import packages from GOPATH only")
+	g_loader                     = flag.String("loader", "legacy", "package loader (legacy | packages)")
 )
 
 func getSocketPath() string {
@@ -30,6 +74,18 @@ func getSocketPath() string {
 	return filepath.Join(os.TempDir(), fmt.Sprintf("gocode-daemon.%s", user))
 }
 
+// getDaemonLogPath returns the file the daemon started by a client
+// writes its output to.
+func getDaemonLogPath() string {
+	return getSocketPath() + ".log"
+}
+
+// getDaemonPidPath returns the file holding the process id of the
+// running daemon.
+func getDaemonPidPath() string {
+	return getSocketPath() + ".pid"
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr,
 		"Usage: %s [-s] [-f=<format>] [-in=<path>] [-sock=<type>] [-addr=<addr>]\n"+
@@ -41,7 +97,17 @@ func usage() {
 	fmt.Fprintf(os.Stderr,
 		"\nCommands:\n"+
 			"  autocomplete [<path>] <offset>     main autocompletion command\n"+
-			"  exit                               terminate the gocode daemon\n")
+			"                                     (<offset> may be a comma-separated list)\n"+
+			"  outline [<path>]                   list package-level declarations\n"+
+			"  imports <path>                     print how each import would be resolved as json (-cache)\n"+
+			"  warm <dir>[/...]                   import the uncached imports of the files in dir (-cache)\n"+
+			"  warm-std [-goos <os>] [-goarch <arch>]\n"+
+			"                                     import the standard library for the target,\n"+
+			"                                     keeping its export data in the user cache directory (-cache)\n"+
+			"  stats                              print daemon statistics as json\n"+
+			"  reload                             make the daemon re-run go env\n"+
+			"  exit                               terminate the gocode daemon\n"+
+			"  schema                             print the JSON Schema of the json format\n")
 }
 
 func main() {
@@ -0,0 +1,9 @@
+package cache
+
+import "go/build"
+
+// SetBuildDir sets the directory in which ctx runs the go command, which
+// determines the module that packages are resolved in.
+func SetBuildDir(ctx *build.Context, dir string) {
+	ctx.Dir = dir
+}
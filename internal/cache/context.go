@@ -1,6 +1,10 @@
 package cache
 
-import "go/build"
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+)
 
 // PackedContext is a copy of build.Context without the func fields.
 //
@@ -16,6 +20,43 @@ type PackedContext struct {
 	BuildTags     []string
 	ReleaseTags   []string
 	InstallSuffix string
+
+	// GO111MODULE is the client's setting of the variable, which
+	// go/build would otherwise read from the server's environment.
+	GO111MODULE string
+
+	// ExtraSrcDirs map import paths to directories holding packages
+	// outside of GOPATH and modules, such as generated ones. The
+	// cache importer imports the packages they map from source,
+	// before looking anywhere else, with the longest matching
+	// prefix.
+	ExtraSrcDirs []SrcDir
+}
+
+// hostGOOS and hostGOARCH are the target of the environment gocode was
+// started in.
+var hostGOOS, hostGOARCH = build.Default.GOOS, build.Default.GOARCH
+
+// Native reports whether ctx targets the GOOS and GOARCH of the
+// environment gocode was started in, those the go command run by the
+// default importer of go/importer builds for. The packages of other
+// targets, such as js/wasm, must be imported from their export data,
+// such as that written by warm-std, or from source.
+func (ctx *PackedContext) Native() bool {
+	return ctx.GOOS == hostGOOS && ctx.GOARCH == hostGOARCH
+}
+
+// GOPATHMode reports whether packages are resolved in GOPATH mode even
+// in a directory with a go.mod, because GO111MODULE is off.
+func (ctx *PackedContext) GOPATHMode() bool {
+	return ctx.GO111MODULE == "off"
+}
+
+// UseGOPATH makes def resolve packages in GOPATH rather than by running
+// the go command, which go/build only does if no file system hooks are
+// set. The hook it sets is the default behavior.
+func UseGOPATH(def *build.Context) {
+	def.JoinPath = filepath.Join
 }
 
 func PackContext(ctx *build.Context) PackedContext {
@@ -30,5 +71,31 @@ func PackContext(ctx *build.Context) PackedContext {
 		BuildTags:     ctx.BuildTags,
 		ReleaseTags:   ctx.ReleaseTags,
 		InstallSuffix: ctx.InstallSuffix,
+		GO111MODULE:   os.Getenv("GO111MODULE"),
+	}
+}
+
+// BuildContext returns a build.Context for ctx that resolves packages
+// as seen from dir, which determines the current module, if any.
+func BuildContext(ctx *PackedContext, dir string) *build.Context {
+	def := build.Default
+	def.GOARCH = ctx.GOARCH
+	def.GOOS = ctx.GOOS
+	def.GOROOT = ctx.GOROOT
+	def.GOPATH = ctx.GOPATH
+	def.CgoEnabled = ctx.CgoEnabled
+	def.UseAllFiles = ctx.UseAllFiles
+	def.Compiler = ctx.Compiler
+	def.BuildTags = ctx.BuildTags
+	def.ReleaseTags = ctx.ReleaseTags
+	def.InstallSuffix = ctx.InstallSuffix
+	if !ctx.Native() {
+		SetToolTags(&def)
+	}
+	if ctx.GOPATHMode() {
+		UseGOPATH(&def)
+	} else {
+		SetBuildDir(&def, dir)
 	}
+	return &def
 }
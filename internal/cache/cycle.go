@@ -0,0 +1,20 @@
+package cache
+
+import "strings"
+
+// ImportCycleError reports an import cycle met while importing from
+// source, as introduced by an edit in progress. Packages imported
+// across the cycle are not cached.
+type ImportCycleError struct {
+	Path []string // import paths, starting and ending with the same package
+}
+
+func (e *ImportCycleError) Error() string {
+	return "import cycle not allowed: " + strings.Join(e.Path, " -> ")
+}
+
+// ImportCycle returns e.Path, for the clients that can't depend on this
+// package to recognize import cycles.
+func (e *ImportCycleError) ImportCycle() []string {
+	return e.Path
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// A VersionMismatch reports export data that gocode can't read,
+// because it was written by a newer Go toolchain than the one gocode
+// was built with.
+type VersionMismatch struct {
+	File      string `json:"file"`
+	Gocode    string `json:"gocode"`              // Go version gocode was built with
+	Toolchain string `json:"toolchain,omitempty"` // Go version that wrote File, if known
+	Err       string `json:"error"`
+}
+
+func (m *VersionMismatch) Error() string {
+	toolchain := m.Toolchain
+	if toolchain == "" {
+		toolchain = "a newer Go"
+	}
+	return fmt.Sprintf("%s was written by %s, which gocode built with %s can't read (%s); rebuild gocode with %s. Using the source importer for now.",
+		m.File, toolchain, m.Gocode, m.Err, toolchain)
+}
+
+// mismatches holds the export data version mismatches seen by the
+// cache importer, keyed by the Go version that wrote the export data,
+// or "" if unknown, in the order they were seen.
+var mismatches struct {
+	sync.Mutex
+	byVersion map[string]*VersionMismatch
+	first     *VersionMismatch
+}
+
+// ExportDataMismatch returns the first export data version mismatch
+// seen by the cache importer, or nil. Once there is one, the cache
+// importer falls back to the source importer, and skips the export
+// data written by the same Go version.
+func ExportDataMismatch() *VersionMismatch {
+	mismatches.Lock()
+	defer mismatches.Unlock()
+	return mismatches.first
+}
+
+// mismatchedVersion reports whether gocode failed to read export data
+// written by the Go version toolchain.
+func mismatchedVersion(toolchain string) bool {
+	mismatches.Lock()
+	defer mismatches.Unlock()
+	_, ok := mismatches.byVersion[toolchain]
+	return ok
+}
+
+// resetMismatches forgets the mismatches seen so far, for tests.
+func resetMismatches() {
+	mismatches.Lock()
+	defer mismatches.Unlock()
+	mismatches.byVersion, mismatches.first = nil, nil
+}
+
+// unsupportedFormats are the messages of gcexportdata, across its
+// versions, for export data in a format it doesn't know, e.g.
+// "unknown iexport format version 3" or "unstable iexport format
+// version 99, just rebuild compiler and std library".
+var unsupportedFormats = []string{
+	"unknown export data",
+	"unknown iexport format",
+	"unknown bexport format",
+	"unstable iexport format",
+	"unsupported iexport format",
+	"export data is newer version",
+}
+
+// exportDataError returns err, the error reading the export data in
+// filename, unless it reports a format that gocode doesn't know,
+// written by another Go version than gocode's. Such a mismatch is
+// recorded instead, and i switches to the source importer.
+func (i *importer) exportDataError(filename string, err error) error {
+	unsupported := false
+	for _, s := range unsupportedFormats {
+		if strings.Contains(err.Error(), s) {
+			unsupported = true
+			break
+		}
+	}
+	if !unsupported {
+		return err
+	}
+	toolchain := exportDataVersion(filename)
+	if toolchain == runtime.Version() {
+		// Not a version mismatch, but corrupt export data.
+		return err
+	}
+	m := &VersionMismatch{
+		File:      filename,
+		Gocode:    runtime.Version(),
+		Toolchain: toolchain,
+		Err:       err.Error(),
+	}
+	i.logf("%v", m)
+
+	mismatches.Lock()
+	if _, ok := mismatches.byVersion[toolchain]; !ok {
+		if mismatches.byVersion == nil {
+			mismatches.byVersion = make(map[string]*VersionMismatch)
+		}
+		mismatches.byVersion[toolchain] = m
+		if mismatches.first == nil {
+			mismatches.first = m
+		}
+	}
+	mismatches.Unlock()
+	i.useSource()
+	return nil
+}
+
+// useSource makes i fall back to the source importer only, as the
+// default importer reads the same export data. In a sandbox, the
+// source importer only reads what the sandbox allows.
+func (i *importer) useSource() {
+	name := "source"
+	if sandboxFS != nil {
+		name = "sandboxed source"
+	}
+	i.source = newSourceImporter(i)
+	i.fallbacks = []fallbackImporter{{name, i.source}}
+}
+
+// exportDataVersion returns the Go version in the object header of the
+// export data in filename, e.g. "go1.22.1", or "" if there is none.
+func exportDataVersion(filename string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	n, _ := f.Read(buf)
+	buf = buf[:n]
+
+	// The header is "go object $GOOS $GOARCH $VERSION ...".
+	i := bytes.Index(buf, []byte("go object "))
+	if i < 0 {
+		return ""
+	}
+	line := buf[i:]
+	if j := bytes.IndexByte(line, '\n'); j >= 0 {
+		line = line[:j]
+	}
+	if fields := strings.Fields(string(line)); len(fields) >= 5 {
+		return fields[4]
+	}
+	return ""
+}
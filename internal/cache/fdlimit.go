@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxOpenRetries is how many times reading a source file is retried
+// when the process runs out of file descriptors.
+const maxOpenRetries = 5
+
+// openSlots limits the number of files the source importers have open
+// at once. It is sized below the process's limit on open files, so
+// that bursts of source imports leave descriptors for the rest of the
+// server.
+var openSlots = make(chan struct{}, openSlotCount(openFileLimit()))
+
+// fdErrors counts the loads that ran out of file descriptors, so that
+// packages imported meanwhile aren't cached: they may lack files or
+// imports.
+var fdErrors uint64
+
+// openSlotCount returns the size of openSlots for a limit of open
+// files, or a default if the limit is unknown.
+func openSlotCount(limit uint64) int {
+	switch {
+	case limit == 0:
+		return 64
+	case limit < 4:
+		return 1
+	case limit > 1024:
+		return 256
+	}
+	return int(limit / 4)
+}
+
+// readSourceFile reads filename for a source importer, within the
+// sandbox if any. It waits for a free slot in openSlots, and retries
+// after a while if the process is out of file descriptors anyway.
+func readSourceFile(filename string) ([]byte, error) {
+	read := ioutil.ReadFile
+	if sandboxFS != nil {
+		read = sandboxFS.ReadFile
+	}
+	for try := 0; ; try++ {
+		openSlots <- struct{}{}
+		data, err := read(filename)
+		<-openSlots
+		if !tooManyOpenFiles(err) {
+			return data, err
+		}
+		if try == maxOpenRetries {
+			noteFDError()
+			return nil, err
+		}
+		time.Sleep(time.Duration(10<<uint(try)) * time.Millisecond)
+	}
+}
+
+// openSourceFile opens filename for go/build, within the sandbox if
+// any. The file holds a slot of openSlots until it is closed.
+func openSourceFile(filename string) (io.ReadCloser, error) {
+	open := os.Open
+	if sandboxFS != nil {
+		open = sandboxFS.Open
+	}
+	slots := openSlots
+	slots <- struct{}{}
+	f, err := open(filename)
+	if err != nil {
+		<-slots
+		if tooManyOpenFiles(err) {
+			noteFDError()
+		}
+		return nil, err
+	}
+	return &slotFile{File: f, slots: slots}, nil
+}
+
+// slotFile is a file opened by openSourceFile.
+type slotFile struct {
+	*os.File
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (f *slotFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() { <-f.slots })
+	return err
+}
+
+// readSourceDir lists dir for go/build, within the sandbox if any,
+// holding a slot of openSlots meanwhile.
+func readSourceDir(dir string) ([]os.FileInfo, error) {
+	read := ioutil.ReadDir
+	if sandboxFS != nil {
+		read = sandboxFS.ReadDir
+	}
+	slots := openSlots
+	slots <- struct{}{}
+	infos, err := read(dir)
+	<-slots
+	if tooManyOpenFiles(err) {
+		noteFDError()
+	}
+	return infos, err
+}
+
+// tooManyOpenFiles reports whether err means that the process or the
+// system ran out of file descriptors.
+func tooManyOpenFiles(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.EMFILE || err == syscall.ENFILE
+}
+
+// noteFDError records that a load ran out of file descriptors.
+func noteFDError() {
+	atomic.AddUint64(&fdErrors, 1)
+}
+
+// fdErrorCount returns the number of loads that ran out of file
+// descriptors so far.
+func fdErrorCount() uint64 {
+	return atomic.LoadUint64(&fdErrors)
+}
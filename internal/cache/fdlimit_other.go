@@ -0,0 +1,9 @@
+//go:build windows || plan9 || js || wasip1
+// +build windows plan9 js wasip1
+
+package cache
+
+// openFileLimit returns 0: the limit on open files is unknown.
+func openFileLimit() uint64 {
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9 && !js && !wasip1
+// +build !windows,!plan9,!js,!wasip1
+
+package cache
+
+import "syscall"
+
+// openFileLimit returns the soft limit on the number of files the
+// process can open, or 0 if it is unknown.
+func openFileLimit() uint64 {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0
+	}
+	return uint64(rlim.Cur)
+}
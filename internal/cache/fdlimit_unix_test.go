@@ -0,0 +1,71 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package cache
+
+import (
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestLowFileLimit(t *testing.T) {
+	files := map[string]string{
+		"src/user/user.go": "package user\n\nimport \"many\"\n\nfunc f() {\n\tmany.V29\n}\n",
+	}
+	for i := 0; i < 300; i++ {
+		files[fmt.Sprintf("src/many/v%d.go", i)] = fmt.Sprintf("package many\n\nvar V%d = %d\n", i, i)
+	}
+	gopath := newTestGOPATH(t, files)
+	filename := filepath.Join(gopath, "src", "user", "user.go")
+
+	// Leave a few descriptors on top of those already open.
+	open, err := ioutil.ReadDir("/dev/fd")
+	if err != nil {
+		t.Skipf("can't count open files: %v", err)
+	}
+	var orig syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &orig); err != nil {
+		t.Skipf("getrlimit: %v", err)
+	}
+	low := orig
+	low.Cur = uint64(len(open) + 16)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low); err != nil {
+		t.Skipf("setrlimit: %v", err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &orig)
+	defer func(orig chan struct{}) { openSlots = orig }(openSlots)
+	openSlots = make(chan struct{}, openSlotCount(openFileLimit()))
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer delete(importCache.imports, "many")
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := suggest.Config{
+		Importer: NewImporter(&ctx, filename, nil, true, true, false, t.Logf),
+		Logf:     t.Logf,
+	}
+	cands, _ := cfg.Suggest(filename, src, strings.Index(string(src), "V29")+3)
+	var names []string
+	for _, c := range cands {
+		names = append(names, c.Name)
+	}
+	if want := "V29 V290 V291 V292 V293 V294 V295 V296 V297 V298 V299"; strings.Join(names, " ") != want {
+		t.Errorf("got candidates %v, want %s", names, want)
+	}
+	if entry, ok := importCache.imports["many"]; !ok || entry.pkg.Scope().Len() != 300 {
+		t.Errorf("many wasn't cached with its 300 variables")
+	}
+}
@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// InGOROOT reports whether filename is within $GOROOT/src of ctx, as
+// when editing the standard library itself. Such files are not part
+// of a gb project or GOPATH, and their imports must come from the
+// same tree, not from installed packages.
+func InGOROOT(ctx *PackedContext, filename string) bool {
+	goroot := strings.TrimRight(ctx.GOROOT, "\\/")
+	if goroot == "" {
+		return false
+	}
+	src := filepath.Join(goroot, "src")
+	for dir := filepath.Dir(filename); ; {
+		if SamePath(dir, src) {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
@@ -6,8 +6,11 @@ import (
 	goimporter "go/importer"
 	"go/token"
 	"go/types"
+	"io/ioutil"
 	"os"
+	pathpkg "path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,24 +22,110 @@ import (
 // intended, so use a lock to protect against concurrent accesses.
 var buildDefaultLock sync.Mutex
 
-// Mu must be held while using the cache importer.
+// Mu must be held while using the cache importer. It serializes the
+// requests importing through the cache, so of concurrent imports of a
+// package not yet cached, the first resolves it and the others find
+// it cached: unlike pkgsimporter's loads, they need no single-flight.
 var Mu sync.Mutex
 
 var importCache = importerCache{
 	fset:    token.NewFileSet(),
 	imports: make(map[string]importCacheEntry),
+	pinned:  make(map[string]bool),
+	used:    make(map[string]uint64),
 }
 
-func NewImporter(ctx *PackedContext, filename string, fallbackToSource bool, logger func(string, ...interface{})) types.ImporterFrom {
+// Statuses reported by an Importer.
+const (
+	// StatusCached means the package is cached and up to date.
+	StatusCached = "cached"
+	// StatusStale means the package has to be read from export
+	// data, or imported again because its cache entry expired.
+	StatusStale = "stale"
+	// StatusSource means there is no export data for the package,
+	// so it has to be imported by the fallback importer.
+	StatusSource = "source"
+	// StatusMissing means the package can't be found.
+	StatusMissing = "missing"
+	// StatusUnavailable means the package has no export data and
+	// is outside of the sandbox, so it can't be imported.
+	StatusUnavailable = "unavailable"
+)
+
+// maxEntryAge is how long a package imported without export data
+// stays cached.
+//
+// TODO(rstambler): Develop a better heuristic for entry eviction.
+const maxEntryAge = 20 * time.Minute
+
+// maxEntries is the number of packages the cache holds at most.
+const maxEntries = 100
+
+// objectBytes is a rough guess at the memory taken by an object of an
+// imported package, along with its type, for packageSize.
+const objectBytes = 512
+
+// SetMaxBytes bounds the estimated memory taken by the cached
+// packages, besides their number: beyond n bytes, the least recently
+// used packages are evicted. Pinned packages are never evicted, but
+// count toward n. A non-positive n lifts the bound. It must be called
+// before any importer is used.
+//
+// The bound is approximate: sizes are estimated by packageSize, and an
+// evicted package stays in memory as long as the imports of a cached
+// one, or the caches of the suggest package, refer to it.
+func SetMaxBytes(n int64) {
+	importCache.maxBytes = n
+}
+
+// An Importer is a types.ImporterFrom that can also report how it
+// would import a package.
+type Importer interface {
+	types.ImporterFrom
+
+	// Status reports how importPath would be imported from srcDir,
+	// without importing anything.
+	Status(importPath, srcDir string) string
+
+	// Overlay makes the importer read data in place of the file
+	// filename, which is being edited, when it imports the
+	// package of the file from source.
+	Overlay(filename string, data []byte)
+}
+
+// NewImporter returns an importer that caches packages across
+// requests. Export data is looked up in exportDirs before the
+// standard locations. If refresh is set, cached packages are ignored
+// and replaced by freshly imported ones. If noGb is set, filename is
+// not checked for being part of a gb project.
+func NewImporter(ctx *PackedContext, filename string, exportDirs []string, fallbackToSource, refresh, noGb bool, logger func(string, ...interface{})) Importer {
 	importCache.clean()
 
 	imp := &importer{
-		ctx:              ctx,
-		importerCache:    &importCache,
-		fallbackToSource: fallbackToSource,
-		logf:             logger,
+		ctx:           ctx,
+		importerCache: &importCache,
+		dir:           filepath.Dir(filename),
+		exportDirs:    exportDirs,
+		refresh:       refresh,
+		logf:          logger,
+	}
+	if fallbackToSource || ExportDataMismatch() != nil || sandboxFS != nil || !ctx.Native() {
+		imp.useSource()
+	} else {
+		imp.fallbacks = []fallbackImporter{{"default", goimporter.Default()}}
+	}
+	if InGOROOT(ctx, filename) {
+		// The standard library is being edited, so installed
+		// packages and cached ones may be stale. Import the
+		// dependencies from the same tree instead.
+		imp.goroot = true
+		imp.useSource()
+		return imp
+	}
+	if noGb {
+		return imp
 	}
-	gbroot, gbvendor := GetGbProjectPaths(ctx, filename)
+	gbroot, gbvendor := getGbProjectPaths(ctx, filename)
 	if gbroot != "" {
 		imp.gbroot, imp.gbvendor = gbroot, gbvendor
 	}
@@ -47,18 +136,51 @@ type importer struct {
 	*importerCache
 	gbroot, gbvendor string
 	ctx              *PackedContext
-	fallbackToSource bool
+	dir              string // directory of the file being completed
+	goroot           bool   // the file is within $GOROOT/src
+	exportDirs       []string
+	fallbacks        []fallbackImporter
+	source           *sourceImporter // shared by the fallbacks and importCompleted
+	refresh          bool
+	overlay          map[string][]byte // file contents read in place of those on disk
 	logf             func(string, ...interface{})
+
+	// completed is the import path of the package being completed,
+	// once looked up by completedPath.
+	completed *string
+}
+
+// fallbackImporter is used when there is no usable export data.
+type fallbackImporter struct {
+	name string
+	imp  types.Importer
 }
 
 type importerCache struct {
-	fset    *token.FileSet
+	fset *token.FileSet
+
+	// entries guards imports for the users of NewCachedImporter,
+	// who don't hold Mu. The others only need it to change imports.
+	entries sync.RWMutex
 	imports map[string]importCacheEntry
+	pinned  map[string]bool // paths never evicted by clean
+
+	// maxBytes, if positive, bounds the sizes of the cached packages,
+	// estimated by packageSize.
+	maxBytes int64
+	used     map[string]uint64 // the tick of the last use of each path
+	tick     uint64
 }
 
 type importCacheEntry struct {
 	pkg   *types.Package
 	mtime time.Time
+	size  int64 // estimated by packageSize, once needed
+
+	// deps holds the packages a package imported from a directory
+	// of ExtraSrcDirs imported, by import path. The entry is only
+	// reused while they are imported as the same packages.
+	deps map[string]*types.Package
 }
 
 func (i *importer) Import(importPath string) (*types.Package, error) {
@@ -66,15 +188,320 @@ func (i *importer) Import(importPath string) (*types.Package, error) {
 }
 
 func (i *importer) ImportFrom(importPath, srcDir string, mode types.ImportMode) (*types.Package, error) {
-	buildDefaultLock.Lock()
-	defer buildDefaultLock.Unlock()
+	// In GOPATH mode, go/build only resolves imports to the vendor
+	// directories above srcDir if it is set. The cache is keyed by the
+	// resolved path, so that the vendored and non-vendored copies of a
+	// package don't shadow each other.
+	srcDir = i.srcDir(srcDir)
+	if err := CheckVendored(i.ctx, srcDir, importPath); err != nil {
+		i.logf("%v", err)
+		return nil, err
+	}
+	defer i.useContext(srcDir)()
+	return i.importLocked(importPath, srcDir)
+}
+
+// importLocked is ImportFrom, for a non-empty srcDir, once build.Default
+// is set up by useContext.
+func (i *importer) importLocked(importPath, srcDir string) (*types.Package, error) {
+	i.logf("importing: %v, srcdir: %v", importPath, srcDir)
+	if m, dir, ok := LookupSrcDir(i.ctx.ExtraSrcDirs, importPath); ok {
+		return i.importMapped(importPath, dir, m)
+	}
+	filename, path, dir := i.findExportData(importPath, srcDir)
+	if i.completing(dir) {
+		return i.importCompleted(path, srcDir)
+	}
+	if i.goroot && dir != "" {
+		return i.importGOROOT(path, srcDir, dir)
+	}
+	entry, ok := i.imports[i.key(path)]
+	if filename == "" {
+		i.logf("no gcexportdata file for %s", path)
+		// If there is no export data, check the cache.
+		if ok && !i.refresh && time.Since(entry.mtime) <= maxEntryAge {
+			i.touch(i.key(path))
+			return entry.pkg, nil
+		}
+		return i.importFallback(path, srcDir)
+	}
+
+	// If there is export data for the package.
+	pkg, err := i.importExportData(filename, path, entry)
+	if err != nil {
+		return nil, err
+	}
+	if pkg == nil {
+		return i.importFallback(path, srcDir)
+	}
+	return pkg, nil
+}
+
+// completing reports whether dir, the directory of an imported
+// package, is that of the file being completed. The package being
+// completed, which an external test package or a file importing its
+// own package may import, is never served from its export data or the
+// cache, which lack the edits since it was last compiled or imported.
+func (i *importer) completing(dir string) bool {
+	return dir != "" && filepath.IsAbs(i.dir) && SamePath(filepath.Clean(dir), filepath.Clean(i.dir))
+}
+
+// completedPath returns the import path of the package being completed:
+// its path below a GOPATH, or below the module holding it. It returns ""
+// if it has none.
+func (i *importer) completedPath() string {
+	if i.completed != nil {
+		return *i.completed
+	}
+	path := ""
+	if filepath.IsAbs(i.dir) {
+		path = gopathImportPath(i.ctx, i.dir)
+		if path == "" && !i.ctx.GOPATHMode() {
+			path = moduleImportPath(i.dir)
+		}
+	}
+	i.completed = &path
+	return path
+}
+
+// gopathImportPath returns the import path of the package in dir below
+// a GOPATH of ctx, or "".
+func gopathImportPath(ctx *PackedContext, dir string) string {
+	for _, root := range filepath.SplitList(ctx.GOPATH) {
+		rel, err := filepath.Rel(filepath.Join(root, "src"), dir)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return ""
+}
 
+// moduleImportPath returns the import path of the package in dir, from
+// the module line of the go.mod above it, or "". In a sandbox, only the
+// go.mod files within it are read.
+func moduleImportPath(dir string) string {
+	read := ioutil.ReadFile
+	if sandboxFS != nil {
+		read = sandboxFS.ReadFile
+	}
+	for root := dir; ; {
+		if data, err := read(filepath.Join(root, "go.mod")); err == nil {
+			mod := modulePath(data)
+			rel, err := filepath.Rel(root, dir)
+			if mod == "" || err != nil {
+				return ""
+			}
+			return pathpkg.Join(mod, filepath.ToSlash(rel))
+		}
+		parent := filepath.Dir(root)
+		if parent == root {
+			return ""
+		}
+		root = parent
+	}
+}
+
+// modulePath returns the module path of the go.mod file data, or "".
+func modulePath(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "module" {
+			return strings.Trim(f[1], "\"`")
+		}
+	}
+	return ""
+}
+
+// importCompleted imports path, the package being completed, from its
+// files, read from the overlay if they are in it, and doesn't cache it
+// beyond the request.
+func (i *importer) importCompleted(path, srcDir string) (*types.Package, error) {
+	i.logf("importing %s, the package being completed, from source", path)
+	if i.source == nil {
+		i.source = newSourceImporter(i)
+	}
+	return i.source.ImportFrom(path, srcDir, 0)
+}
+
+// NewCachedImporter returns an importer of the packages that the cache
+// importer holds, as imported from the directory of filename, which
+// fails for the others. Unlike the cache importer, it can be used
+// without holding Mu, while another request imports packages.
+func NewCachedImporter(ctx *PackedContext, filename string) types.ImporterFrom {
+	return cachedImporter{&importer{
+		ctx:           ctx,
+		importerCache: &importCache,
+		dir:           filepath.Dir(filename),
+	}}
+}
+
+type cachedImporter struct{ i *importer }
+
+func (c cachedImporter) Import(importPath string) (*types.Package, error) {
+	return c.ImportFrom(importPath, "", 0)
+}
+
+func (c cachedImporter) ImportFrom(importPath, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	if importPath == "unsafe" {
+		return types.Unsafe, nil
+	}
+	i := c.i
+	srcDir = i.srcDir(srcDir)
+	path := importPath
+	if i.ctx.GOPATHMode() {
+		// Vendored packages are cached by their resolved path.
+		// Unlike in module mode, resolving it only takes a
+		// look at the file system.
+		bp, err := BuildContext(i.ctx, srcDir).Import(importPath, srcDir, build.FindOnly)
+		if err == nil && bp.ImportPath != "" && bp.ImportPath != "." {
+			path = bp.ImportPath
+		}
+	}
+	i.entries.RLock()
+	entry, ok := i.imports[i.key(path)]
+	i.entries.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s not imported yet", importPath)
+	}
+	return entry.pkg, nil
+}
+
+// importGOROOT imports path from its source in dir, for a file being
+// edited in $GOROOT/src. The package is cached until dir or one of its
+// Go files changes.
+func (i *importer) importGOROOT(path, srcDir, dir string) (*types.Package, error) {
+	mtime, err := srcDirModTime(dir)
+	if err != nil {
+		return nil, err
+	}
+	overlaid := i.overlaid(dir)
+	if entry, ok := i.imports[i.key(path)]; ok && !i.refresh && !overlaid && entry.mtime.Equal(mtime) {
+		i.touch(i.key(path))
+		return entry.pkg, nil
+	}
+	i.logf("importing %s from the edited GOROOT", path)
+	fdErrs := fdErrorCount()
+	pkg, err := i.source.ImportFrom(path, srcDir, 0)
+	if err != nil || pkg == nil || !looksComplete(pkg) || fdErrorCount() != fdErrs || overlaid {
+		// It may lack some of its files, or have those of the
+		// overlay, which aren't on disk.
+		return pkg, err
+	}
+	i.store(i.key(path), importCacheEntry{pkg: pkg, mtime: mtime})
+	return pkg, nil
+}
+
+// Overlay makes i read data in place of the file filename when it
+// imports packages from source.
+func (i *importer) Overlay(filename string, data []byte) {
+	if i.overlay == nil {
+		i.overlay = make(map[string][]byte)
+	}
+	i.overlay[filepath.Clean(filename)] = data
+}
+
+// overlaid reports whether a file in dir is overlaid.
+func (i *importer) overlaid(dir string) bool {
+	for filename := range i.overlay {
+		if SamePath(filepath.Dir(filename), filepath.Clean(dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the key of the package path in the cache: path itself
+// for the server's target in GOPATH mode, qualified by GOOS and GOARCH
+// for the other targets, whose packages have other files, and marked
+// in module mode, where path may name another directory. A path that
+// ExtraSrcDirs map is qualified by the directory it maps to.
+func (i *importer) key(path string) string {
+	key := path
+	if _, dir, ok := LookupSrcDir(i.ctx.ExtraSrcDirs, path); ok {
+		// Workspaces may map path to different directories.
+		key += " " + dir
+	}
+	if !i.ctx.Native() {
+		key += " " + i.ctx.GOOS + "/" + i.ctx.GOARCH
+	}
+	if !i.ctx.GOPATHMode() {
+		key += " module"
+	}
+	return key
+}
+
+// srcDir returns srcDir, or the directory of the file being completed
+// if srcDir is empty.
+func (i *importer) srcDir(srcDir string) string {
+	if srcDir == "" {
+		return i.dir
+	}
+	return srcDir
+}
+
+// Status reports how importPath would be imported from srcDir,
+// without importing anything. It returns one of StatusCached,
+// StatusStale, StatusSource or StatusMissing.
+func (i *importer) Status(importPath, srcDir string) string {
+	srcDir = i.srcDir(srcDir)
+	defer i.useContext(srcDir)()
+
+	if _, dir, ok := LookupSrcDir(i.ctx.ExtraSrcDirs, importPath); ok {
+		return i.mappedStatus(importPath, dir)
+	}
+	filename, path, dir := i.findExportData(importPath, srcDir)
+	if i.completing(dir) {
+		return StatusSource
+	}
+	entry, ok := i.imports[i.key(path)]
+	if i.refresh {
+		ok = false
+	}
+	if i.goroot && dir != "" {
+		mtime, err := srcDirModTime(dir)
+		switch {
+		case err != nil:
+			return StatusMissing
+		case ok && entry.mtime.Equal(mtime):
+			return StatusCached
+		case ok:
+			return StatusStale
+		}
+		return StatusSource
+	}
+	if filename != "" {
+		if fi, err := os.Stat(filename); err == nil && ok && entry.mtime == fi.ModTime() {
+			return StatusCached
+		}
+		return StatusStale
+	}
+	switch {
+	case ok && time.Since(entry.mtime) <= maxEntryAge:
+		return StatusCached
+	case ok:
+		return StatusStale
+	}
+	if bp, err := build.Import(importPath, srcDir, build.FindOnly); err == nil && bp.Dir != "" {
+		if sandboxFS != nil && sandboxFS.Check(bp.Dir) != nil {
+			return StatusUnavailable
+		}
+		return StatusSource
+	}
+	return StatusMissing
+}
+
+// useContext points build.Default at the importer's context, so that
+// gcexportdata and the fallback importers search the right places
+// for imports from dir. The returned function restores build.Default.
+func (i *importer) useContext(dir string) (restore func()) {
+	buildDefaultLock.Lock()
 	origDef := build.Default
-	defer func() { build.Default = origDef }()
 
 	def := &build.Default
 	// The gb root of a project can be used as a $GOPATH because it contains pkg/.
-	def.GOPATH = i.ctx.GOPATH
+	def.GOPATH = strings.Join(SplitPathList(i.ctx.GOPATH, i.ctx.GOROOT, i.logf), string(filepath.ListSeparator))
 	if i.gbroot != "" {
 		def.GOPATH = i.gbroot
 	}
@@ -87,78 +514,314 @@ func (i *importer) ImportFrom(importPath, srcDir string, mode types.ImportMode)
 	def.BuildTags = i.ctx.BuildTags
 	def.ReleaseTags = i.ctx.ReleaseTags
 	def.InstallSuffix = i.ctx.InstallSuffix
-	def.SplitPathList = i.splitPathList
-	def.JoinPath = i.joinPath
+	if !i.ctx.Native() {
+		SetToolTags(def)
+	}
+	if i.gbroot != "" {
+		def.SplitPathList = i.splitPathList
+		def.JoinPath = i.joinPath
+	} else if i.ctx.GOPATHMode() {
+		def.SplitPathList = nil
+		UseGOPATH(def)
+	} else {
+		// go/build only consults the go command, and thus
+		// resolves packages of the current module, if no file
+		// system hooks are set.
+		def.SplitPathList = nil
+		def.JoinPath = nil
+		SetBuildDir(def, dir)
+	}
 
-	i.logf("importing: %v, srcdir: %v", importPath, srcDir)
-	filename, path := gcexportdata.Find(importPath, srcDir)
-	entry, ok := i.imports[path]
-	if filename == "" {
-		i.logf("no gcexportdata file for %s", path)
-		// If there is no export data, check the cache.
-		// TODO(rstambler): Develop a better heuristic for entry eviction.
-		if ok && time.Since(entry.mtime) <= time.Minute*20 {
-			return entry.pkg, nil
+	return func() {
+		build.Default = origDef
+		buildDefaultLock.Unlock()
+	}
+}
+
+// importExportData imports path from the export data in filename,
+// unless entry is still up to date. It returns a nil package if the
+// export data yields an incomplete package, or has an unsupported
+// format version.
+func (i *importer) importExportData(filename, path string, entry importCacheEntry) (*types.Package, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		i.logf("could not stat %s", filename)
+		return nil, err
+	}
+	if !i.refresh && entry.mtime == fi.ModTime() {
+		i.touch(i.key(path))
+		return entry.pkg, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if tooManyOpenFiles(err) {
+			noteFDError()
 		}
-		// If there is no cache entry and the user has configured the correct
-		// setting, import and cache using the source importer.
+		return nil, err
+	}
+	defer f.Close()
+	in, err := gcexportdata.NewReader(f)
+	if err != nil {
+		return nil, i.exportDataError(filename, err)
+	}
+	pkg, err := gcexportdata.Read(in, i.fset, make(map[string]*types.Package), path)
+	if err != nil {
+		return nil, i.exportDataError(filename, err)
+	}
+	if !looksComplete(pkg) {
+		i.logf("export data %s yields an incomplete package", filename)
+		return nil, nil
+	}
+	i.store(i.key(path), importCacheEntry{pkg: pkg, mtime: fi.ModTime()})
+	return pkg, nil
+}
+
+// importFallback imports path with each of the fallback importers in
+// turn, until one of them yields a complete package, which is cached.
+func (i *importer) importFallback(path, srcDir string) (*types.Package, error) {
+	var incomplete *types.Package
+	var err error
+	fdErrs := fdErrorCount()
+	for _, fb := range i.fallbacks {
+		i.logf("falling back to the %s importer for %s", fb.name, path)
 		var pkg *types.Package
-		var err error
-		if i.fallbackToSource {
-			i.logf("cache: falling back to the source importer for %s", path)
-			pkg, err = goimporter.For("source", nil).Import(path)
+		if imp, ok := fb.imp.(types.ImporterFrom); ok {
+			pkg, err = imp.ImportFrom(path, srcDir, 0)
 		} else {
-			i.logf("cache: falling back to the source default for %s", path)
-			pkg, err = goimporter.Default().Import(path)
+			pkg, err = fb.imp.Import(path)
+		}
+		if cycle, ok := err.(*ImportCycleError); ok {
+			// Importing across the cycle yields, at best, a
+			// package missing the import that closes it. Use
+			// it for this completion only.
+			i.logf("%s: %v", path, cycle)
+			return pkg, cycle
 		}
 		if pkg == nil {
-			i.logf("failed to fall back to another importer for %s: %v", pkg, err)
-			return nil, err
+			i.logf("failed to fall back to the %s importer for %s: %v", fb.name, path, err)
+			continue
 		}
-		entry = importCacheEntry{pkg, time.Now()}
-		i.imports[path] = entry
-		return entry.pkg, nil
+		if !looksComplete(pkg) {
+			// Don't cache it, or the package would complete
+			// to nothing until the entry is evicted.
+			i.logf("the %s importer returned an incomplete package for %s", fb.name, path)
+			incomplete = pkg
+			continue
+		}
+		if fdErrorCount() != fdErrs {
+			// Some of its files or imports may be missing.
+			i.logf("ran out of file descriptors importing %s, not caching it", path)
+			return pkg, nil
+		}
+		i.store(i.key(path), importCacheEntry{pkg: pkg, mtime: time.Now()})
+		return pkg, nil
+	}
+	if incomplete != nil {
+		return incomplete, nil
 	}
+	return nil, err
+}
 
-	// If there is export data for the package.
-	fi, err := os.Stat(filename)
-	if err != nil {
-		i.logf("could not stat %s", filename)
-		return nil, err
+// looksComplete reports whether pkg appears to be fully imported.
+// Importers occasionally return an empty, half-initialized package
+// along with a nil error.
+func looksComplete(pkg *types.Package) bool {
+	return pkg.Complete() && pkg.Scope().Len() > 0
+}
+
+// findExportData returns the export data file for importPath, if
+// any, the resolved package path and the package's directory, if
+// known. It must be called with build.Default set up for the
+// importer's context, so that the package directories of the
+// context's GOOS and GOARCH are searched rather than the host's.
+func (i *importer) findExportData(importPath, srcDir string) (filename, path, dir string) {
+	filename, path, dir = i.lookupExportData(importPath, srcDir)
+	if filename != "" && ExportDataMismatch() != nil && mismatchedVersion(exportDataVersion(filename)) {
+		// Export data can't be read by this gocode.
+		return "", path, dir
 	}
-	if entry.mtime != fi.ModTime() {
-		f, err := os.Open(filename)
-		if err != nil {
-			return nil, err
+	if filename != "" && i.goroot {
+		// Export data doesn't reflect edits to the standard library.
+		return "", path, dir
+	}
+	if filename != "" && sandboxFS != nil {
+		if err := sandboxFS.CheckExport(filename); err != nil {
+			i.logf("%v", err)
+			return "", path, dir
 		}
-		in, err := gcexportdata.NewReader(f)
-		if err != nil {
-			return nil, err
+	}
+	if filename != "" && !exportVerified(filename) {
+		return "", path, dir
+	}
+	return filename, path, dir
+}
+
+// lookupExportData is findExportData, whether or not gocode can read
+// the export data.
+func (i *importer) lookupExportData(importPath, srcDir string) (filename, path, dir string) {
+	if filename, path := FindExportData(i.exportDirs, importPath); filename != "" {
+		// Only the directories of the package being completed
+		// and of the standard library being edited are needed.
+		if i.goroot || path == i.completedPath() {
+			bp, _ := build.Import(importPath, srcDir, build.FindOnly)
+			dir = bp.Dir
 		}
-		pkg, err := gcexportdata.Read(in, i.fset, make(map[string]*types.Package), path)
-		if err != nil {
-			return nil, err
+		return filename, path, dir
+	}
+
+	bp, _ := build.Import(importPath, srcDir, build.FindOnly|build.AllowBinary)
+	path = bp.ImportPath
+	if path == "" || path == "." {
+		path = importPath
+	}
+	if bp.PkgObj == "" {
+		return "", path, bp.Dir
+	}
+	noext := strings.TrimSuffix(bp.PkgObj, ".a")
+	for _, ext := range []string{".a", ".o"} {
+		filename := noext + ext
+		if fi, err := os.Stat(filename); err == nil && fi.Mode().IsRegular() {
+			return filename, path, bp.Dir
 		}
-		entry = importCacheEntry{pkg, fi.ModTime()}
-		i.imports[path] = entry
 	}
+	return "", path, bp.Dir
+}
 
-	return entry.pkg, nil
+// FindExportData returns the export data file for importPath in the
+// first of dirs that has one, laid out like a pkg/$GOOS_$GOARCH
+// directory, and the package path it holds.
+func FindExportData(dirs []string, importPath string) (filename, path string) {
+	for _, dir := range dirs {
+		filename := filepath.Join(dir, filepath.FromSlash(importPath)+".a")
+		if fi, err := os.Stat(filename); err == nil && fi.Mode().IsRegular() {
+			return filename, importPath
+		}
+	}
+	return "", ""
 }
 
-// Delete random files to keep the cache at most 100 entries.
-// Only call while holding the importer's mutex.
+// store caches entry for path, as its most recently used package.
+func (i *importerCache) store(path string, entry importCacheEntry) {
+	i.entries.Lock()
+	i.imports[path] = entry
+	i.entries.Unlock()
+	i.touch(path)
+}
+
+// touch records a use of the package cached for path.
+func (i *importerCache) touch(path string) {
+	i.tick++
+	i.used[path] = i.tick
+}
+
+// Delete random unpinned files to keep the cache at most maxEntries
+// entries, and then the least recently used ones to keep it within
+// maxBytes. Only call while holding the importer's mutex.
 func (i *importerCache) clean() {
+	i.entries.Lock()
+	defer i.entries.Unlock()
 	for k := range i.imports {
-		if len(i.imports) <= 100 {
+		if len(i.imports) <= maxEntries {
+			break
+		}
+		if !i.pinned[k] {
+			delete(i.imports, k)
+		}
+	}
+	if i.maxBytes > 0 {
+		i.evictLRU()
+	}
+
+	// Forget the uses of the packages that were evicted.
+	for path := range i.used {
+		if _, ok := i.imports[path]; !ok {
+			delete(i.used, path)
+		}
+	}
+}
+
+// evictLRU deletes the least recently used unpinned packages until
+// the sizes of those cached add up to at most maxBytes. A package
+// cached under several keys, such as for several directories of
+// ExtraSrcDirs, counts once, until the last of them is evicted.
+func (i *importerCache) evictLRU() {
+	var total int64
+	var paths []string
+	keys := make(map[*types.Package]int)
+	for path, entry := range i.imports {
+		if entry.size == 0 {
+			entry.size = packageSize(entry.pkg)
+			i.imports[path] = entry
+		}
+		if keys[entry.pkg]++; keys[entry.pkg] == 1 {
+			total += entry.size
+		}
+		if !i.pinned[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(a, b int) bool { return i.used[paths[a]] < i.used[paths[b]] })
+	for _, path := range paths {
+		if total <= i.maxBytes {
 			break
 		}
-		delete(i.imports, k)
+		entry := i.imports[path]
+		if keys[entry.pkg]--; keys[entry.pkg] == 0 {
+			total -= entry.size
+		}
+		delete(i.imports, path)
+	}
+}
+
+// packageSize estimates the memory taken by pkg from the number of its
+// objects: the package-level ones and the fields and methods of its
+// types. The packages it imports aren't counted. It is replaced by
+// tests.
+var packageSize = func(pkg *types.Package) int64 {
+	scope := pkg.Scope()
+	n := 0
+	for _, name := range scope.Names() {
+		n++
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok {
+			continue
+		}
+		if named, ok := tn.Type().(*types.Named); ok {
+			n += named.NumMethods()
+		}
+		switch u := tn.Type().Underlying().(type) {
+		case *types.Struct:
+			n += u.NumFields()
+		case *types.Interface:
+			n += u.NumExplicitMethods()
+		}
 	}
+	return int64(n) * objectBytes
+}
+
+// Preload imports each of paths as seen from the file filename, and
+// pins the packages in the cache so that they are never evicted. It
+// returns the errors of the imports that failed.
+func Preload(ctx *PackedContext, filename string, paths []string, fallbackToSource bool, logger func(string, ...interface{})) []error {
+	Mu.Lock()
+	defer Mu.Unlock()
+
+	imp := NewImporter(ctx, filename, nil, fallbackToSource, false, false, logger).(*importer)
+	var errs []error
+	for _, path := range paths {
+		pkg, err := imp.Import(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("preloading %s: %v", path, err))
+			continue
+		}
+		importCache.pinned[imp.key(pkg.Path())] = true
+	}
+	return errs
 }
 
 func (i *importer) splitPathList(list string) []string {
-	res := filepath.SplitList(list)
+	res := SplitPathList(list, i.ctx.GOROOT, i.logf)
 	if i.gbroot != "" {
 		res = append(res, i.gbroot, i.gbvendor)
 	}
@@ -196,9 +859,17 @@ func match(s, prefix string) (string, bool) {
 	return rest, len(rest) < len(s)
 }
 
+// getGbProjectPaths is GetGbProjectPaths, replaced by tests.
+var getGbProjectPaths = GetGbProjectPaths
+
 // GetGbProjectPaths checks whether we'are in a gb project and returns
 // gbroot and gbvendor
 func GetGbProjectPaths(ctx *PackedContext, filename string) (string, string) {
+	if InGOROOT(ctx, filename) {
+		// Paths such as $GOROOT/src/cmd/api/testdata/src/...
+		// look like gb projects, but aren't.
+		return "", ""
+	}
 	slashed := filepath.ToSlash(filename)
 	i := strings.LastIndex(slashed, "/vendor/src/")
 	if i < 0 {
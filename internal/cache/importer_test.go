@@ -0,0 +1,1006 @@
+package cache
+
+import (
+	"fmt"
+	"go/build"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/sandbox"
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+// writeFiles returns a temporary directory containing the given files,
+// keyed by slash-separated paths relative to it. The directory has
+// spaces and non-ASCII characters in its name.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "My Projects", "José Müller")
+	for name, src := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// newTestGOPATH returns a temporary GOPATH containing the given files,
+// as writeFiles does.
+func newTestGOPATH(t *testing.T, files map[string]string) string {
+	t.Helper()
+	// The source importer must resolve packages in GOPATH mode.
+	t.Setenv("GO111MODULE", "off")
+	return writeFiles(t, files)
+}
+
+func TestRefresh(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/p/p.go": "package p\n\nfunc Fresh() {}\n",
+	})
+
+	Mu.Lock()
+	defer Mu.Unlock()
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+
+	stale := types.NewPackage("p", "p")
+	stale.MarkComplete()
+	importCache.imports["p"] = importCacheEntry{pkg: stale, mtime: time.Now()}
+	defer delete(importCache.imports, "p")
+
+	pkg, err := NewImporter(&ctx, "", nil, true, false, false, t.Logf).Import("p")
+	if err != nil || pkg != stale {
+		t.Fatalf("without refresh: got %v, %v; want the cached package", pkg, err)
+	}
+
+	pkg, err = NewImporter(&ctx, "", nil, true, true, false, t.Logf).Import("p")
+	if err != nil || pkg == stale || pkg.Scope().Lookup("Fresh") == nil {
+		t.Fatalf("with refresh: got %v, %v; want a fresh package", pkg, err)
+	}
+	if importCache.imports["p"].pkg != pkg {
+		t.Errorf("the cache was not updated with the refreshed package")
+	}
+}
+
+func TestExportDirs(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/q/q.go":    "package q\n\nfunc FromSource() {}\n",
+		"export/q/q.go": "package q\n\nfunc FromExport() {}\n",
+	})
+
+	exportDir := filepath.Join(gopath, "custom")
+	compileExportData(t, "q", filepath.Join(gopath, "export", "q", "q.go"), filepath.Join(exportDir, "q.a"))
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer delete(importCache.imports, "q")
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+
+	pkg, err := NewImporter(&ctx, "", []string{filepath.Join(gopath, "missing"), exportDir}, true, true, false, t.Logf).Import("q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Scope().Lookup("FromExport") == nil {
+		t.Errorf("got package with %v, want the one from the export data directory", pkg.Scope().Names())
+	}
+}
+
+// compileExportData compiles the package in srcFile to the export
+// data file dst, skipping the test if that's not possible.
+func compileExportData(t *testing.T, pkgPath, srcFile, dst string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "tool", "compile", "-p", pkgPath, "-pack", "-o", dst, srcFile)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("cannot compile export data: %v\n%s", err, out)
+	}
+}
+
+func TestContextGOARCH(t *testing.T) {
+	goarch := "arm64"
+	if runtime.GOARCH == goarch {
+		goarch = "amd64"
+	}
+
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/r/r.go":          "package r\n",
+		"src/r/vendor/q/q.go": "package q\n\nfunc FromSource() {}\n",
+		"export/q.go":         "package q\n\nfunc FromExport() {}\n",
+	})
+	pkgDir := filepath.Join(gopath, "pkg", fmt.Sprintf("%s_%s", runtime.GOOS, goarch))
+	compileExportData(t, "r/vendor/q", filepath.Join(gopath, "export", "q.go"), filepath.Join(pkgDir, "r", "vendor", "q.a"))
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer delete(importCache.imports, "r/vendor/q")
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GOARCH = goarch
+
+	imp := NewImporter(&ctx, "", nil, false, true, false, t.Logf)
+	pkg, err := imp.ImportFrom("q", filepath.Join(gopath, "src", "r"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Path() != "r/vendor/q" || pkg.Scope().Lookup("FromExport") == nil {
+		t.Errorf("got package %s with %v, want r/vendor/q from the %s export data", pkg.Path(), pkg.Scope().Names(), goarch)
+	}
+}
+
+type stubImporter func(path string) (*types.Package, error)
+
+func (f stubImporter) Import(path string) (*types.Package, error) { return f(path) }
+
+func TestModeCachedApart(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/p/p.go": "package p\n\nfunc Fresh() {}\n",
+	})
+
+	Mu.Lock()
+	defer Mu.Unlock()
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GO111MODULE = "off"
+	imp := NewImporter(&ctx, "", nil, true, false, false, t.Logf).(*importer)
+	defer delete(importCache.imports, imp.key("p"))
+	stale := types.NewPackage("p", "p")
+	stale.MarkComplete()
+	importCache.imports[imp.key("p")] = importCacheEntry{pkg: stale, mtime: time.Now()}
+
+	// The same path may name another package in module mode, so
+	// the one cached in GOPATH mode isn't used.
+	ctx.GO111MODULE = "on"
+	imp = NewImporter(&ctx, "", nil, true, false, false, t.Logf).(*importer)
+	defer delete(importCache.imports, imp.key("p"))
+	if pkg, _ := imp.Import("p"); pkg == stale {
+		t.Errorf("module mode: got the package cached in GOPATH mode")
+	}
+}
+
+func TestIncompletePackageNotCached(t *testing.T) {
+	gopath := newTestGOPATH(t, nil)
+
+	Mu.Lock()
+	defer Mu.Unlock()
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+
+	empty := types.NewPackage("q", "q")
+	empty.MarkComplete()
+	good := types.NewPackage("q", "q")
+	good.Scope().Insert(types.NewConst(0, good, "C", types.Typ[types.Int], nil))
+	good.MarkComplete()
+
+	imp := &importer{
+		importerCache: &importCache,
+		ctx:           &ctx,
+		logf:          t.Logf,
+	}
+	defer delete(importCache.imports, "q")
+
+	imp.fallbacks = []fallbackImporter{
+		{"empty", stubImporter(func(string) (*types.Package, error) { return empty, nil })},
+	}
+	pkg, err := imp.Import("q")
+	if err != nil || pkg != empty {
+		t.Fatalf("got %v, %v; want the empty package", pkg, err)
+	}
+	if _, ok := importCache.imports["q"]; ok {
+		t.Fatalf("the empty package was cached")
+	}
+
+	imp.fallbacks = append(imp.fallbacks,
+		fallbackImporter{"good", stubImporter(func(string) (*types.Package, error) { return good, nil })})
+	pkg, err = imp.Import("q")
+	if err != nil || pkg != good {
+		t.Fatalf("got %v, %v; want the package from the second importer", pkg, err)
+	}
+	if importCache.imports["q"].pkg != good {
+		t.Errorf("the complete package was not cached")
+	}
+}
+
+func TestFDErrorNotCached(t *testing.T) {
+	Mu.Lock()
+	defer Mu.Unlock()
+
+	ctx := PackContext(&build.Default)
+	pkg := types.NewPackage("q", "q")
+	pkg.Scope().Insert(types.NewConst(0, pkg, "C", types.Typ[types.Int], nil))
+	pkg.MarkComplete()
+
+	imp := &importer{
+		importerCache: &importCache,
+		ctx:           &ctx,
+		logf:          t.Logf,
+	}
+	defer delete(importCache.imports, imp.key("q"))
+
+	// The package looks complete, but one of its imports failed
+	// for lack of file descriptors.
+	imp.fallbacks = []fallbackImporter{
+		{"exhausted", stubImporter(func(string) (*types.Package, error) {
+			noteFDError()
+			return pkg, nil
+		})},
+	}
+	if got, err := imp.Import("q"); err != nil || got != pkg {
+		t.Fatalf("got %v, %v; want the package", got, err)
+	}
+	if _, ok := importCache.imports[imp.key("q")]; ok {
+		t.Errorf("the package was cached")
+	}
+}
+
+func TestConcurrentImports(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = newTestGOPATH(t, nil)
+	pkg := types.NewPackage("q", "q")
+	pkg.Scope().Insert(types.NewConst(0, pkg, "C", types.Typ[types.Int], nil))
+	pkg.MarkComplete()
+	defer func() {
+		Mu.Lock()
+		delete(importCache.imports, "q")
+		Mu.Unlock()
+	}()
+
+	var resolved int32
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// As the server's requests do.
+			Mu.Lock()
+			defer Mu.Unlock()
+			imp := &importer{
+				importerCache: &importCache,
+				ctx:           &ctx,
+				logf:          t.Logf,
+			}
+			imp.fallbacks = []fallbackImporter{
+				{"counting", stubImporter(func(string) (*types.Package, error) {
+					atomic.AddInt32(&resolved, 1)
+					return pkg, nil
+				})},
+			}
+			if got, err := imp.Import("q"); err != nil || got != pkg {
+				t.Errorf("got %v, %v; want the package", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if resolved != 1 {
+		t.Errorf("q was resolved %d times, want once", resolved)
+	}
+}
+
+func TestNoGb(t *testing.T) {
+	defer func(orig func(*PackedContext, string) (string, string)) { getGbProjectPaths = orig }(getGbProjectPaths)
+	detected := false
+	getGbProjectPaths = func(ctx *PackedContext, filename string) (string, string) {
+		detected = true
+		return GetGbProjectPaths(ctx, filename)
+	}
+
+	ctx := PackContext(&build.Default)
+	filename := filepath.Join("gbproject", "src", "p", "p.go")
+
+	NewImporter(&ctx, filename, nil, false, false, true, t.Logf)
+	if detected {
+		t.Errorf("gb detection was performed with noGb set")
+	}
+	NewImporter(&ctx, filename, nil, false, false, false, t.Logf)
+	if !detected {
+		t.Errorf("gb detection was not performed with noGb unset")
+	}
+}
+
+func TestGbProjectPathsUnusualNames(t *testing.T) {
+	gopath := newTestGOPATH(t, nil)
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+
+	gbroot := filepath.Join(filepath.Dir(gopath), "gb projekt ü")
+	gotRoot, gotVendor := GetGbProjectPaths(&ctx, filepath.Join(gbroot, "src", "p", "p.go"))
+	if gotRoot != gbroot || gotVendor != filepath.Join(gbroot, "vendor") {
+		t.Errorf("got %q, %q; want %q and its vendor directory", gotRoot, gotVendor, gbroot)
+	}
+
+	gotRoot, _ = GetGbProjectPaths(&ctx, filepath.Join(gopath, "src", "p", "p.go"))
+	if gotRoot != "" {
+		t.Errorf("file in GOPATH: got gb root %q", gotRoot)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/p/p.go":    "package p\n\nfunc F() {}\n",
+		"export/q/q.go": "package q\n\nfunc G() {}\n",
+	})
+	exportDir := filepath.Join(gopath, "custom")
+	compileExportData(t, "q", filepath.Join(gopath, "export", "q", "q.go"), filepath.Join(exportDir, "q.a"))
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer delete(importCache.imports, "p")
+	defer delete(importCache.imports, "q")
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	imp := NewImporter(&ctx, "", []string{exportDir}, true, false, false, t.Logf)
+
+	check := func(path, want string) {
+		t.Helper()
+		if got := imp.Status(path, ""); got != want {
+			t.Errorf("Status(%q): got %q, want %q", path, got, want)
+		}
+	}
+	check("p", StatusSource)
+	check("q", StatusStale)
+	check("nonexistent", StatusMissing)
+
+	for _, path := range []string{"p", "q"} {
+		if _, err := imp.Import(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("p", StatusCached)
+	check("q", StatusCached)
+}
+
+func TestModuleMainPackage(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir := writeFiles(t, map[string]string{
+		"go.mod":              "module example.com/m\n",
+		"internal/lib/lib.go": "package lib\n\nfunc Hello() string { return \"hello\" }\n",
+		"cmd/foo/main.go":     "package main\n\nimport \"example.com/m/internal/lib\"\n\nfunc main() { lib.Hello() }\n",
+	})
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer delete(importCache.imports, "example.com/m/internal/lib")
+
+	ctx := PackContext(&build.Default)
+	filename := filepath.Join(dir, "cmd", "foo", "main.go")
+	pkg, err := NewImporter(&ctx, filename, nil, true, true, false, t.Logf).Import("example.com/m/internal/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Scope().Lookup("Hello") == nil {
+		t.Errorf("got package %s without Hello", pkg.Path())
+	}
+}
+
+func TestVendorShadowing(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/app/main.go":           "package main\n",
+		"src/app/cmd/tool/main.go":  "package main\n",
+		"src/app/vendor/foo/foo.go": "package foo\n\nfunc Vendored() {}\n",
+		"src/foo/foo.go":            "package foo\n\nfunc Plain() {}\n",
+		"src/other/main.go":         "package main\n",
+	})
+
+	Mu.Lock()
+	defer Mu.Unlock()
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	file := func(name string) string {
+		return filepath.Join(gopath, "src", filepath.FromSlash(name))
+	}
+
+	tests := []struct {
+		file, want string
+	}{
+		{"other/main.go", "Plain"},
+		{"app/main.go", "Vendored"},
+		{"app/cmd/tool/main.go", "Vendored"},
+		{"other/main.go", "Plain"},
+	}
+	for _, fallbackToSource := range []bool{true, false} {
+		for _, test := range tests {
+			filename := file(test.file)
+			imp := NewImporter(&ctx, filename, nil, fallbackToSource, false, true, t.Logf)
+			for _, srcDir := range []string{"", filepath.Dir(filename)} {
+				pkg, err := imp.ImportFrom("foo", srcDir, 0)
+				if err != nil {
+					t.Errorf("%s: %v", test.file, err)
+					continue
+				}
+				if pkg.Scope().Lookup(test.want) == nil {
+					t.Errorf("fallbackToSource=%v: importing foo from %s (srcDir %q): got %s, want the package with %s", fallbackToSource, test.file, srcDir, pkg.Scope().Names(), test.want)
+				}
+			}
+		}
+	}
+	for path := range importCache.imports {
+		delete(importCache.imports, path)
+	}
+}
+
+func TestExportDataVersionMismatch(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/p/p.go": "package p\n\nfunc FromSource() {}\n",
+	})
+
+	// An archive of export data in the indexed format, with a
+	// version from the future.
+	exportDir := filepath.Join(gopath, "export")
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeExport := func(version string) {
+		t.Helper()
+		pkgdef := "go object linux amd64 " + version + " X:none\n\n$$B\ni\x63\x00\x00\x00\x00"
+		if len(pkgdef)%2 != 0 {
+			pkgdef += "\n"
+		}
+		blob := fmt.Sprintf("!<arch>\n%-16s%-12d%-6d%-6d%-8o%-10d`\n%s", "__.PKGDEF", 0, 0, 0, 0644, len(pkgdef), pkgdef)
+		if err := ioutil.WriteFile(filepath.Join(exportDir, "p.a"), []byte(blob), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeExport("go1.99.0")
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer delete(importCache.imports, "p")
+	resetMismatches()
+	defer resetMismatches()
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+
+	for i := 0; i < 2; i++ {
+		pkg, err := NewImporter(&ctx, "", []string{exportDir}, false, true, false, t.Logf).Import("p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg.Scope().Lookup("FromSource") == nil {
+			t.Errorf("import %d: got package without FromSource", i)
+		}
+	}
+
+	m := ExportDataMismatch()
+	if m == nil {
+		t.Fatal("no mismatch recorded")
+	}
+	if m.Toolchain != "go1.99.0" || m.Gocode != runtime.Version() || m.File != filepath.Join(exportDir, "p.a") {
+		t.Errorf("got mismatch %+v", m)
+	}
+	for _, s := range []string{"go1.99.0", runtime.Version(), "rebuild gocode"} {
+		if !strings.Contains(m.Error(), s) {
+			t.Errorf("diagnostic %q doesn't mention %q", m.Error(), s)
+		}
+	}
+
+	// Written by gocode's own Go version, the export data is
+	// corrupt rather than too new.
+	resetMismatches()
+	writeExport(runtime.Version())
+	if _, err := NewImporter(&ctx, "", []string{exportDir}, false, true, false, t.Logf).Import("p"); err == nil {
+		t.Error("no error importing corrupt export data")
+	}
+	if m := ExportDataMismatch(); m != nil {
+		t.Errorf("corrupt export data recorded as a mismatch: %v", m)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/app/main.go":           "package main\n",
+		"src/app/vendor/dep/dep.go": "package dep\n\nfunc Dep() {}\n",
+		"src/lib/lib.go":            "package lib\n\nfunc Lib() {}\n",
+	})
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	filename := filepath.Join(gopath, "src", "app", "deps.txt")
+	if errs := Preload(&ctx, filename, []string{"dep", "lib", "missing"}, true, t.Logf); len(errs) != 1 {
+		t.Errorf("got errors %v, want one for missing", errs)
+	}
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	want := []string{"app/vendor/dep", "lib"}
+	defer func() {
+		for _, path := range want {
+			delete(importCache.imports, path)
+			delete(importCache.pinned, path)
+		}
+	}()
+
+	// Fill the cache past its limit to make it evict entries.
+	for i := 0; i < 200; i++ {
+		path := fmt.Sprintf("filler%d", i)
+		importCache.imports[path] = importCacheEntry{pkg: types.NewPackage(path, "filler"), mtime: time.Now()}
+	}
+	importCache.clean()
+	for path := range importCache.imports {
+		if strings.HasPrefix(path, "filler") {
+			delete(importCache.imports, path)
+		}
+	}
+
+	for _, path := range want {
+		if _, ok := importCache.imports[path]; !ok {
+			t.Errorf("%s is not cached", path)
+		}
+		if !importCache.pinned[path] {
+			t.Errorf("%s is not pinned", path)
+		}
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	sizes := map[string]int64{"small1": 100, "small2": 100, "small3": 100, "big": 600, "huge": 900, "pinned": 300}
+	orig := packageSize
+	packageSize = func(pkg *types.Package) int64 { return sizes[pkg.Path()] }
+	defer func() { packageSize = orig }()
+
+	c := importerCache{
+		imports:  make(map[string]importCacheEntry),
+		pinned:   map[string]bool{"pinned": true},
+		used:     make(map[string]uint64),
+		maxBytes: 1000,
+	}
+	store := func(paths ...string) {
+		for _, path := range paths {
+			c.store(path, importCacheEntry{pkg: types.NewPackage(path, path), mtime: time.Now()})
+		}
+	}
+	cached := func() []string {
+		var paths []string
+		for path := range c.imports {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	// 1200 bytes: big is the least recently used once small1 is.
+	store("pinned", "small1", "big", "small2", "small3")
+	c.touch("small1")
+	c.clean()
+	if got, want := cached(), []string{"pinned", "small1", "small2", "small3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v cached, want %v", got, want)
+	}
+
+	// 1500 bytes: only the pinned package fits along with huge,
+	// which is evicted too.
+	store("huge")
+	c.clean()
+	if got, want := cached(), []string{"pinned"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v cached, want %v", got, want)
+	}
+	if len(c.used) != 1 {
+		t.Errorf("kept the uses of %d packages, want 1", len(c.used))
+	}
+
+	// A package cached under two keys counts once: 900 bytes.
+	shared := types.NewPackage("big", "big")
+	c.store("big", importCacheEntry{pkg: shared, mtime: time.Now()})
+	c.store("big /mapped", importCacheEntry{pkg: shared, mtime: time.Now()})
+	c.clean()
+	if got, want := cached(), []string{"big", "big /mapped", "pinned"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("shared: got %v cached, want %v", got, want)
+	}
+	// Evicting one key frees nothing: with huge and small1, 1900
+	// bytes until both keys of big, and then huge, are evicted.
+	store("huge", "small1")
+	c.clean()
+	if got, want := cached(), []string{"pinned", "small1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("shared: got %v cached, want %v", got, want)
+	}
+
+	// Without a budget, only the number of packages is bounded.
+	c.maxBytes = 0
+	store("small1", "big", "huge")
+	c.clean()
+	if got, want := cached(), []string{"big", "huge", "pinned", "small1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without a budget: got %v cached, want %v", got, want)
+	}
+}
+
+func TestEditingGOROOT(t *testing.T) {
+	goroot := newTestGOPATH(t, map[string]string{
+		"src/cmd/api/testdata/src/p/p.go": "package p\n",
+		"src/mystd/mystd.go":              "package mystd\n\nfunc Edited() {}\n",
+		"export/mystd.a":                  "stale export data\n",
+	})
+
+	ctx := PackContext(&build.Default)
+	ctx.GOROOT = goroot
+	ctx.GOPATH = filepath.Join(goroot, "gopath")
+	filename := filepath.Join(goroot, "src", "cmd", "api", "testdata", "src", "p", "p.go")
+	if !InGOROOT(&ctx, filename) {
+		t.Errorf("%s is not reported to be in GOROOT", filename)
+	}
+	if gbroot, _ := GetGbProjectPaths(&ctx, filename); gbroot != "" {
+		t.Errorf("got gb root %s for a file in GOROOT", gbroot)
+	}
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer delete(importCache.imports, "mystd")
+
+	exportDirs := []string{filepath.Join(goroot, "export")}
+	mystd := filepath.Join(goroot, "src", "mystd", "mystd.go")
+	// Later than the directory, as edits are.
+	mtime := time.Now().Add(time.Hour)
+	var prev *types.Package
+	for i, name := range []string{"Edited", "EditedAgain"} {
+		src := fmt.Sprintf("package mystd\n\nfunc %s() {}\n", name)
+		if err := ioutil.WriteFile(mystd, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime = mtime.Add(time.Minute)
+		if err := os.Chtimes(mystd, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		pkg, err := NewImporter(&ctx, filename, exportDirs, false, false, false, t.Logf).Import("mystd")
+		if err != nil {
+			t.Fatalf("import %d: %v", i, err)
+		}
+		if pkg.Scope().Lookup(name) == nil {
+			t.Errorf("import %d: got package without %s", i, name)
+		}
+		if pkg == prev {
+			t.Errorf("import %d: got the package cached before the edit", i)
+		}
+		prev = pkg
+	}
+
+	// Unchanged, it is cached.
+	if pkg, err := NewImporter(&ctx, filename, exportDirs, false, false, false, t.Logf).Import("mystd"); err != nil || pkg != prev {
+		t.Errorf("unchanged: got %v, %v; want the cached package", pkg, err)
+	}
+
+	// The file being edited is read from the overlay, which isn't
+	// cached.
+	imp := NewImporter(&ctx, filename, exportDirs, false, false, false, t.Logf)
+	imp.Overlay(mystd, []byte("package mystd\n\nfunc Unsaved() {}\n"))
+	if pkg, err := imp.Import("mystd"); err != nil || pkg.Scope().Lookup("Unsaved") == nil {
+		t.Errorf("overlay: got %v, %v; want a package with Unsaved", pkg, err)
+	}
+	if pkg, err := NewImporter(&ctx, filename, exportDirs, false, false, false, t.Logf).Import("mystd"); err != nil || pkg != prev {
+		t.Errorf("after the overlay: got %v, %v; want the cached package", pkg, err)
+	}
+}
+
+func TestForeignTarget(t *testing.T) {
+	if hostGOOS == "js" {
+		t.Skip("js/wasm is the native target")
+	}
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/app/main.go": "//go:build js && wasm\n\npackage main\n",
+	})
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GO111MODULE = "off"
+	ctx.GOOS, ctx.GOARCH, ctx.CgoEnabled = "js", "wasm", false
+	filename := filepath.Join(gopath, "src", "app", "main.go")
+	src := "//go:build js && wasm\n\npackage main\n\nimport \"syscall/js\"\n\nfunc main() {\n\tjs.Global().\n}\n"
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer func() {
+		for key := range importCache.imports {
+			if strings.HasSuffix(key, " js/wasm") {
+				delete(importCache.imports, key)
+			}
+		}
+	}()
+	cfg := suggest.Config{
+		Importer: NewImporter(&ctx, filename, nil, false, false, true, t.Logf),
+		Logf:     t.Logf,
+	}
+	got, _ := cfg.Suggest(filename, []byte(src), strings.Index(src, "Global().")+len("Global()."))
+	methods := make(map[string]bool)
+	for _, c := range got {
+		methods[c.Name] = true
+	}
+	for _, name := range []string{"Call", "Get", "Set", "Invoke"} {
+		if !methods[name] {
+			t.Errorf("js.Global() has no %s among %d candidates", name, len(got))
+		}
+	}
+
+	// The packages of the target are cached apart from the native ones.
+	if _, ok := importCache.imports["syscall/js js/wasm"]; !ok {
+		t.Error("syscall/js isn't cached for js/wasm")
+	}
+	if _, ok := importCache.imports["syscall/js"]; ok {
+		t.Error("syscall/js is cached for the native target")
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/repo/p/p.go":      "package p\n\nimport \"repo/q\"\n\nfunc P() { q.Q() }\n",
+		"src/repo/q/q.go":      "package q\n\nfunc Q() {}\n",
+		"src/outside/o.go":     "package outside\n\nfunc O() {}\n",
+		"src/outside/bad.go":   "not Go, failing the import if read\n",
+		"src/exported/e.go":    "package exported\n\nfunc E() {}\n",
+		"export/exported/e.go": "package exported\n\nfunc E() {}\n",
+	})
+	root := filepath.Join(gopath, "src", "repo")
+	if err := os.Symlink(filepath.Join(gopath, "src", "outside"), filepath.Join(root, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	exportDir := filepath.Join(gopath, "custom")
+	compileExportData(t, "exported", filepath.Join(gopath, "export", "exported", "e.go"), filepath.Join(exportDir, "exported.a"))
+
+	fs, err := sandbox.New(root, build.Default.GOROOT, exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSandbox(fs)
+	defer SetSandbox(nil)
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	for _, path := range []string{"repo/p", "repo/q", "outside", "repo/link", "exported"} {
+		defer delete(importCache.imports, path)
+	}
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	filename := filepath.Join(root, "main.go")
+	for _, test := range []struct {
+		path, name string
+		status     string
+	}{
+		{"repo/p", "P", StatusSource},
+		{"exported", "E", StatusStale},
+		{"outside", "", StatusUnavailable},
+		{"repo/link", "", StatusUnavailable},
+	} {
+		imp := NewImporter(&ctx, filename, []string{exportDir}, false, true, false, t.Logf)
+		if got := imp.Status(test.path, root); got != test.status {
+			t.Errorf("%s: got status %s, want %s", test.path, got, test.status)
+		}
+		pkg, err := imp.Import(test.path)
+		if test.name == "" {
+			if _, ok := err.(*sandbox.Violation); !ok {
+				t.Errorf("%s: got %v, want a sandbox violation before reading anything", test.path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if pkg.Scope().Lookup(test.name) == nil {
+			t.Errorf("%s: got package without %s", test.path, test.name)
+		}
+	}
+}
+
+func TestImportDirSlots(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go": "package p\n",
+		"b.go": "package p\n",
+		"c.go": "package p\n",
+	})
+	defer func(orig chan struct{}) { openSlots = orig }(openSlots)
+	openSlots = make(chan struct{}, 1)
+
+	// With a single slot, each file must give it back once read.
+	done := make(chan error)
+	go func() {
+		_, err := importDir(dir)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("importDir held on to its slot")
+	}
+	if n := len(openSlots); n != 0 {
+		t.Errorf("%d slots still taken", n)
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	// b was just edited to import a, which imports b.
+	const bsrc = "package b\n\nimport \"a\"\n\nvar B = 1\n\nvar _ = a.A\n\nfunc Local() {}\n\nfunc f() {\n\tLo\n}\n"
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/a/a.go": "package a\n\nimport \"b\"\n\nvar A = b.B\n\nfunc Other() {}\n",
+		"src/b/b.go": bsrc,
+	})
+	filename := filepath.Join(gopath, "src", "b", "b.go")
+
+	Mu.Lock()
+	defer Mu.Unlock()
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	for _, sandboxed := range []bool{false, true} {
+		if sandboxed {
+			fs, err := sandbox.New(gopath, build.Default.GOROOT)
+			if err != nil {
+				t.Fatal(err)
+			}
+			SetSandbox(fs)
+		}
+
+		imp := NewImporter(&ctx, filename, nil, true, true, false, t.Logf)
+		pkg, err := imp.Import("a")
+		cycle, ok := err.(*ImportCycleError)
+		if !ok {
+			t.Errorf("sandboxed %v: got error %v, want an import cycle", sandboxed, err)
+		} else if want := []string{"a", "b", "a"}; !reflect.DeepEqual(cycle.Path, want) {
+			t.Errorf("sandboxed %v: got cycle %v, want %v", sandboxed, cycle.Path, want)
+		}
+		if sandboxed && (pkg == nil || pkg.Scope().Lookup("Other") == nil) {
+			// The sandboxed importer only drops the import
+			// closing the cycle.
+			t.Errorf("sandboxed %v: got package %v without Other", sandboxed, pkg)
+		}
+		for _, path := range []string{"a", "b"} {
+			if _, ok := importCache.imports[path]; ok {
+				t.Errorf("sandboxed %v: %s was cached", sandboxed, path)
+				delete(importCache.imports, path)
+			}
+		}
+
+		// The rest of b still completes.
+		cfg := suggest.Config{
+			Importer: NewImporter(&ctx, filename, nil, true, true, false, t.Logf),
+			Logf:     t.Logf,
+		}
+		cands, _ := cfg.Suggest(filename, []byte(bsrc), strings.Index(bsrc, "Lo\n")+2)
+		if len(cands) != 1 || cands[0].Name != "Local" {
+			t.Errorf("sandboxed %v: got candidates %v, want Local", sandboxed, cands)
+		}
+		SetSandbox(nil)
+	}
+}
+
+func TestStaleOwnExportData(t *testing.T) {
+	const psrc = "package p\n\nfunc Old() {}\n\nfunc New() {}\n\nfunc Buffered() {}\n\nfunc f() {\n\tBu\n}\n"
+	const xsrc = "package p_test\n\nimport \"p\"\n\nfunc g() {\n\tp.Ne\n}\n"
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/p/p.go":      "package p\n\nfunc Old() {}\n\nfunc New() {}\n",
+		"src/q/q.go":      "package q\n",
+		"export/p/p.go":   "package p\n\nfunc Old() {}\n",
+		"src/p/x_test.go": xsrc,
+	})
+	pkgDir := filepath.Join(gopath, "pkg", fmt.Sprintf("%s_%s", runtime.GOOS, runtime.GOARCH))
+	compileExportData(t, "p", filepath.Join(gopath, "export", "p", "p.go"), filepath.Join(pkgDir, "p.a"))
+
+	Mu.Lock()
+	defer Mu.Unlock()
+	defer delete(importCache.imports, "p")
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	filename := filepath.Join(gopath, "src", "p", "p.go")
+
+	// The stale export data is used by other packages...
+	pkg, err := NewImporter(&ctx, filepath.Join(gopath, "src", "q", "q.go"), nil, false, false, false, t.Logf).Import("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Scope().Lookup("New") != nil {
+		t.Fatalf("got package with %v from q, want the stale export data", pkg.Scope().Names())
+	}
+
+	// ...but not by p, even though it is cached now.
+	imp := NewImporter(&ctx, filename, nil, false, false, false, t.Logf)
+	if got := imp.Status("p", ""); got != StatusSource {
+		t.Errorf("got status %s for the package being completed, want %s", got, StatusSource)
+	}
+	pkg, err = imp.Import("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Scope().Lookup("New") == nil {
+		t.Errorf("got package with %v from p, want the one on disk", pkg.Scope().Names())
+	}
+
+	// The unsaved edits of the file being completed are read, also
+	// when the export data is found in an export directory.
+	for _, exportDirs := range [][]string{nil, {pkgDir}} {
+		imp := NewImporter(&ctx, filename, exportDirs, false, false, false, t.Logf)
+		imp.Overlay(filename, []byte("package p\n\nfunc Unsaved() {}\n"))
+		pkg, err := imp.Import("p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg.Scope().Lookup("Unsaved") == nil {
+			t.Errorf("export dirs %v: got package with %v from p, want the unsaved one", exportDirs, pkg.Scope().Names())
+		}
+	}
+
+	for _, test := range []struct {
+		filename, src, partial, want string
+	}{
+		{filename, psrc, "Bu", "Buffered"},
+		{filepath.Join(gopath, "src", "p", "x_test.go"), xsrc, "p.Ne", "New"},
+	} {
+		cfg := suggest.Config{
+			Importer: NewImporter(&ctx, test.filename, nil, false, false, false, t.Logf),
+			Logf:     t.Logf,
+		}
+		cands, _ := cfg.Suggest(test.filename, []byte(test.src), strings.Index(test.src, test.partial+"\n")+len(test.partial))
+		if len(cands) != 1 || cands[0].Name != test.want {
+			t.Errorf("%s: got candidates %v, want %s", test.partial, cands, test.want)
+		}
+	}
+}
+
+func TestSetToolTags(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	defer func(orig func(*build.Context) []string) { listToolTags = orig }(listToolTags)
+	lists := 0
+	list := listToolTags
+	listToolTags = func(ctx *build.Context) []string {
+		lists++
+		return list(ctx)
+	}
+
+	ctx := build.Default
+	ctx.GOOS, ctx.GOARCH = "js", "wasm"
+	toolTags.Lock()
+	delete(toolTags.m, toolTagsKey{ctx.GOROOT, ctx.GOOS, ctx.GOARCH})
+	toolTags.Unlock()
+	SetToolTags(&ctx)
+	if lists != 1 {
+		t.Errorf("listed the tool tags %d times, want 1", lists)
+	}
+	tags := make(map[string]bool)
+	for _, tag := range ctx.ToolTags {
+		tags[tag] = true
+	}
+	if len(tags) == 0 {
+		t.Fatal("got no tool tags")
+	}
+	if tags["goexperiment.regabiargs"] || tags["goexperiment.regabiwrappers"] {
+		t.Errorf("got the tags of the register-based ABI for wasm: %q", ctx.ToolTags)
+	}
+	if tags["amd64.v1"] || tags["arm64.v8.0"] {
+		t.Errorf("got the tags of another architecture: %q", ctx.ToolTags)
+	}
+
+	// The tags of a target are listed once.
+	ctx.ToolTags = nil
+	SetToolTags(&ctx)
+	if lists != 1 || ctx.ToolTags == nil {
+		t.Errorf("listed the tool tags %d times, got %q", lists, ctx.ToolTags)
+	}
+}
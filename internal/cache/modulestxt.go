@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/fswalk"
+)
+
+// symlinks is the policy for symbolic links to vendored packages.
+var symlinks = fswalk.Default
+
+// SetSymlinkPolicy sets whether CheckVendored follows symbolic links
+// to vendored packages. It must be called before any importer is used.
+func SetSymlinkPolicy(p fswalk.Policy) {
+	symlinks = p
+}
+
+// CheckVendored returns an error if pkgPath, imported from srcDir, is
+// in the vendor directory of a module in vendor mode, but isn't listed
+// in its vendor/modules.txt. The go command refuses such imports. In
+// GOPATH mode, vendor directories are used regardless.
+func CheckVendored(ctx *PackedContext, srcDir, pkgPath string) error {
+	if ctx.GOPATHMode() {
+		return nil
+	}
+	for dir := srcDir; dir != ""; {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			pkgs, ok := vendoredPackages(dir)
+			if !ok {
+				return nil
+			}
+			vendored := filepath.Join(dir, "vendor", filepath.FromSlash(pkgPath))
+			if fi, err := fswalk.Stat(vendored, symlinks); err == nil && fi.IsDir() && !pkgs[pkgPath] {
+				return fmt.Errorf("%s is vendored but not listed in %s", pkgPath, filepath.Join(dir, "vendor", "modules.txt"))
+			}
+			return nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return nil
+}
+
+// modulesTxt caches the packages listed in the vendor/modules.txt of
+// each module root, as parsed by vendoredPackages.
+var modulesTxt struct {
+	sync.Mutex
+	byRoot map[string]modulesTxtEntry
+}
+
+type modulesTxtEntry struct {
+	mtime time.Time
+	size  int64
+	pkgs  map[string]bool
+}
+
+// vendoredPackages returns the import paths of the packages listed in
+// the vendor/modules.txt of the module rooted at root, and whether
+// there is one, i.e. whether the module is in vendor mode. The file is
+// only parsed again once it changes.
+func vendoredPackages(root string) (map[string]bool, bool) {
+	filename := filepath.Join(root, "vendor", "modules.txt")
+	fi, err := os.Stat(filename)
+	modulesTxt.Lock()
+	defer modulesTxt.Unlock()
+	if err != nil {
+		delete(modulesTxt.byRoot, root)
+		return nil, false
+	}
+	if e, ok := modulesTxt.byRoot[root]; ok && e.mtime.Equal(fi.ModTime()) && e.size == fi.Size() {
+		return e.pkgs, true
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, false
+	}
+	pkgs := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		// Lines starting with "#" describe modules; the others
+		// list the packages vendored from the module above them.
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			pkgs[line] = true
+		}
+	}
+	if modulesTxt.byRoot == nil {
+		modulesTxt.byRoot = make(map[string]modulesTxtEntry)
+	}
+	modulesTxt.byRoot[root] = modulesTxtEntry{fi.ModTime(), fi.Size(), pkgs}
+	return pkgs, true
+}
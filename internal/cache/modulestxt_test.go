@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/fswalk"
+)
+
+func TestCheckVendoredEdited(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"go.mod":                          "module example.com/m\n",
+		"vendor/modules.txt":              "# example.com/dep v1.0.0\nexample.com/dep\n",
+		"vendor/example.com/dep/dep.go":   "package dep\n",
+		"vendor/example.com/more/more.go": "package more\n",
+	})
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = filepath.Join(root, "gopath")
+	ctx.GO111MODULE = "on"
+
+	if err := CheckVendored(&ctx, root, "example.com/dep"); err != nil {
+		t.Errorf("listed package: %v", err)
+	}
+	if err := CheckVendored(&ctx, root, "example.com/more"); err == nil {
+		t.Error("unlisted package accepted")
+	}
+
+	// go mod vendor lists it.
+	txt := filepath.Join(root, "vendor", "modules.txt")
+	if err := ioutil.WriteFile(txt, []byte("# example.com/dep v1.0.0\nexample.com/dep\nexample.com/more\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(txt, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckVendored(&ctx, root, "example.com/more"); err != nil {
+		t.Errorf("package listed once modules.txt changed: %v", err)
+	}
+}
+
+func TestCheckVendoredSymlink(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"go.mod":             "module example.com/m\n",
+		"vendor/modules.txt": "# example.com/dep v1.0.0\nexample.com/dep\n",
+		"elsewhere/more.go":  "package more\n",
+	})
+	if err := os.MkdirAll(filepath.Join(root, "vendor", "example.com"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "elsewhere"), filepath.Join(root, "vendor", "example.com", "more")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	ctx := PackContext(&build.Default)
+	ctx.GO111MODULE = "on"
+	defer SetSymlinkPolicy(symlinks)
+
+	// By default, the link is followed to the vendored package,
+	// which isn't listed.
+	SetSymlinkPolicy(fswalk.Default)
+	if err := CheckVendored(&ctx, root, "example.com/more"); err == nil {
+		t.Error("default: unlisted package through a link accepted")
+	}
+	SetSymlinkPolicy(fswalk.Skip)
+	if err := CheckVendored(&ctx, root, "example.com/more"); err != nil {
+		t.Errorf("skip: %v", err)
+	}
+}
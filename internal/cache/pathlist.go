@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var warned struct {
+	sync.Mutex
+	m map[string]bool
+}
+
+// SplitPathList splits a GOPATH-style list and drops entries that
+// would make the same package resolvable through more than one root:
+// empty entries, duplicates, entries inside GOROOT, and entries nested
+// inside other entries (e.g., $GOPATH/pkg/mod listed next to $GOPATH).
+// Each dropped entry is logged once.
+func SplitPathList(list, goroot string, logf func(string, ...interface{})) []string {
+	var paths []string
+	for _, p := range filepath.SplitList(list) {
+		if p != "" {
+			paths = append(paths, filepath.Clean(p))
+		}
+	}
+
+	var res []string
+outer:
+	for i, p := range paths {
+		if goroot != "" && withinDir(filepath.Clean(goroot), p) {
+			warnDropped(logf, p, "it is inside GOROOT")
+			continue
+		}
+		for j, q := range paths {
+			if i == j {
+				continue
+			}
+			if withinDir(q, p) && (!withinDir(p, q) || j < i) {
+				// Nested in q, or a duplicate of an earlier entry.
+				warnDropped(logf, p, "it is inside "+q)
+				continue outer
+			}
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+func warnDropped(logf func(string, ...interface{}), path, reason string) {
+	warned.Lock()
+	defer warned.Unlock()
+	if warned.m == nil {
+		warned.m = make(map[string]bool)
+	}
+	if warned.m[path] {
+		return
+	}
+	warned.m[path] = true
+	logf("ignoring GOPATH entry %s: %s", path, reason)
+}
+
+// withinDir reports whether path is dir or a descendant of dir.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
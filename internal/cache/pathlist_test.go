@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitPathList(t *testing.T) {
+	tests := []struct {
+		gopath string
+		goroot string
+		want   []string
+	}{
+		{"/home/u/go", "/usr/local/go", []string{"/home/u/go"}},
+		{"/home/u/go:/home/u/work", "/usr/local/go", []string{"/home/u/go", "/home/u/work"}},
+		{"/home/u/go::/home/u/go/", "/usr/local/go", []string{"/home/u/go"}},
+		{"/home/u/go:/home/u/go/pkg/mod", "/usr/local/go", []string{"/home/u/go"}},
+		{"/home/u/go/pkg/mod:/home/u/go", "/usr/local/go", []string{"/home/u/go"}},
+		{"/usr/local/go:/home/u/go", "/usr/local/go", []string{"/home/u/go"}},
+		{"/usr/local/go/src/x:/home/u/go", "/usr/local/go/", []string{"/home/u/go"}},
+		{"/usr/local/gopath", "/usr/local/go", []string{"/usr/local/gopath"}},
+		{"/a/b/../c:/a/c", "", []string{"/a/c"}},
+	}
+	for _, test := range tests {
+		gopath := filepath.FromSlash(strings.Replace(test.gopath, ":", string(filepath.ListSeparator), -1))
+		var want []string
+		for _, p := range test.want {
+			want = append(want, filepath.FromSlash(p))
+		}
+		got := SplitPathList(gopath, filepath.FromSlash(test.goroot), t.Logf)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SplitPathList(%q, %q) = %q, want %q", test.gopath, test.goroot, got, want)
+		}
+	}
+}
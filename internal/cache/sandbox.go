@@ -0,0 +1,19 @@
+package cache
+
+import "github.com/mdempsky/gocode/internal/sandbox"
+
+// sandboxFS, if non-nil, confines the reads of all importers.
+var sandboxFS *sandbox.FS
+
+// SetSandbox confines the reads of all importers to fs: export data
+// outside of it is ignored, and packages outside of it can't be
+// imported from source. A nil fs lifts the restriction. It must be
+// called before any importer is used.
+func SetSandbox(fs *sandbox.FS) {
+	sandboxFS = fs
+}
+
+// Sandbox returns the FS set by SetSandbox.
+func Sandbox() *sandbox.FS {
+	return sandboxFS
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"go/ast"
+	"go/build"
+	goimporter "go/importer"
+	"go/parser"
+	"go/types"
+	"path/filepath"
+
+	"github.com/mdempsky/gocode/internal/sandbox"
+)
+
+// sourceImporter imports packages from source, like the source
+// importer, but reads directories and files holding slots of openSlots,
+// by importDir and readSourceFile, so that large imports don't run the
+// process out of file descriptors, and only those sandboxFS allows, if
+// set. The source importer can't be throttled so in module mode, where
+// go/build only finds packages if build.Default has no file system
+// hooks. The imports of a package are
+// resolved by i, so that they can still come from export data, and are
+// cached.
+type sourceImporter struct {
+	i    *importer
+	pkgs map[string]*types.Package // nil while being imported
+
+	stack []string          // the packages being imported, outermost first
+	cycle *ImportCycleError // met while importing the top of stack
+
+	// cgo imports the packages with cgo files outside of a
+	// sandbox, as their Go types come from running cgo.
+	cgo types.ImporterFrom
+}
+
+func newSourceImporter(i *importer) *sourceImporter {
+	return &sourceImporter{i: i, pkgs: make(map[string]*types.Package)}
+}
+
+func (s *sourceImporter) Import(path string) (*types.Package, error) {
+	return s.ImportFrom(path, "", 0)
+}
+
+// ImportFrom must be called with build.Default set up by i.useContext.
+func (s *sourceImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	bp, err := buildImport(path, srcDir)
+	if err != nil {
+		if tooManyOpenFiles(err) {
+			noteFDError()
+		}
+		if _, ok := err.(*sandbox.Violation); ok {
+			s.i.logf("%v", err)
+		}
+		return nil, err
+	}
+	if sandboxFS == nil && len(bp.CgoFiles) > 0 {
+		if s.cgo == nil {
+			s.cgo = goimporter.For("source", nil).(types.ImporterFrom)
+		}
+		return s.cgo.ImportFrom(path, srcDir, mode)
+	}
+
+	return s.importPackage(bp)
+}
+
+// buildImport is build.Import(path, srcDir, 0), except that the files
+// of the package are read by importDir. In module mode, go/build only
+// finds packages with the go command if build.Default has no file
+// system hooks, so the package is found first, and its directory read
+// with them.
+func buildImport(path, srcDir string) (*build.Package, error) {
+	found, err := build.Import(path, srcDir, build.FindOnly)
+	if err != nil {
+		return nil, err
+	}
+	bp, err := importDir(found.Dir)
+	if bp != nil {
+		bp.ImportPath = found.ImportPath
+	}
+	return bp, err
+}
+
+// importDir is build.ImportDir(dir, 0), for build.Default set up by
+// useContext, except that dir and its files are read holding slots of
+// openSlots, and through the sandbox if any.
+func importDir(dir string) (*build.Package, error) {
+	ctxt := build.Default
+	if sandboxFS != nil {
+		if err := sandboxFS.Check(dir); err != nil {
+			return nil, err
+		}
+		ctxt.IsDir = sandboxFS.IsDir
+	}
+	ctxt.ReadDir = readSourceDir
+	ctxt.OpenFile = openSourceFile
+	return ctxt.ImportDir(dir, 0)
+}
+
+// importPackage imports the package bp from its files, which the
+// sandbox, if any, allows reading.
+func (s *sourceImporter) importPackage(bp *build.Package) (*types.Package, error) {
+	if pkg, ok := s.pkgs[bp.ImportPath]; ok {
+		if pkg == nil {
+			for i, p := range s.stack {
+				if p == bp.ImportPath {
+					s.cycle = &ImportCycleError{Path: append(s.stack[i:len(s.stack):len(s.stack)], p)}
+					break
+				}
+			}
+			return nil, s.cycle
+		}
+		return pkg, nil
+	}
+	fdErrs := fdErrorCount()
+	s.pkgs[bp.ImportPath] = nil
+	var files []*ast.File
+	for _, name := range append(bp.GoFiles, bp.CgoFiles...) {
+		filename := filepath.Join(bp.Dir, name)
+		src, ok := s.i.overlay[filename]
+		var err error
+		if !ok {
+			src, err = readSourceFile(filename)
+		}
+		if err != nil {
+			s.i.logf("%v", err)
+			delete(s.pkgs, bp.ImportPath)
+			return nil, err
+		}
+		if f, _ := parser.ParseFile(s.i.fset, filename, src, 0); f != nil {
+			files = append(files, f)
+		}
+	}
+	conf := types.Config{
+		Importer:    sourceImports{s, bp.Dir},
+		FakeImportC: true,
+		Error:       func(err error) {},
+	}
+	outer := s.cycle
+	s.cycle = nil
+	s.stack = append(s.stack, bp.ImportPath)
+	pkg, _ := conf.Check(bp.ImportPath, s.i.fset, files, nil)
+	s.stack = s.stack[:len(s.stack)-1]
+
+	cycle := s.cycle
+	if len(s.stack) == 0 {
+		s.cycle = nil
+	} else if cycle == nil {
+		s.cycle = outer
+	}
+	if cycle != nil {
+		// The package lacks the import closing the cycle,
+		// so don't keep it. Packages importing it don't
+		// either, as s.cycle is still set for them.
+		delete(s.pkgs, bp.ImportPath)
+		return pkg, cycle
+	}
+	if fdErrorCount() != fdErrs {
+		// An import may have failed for lack of file
+		// descriptors. Use the package for this completion
+		// only; importFallback doesn't cache it either.
+		delete(s.pkgs, bp.ImportPath)
+		return pkg, nil
+	}
+	s.pkgs[bp.ImportPath] = pkg
+	return pkg, nil
+}
+
+// sourceImports resolves the imports of a package in dir being
+// imported by a sourceImporter.
+type sourceImports struct {
+	s   *sourceImporter
+	dir string
+}
+
+func (imp sourceImports) Import(path string) (*types.Package, error) {
+	// build.Default is already set up, and its lock held.
+	return imp.s.i.importLocked(path, imp.dir)
+}
@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A SrcDir maps the packages whose import paths are Prefix or start
+// with Prefix and a slash to the directories below Dir, such as
+// packages generated into a build output tree that is neither in
+// GOPATH nor in a module.
+type SrcDir struct {
+	Prefix string
+	Dir    string
+}
+
+func (m SrcDir) String() string {
+	return m.Prefix + "=" + m.Dir
+}
+
+// ParseSrcDirs parses a list of prefix=dir mappings separated by the
+// OS-specific path list separator, such as
+// "example.com/gen=bazel-bin/gen:example.com/proto=/tmp/proto". The
+// directories are made absolute.
+func ParseSrcDirs(list string) ([]SrcDir, error) {
+	var res []SrcDir
+	for _, s := range filepath.SplitList(list) {
+		if s == "" {
+			continue
+		}
+		m, err := parseSrcDir(s, "")
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// parseSrcDir parses the mapping prefix=dir, with dir relative to the
+// directory base, or to the current directory if base is empty.
+func parseSrcDir(s, base string) (SrcDir, error) {
+	eq := strings.IndexByte(s, '=')
+	if eq <= 0 || eq == len(s)-1 {
+		return SrcDir{}, fmt.Errorf("source directory mapping %q isn't of the form prefix=dir", s)
+	}
+	dir := filepath.FromSlash(s[eq+1:])
+	if base != "" && !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return SrcDir{}, err
+	}
+	return SrcDir{Prefix: strings.TrimSuffix(s[:eq], "/"), Dir: dir}, nil
+}
+
+// WorkspaceConfig is the name of the file configuring the workspace
+// of the directory holding it: the files in it and below it, up to
+// the next such file.
+const WorkspaceConfig = ".gocode.json"
+
+// workspaceConfig is the content of a WorkspaceConfig file, such as
+// {"extra-src-dirs": ["example.com/gen=bazel-bin/gen"]}.
+type workspaceConfig struct {
+	// ExtraSrcDirs are prefix=dir mappings, as for ParseSrcDirs,
+	// with the directories relative to the workspace.
+	ExtraSrcDirs []string `json:"extra-src-dirs"`
+}
+
+// WorkspaceSrcDirs returns the mappings of the WorkspaceConfig of the
+// workspace of dir, found in dir or the closest directory above it
+// holding one, if any.
+func WorkspaceSrcDirs(dir string) ([]SrcDir, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		data, err := ioutil.ReadFile(filepath.Join(dir, WorkspaceConfig))
+		if err == nil {
+			return parseWorkspaceConfig(data, dir)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// parseWorkspaceConfig returns the mappings of the WorkspaceConfig
+// data of the workspace root.
+func parseWorkspaceConfig(data []byte, root string) ([]SrcDir, error) {
+	var cfg workspaceConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(root, WorkspaceConfig), err)
+	}
+	var res []SrcDir
+	for _, s := range cfg.ExtraSrcDirs {
+		m, err := parseSrcDir(s, root)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Join(root, WorkspaceConfig), err)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// LookupSrcDir returns the mapping of dirs with the longest prefix
+// matching importPath, the first of those with that prefix, and the
+// directory it maps importPath to.
+func LookupSrcDir(dirs []SrcDir, importPath string) (m SrcDir, dir string, ok bool) {
+	for _, d := range dirs {
+		if importPath != d.Prefix && !strings.HasPrefix(importPath, d.Prefix+"/") {
+			continue
+		}
+		if !ok || len(d.Prefix) > len(m.Prefix) {
+			m, ok = d, true
+		}
+	}
+	if !ok {
+		return SrcDir{}, "", false
+	}
+	rest := strings.TrimPrefix(importPath[len(m.Prefix):], "/")
+	return m, filepath.Join(m.Dir, filepath.FromSlash(rest)), true
+}
+
+// importMapped imports path from dir, where m maps it, from source.
+// The package is cached until dir or one of its Go files changes, or
+// one of its imports is imported anew.
+func (i *importer) importMapped(path, dir string, m SrcDir) (*types.Package, error) {
+	mtime, err := srcDirModTime(dir)
+	if err != nil {
+		return nil, fmt.Errorf("importing %s, mapped by %s: %v", path, m, err)
+	}
+	completing := i.completing(dir)
+	if entry, ok := i.imports[i.key(path)]; ok && !completing && !i.refresh && entry.mtime.Equal(mtime) && i.depsImported(entry.deps, dir) {
+		i.touch(i.key(path))
+		return entry.pkg, nil
+	}
+	if sandboxFS != nil {
+		if err := sandboxFS.Check(dir); err != nil {
+			i.logf("%v", err)
+			return nil, err
+		}
+	}
+	i.logf("importing %s from %s, mapped by %s", path, dir, m)
+	bp, err := importDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("importing %s, mapped by %s: %v", path, m, err)
+	}
+	bp.ImportPath = path
+	if i.source == nil {
+		i.source = newSourceImporter(i)
+	}
+	fdErrs := fdErrorCount()
+	pkg, err := i.source.importPackage(bp)
+	if err != nil || pkg == nil || completing || !looksComplete(pkg) || fdErrorCount() != fdErrs {
+		// The package being completed lacks the edits in
+		// progress, and the others may lack some of their files.
+		return pkg, err
+	}
+	deps := make(map[string]*types.Package)
+	for _, dep := range bp.Imports {
+		// Already imported, so cached unless it can't be.
+		deps[dep], _ = i.importLocked(dep, dir)
+	}
+	i.store(i.key(path), importCacheEntry{pkg: pkg, mtime: mtime, deps: deps})
+	return pkg, nil
+}
+
+// depsImported reports whether the imports deps of a package in dir
+// are still imported as the same packages.
+func (i *importer) depsImported(deps map[string]*types.Package, dir string) bool {
+	for path, want := range deps {
+		if got, _ := i.importLocked(path, dir); got != want {
+			i.logf("%s was imported anew", path)
+			return false
+		}
+	}
+	return true
+}
+
+// depsCached reports whether the imports deps of a package are still
+// cached as the same packages, for Status, which doesn't import them.
+func (i *importer) depsCached(deps map[string]*types.Package) bool {
+	for _, want := range deps {
+		if want == nil || want == types.Unsafe {
+			continue
+		}
+		if entry, ok := i.imports[i.key(want.Path())]; !ok || entry.pkg != want {
+			return false
+		}
+	}
+	return true
+}
+
+// mappedStatus is Status for path, which m maps to dir.
+func (i *importer) mappedStatus(path, dir string) string {
+	mtime, err := srcDirModTime(dir)
+	if err != nil {
+		return StatusMissing
+	}
+	if sandboxFS != nil && sandboxFS.Check(dir) != nil {
+		return StatusUnavailable
+	}
+	entry, ok := i.imports[i.key(path)]
+	switch {
+	case i.completing(dir):
+		return StatusSource
+	case ok && !i.refresh && entry.mtime.Equal(mtime) && i.depsCached(entry.deps):
+		return StatusCached
+	case ok:
+		return StatusStale
+	}
+	return StatusSource
+}
+
+// srcDirModTime returns the latest modification time of dir and of
+// the Go files in it.
+func srcDirModTime(dir string) (time.Time, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !fi.IsDir() {
+		return time.Time{}, fmt.Errorf("%s isn't a directory", dir)
+	}
+	mtime := fi.ModTime()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".go") && fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	return mtime, nil
+}
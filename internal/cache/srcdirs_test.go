@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"go/build"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLookupSrcDir(t *testing.T) {
+	dirs, err := ParseSrcDirs(string(filepath.ListSeparator) + "example.com/gen=/out/gen" + string(filepath.ListSeparator) + "example.com/gen/api/v2/=/out/v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := func(dir string) string {
+		dir, _ = filepath.Abs(filepath.FromSlash(dir))
+		return dir
+	}
+	if want := []SrcDir{{"example.com/gen", abs("/out/gen")}, {"example.com/gen/api/v2", abs("/out/v2")}}; !reflect.DeepEqual(dirs, want) {
+		t.Fatalf("got %v, want %v", dirs, want)
+	}
+
+	for _, test := range []struct {
+		path, prefix, dir string
+	}{
+		{"example.com/gen", "example.com/gen", "/out/gen"},
+		{"example.com/gen/api", "example.com/gen", "/out/gen/api"},
+		// The longest prefix wins.
+		{"example.com/gen/api/v2", "example.com/gen/api/v2", "/out/v2"},
+		{"example.com/gen/api/v2/types", "example.com/gen/api/v2", "/out/v2/types"},
+		{"example.com/gen/api/v20", "example.com/gen", "/out/gen/api/v20"},
+		// Prefixes match whole path elements.
+		{"example.com/generated", "", ""},
+		{"fmt", "", ""},
+	} {
+		m, dir, ok := LookupSrcDir(dirs, test.path)
+		if test.prefix == "" {
+			if ok {
+				t.Errorf("%s: mapped by %s, want no mapping", test.path, m)
+			}
+			continue
+		}
+		if !ok || m.Prefix != test.prefix || dir != abs(test.dir) {
+			t.Errorf("%s: got %s, mapped by %s, want %s, mapped by %s", test.path, dir, m, abs(test.dir), test.prefix)
+		}
+	}
+
+	for _, list := range []string{"example.com/gen", "=/out", "example.com/gen="} {
+		if _, err := ParseSrcDirs(list); err == nil {
+			t.Errorf("ParseSrcDirs(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestExtraSrcDirs(t *testing.T) {
+	// A build output tree, outside of GOPATH, with generated
+	// packages importing each other.
+	root := newTestGOPATH(t, map[string]string{
+		"src/q/q.go":                    "package q\n\nimport \"example.com/gen/api\"\n\nvar _ = api.New\n",
+		"bazel-bin/gen/api/api.go":      "package api\n\nimport \"example.com/gen/api/types\"\n\nfunc New() types.ID { return 0 }\n",
+		"bazel-bin/gen/api/types/id.go": "package types\n\ntype ID int\n",
+		"bazel-bin/gen/api/v2/v2.go":    "package v2\n\nfunc Shadowed() {}\n",
+		"bazel-bin/v2/v2.go":            "package v2\n\nfunc V2() {}\n",
+		"bazel-bin/gen/api/skipped.go":  "// +build ignore\n\npackage api\n\nfunc Ignored() {}\n",
+	})
+	gen := filepath.Join(root, "bazel-bin", "gen")
+
+	Mu.Lock()
+	defer Mu.Unlock()
+
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = root
+	ctx.ExtraSrcDirs = []SrcDir{
+		{"example.com/gen", gen},
+		{"example.com/gen/api/v2", filepath.Join(root, "bazel-bin", "v2")},
+	}
+	filename := filepath.Join(root, "src", "q", "q.go")
+	newImporter := func() Importer {
+		return NewImporter(&ctx, filename, nil, false, false, false, t.Logf)
+	}
+	for _, path := range []string{"example.com/gen/api", "example.com/gen/api/types", "example.com/gen/api/v2"} {
+		defer delete(importCache.imports, newImporter().(*importer).key(path))
+	}
+	check := func(path, want string) {
+		t.Helper()
+		if got := newImporter().Status(path, ""); got != want {
+			t.Errorf("Status(%q): got %q, want %q", path, got, want)
+		}
+	}
+	lookup := func(path, name string) types.Object {
+		t.Helper()
+		pkg, err := newImporter().Import(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg.Path() != path {
+			t.Errorf("imported %s as %s", path, pkg.Path())
+		}
+		return pkg.Scope().Lookup(name)
+	}
+
+	check("example.com/gen/api", StatusSource)
+	check("example.com/gen/missing", StatusMissing)
+	newFunc := lookup("example.com/gen/api", "New")
+	if newFunc == nil {
+		t.Fatal("example.com/gen/api lacks New")
+	}
+	if got := types.TypeString(newFunc.Type(), nil); got != "func() example.com/gen/api/types.ID" {
+		t.Errorf("got New of type %s", got)
+	}
+	if lookup("example.com/gen/api", "Ignored") != nil {
+		t.Error("imported a file excluded by its build constraints")
+	}
+	check("example.com/gen/api", StatusCached)
+	check("example.com/gen/api/types", StatusCached)
+	if lookup("example.com/gen/api/v2", "V2") == nil {
+		t.Error("example.com/gen/api/v2 wasn't imported through the longest prefix")
+	}
+
+	// Regenerating an import invalidates the packages importing it.
+	id := filepath.Join(gen, "api", "types", "id.go")
+	if err := ioutil.WriteFile(id, []byte("package types\n\ntype ID string\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(id, later, later); err != nil {
+		t.Fatal(err)
+	}
+	check("example.com/gen/api/types", StatusStale)
+	lookup("example.com/gen/api/types", "ID")
+	check("example.com/gen/api", StatusStale)
+	newFunc = lookup("example.com/gen/api", "New")
+	if got := newFunc.Type().(*types.Signature).Results().At(0).Type().Underlying().String(); got != "string" {
+		t.Errorf("New still returns the ID of underlying type %s", got)
+	}
+	check("example.com/gen/api", StatusCached)
+
+	// Regenerating the package invalidates it.
+	api := filepath.Join(gen, "api", "api.go")
+	if err := ioutil.WriteFile(api, []byte("package api\n\nfunc Regenerated() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(api, later, later); err != nil {
+		t.Fatal(err)
+	}
+	check("example.com/gen/api", StatusStale)
+	if lookup("example.com/gen/api", "Regenerated") == nil {
+		t.Error("the regenerated package is still cached")
+	}
+	check("example.com/gen/api", StatusCached)
+}
+
+func TestWorkspaceSrcDirs(t *testing.T) {
+	root := newTestGOPATH(t, map[string]string{
+		"ws/.gocode.json":        `{"extra-src-dirs": ["example.com/gen=bazel-bin/gen", "example.com/abs=/out/abs"]}`,
+		"ws/src/q/q.go":          "package q\n",
+		"ws/nested/.gocode.json": `{}`,
+		"bad/.gocode.json":       `{"extra-src-dirs": ["example.com/gen"]}`,
+		"other/o.go":             "package o\n",
+	})
+	ws := filepath.Join(root, "ws")
+	abs, _ := filepath.Abs(filepath.FromSlash("/out/abs"))
+
+	dirs, err := WorkspaceSrcDirs(filepath.Join(ws, "src", "q"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []SrcDir{{"example.com/gen", filepath.Join(ws, "bazel-bin", "gen")}, {"example.com/abs", abs}}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("got %v, want %v", dirs, want)
+	}
+
+	// The closest configuration wins, even without mappings.
+	for _, dir := range []string{filepath.Join(ws, "nested"), filepath.Join(root, "other")} {
+		if dirs, err := WorkspaceSrcDirs(dir); err != nil || dirs != nil {
+			t.Errorf("%s: got %v, %v, want no mappings", dir, dirs, err)
+		}
+	}
+	if _, err := WorkspaceSrcDirs(filepath.Join(root, "bad")); err == nil {
+		t.Error("parsed a malformed mapping")
+	}
+}
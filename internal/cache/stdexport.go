@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/cachefile"
+	"github.com/mdempsky/gocode/internal/fswalk"
+)
+
+// StdPackages returns the import paths of the standard library
+// packages in goroot that programs can import: those below
+// $GOROOT/src with Go files, other than the commands, internal and
+// vendored packages.
+func StdPackages(goroot string) ([]string, error) {
+	src := filepath.Join(goroot, "src")
+	var paths []string
+	seen := make(map[string]bool)
+	err := fswalk.WalkPackages(src, fswalk.Skip, false, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			switch name := info.Name(); {
+			case path == src:
+			case name == "internal", name == "vendor", path == filepath.Join(src, "cmd"):
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := info.Name()
+		if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			return nil
+		}
+		rel, err := filepath.Rel(src, filepath.Dir(path))
+		if err != nil || rel == "." {
+			return nil
+		}
+		if rel = filepath.ToSlash(rel); !seen[rel] {
+			seen[rel] = true
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+// exportTimeout bounds how long the go command exporting the standard
+// library may run.
+const exportTimeout = 5 * time.Minute
+
+// Throttle is called before ExportStd runs the go command, and returns
+// the func to call once it is done. It is replaced by the server to
+// share the slots of go install, which ExportStd competes with for CPU.
+var Throttle = func() (release func()) { return func() {} }
+
+// ExportStd writes the export data of the standard library packages
+// paths for ctx to dir, laid out like a pkg/$GOOS_$GOARCH directory so
+// that it can be passed to NewImporter as an export directory. The
+// export data is built by "go list -export". Packages whose export data
+// in dir is newer than their sources and the Go version are skipped;
+// they are returned as fresh. The go command is killed after
+// exportTimeout.
+func ExportStd(ctx *PackedContext, dir string, paths []string) (fresh map[string]bool, err error) {
+	fresh = make(map[string]bool)
+	var stale []string
+	for _, path := range paths {
+		if stdExportFresh(ctx.GOROOT, dir, path) {
+			fresh[path] = true
+		} else {
+			stale = append(stale, path)
+		}
+	}
+	if len(stale) == 0 {
+		return fresh, nil
+	}
+
+	cgo := "0"
+	if ctx.CgoEnabled {
+		cgo = "1"
+	}
+	goBin := filepath.Join(ctx.GOROOT, "bin", "go")
+	if _, err := os.Stat(goBin); err != nil {
+		goBin = "go"
+	}
+	args := append([]string{"list", "-e", "-export", "-f", "{{.ImportPath}}\t{{.Export}}", "--"}, stale...)
+	release := Throttle()
+	defer release()
+	runCtx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(runCtx, goBin, args...)
+	cmd.Dir = filepath.Join(ctx.GOROOT, "src")
+	// GOFLAGS such as -mod=mod don't apply to the standard library.
+	cmd.Env = append(os.Environ(),
+		"GOOS="+ctx.GOOS,
+		"GOARCH="+ctx.GOARCH,
+		"GOROOT="+ctx.GOROOT,
+		"CGO_ENABLED="+cgo,
+		"GOFLAGS=",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if runCtx.Err() == context.DeadlineExceeded {
+		return fresh, fmt.Errorf("go list -export: timed out after %v", exportTimeout)
+	}
+	if err != nil {
+		return fresh, fmt.Errorf("go list -export: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), "\t", 2)
+		if len(fields) != 2 || fields[1] == "" {
+			// Excluded by build constraints, or unsafe,
+			// which has no export data.
+			continue
+		}
+		if err := copyExportData(fields[1], filepath.Join(dir, filepath.FromSlash(fields[0])+".a")); err != nil {
+			return fresh, err
+		}
+	}
+	return fresh, sc.Err()
+}
+
+// stdExportFresh reports whether the export data of the standard
+// library package path in dir is intact and newer than its files in
+// goroot and goroot's VERSION file, which changes when Go is upgraded
+// in place. Corrupt export data is quarantined.
+func stdExportFresh(goroot, dir, path string) bool {
+	filename := filepath.Join(dir, filepath.FromSlash(path)+".a")
+	fi, err := os.Stat(filename)
+	if err != nil || cachefile.VerifySum(filename) != nil {
+		return false
+	}
+	if vi, err := os.Stat(filepath.Join(goroot, "VERSION")); err == nil && vi.ModTime().After(fi.ModTime()) {
+		return false
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(goroot, "src", filepath.FromSlash(path)))
+	if err != nil {
+		return false
+	}
+	for _, info := range infos {
+		if !info.IsDir() && info.ModTime().After(fi.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyExportData copies the export data file src to dst, with a
+// checksum file, through temporary files renamed into place, so that
+// importers never read a partly written file.
+func copyExportData(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return cachefile.WriteSum(dst, data)
+}
+
+// summedExports records the directories of export data written by
+// ExportStd, and the files in them verified since they were last
+// modified.
+var summedExports struct {
+	sync.Mutex
+	dirs  map[string]bool
+	files map[string]time.Time
+}
+
+// VerifyExports makes importers verify each export data file in dir,
+// written by ExportStd, against its checksum the first time they find
+// it, as the daemon writing it may have been killed halfway. A file
+// that fails verification is quarantined, and one without a checksum,
+// written by an older gocode, is passed over; the packages of both are
+// imported from source until ExportStd rebuilds them.
+func VerifyExports(dir string) {
+	summedExports.Lock()
+	defer summedExports.Unlock()
+	if summedExports.dirs == nil {
+		summedExports.dirs = make(map[string]bool)
+		summedExports.files = make(map[string]time.Time)
+	}
+	summedExports.dirs[dir] = true
+}
+
+// exportVerified reports whether the export data file filename may be
+// read: it isn't in a directory passed to VerifyExports, or it was
+// verified since it was last modified.
+func exportVerified(filename string) bool {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	summedExports.Lock()
+	summed := false
+	for dir := range summedExports.dirs {
+		if strings.HasPrefix(filename, dir+string(filepath.Separator)) {
+			summed = true
+			break
+		}
+	}
+	mtime, verified := summedExports.files[filename]
+	summedExports.Unlock()
+	if !summed || verified && mtime.Equal(fi.ModTime()) {
+		return true
+	}
+
+	if cachefile.VerifySum(filename) != nil {
+		return false
+	}
+	summedExports.Lock()
+	summedExports.files[filename] = fi.ModTime()
+	summedExports.Unlock()
+	return true
+}
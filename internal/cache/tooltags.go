@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"go/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolTagsTimeout bounds how long the go command listing the tool tags
+// of a target may run.
+const toolTagsTimeout = 30 * time.Second
+
+// toolTags caches the tool tags of each target, which are listed by
+// running the go command.
+var toolTags = struct {
+	sync.Mutex
+	m map[toolTagsKey][]string
+}{m: make(map[toolTagsKey][]string)}
+
+type toolTagsKey struct {
+	goroot, goos, goarch string
+}
+
+// SetToolTags sets the tool tags of ctx, which go/build sets for the
+// target gocode was built for, to those the go command of ctx.GOROOT
+// uses for ctx.GOOS and ctx.GOARCH: the goexperiment tags, such as
+// those of the register-based ABI, and the architecture feature tags,
+// such as amd64.v1. Otherwise, packages with files for either ABI,
+// such as internal/abi, have none for a target such as GOARCH=wasm.
+// The tags of a target are listed once; they are left as they are if
+// the go command fails.
+func SetToolTags(ctx *build.Context) {
+	key := toolTagsKey{ctx.GOROOT, ctx.GOOS, ctx.GOARCH}
+	toolTags.Lock()
+	tags, ok := toolTags.m[key]
+	if !ok {
+		tags = listToolTags(ctx)
+		toolTags.m[key] = tags
+	}
+	toolTags.Unlock()
+	if tags != nil {
+		ctx.ToolTags = tags
+	}
+}
+
+// listToolTags returns the tool tags the go command of ctx.GOROOT uses
+// for ctx.GOOS and ctx.GOARCH, or nil if it fails. It is replaced by
+// tests.
+var listToolTags = func(ctx *build.Context) []string {
+	goBin := filepath.Join(ctx.GOROOT, "bin", "go")
+	if _, err := os.Stat(goBin); err != nil {
+		goBin = "go"
+	}
+	runCtx, cancel := context.WithTimeout(context.Background(), toolTagsTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(runCtx, goBin, "list", "-e", "-f", "{{context.ToolTags}}", "unsafe")
+	cmd.Dir = filepath.Join(ctx.GOROOT, "src")
+	// GOFLAGS such as -mod=mod don't apply to the standard library.
+	cmd.Env = append(os.Environ(),
+		"GOOS="+ctx.GOOS,
+		"GOARCH="+ctx.GOARCH,
+		"GOROOT="+ctx.GOROOT,
+		"GOFLAGS=",
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	list := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(list, "[") || !strings.HasSuffix(list, "]") {
+		return nil
+	}
+	return append([]string{}, strings.Fields(list[1:len(list)-1])...)
+}
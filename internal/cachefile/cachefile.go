@@ -0,0 +1,208 @@
+// Package cachefile writes and reads the files gocode keeps in the
+// user cache directory, such as the reference index and the export
+// data written by warm-std. The daemon writing them may be killed at
+// any moment, so files are replaced atomically, through a temporary
+// file renamed into place, and carry a checksum verified on read. A
+// file that fails verification is quarantined: renamed with a .corrupt
+// suffix, so that it is rebuilt rather than read again.
+package cachefile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Version is the format version of cache files. Files of another
+// version fail verification.
+const Version = 1
+
+// magic starts the header of a cache file, which is followed by the
+// format version, the checksum of the contents, and a newline.
+const magic = "gocode-cache"
+
+// SumSuffix is appended to the name of a file written by WriteSum to
+// name the file holding its checksum.
+const SumSuffix = ".sum"
+
+// CorruptSuffix is appended to the name of a quarantined file.
+const CorruptSuffix = ".corrupt"
+
+// A CorruptError is returned by Read and VerifySum for files that fail
+// verification.
+type CorruptError struct {
+	Filename string
+	Err      error // why
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("%s: corrupt cache file: %v", e.Filename, e.Err)
+}
+
+// Logf logs the quarantine of files. It is replaced by tests.
+var Logf = log.Printf
+
+// Write replaces filename with data, preceded by a header holding the
+// format version and the checksum of data.
+func Write(filename string, data []byte) error {
+	var buf bytes.Buffer
+	buf.Grow(len(magic) + 2*sha256.Size + len(data) + 16)
+	fmt.Fprintf(&buf, "%s %d %s\n", magic, Version, checksum(data))
+	buf.Write(data)
+	return writeAtomic(filename, buf.Bytes())
+}
+
+// Read returns the contents of filename, written by Write. If the file
+// fails verification, it is quarantined and Read returns a
+// *CorruptError.
+func Read(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := verify(data)
+	if err != nil {
+		return nil, quarantine(filename, err)
+	}
+	return contents, nil
+}
+
+// verify returns the contents of data, the whole of a cache file, if
+// its header is valid and its checksum matches.
+func verify(data []byte) ([]byte, error) {
+	nl := bytes.IndexByte(data, '\n')
+	if nl < 0 {
+		return nil, errors.New("no header")
+	}
+	var version int
+	var sum string
+	if _, err := fmt.Sscanf(string(data[:nl]), magic+" %d %s", &version, &sum); err != nil {
+		return nil, fmt.Errorf("bad header: %v", err)
+	}
+	if version != Version {
+		return nil, fmt.Errorf("format version %d, want %d", version, Version)
+	}
+	contents := data[nl+1:]
+	if sum != checksum(contents) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return contents, nil
+}
+
+// ErrNoSum is returned by VerifySum for a file without a checksum
+// file: one written before checksums were, or whose writer was killed
+// before writing its checksum. Such a file isn't corrupt, only
+// unverified, so it is left in place to be rewritten.
+var ErrNoSum = errors.New("no checksum file")
+
+// WriteSum replaces filename with data as is, for files read by other
+// means, such as export data, and then filename+SumSuffix with its
+// checksum. A file without a checksum file, because the writer was
+// killed in between, fails VerifySum with ErrNoSum.
+func WriteSum(filename string, data []byte) error {
+	if err := writeAtomic(filename, data); err != nil {
+		return err
+	}
+	return Write(filename+SumSuffix, []byte(checksum(data)))
+}
+
+// VerifySum verifies filename against its checksum file, written by
+// WriteSum, and returns ErrNoSum if there is none. If it fails
+// verification otherwise, it is quarantined, its checksum file is
+// removed, and VerifySum returns a *CorruptError.
+func VerifySum(filename string) error {
+	sum, err := ioutil.ReadFile(filename + SumSuffix)
+	if os.IsNotExist(err) {
+		return ErrNoSum
+	}
+	if err == nil {
+		sum, err = verify(sum)
+	}
+	if err != nil {
+		os.Remove(filename + SumSuffix)
+		return quarantine(filename, err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if string(sum) != checksum(data) {
+		os.Remove(filename + SumSuffix)
+		return quarantine(filename, errors.New("checksum mismatch"))
+	}
+	return nil
+}
+
+// logged records the files whose quarantine was logged, so that a file
+// that can't be renamed is only reported once.
+var logged struct {
+	sync.Mutex
+	files map[string]bool
+}
+
+// quarantine renames filename, which failed verification because of
+// why, with CorruptSuffix, replacing any earlier quarantined copy, and
+// returns the error to report.
+func quarantine(filename string, why error) error {
+	err := &CorruptError{filename, why}
+	rerr := os.Rename(filename, filename+CorruptSuffix)
+	if os.IsNotExist(rerr) {
+		rerr = nil
+	}
+
+	logged.Lock()
+	defer logged.Unlock()
+	if logged.files[filename] {
+		return err
+	}
+	if logged.files == nil {
+		logged.files = make(map[string]bool)
+	}
+	logged.files[filename] = true
+	if rerr != nil {
+		Logf("%v; can't quarantine it: %v", err, rerr)
+	} else {
+		Logf("%v; quarantined as %s", err, filepath.Base(filename+CorruptSuffix))
+	}
+	return err
+}
+
+// writeAtomic replaces filename with data through a temporary file in
+// the same directory renamed into place, so that readers, and a writer
+// killed halfway, never leave a partly written file.
+func writeAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,159 @@
+package cachefile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureLogs sets Logf to record the messages logged in the returned
+// slice until the returned func is called.
+func captureLogs() (*[]string, func()) {
+	var logs []string
+	orig := Logf
+	Logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	return &logs, func() { Logf = orig }
+}
+
+func TestRead(t *testing.T) {
+	dir := t.TempDir()
+	logs, restore := captureLogs()
+	defer restore()
+
+	contents := []byte(`{"root":"/ws","dirs":{}}`)
+	filename := filepath.Join(dir, "sub", "refs.json")
+	if err := Write(filename, contents); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Read(filename); err != nil || string(got) != string(contents) {
+		t.Fatalf("Read: got %q, %v; want %q", got, err, contents)
+	}
+	if fis, _ := ioutil.ReadDir(filepath.Dir(filename)); len(fis) != 1 {
+		t.Errorf("Write left %d files, want 1", len(fis))
+	}
+
+	written, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := strings.IndexByte(string(written), '\n')
+	corruptions := map[string][]byte{
+		"empty":            nil,
+		"torn header":      written[:header/2],
+		"truncated":        written[:len(written)-1],
+		"other version":    []byte(strings.Replace(string(written), " 1 ", " 2 ", 1)),
+		"flipped version":  flip(written, len(magic)+1),
+		"flipped checksum": flip(written, header-1),
+		"flipped contents": flip(written, len(written)-3),
+	}
+	for name, data := range corruptions {
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			_, err := Read(filename)
+			if i == 1 {
+				// The file was quarantined.
+				if !os.IsNotExist(err) {
+					t.Errorf("%s: reading again: got %v, want a missing file", name, err)
+				}
+				continue
+			}
+			if _, ok := err.(*CorruptError); !ok {
+				t.Errorf("%s: got %v, want a CorruptError", name, err)
+			}
+		}
+		if got, err := ioutil.ReadFile(filename + CorruptSuffix); err != nil || string(got) != string(data) {
+			t.Errorf("%s: quarantined %q, %v; want %q", name, got, err, data)
+		}
+	}
+	// Each file is only reported once.
+	if len(*logs) != 1 || !strings.Contains((*logs)[0], "quarantined as refs.json.corrupt") {
+		t.Errorf("logged %q, want one quarantine", *logs)
+	}
+
+	// Rewriting a quarantined file recovers it.
+	if err := Write(filename, contents); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Read(filename); err != nil || string(got) != string(contents) {
+		t.Errorf("Read after rewriting: got %q, %v; want %q", got, err, contents)
+	}
+}
+
+func TestVerifySum(t *testing.T) {
+	dir := t.TempDir()
+	_, restore := captureLogs()
+	defer restore()
+
+	data := []byte("!<arch>\nexport data")
+	filename := filepath.Join(dir, "strings.a")
+	for _, test := range []struct {
+		name    string
+		corrupt func() error
+	}{
+		{"intact", func() error { return nil }},
+		{"truncated", func() error { return ioutil.WriteFile(filename, data[:len(data)/2], 0644) }},
+		{"bit-flipped", func() error { return ioutil.WriteFile(filename, flip(data, 3), 0644) }},
+		{"truncated checksum", func() error { return ioutil.WriteFile(filename+SumSuffix, []byte(magic+" 1 "), 0644) }},
+	} {
+		if err := WriteSum(filename, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.corrupt(); err != nil {
+			t.Fatal(err)
+		}
+		err := VerifySum(filename)
+		if test.name == "intact" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if _, ok := err.(*CorruptError); !ok {
+			t.Errorf("%s: got %v, want a CorruptError", test.name, err)
+		}
+		for _, name := range []string{filename, filename + SumSuffix} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("%s: %s left in place", test.name, filepath.Base(name))
+			}
+		}
+		if _, err := os.Stat(filename + CorruptSuffix); err != nil {
+			t.Errorf("%s: not quarantined: %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifySumLegacy(t *testing.T) {
+	dir := t.TempDir()
+	logs, restore := captureLogs()
+	defer restore()
+
+	// Export data written before checksums were is rebuilt, not
+	// quarantined.
+	filename := filepath.Join(dir, "strings.a")
+	if err := ioutil.WriteFile(filename, []byte("!<arch>\nexport data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySum(filename); err != ErrNoSum {
+		t.Errorf("got %v, want ErrNoSum", err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("legacy file not left in place: %v", err)
+	}
+	if len(*logs) != 0 {
+		t.Errorf("logged %q", *logs)
+	}
+}
+
+// flip returns a copy of data with a bit of data[i] flipped.
+func flip(data []byte, i int) []byte {
+	data = append([]byte(nil), data...)
+	data[i] ^= 4
+	return data
+}
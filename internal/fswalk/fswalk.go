@@ -0,0 +1,167 @@
+// Package fswalk walks directory trees according to a policy for
+// symbolic links.
+package fswalk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Policy says whether symbolic links are followed.
+type Policy int
+
+const (
+	// Default follows symbolic links when looking up a single
+	// path, as os.Stat does, but not when walking trees or
+	// listing directories, like Skip.
+	Default Policy = iota
+
+	// Skip doesn't follow symbolic links: walks don't descend into
+	// linked directories and linked files are described by the
+	// link itself, like filepath.Walk.
+	Skip
+
+	// Follow follows symbolic links, as needed for symlink trees
+	// such as bazel's. Each directory is visited at most once, so
+	// links to a parent directory don't loop forever.
+	Follow
+)
+
+// ParsePolicy parses "default", "skip" or "follow".
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "default":
+		return Default, nil
+	case "skip":
+		return Skip, nil
+	case "follow":
+		return Follow, nil
+	}
+	return Default, fmt.Errorf("unknown symlink policy %q (want default, skip or follow)", s)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Skip:
+		return "skip"
+	case Follow:
+		return "follow"
+	}
+	return "default"
+}
+
+// Stat returns the FileInfo describing name, or the link itself if
+// name is a symbolic link and p is Skip.
+func Stat(name string, p Policy) (os.FileInfo, error) {
+	if p == Skip {
+		return os.Lstat(name)
+	}
+	return os.Stat(name)
+}
+
+// ReadDir is like ioutil.ReadDir, but if p is Follow, the entries for
+// symbolic links describe their targets, unless they are dangling.
+func ReadDir(dir string, p Policy) ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil || p != Follow {
+		return infos, err
+	}
+	for i, info := range infos {
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if fi, err := os.Stat(filepath.Join(dir, info.Name())); err == nil {
+			infos[i] = fi
+		}
+	}
+	return infos, nil
+}
+
+// Walk is like filepath.Walk, which it is if p is Skip. If p is
+// Follow, symbolic links to directories are walked too, and the
+// FileInfo passed to fn describes the targets of links.
+func Walk(root string, p Policy, fn filepath.WalkFunc) error {
+	if p != Follow {
+		return filepath.Walk(root, fn)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walk(root, info, make(map[string]bool), fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walk walks path following symbolic links. visited holds the real
+// paths of the directories already walked.
+func walk(path string, info os.FileInfo, visited map[string]bool, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		if visited[real] {
+			return nil
+		}
+		visited[real] = true
+	}
+	if err := fn(path, info, nil); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return fn(path, info, err)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+		fi, err := os.Stat(filename)
+		if err != nil {
+			// A dangling link is reported as itself.
+			fi, err = os.Lstat(filename)
+		}
+		if err != nil {
+			if err := fn(filename, fi, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := walk(filename, fi, visited, fn); err != nil {
+			if !fi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Ignored reports whether the go tool ignores directories named name
+// when matching package patterns: testdata, and those starting with
+// "." or "_". Their packages aren't importable by their paths.
+func Ignored(name string) bool {
+	return name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// WalkPackages is like Walk, but doesn't descend into the directories
+// below root that the go tool ignores, unless ignored is set.
+func WalkPackages(root string, p Policy, ignored bool, fn filepath.WalkFunc) error {
+	return Walk(root, p, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !ignored && info.IsDir() && path != root && Ignored(info.Name()) {
+			return filepath.SkipDir
+		}
+		return fn(path, info, err)
+	})
+}
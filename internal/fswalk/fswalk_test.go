@@ -0,0 +1,133 @@
+package fswalk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles returns a temporary directory containing empty files of
+// the given slash-separated names.
+func writeFiles(t *testing.T, names ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range names {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	root := writeFiles(t, "a/a.go", "b/b.go")
+	// a/loop points back at the root, and a/b at a sibling.
+	if err := os.Symlink("..", filepath.Join(root, "a", "loop")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join("..", "b"), filepath.Join(root, "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	walkFiles := func(p Policy) []string {
+		var files []string
+		err := Walk(root, p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				rel, _ := filepath.Rel(root, path)
+				files = append(files, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%v: %v", p, err)
+		}
+		return files
+	}
+
+	// With Skip, and by default, the links are reported as files.
+	for _, p := range []Policy{Default, Skip} {
+		if got, want := walkFiles(p), []string{"a/a.go", "a/b", "a/loop", "b/b.go"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %q, want %q", p, got, want)
+		}
+	}
+	// With Follow, each directory is walked once, through
+	// whichever path reaches it first.
+	if got, want := walkFiles(Follow), []string{"a/a.go", "a/b/b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("follow: got %q, want %q", got, want)
+	}
+
+	for _, p := range []Policy{Default, Skip, Follow} {
+		infos, err := ReadDir(filepath.Join(root, "a"), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if info.Name() == "b" && info.IsDir() != (p == Follow) {
+				t.Errorf("%v: a/b is a directory: %v", p, info.IsDir())
+			}
+		}
+
+		// Looking up a single path only doesn't follow links
+		// with Skip.
+		info, err := Stat(filepath.Join(root, "a", "b"), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.IsDir() != (p != Skip) {
+			t.Errorf("%v: a/b is stated as a directory: %v", p, info.IsDir())
+		}
+	}
+}
+
+func TestWalkPackagesIgnored(t *testing.T) {
+	root := writeFiles(t,
+		"p.go",
+		"q/q.go",
+		"q/testdata/t.go",
+		"testdata/src/r/r.go",
+		"_ignored/i.go",
+		".hidden/h.go",
+		"q/_old/o.go",
+	)
+
+	walkFiles := func(root string, p Policy, ignored bool) []string {
+		var files []string
+		err := WalkPackages(root, p, ignored, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				rel, _ := filepath.Rel(root, path)
+				files = append(files, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%v: %v", p, err)
+		}
+		return files
+	}
+
+	for _, p := range []Policy{Skip, Follow} {
+		if got, want := walkFiles(root, p, false), []string{"p.go", "q/q.go"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %q, want %q", p, got, want)
+		}
+		want := []string{".hidden/h.go", "_ignored/i.go", "p.go", "q/_old/o.go", "q/q.go", "q/testdata/t.go", "testdata/src/r/r.go"}
+		if got := walkFiles(root, p, true); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v, ignored: got %q, want %q", p, got, want)
+		}
+		// The root is walked even if it would be ignored.
+		if got, want := walkFiles(filepath.Join(root, "testdata"), p, false), []string{"src/r/r.go"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v, testdata root: got %q, want %q", p, got, want)
+		}
+	}
+}
@@ -1,24 +1,31 @@
 package gbimporter
 
 import (
+	"context"
 	"fmt"
 	"go/build"
+	goimporter "go/importer"
 	"go/types"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mdempsky/gocode/internal/cache"
+	"github.com/mdempsky/gocode/internal/fswalk"
 )
 
 type installedInfo struct {
 	Target string
 	MTime  int64
+
+	// Archive is the .a file of Target, if it was found after the
+	// install. Target is installed again once it is deleted.
+	Archive string
 }
 
 var installedMap map[string]*installedInfo
@@ -27,6 +34,72 @@ func init() {
 	installedMap = make(map[string]*installedInfo)
 }
 
+// installTimeout bounds how long a single go install may run.
+const installTimeout = time.Minute
+
+// InstallStats counts the go install commands run by importers.
+type InstallStats struct {
+	Attempted int64
+	Succeeded int64
+	Failed    int64
+	TimedOut  int64
+
+	// Running and Queued are the number of go install commands
+	// currently running or waiting for a slot.
+	Running int64
+	Queued  int64
+}
+
+var installStats InstallStats
+
+// installSem limits the number of concurrent go install commands
+// across all importers.
+var installSem = make(chan struct{}, 2)
+
+// SetMaxInstalls sets how many go install commands may run at once.
+// It must be called before any importer is used.
+func SetMaxInstalls(n int) {
+	if n < 1 {
+		n = 1
+	}
+	installSem = make(chan struct{}, n)
+}
+
+// symlinks is the policy for symbolic links met while looking for
+// packages to install.
+var symlinks = fswalk.Default
+
+// SetSymlinkPolicy sets whether symbolic links to vendored packages
+// and source files are followed. It must be called before any
+// importer is used.
+func SetSymlinkPolicy(p fswalk.Policy) {
+	symlinks = p
+}
+
+// getGbProjectPaths is cache.GetGbProjectPaths, replaced by tests.
+var getGbProjectPaths = cache.GetGbProjectPaths
+
+// Logf logs the failures of go install, which aren't about a single
+// request. It may be replaced to throttle them.
+var Logf = log.Printf
+
+// installCommand returns the command used to install target.
+var installCommand = func(ctx context.Context, target string) *exec.Cmd {
+	return exec.CommandContext(ctx, "go", "install", target)
+}
+
+// Stats returns a snapshot of the go install counters.
+func Stats() InstallStats {
+	return InstallStats{
+		Attempted: atomic.LoadInt64(&installStats.Attempted),
+		Succeeded: atomic.LoadInt64(&installStats.Succeeded),
+		Failed:    atomic.LoadInt64(&installStats.Failed),
+		TimedOut:  atomic.LoadInt64(&installStats.TimedOut),
+		Running:   atomic.LoadInt64(&installStats.Running),
+		Queued:    atomic.LoadInt64(&installStats.Queued),
+	}
+}
+
 // We need to mangle go/build.Default to make gcimporter work as
 // intended, so use a lock to protect against concurrent accesses.
 var buildDefaultLock sync.Mutex
@@ -35,23 +108,47 @@ var buildDefaultLock sync.Mutex
 // support for gb-based projects.
 type importer struct {
 	ctx        *cache.PackedContext
+	dir        string // directory of the file being completed
+	goroot     bool   // the file is within $GOROOT/src
+	foreign    bool   // ctx isn't the server's target, see cache.PackedContext.Native
 	gbroot     string
 	gbpaths    []string
 	underlying types.ImporterFrom
 	logf       func(string, ...interface{})
 }
 
-func New(ctx *cache.PackedContext, filename string, underlying types.Importer, logger func(string, ...interface{})) types.ImporterFrom {
+// New returns an importer for filename that imports packages with
+// underlying. If noGb is set, filename is not checked for being part
+// of a gb project.
+func New(ctx *cache.PackedContext, filename string, underlying types.Importer, noGb bool, logger func(string, ...interface{})) types.ImporterFrom {
 	imp := &importer{
 		ctx:        ctx,
+		dir:        filepath.Dir(filename),
 		underlying: underlying.(types.ImporterFrom),
 		logf:       logger,
 	}
+	if cache.InGOROOT(ctx, filename) {
+		// The standard library is being edited, so import its
+		// packages from source rather than from stale export
+		// data, and don't try to install them.
+		imp.goroot = true
+		imp.underlying = goimporter.For("source", nil).(types.ImporterFrom)
+		return imp
+	}
+	if !ctx.Native() {
+		// The default importer only imports packages for the
+		// server's target, and go install only installs them.
+		imp.foreign = true
+		imp.underlying = goimporter.For("source", nil).(types.ImporterFrom)
+	}
+	if noGb {
+		return imp
+	}
 
-	gbroot, gbvendor := cache.GetGbProjectPaths(ctx, filename)
+	gbroot, gbvendor := getGbProjectPaths(ctx, filename)
 	if gbroot != "" {
 		imp.gbroot = gbroot
-		imp.gbpaths = append(filepath.SplitList(imp.ctx.GOPATH), gbroot, gbvendor)
+		imp.gbpaths = append(cache.SplitPathList(imp.ctx.GOPATH, imp.ctx.GOROOT, logger), gbroot, gbvendor)
 	}
 	return imp
 }
@@ -61,7 +158,16 @@ func (i *importer) Import(path string) (*types.Package, error) {
 }
 
 func (i *importer) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
-	i.tryInstallPackage(path, srcDir)
+	if srcDir == "" {
+		srcDir = i.dir
+	}
+	if err := cache.CheckVendored(i.ctx, srcDir, path); err != nil {
+		i.logf("%v", err)
+		return nil, err
+	}
+	if !i.goroot && !i.foreign {
+		i.tryInstallPackage(path, srcDir)
+	}
 	buildDefaultLock.Lock()
 	defer buildDefaultLock.Unlock()
 
@@ -72,16 +178,31 @@ func (i *importer) ImportFrom(path, srcDir string, mode types.ImportMode) (*type
 	def.GOARCH = i.ctx.GOARCH
 	def.GOOS = i.ctx.GOOS
 	def.GOROOT = i.ctx.GOROOT
-	def.GOPATH = i.ctx.GOPATH
+	def.GOPATH = strings.Join(cache.SplitPathList(i.ctx.GOPATH, i.ctx.GOROOT, i.logf), string(filepath.ListSeparator))
 	def.CgoEnabled = i.ctx.CgoEnabled
 	def.UseAllFiles = i.ctx.UseAllFiles
 	def.Compiler = i.ctx.Compiler
 	def.BuildTags = i.ctx.BuildTags
 	def.ReleaseTags = i.ctx.ReleaseTags
 	def.InstallSuffix = i.ctx.InstallSuffix
+	if i.foreign {
+		cache.SetToolTags(def)
+	}
 
-	def.SplitPathList = i.splitPathList
-	def.JoinPath = i.joinPath
+	if i.gbroot != "" {
+		def.SplitPathList = i.splitPathList
+		def.JoinPath = i.joinPath
+	} else if i.ctx.GOPATHMode() {
+		def.SplitPathList = nil
+		cache.UseGOPATH(def)
+	} else {
+		// go/build only consults the go command, and thus
+		// resolves packages of the current module, if no file
+		// system hooks are set.
+		def.SplitPathList = nil
+		def.JoinPath = nil
+		cache.SetBuildDir(def, srcDir)
+	}
 
 	pkg, err := i.underlying.ImportFrom(path, srcDir, mode)
 	if pkg == nil {
@@ -92,42 +213,108 @@ func (i *importer) ImportFrom(path, srcDir string, mode types.ImportMode) (*type
 }
 
 func (i *importer) tryInstallPackage(pkgPath, srcDir string) {
-	goPath := strings.Split(i.ctx.GOPATH, ":")[0]
-	target := path.Join(goPath, "src", pkgPath)
-	for dir := srcDir; dir != "/" && dir != "."; dir = path.Dir(dir) {
-		tryDir := path.Join(dir, "vendor", pkgPath)
-		if stat, err := os.Stat(tryDir); err == nil && stat.IsDir() {
+	// GOPATH, srcDir and the result are OS paths, which may
+	// contain colons, spaces or any other character, so only
+	// manipulate them with package filepath.
+	gopaths := filepath.SplitList(i.ctx.GOPATH)
+	if len(gopaths) == 0 {
+		return
+	}
+	goPath := gopaths[0]
+	target := filepath.Join(goPath, "src", filepath.FromSlash(pkgPath))
+	for dir := srcDir; dir != ""; {
+		tryDir := filepath.Join(dir, "vendor", filepath.FromSlash(pkgPath))
+		if stat, err := fswalk.Stat(tryDir, symlinks); err == nil && stat.IsDir() {
 			target = tryDir
 			break
 		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
 	}
 	mtime, err := newest(target, ".go")
 	if err != nil || mtime == 0 {
-		log.Printf("newest error %s", err)
+		// Packages outside of GOPATH, such as those of the
+		// standard library, have no target to look at.
+		if err != nil && !os.IsNotExist(err) {
+			Logf("newest error %s", err)
+		}
 		return
 	}
 	// check build
+	var archive string
 	if gprel, err := filepath.Rel(filepath.Join(goPath, "src"), target); err == nil {
-		pkgPath := filepath.Join(goPath, "pkg", fmt.Sprintf("%s_%s", i.ctx.GOOS, i.ctx.GOARCH), gprel+".a")
-		pkgMTime := modTime(pkgPath)
+		archive = filepath.Join(goPath, "pkg", fmt.Sprintf("%s_%s", i.ctx.GOOS, i.ctx.GOARCH), gprel+".a")
+		pkgMTime := modTime(archive)
 		if pkgMTime > mtime {
-			installedMap[target] = &installedInfo{Target: target, MTime: mtime}
+			installedMap[target] = &installedInfo{Target: target, MTime: mtime, Archive: archive}
 			return
 		}
 	}
 	info, ok := installedMap[target]
+	if ok && info.Archive != "" && modTime(info.Archive) == 0 {
+		// The archive was deleted since it was installed.
+		ok = false
+	}
 	if !ok || info.MTime == 0 || info.MTime < mtime {
 		if stat, err := os.Stat(target); err == nil && stat.IsDir() {
-			if err := exec.Command("go", "install", target).Run(); err != nil {
-				log.Printf("try go install error: %s", err)
+			goInstall(target, i.ctx.GO111MODULE)
+			info := &installedInfo{Target: target, MTime: mtime}
+			// In module mode, go install leaves no archive
+			// behind, so there is none to check.
+			if archive != "" && modTime(archive) != 0 {
+				info.Archive = archive
 			}
-			installedMap[target] = &installedInfo{Target: target, MTime: mtime}
+			installedMap[target] = info
 		}
 	}
 }
 
+// AcquireSlot waits for one of the slots of go install commands, and
+// returns the func releasing it. Other go commands building packages,
+// such as those of cache.ExportStd, take one too.
+func AcquireSlot() (release func()) {
+	atomic.AddInt64(&installStats.Queued, 1)
+	installSem <- struct{}{}
+	atomic.AddInt64(&installStats.Queued, -1)
+	atomic.AddInt64(&installStats.Running, 1)
+	return func() {
+		atomic.AddInt64(&installStats.Running, -1)
+		<-installSem
+	}
+}
+
+// goInstall installs target, with the client's GO111MODULE if it set one.
+func goInstall(target, go111module string) {
+	defer AcquireSlot()()
+
+	ctx, cancel := context.WithTimeout(context.Background(), installTimeout)
+	defer cancel()
+
+	atomic.AddInt64(&installStats.Attempted, 1)
+	// Run always waits for the process, even when it is killed
+	// on timeout, so no zombies are left behind.
+	cmd := installCommand(ctx, target)
+	if go111module != "" {
+		cmd.Env = append(os.Environ(), "GO111MODULE="+go111module)
+	}
+	err := cmd.Run()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		atomic.AddInt64(&installStats.TimedOut, 1)
+		Logf("try go install timed out: %s", target)
+	case err != nil:
+		atomic.AddInt64(&installStats.Failed, 1)
+		Logf("try go install error: %s", err)
+	default:
+		atomic.AddInt64(&installStats.Succeeded, 1)
+	}
+}
+
 func newest(target, suffix string) (int64, error) {
-	infos, err := ioutil.ReadDir(target)
+	infos, err := fswalk.ReadDir(target, symlinks)
 	if err != nil {
 		return 0, err
 	}
@@ -152,10 +339,7 @@ func modTime(name string) int64 {
 }
 
 func (i *importer) splitPathList(list string) []string {
-	if i.gbroot != "" {
-		return i.gbpaths
-	}
-	return filepath.SplitList(list)
+	return i.gbpaths
 }
 
 func (i *importer) joinPath(elem ...string) string {
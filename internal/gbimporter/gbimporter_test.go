@@ -0,0 +1,397 @@
+package gbimporter
+
+import (
+	"context"
+	"go/build"
+	goimporter "go/importer"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/cache"
+)
+
+// newTestGOPATH returns a temporary GOPATH containing the given files,
+// keyed by slash-separated paths relative to GOPATH. The GOPATH has
+// spaces and non-ASCII characters in its name.
+func newTestGOPATH(t *testing.T, files map[string]string) string {
+	t.Helper()
+	gopath := filepath.Join(t.TempDir(), "My Projects", "José Müller")
+	for name, src := range files {
+		name = filepath.Join(gopath, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return gopath
+}
+
+func TestInstallFailureStats(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/broken/broken.go": "package broken\n\nfunc (\n",
+	})
+
+	imp := &importer{
+		ctx:  &cache.PackedContext{GOPATH: gopath, GOOS: "linux", GOARCH: "amd64"},
+		logf: t.Logf,
+	}
+	before := Stats()
+	imp.tryInstallPackage("broken", "")
+	after := Stats()
+
+	if after.Attempted != before.Attempted+1 {
+		t.Errorf("Attempted: got %d, want %d", after.Attempted, before.Attempted+1)
+	}
+	if after.Failed != before.Failed+1 {
+		t.Errorf("Failed: got %d, want %d", after.Failed, before.Failed+1)
+	}
+	if after.Succeeded != before.Succeeded {
+		t.Errorf("Succeeded: got %d, want %d", after.Succeeded, before.Succeeded)
+	}
+}
+
+func TestInstallTarget(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/app/main.go":           "package main\n",
+		"src/app/vendor/dep/dep.go": "package dep\n",
+		"src/lib/lib.go":            "package lib\n",
+	})
+
+	origCommand := installCommand
+	defer func() { installCommand = origCommand }()
+	var targets []string
+	installCommand = func(ctx context.Context, target string) *exec.Cmd {
+		targets = append(targets, target)
+		return exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+	}
+
+	other := filepath.Join(filepath.Dir(gopath), "other")
+	imp := &importer{
+		ctx:  &cache.PackedContext{GOPATH: gopath + string(filepath.ListSeparator) + other, GOOS: "linux", GOARCH: "amd64"},
+		logf: t.Logf,
+	}
+	imp.tryInstallPackage("dep", filepath.Join(gopath, "src", "app"))
+	imp.tryInstallPackage("lib", filepath.Join(gopath, "src", "app"))
+
+	want := []string{
+		filepath.Join(gopath, "src", "app", "vendor", "dep"),
+		filepath.Join(gopath, "src", "lib"),
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("got install targets %q, want %q", targets, want)
+	}
+}
+
+func TestReinstallDeletedArchive(t *testing.T) {
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/lib/lib.go": "package lib\n",
+	})
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(gopath, "src", "lib", "lib.go"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(gopath, "pkg", "linux_amd64", "lib.a")
+	origCommand := installCommand
+	defer func() { installCommand = origCommand }()
+	installs := 0
+	installCommand = func(ctx context.Context, target string) *exec.Cmd {
+		installs++
+		if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(archive, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+	}
+
+	imp := &importer{
+		ctx:  &cache.PackedContext{GOPATH: gopath, GOOS: "linux", GOARCH: "amd64"},
+		logf: t.Logf,
+	}
+	imp.tryInstallPackage("lib", "")
+	imp.tryInstallPackage("lib", "")
+	if installs != 1 {
+		t.Fatalf("got %d installs, want 1", installs)
+	}
+
+	if err := os.Remove(archive); err != nil {
+		t.Fatal(err)
+	}
+	imp.tryInstallPackage("lib", "")
+	if installs != 2 {
+		t.Errorf("got %d installs after deleting %s, want 2", installs, archive)
+	}
+}
+
+func TestInstallConcurrency(t *testing.T) {
+	if _, err := os.Stat(os.Args[0]); err != nil {
+		t.Skip("test binary not found")
+	}
+
+	origCommand, origSem := installCommand, installSem
+	defer func() { installCommand, installSem = origCommand, origSem }()
+
+	// The fake go install re-runs this test binary, which exits
+	// after a short sleep in TestHelperSlowInstall.
+	installCommand = func(ctx context.Context, target string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=TestHelperSlowInstall")
+		cmd.Env = append(os.Environ(), "GOCODE_TEST_SLOW_INSTALL=1")
+		return cmd
+	}
+	SetMaxInstalls(2)
+
+	const n = 6
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			goInstall("fake", "")
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var maxRunning, maxQueued int64
+	for {
+		select {
+		case <-done:
+			if maxRunning > 2 {
+				t.Errorf("max running installs: got %d, want <= 2", maxRunning)
+			}
+			if maxQueued == 0 {
+				t.Errorf("no installs were ever queued")
+			}
+			if s := Stats(); s.Running != 0 || s.Queued != 0 {
+				t.Errorf("after completion: got %+v", s)
+			}
+			return
+		default:
+		}
+		s := Stats()
+		if s.Running > maxRunning {
+			maxRunning = s.Running
+		}
+		if s.Queued > maxQueued {
+			maxQueued = s.Queued
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHelperSlowInstall(t *testing.T) {
+	if os.Getenv("GOCODE_TEST_SLOW_INSTALL") == "" {
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	os.Exit(0)
+}
+
+func TestNoGb(t *testing.T) {
+	defer func(orig func(*cache.PackedContext, string) (string, string)) { getGbProjectPaths = orig }(getGbProjectPaths)
+	detected := false
+	getGbProjectPaths = func(ctx *cache.PackedContext, filename string) (string, string) {
+		detected = true
+		return cache.GetGbProjectPaths(ctx, filename)
+	}
+
+	ctx := cache.PackContext(&build.Default)
+	filename := filepath.Join("gbproject", "src", "p", "p.go")
+
+	imp := New(&ctx, filename, goimporter.Default(), true, t.Logf)
+	if detected {
+		t.Errorf("gb detection was performed with noGb set")
+	}
+	if imp.(*importer).gbroot != "" {
+		t.Errorf("got gb root %q with noGb set", imp.(*importer).gbroot)
+	}
+	New(&ctx, filename, goimporter.Default(), false, t.Logf)
+	if !detected {
+		t.Errorf("gb detection was not performed with noGb unset")
+	}
+}
+
+func TestModuleMainPackage(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir := newTestGOPATH(t, map[string]string{
+		"go.mod":              "module example.com/m\n",
+		"internal/lib/lib.go": "package lib\n\nfunc Hello() string { return \"hello\" }\n",
+		"cmd/foo/main.go":     "package main\n\nimport \"example.com/m/internal/lib\"\n\nfunc main() { lib.Hello() }\n",
+	})
+
+	ctx := cache.PackContext(&build.Default)
+	filename := filepath.Join(dir, "cmd", "foo", "main.go")
+	imp := New(&ctx, filename, goimporter.For("source", nil), false, t.Logf)
+	pkg, err := imp.(types.ImporterFrom).ImportFrom("example.com/m/internal/lib", filepath.Dir(filename), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Scope().Lookup("Hello") == nil {
+		t.Errorf("got package %s without Hello", pkg.Path())
+	}
+}
+
+func TestGOPATHModeInModule(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/example.com/dep/dep.go": "package dep\n\nfunc FromGOPATH() {}\n",
+		"src/example.com/m/go.mod":   "module example.com/m\n",
+		"src/example.com/m/main.go":  "package main\n\nimport \"example.com/dep\"\n\nfunc main() { dep.FromGOPATH() }\n",
+	})
+
+	// The server's own environment must not decide the mode.
+	t.Setenv("GO111MODULE", "on")
+
+	origCommand := installCommand
+	defer func() { installCommand = origCommand }()
+	installCommand = func(ctx context.Context, target string) *exec.Cmd {
+		return exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+	}
+
+	filename := filepath.Join(gopath, "src", "example.com", "m", "main.go")
+	for _, mode := range []string{"off", "on"} {
+		ctx := cache.PackContext(&build.Default)
+		ctx.GOPATH = gopath
+		ctx.GO111MODULE = mode
+		imp := New(&ctx, filename, goimporter.For("source", nil), true, t.Logf).(types.ImporterFrom)
+		pkg, err := imp.ImportFrom("example.com/dep", filepath.Dir(filename), 0)
+		switch {
+		case mode == "on" && err == nil:
+			t.Errorf("GO111MODULE=on: imported %s from GOPATH despite the go.mod", pkg.Path())
+		case mode == "off" && err != nil:
+			t.Errorf("GO111MODULE=off: %v", err)
+		case mode == "off" && pkg.Scope().Lookup("FromGOPATH") == nil:
+			t.Errorf("GO111MODULE=off: got package %s without FromGOPATH", pkg.Path())
+		}
+	}
+}
+
+type recordingImporter struct{ paths []string }
+
+func (r *recordingImporter) Import(path string) (*types.Package, error) {
+	return r.ImportFrom(path, "", 0)
+}
+
+func (r *recordingImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	r.paths = append(r.paths, path)
+	return types.NewPackage(path, filepath.Base(path)), nil
+}
+
+func TestVendorModulesTxt(t *testing.T) {
+	dir := newTestGOPATH(t, map[string]string{
+		"go.mod":                           "module example.com/m\n",
+		"vendor/modules.txt":               "# example.com/dep v1.0.0\n## explicit\nexample.com/dep\n",
+		"vendor/example.com/dep/dep.go":    "package dep\n",
+		"vendor/example.com/unlisted/u.go": "package unlisted\n",
+		"main.go":                          "package main\n",
+	})
+
+	origCommand := installCommand
+	defer func() { installCommand = origCommand }()
+	installCommand = func(ctx context.Context, target string) *exec.Cmd {
+		return exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+	}
+
+	underlying := &recordingImporter{}
+	ctx := cache.PackContext(&build.Default)
+	imp := New(&ctx, filepath.Join(dir, "main.go"), underlying, true, t.Logf).(types.ImporterFrom)
+
+	if _, err := imp.ImportFrom("example.com/dep", dir, 0); err != nil {
+		t.Errorf("importing listed package: %v", err)
+	}
+	if _, err := imp.ImportFrom("example.com/unlisted", dir, 0); err == nil {
+		t.Errorf("importing unlisted vendored package succeeded")
+	}
+	if want := []string{"example.com/dep"}; !reflect.DeepEqual(underlying.paths, want) {
+		t.Errorf("got underlying imports %q, want %q", underlying.paths, want)
+	}
+}
+
+func TestEditingGOROOT(t *testing.T) {
+	goroot := newTestGOPATH(t, map[string]string{
+		"src/vendor/golang.org/x/dep/dep.go": "package dep\n\nfunc Edited() {}\n",
+		"src/mystd/mystd.go":                 "package mystd\n",
+	})
+
+	origCommand := installCommand
+	defer func() { installCommand = origCommand }()
+	var targets []string
+	installCommand = func(ctx context.Context, target string) *exec.Cmd {
+		targets = append(targets, target)
+		return exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+	}
+
+	ctx := cache.PackContext(&build.Default)
+	ctx.GOROOT = goroot
+	ctx.GOPATH = filepath.Join(goroot, "gopath")
+	filename := filepath.Join(goroot, "src", "mystd", "mystd.go")
+	imp := New(&ctx, filename, goimporter.Default(), false, t.Logf).(types.ImporterFrom)
+	pkg, err := imp.ImportFrom("golang.org/x/dep", filepath.Dir(filename), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Scope().Lookup("Edited") == nil {
+		t.Errorf("got package %s without Edited", pkg.Path())
+	}
+	if len(targets) > 0 {
+		t.Errorf("got install targets %q for the standard library", targets)
+	}
+}
+
+func TestForeignTarget(t *testing.T) {
+	if build.Default.GOOS == "js" {
+		t.Skip("js/wasm is the native target")
+	}
+	gopath := newTestGOPATH(t, map[string]string{
+		"src/lib/lib.go": "package lib\n\nfunc Lib() {}\n",
+	})
+
+	origCommand := installCommand
+	defer func() { installCommand = origCommand }()
+	var targets []string
+	installCommand = func(ctx context.Context, target string) *exec.Cmd {
+		targets = append(targets, target)
+		return exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+	}
+
+	ctx := cache.PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GO111MODULE = "off"
+	ctx.GOOS, ctx.GOARCH, ctx.CgoEnabled = "js", "wasm", false
+	filename := filepath.Join(gopath, "src", "app", "main.go")
+	imp := New(&ctx, filename, goimporter.Default(), true, t.Logf).(types.ImporterFrom)
+	for path, name := range map[string]string{"syscall/js": "Global", "lib": "Lib"} {
+		pkg, err := imp.ImportFrom(path, filepath.Dir(filename), 0)
+		if err != nil {
+			t.Errorf("importing %s: %v", path, err)
+			continue
+		}
+		if pkg.Scope().Lookup(name) == nil {
+			t.Errorf("got package %s without %s", path, name)
+		}
+	}
+	if len(targets) > 0 {
+		t.Errorf("got install targets %q for js/wasm", targets)
+	}
+}
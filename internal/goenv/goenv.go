@@ -0,0 +1,97 @@
+// Package goenv caches the output of "go env", which is too slow to
+// run for every request.
+package goenv
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vars lists the variables queried from "go env".
+var Vars = []string{"GOROOT", "GOPATH", "GO111MODULE", "GOFLAGS", "GOCACHE", "GOMODCACHE"}
+
+// A Cache holds the output of "go env". It is re-queried once TTL has
+// passed, when the go binary on PATH changes, and after Invalidate.
+type Cache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	vars    map[string]string
+	fetched time.Time
+	goBin   string
+	goMtime time.Time
+
+	// Replaced in tests.
+	now    func() time.Time
+	lookGo func() (path string, mtime time.Time)
+	run    func(goBin string, names []string) ([]string, error)
+}
+
+// New returns a Cache that keeps the output of "go env" for ttl.
+func New(ttl time.Duration) *Cache {
+	return &Cache{
+		TTL:    ttl,
+		now:    time.Now,
+		lookGo: lookGo,
+		run:    run,
+	}
+}
+
+// Get returns the value of the go env variable name, which must be one
+// of Vars, or "" if it can't be determined.
+func (c *Cache) Get(name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	goBin, goMtime := c.lookGo()
+	if c.vars == nil || c.now().Sub(c.fetched) > c.TTL || goBin != c.goBin || !goMtime.Equal(c.goMtime) {
+		c.vars = make(map[string]string)
+		c.fetched, c.goBin, c.goMtime = c.now(), goBin, goMtime
+		if goBin != "" {
+			if values, err := c.run(goBin, Vars); err == nil {
+				for i, name := range Vars {
+					c.vars[name] = values[i]
+				}
+			}
+		}
+	}
+	return c.vars[name]
+}
+
+// Invalidate makes the next Get re-query "go env".
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vars = nil
+}
+
+// lookGo returns the path and modification time of the go binary on
+// PATH, or "" if there is none.
+func lookGo() (string, time.Time) {
+	path, err := exec.LookPath("go")
+	if err != nil {
+		return "", time.Time{}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return path, fi.ModTime()
+}
+
+// run returns the values of the go env variables names, in order.
+func run(goBin string, names []string) ([]string, error) {
+	out, err := exec.Command(goBin, append([]string{"env"}, names...)...).Output()
+	if err != nil {
+		return nil, err
+	}
+	values := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(values) != len(names) {
+		return nil, fmt.Errorf("go env printed %d values for %d variables", len(values), len(names))
+	}
+	return values, nil
+}
@@ -0,0 +1,45 @@
+package goenv
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRequery(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	mtime := now.Add(-time.Hour)
+	var queries int
+	c := New(time.Minute)
+	c.now = func() time.Time { return now }
+	c.lookGo = func() (string, time.Time) { return "/usr/local/go/bin/go", mtime }
+	c.run = func(goBin string, names []string) ([]string, error) {
+		queries++
+		if !reflect.DeepEqual(names, Vars) {
+			t.Errorf("queried %v, want %v", names, Vars)
+		}
+		return []string{"/usr/local/go", "/home/gopher/go", "on", "", "/home/gopher/.cache/go-build", "/home/gopher/go/pkg/mod"}, nil
+	}
+
+	steps := []struct {
+		name   string
+		change func()
+		want   int
+	}{
+		{"first use", func() {}, 1},
+		{"cached", func() { now = now.Add(30 * time.Second) }, 1},
+		{"TTL expired", func() { now = now.Add(time.Minute) }, 2},
+		{"invalidated", c.Invalidate, 3},
+		{"go binary replaced", func() { mtime = now }, 4},
+		{"cached again", func() {}, 4},
+	}
+	for _, step := range steps {
+		step.change()
+		if got := c.Get("GOROOT"); got != "/usr/local/go" {
+			t.Errorf("%s: got GOROOT %q, want /usr/local/go", step.name, got)
+		}
+		if queries != step.want {
+			t.Errorf("%s: got %d queries, want %d", step.name, queries, step.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Package golden compares the output of tests with golden files.
+package golden
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// Check compares got with the golden file, or with -update, writes it
+// to the golden file.
+func Check(t testing.TB, golden string, got []byte) {
+	t.Helper()
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s; if intended, run go test -update.\nGot:\n%s\nWant:\n%s", golden, got, want)
+	}
+}
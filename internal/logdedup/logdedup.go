@@ -0,0 +1,144 @@
+// Package logdedup throttles repeated log messages.
+package logdedup
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxEntries bounds the number of messages tracked at once.
+const maxEntries = 1000
+
+// Logger wraps a logging function so that a burst of identical
+// messages is logged once, followed by a periodic summary of how
+// often it repeated.
+//
+// Messages are identified by their format string and first argument,
+// which is usually the package or file the message is about.
+type Logger struct {
+	logf      func(string, ...interface{})
+	window    time.Duration
+	now       func() time.Time
+	afterFunc func(time.Duration, func()) // time.AfterFunc, replaced by tests
+
+	mu      sync.Mutex
+	seen    map[key]*entry
+	pending bool // a summary is scheduled
+}
+
+type key struct {
+	format string
+	arg    string
+}
+
+type entry struct {
+	start      time.Time // start of the current summary window
+	last       time.Time // last occurrence
+	suppressed int       // occurrences not logged since start
+	args       []interface{}
+}
+
+// New returns a Logger that writes to logf and summarizes repeats
+// of a message once per window.
+func New(logf func(string, ...interface{}), window time.Duration) *Logger {
+	return &Logger{
+		logf:      logf,
+		window:    window,
+		now:       time.Now,
+		afterFunc: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		seen:      make(map[key]*entry),
+	}
+}
+
+// Logf logs the message unless it repeats a recent one.
+//
+// The first occurrence of a message is logged immediately. Repeats
+// are counted and reported once per window, even if the message
+// stops. When a message has not been seen for a whole window, it is
+// considered resolved, and its next occurrence is logged immediately
+// again.
+func (l *Logger) Logf(format string, args ...interface{}) {
+	k := key{format: format}
+	if len(args) > 0 {
+		k.arg = fmt.Sprint(args[0])
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	e := l.seen[k]
+	if e != nil && now.Sub(e.last) > l.window {
+		l.flush(k.format, e, now)
+		e = nil
+	}
+	if e == nil {
+		l.prune(now)
+		l.seen[k] = &entry{start: now, last: now}
+		l.logf(format, args...)
+		return
+	}
+
+	e.last = now
+	e.suppressed++
+	e.args = args
+	if now.Sub(e.start) >= l.window {
+		l.flush(k.format, e, now)
+	}
+	if !l.pending {
+		l.pending = true
+		l.afterFunc(l.window, l.tick)
+	}
+}
+
+// tick logs the summaries of the repeats of the last window, and
+// forgets resolved messages.
+func (l *Logger) tick() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = false
+	now := l.now()
+	for k, e := range l.seen {
+		l.flush(k.format, e, now)
+		if now.Sub(e.last) > l.window {
+			delete(l.seen, k)
+		}
+	}
+}
+
+// flush logs a summary of the repeats of e suppressed since e.start,
+// if any, and starts a new summary window at now.
+func (l *Logger) flush(format string, e *entry, now time.Time) {
+	if e.suppressed == 0 {
+		return
+	}
+	l.logf(format+" (repeated %d times in the last %v)", append(e.args[:len(e.args):len(e.args)], e.suppressed, now.Sub(e.start).Round(time.Second))...)
+	e.suppressed = 0
+	e.start = now
+}
+
+// prune forgets resolved messages once too many are tracked, and if
+// there are still too many, those that were seen least recently.
+func (l *Logger) prune(now time.Time) {
+	if len(l.seen) < maxEntries {
+		return
+	}
+	for k, e := range l.seen {
+		if now.Sub(e.last) > l.window {
+			l.flush(k.format, e, now)
+			delete(l.seen, k)
+		}
+	}
+	for len(l.seen) >= maxEntries {
+		var oldest key
+		var last time.Time
+		for k, e := range l.seen {
+			if last.IsZero() || e.last.Before(last) {
+				oldest, last = k, e.last
+			}
+		}
+		l.flush(oldest.format, l.seen[oldest], now)
+		delete(l.seen, oldest)
+	}
+}
@@ -0,0 +1,94 @@
+package logdedup
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestLogger returns a Logger appending the messages it logs to
+// *got, with a clock advanced by step, and its pending summary run by
+// tick, if any.
+func newTestLogger(got *[]string) (l *Logger, step func(time.Duration), tick func()) {
+	l = New(func(format string, args ...interface{}) {
+		*got = append(*got, fmt.Sprintf(format, args...))
+	}, time.Minute)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	var timer func()
+	l.afterFunc = func(d time.Duration, f func()) { timer = f }
+	step = func(d time.Duration) { now = now.Add(d) }
+	tick = func() {
+		if f := timer; f != nil {
+			timer = nil
+			f()
+		}
+	}
+	return l, step, tick
+}
+
+func TestBurst(t *testing.T) {
+	var got []string
+	l, step, tick := newTestLogger(&got)
+
+	// A burst of 100 identical failures, one every second,
+	// interleaved with a different one.
+	for i := 0; i < 100; i++ {
+		step(time.Second)
+		l.Logf("no package found for %s: %v", "x", "not found")
+		if i == 10 {
+			l.Logf("no package found for %s: %v", "y", "not found")
+		}
+	}
+	// The error stops, and the summary is logged anyway.
+	step(20 * time.Second)
+	tick()
+	// It comes back later.
+	step(5 * time.Minute)
+	tick()
+	l.Logf("no package found for %s: %v", "x", "not found")
+
+	want := []string{
+		"no package found for x: not found",
+		"no package found for y: not found",
+		"no package found for x: not found (repeated 60 times in the last 1m0s)",
+		"no package found for x: not found (repeated 39 times in the last 59s)",
+		"no package found for x: not found",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+	if len(l.seen) != 1 {
+		t.Errorf("tracking %d messages, want 1", len(l.seen))
+	}
+}
+
+func TestBounded(t *testing.T) {
+	var got []string
+	l, step, _ := newTestLogger(&got)
+	for i := 0; i < 2*maxEntries; i++ {
+		step(time.Millisecond)
+		l.Logf("failed %d", i)
+		l.Logf("failed %d", i)
+	}
+	if len(l.seen) > maxEntries {
+		t.Errorf("tracking %d messages, want at most %d", len(l.seen), maxEntries)
+	}
+	// Each message is logged, and the repeats of those forgotten
+	// are summarized.
+	if want := 2*maxEntries + maxEntries; len(got) != want {
+		t.Errorf("logged %d messages, want %d", len(got), want)
+	}
+}
+
+func TestNoArgs(t *testing.T) {
+	n := 0
+	l := New(func(string, ...interface{}) { n++ }, time.Minute)
+	for i := 0; i < 10; i++ {
+		l.Logf("something failed")
+	}
+	if n != 1 {
+		t.Errorf("logged %d times, want 1", n)
+	}
+}
@@ -0,0 +1,9 @@
+package lookdot
+
+import "go/types"
+
+// Unalias returns the type denoted by typ, following any chain of
+// type aliases.
+func Unalias(typ types.Type) types.Type {
+	return types.Unalias(typ)
+}
@@ -16,6 +16,58 @@ func Walk(tv *types.TypeAndValue, v Visitor) bool {
 	return true
 }
 
+// WalkValue is like Walk, but for a value of type typ.
+func WalkValue(typ types.Type, addressable bool, v Visitor) {
+	walk(typ, addressable, true, v)
+}
+
+// A Cache memoizes the objects walks visit, for the walks of a single
+// completion, which may walk the same operand several times. The zero
+// value is ready to use.
+type Cache struct {
+	m map[cacheKey][]types.Object
+}
+
+type cacheKey struct {
+	typ            types.Type
+	addable, value bool
+}
+
+// Walk is like the package's Walk, memoized in c.
+func (c *Cache) Walk(tv *types.TypeAndValue, v Visitor) bool {
+	switch {
+	case tv.IsType():
+		c.walk(tv.Type, false, false, v)
+	case tv.IsValue():
+		c.walk(tv.Type, tv.Addressable(), true, v)
+	default:
+		return false
+	}
+	return true
+}
+
+// WalkValue is like the package's WalkValue, memoized in c.
+func (c *Cache) WalkValue(typ types.Type, addressable bool, v Visitor) {
+	c.walk(typ, addressable, true, v)
+}
+
+func (c *Cache) walk(typ types.Type, addable, value bool, v Visitor) {
+	key := cacheKey{typ, addable, value}
+	objs, ok := c.m[key]
+	if !ok {
+		walk(typ, addable, value, func(obj types.Object) {
+			objs = append(objs, obj)
+		})
+		if c.m == nil {
+			c.m = make(map[cacheKey][]types.Object)
+		}
+		c.m[key] = objs
+	}
+	for _, obj := range objs {
+		v(obj)
+	}
+}
+
 func walk(typ0 types.Type, addable0, value bool, v Visitor) {
 	// Enumerating valid selector expression identifiers is
 	// surprisingly nuanced.
@@ -53,8 +105,10 @@ func walk(typ0 types.Type, addable0, value bool, v Visitor) {
 		addable bool
 	}
 
+	// Aliases are resolved up front, so that their methods are
+	// found the same way as those of the types they denote.
 	var cur, next []todo
-	cur = []todo{{typ0, addable0}}
+	cur = []todo{{Unalias(typ0), addable0}}
 
 	for {
 		if len(cur) == 0 {
@@ -126,7 +180,7 @@ func walk(typ0 types.Type, addable0, value bool, v Visitor) {
 					f := typ.Field(i)
 					addObj(f, value)
 					if f.Anonymous() {
-						next = append(next, todo{f.Type(), addable})
+						next = append(next, todo{Unalias(f.Type()), addable})
 					}
 				}
 			}
@@ -138,7 +192,7 @@ func walk(typ0 types.Type, addable0, value bool, v Visitor) {
 // Otherwise, it returns nil.
 func namedOf(typ types.Type) *types.Named {
 	if ptr, isPtr := typ.(*types.Pointer); isPtr {
-		typ = ptr.Elem()
+		typ = Unalias(ptr.Elem())
 	}
 	res, _ := typ.(*types.Named)
 	return res
@@ -151,7 +205,7 @@ func hasPtrRecv(m *types.Func) bool {
 
 func chasePointer(typ types.Type) (types.Type, bool) {
 	if ptr, isPtr := typ.(*types.Pointer); isPtr {
-		return ptr.Elem(), true
+		return Unalias(ptr.Elem()), true
 	}
 	return typ, false
 }
@@ -17,7 +17,10 @@ import (
 const src = `
 package p
 
-import "time"
+import (
+	"os"
+	"time"
+)
 
 type S struct { x int; y int }
 func (S) Sv()
@@ -53,6 +56,13 @@ func (B1) b()
 type B2 struct { b int; B1 }
 
 var loc time.Location
+
+type Loc = time.Location
+var aloc Loc
+type E struct { Loc }
+type EP struct { *Loc }
+
+var mode os.FileMode
 `
 
 var tests = []struct {
@@ -89,6 +99,14 @@ var tests = []struct {
 	{"B2", nil},
 
 	{"loc", []string{"String"}},
+
+	// Aliases behave like the types they denote, including
+	// aliases declared in other packages.
+	{"aloc", []string{"String"}},
+	{"Loc{}", nil},
+	{"E{}", []string{"Loc"}},
+	{"EP{}", []string{"Loc", "String"}},
+	{"mode", []string{"IsDir", "IsRegular", "Perm", "String", "Type"}},
 }
 
 func TestWalk(t *testing.T) {
@@ -115,6 +133,9 @@ func TestWalk(t *testing.T) {
 		}{"q", []string{"Z"}})
 	}
 
+	// The walks memoized in cache, twice each, visit the same
+	// objects.
+	var cache lookdot.Cache
 	for _, test := range tests {
 		tv, err := types.Eval(fset, pkg, token.NoPos, test.lhs)
 		if err != nil {
@@ -143,6 +164,15 @@ func TestWalk(t *testing.T) {
 			t.Errorf("Look(%q): got %v, want %v", test.lhs, got, test.want)
 			continue
 		}
+
+		for i := 0; i < 2; i++ {
+			got = nil
+			cache.Walk(&tv, visitor)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Cache.Walk(%q), walk %d: got %v, want %v", test.lhs, i+1, got, test.want)
+			}
+		}
 	}
 }
 
@@ -0,0 +1,163 @@
+package pkgsimporter
+
+import (
+	"go/build"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/cache"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestConcurrentImportsShareLoad(t *testing.T) {
+	release := make(chan struct{})
+	var count int32
+	defer func(orig func(*packages.Config, ...string) ([]*packages.Package, error)) { loadPackages = orig }(loadPackages)
+	loadPackages = func(cfg *packages.Config, patterns ...string) ([]*packages.Package, error) {
+		atomic.AddInt32(&count, 1)
+		<-release
+		return []*packages.Package{{Types: types.NewPackage(patterns[0], "dep")}}, nil
+	}
+
+	ctx := cache.PackContext(&build.Default)
+	filename := filepath.Join("src", "p", "p.go")
+
+	const n = 8
+	pkgs := make([]*types.Package, n)
+	var started, wg sync.WaitGroup
+	started.Add(n)
+	for j := 0; j < n; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			started.Done()
+			pkg, err := New(&ctx, filename, nil, t.Logf).Import("example.com/dep")
+			if err != nil {
+				t.Error(err)
+			}
+			pkgs[j] = pkg
+		}(j)
+	}
+	started.Wait()
+	// Give the importers time to join the load in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if count := atomic.LoadInt32(&count); count != 1 {
+		t.Errorf("got %d loads, want 1", count)
+	}
+	for _, pkg := range pkgs[1:] {
+		if pkg != pkgs[0] {
+			t.Errorf("got distinct packages %p and %p", pkg, pkgs[0])
+		}
+	}
+}
+
+func TestCanceledImportDoesNotCancelLoad(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var count int32
+	defer func(orig func(*packages.Config, ...string) ([]*packages.Package, error)) { loadPackages = orig }(loadPackages)
+	loadPackages = func(cfg *packages.Config, patterns ...string) ([]*packages.Package, error) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return []*packages.Package{{Types: types.NewPackage(patterns[0], "dep")}}, nil
+	}
+
+	ctx := cache.PackContext(&build.Default)
+	filename := filepath.Join("src", "p", "p.go")
+
+	cancel := make(chan struct{})
+	canceled := New(&ctx, filename, nil, t.Logf).(*importer)
+	canceled.cancel = cancel
+	errc := make(chan error)
+	go func() {
+		_, err := canceled.Import("example.com/dep")
+		errc <- err
+	}()
+	<-started
+	close(cancel)
+	if err := <-errc; err != errCanceled {
+		t.Errorf("canceled importer: got error %v, want errCanceled", err)
+	}
+
+	// The load is still in flight for the other importers.
+	pkgc := make(chan *types.Package)
+	go func() {
+		pkg, err := New(&ctx, filename, nil, t.Logf).Import("example.com/dep")
+		if err != nil {
+			t.Error(err)
+		}
+		pkgc <- pkg
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if pkg := <-pkgc; pkg == nil || pkg.Path() != "example.com/dep" {
+		t.Errorf("got %v, want example.com/dep", pkg)
+	}
+	if count := atomic.LoadInt32(&count); count != 1 {
+		t.Errorf("got %d loads, want 1", count)
+	}
+}
+
+func TestFileImportsShareDeps(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":    "module example.com/m\n",
+		"c/c.go":    "package c\n\ntype T int\n",
+		"a/a.go":    "package a\n\nimport \"example.com/m/c\"\n\nvar V c.T\n",
+		"b/b.go":    "package b\n\nimport \"example.com/m/c\"\n\nvar V c.T\n",
+		"main/m.go": "package main\n\nimport (\n\t\"example.com/m/a\"\n\t\"example.com/m/b\"\n)\n\nvar _ = a.V == b.V\n",
+	}
+	for name, src := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int32
+	defer func(orig func(*packages.Config, ...string) ([]*packages.Package, error)) { loadPackages = orig }(loadPackages)
+	loadPackages = func(cfg *packages.Config, patterns ...string) ([]*packages.Package, error) {
+		atomic.AddInt32(&count, 1)
+		return packages.Load(cfg, patterns...)
+	}
+
+	ctx := cache.PackContext(&build.Default)
+	filename := filepath.Join(dir, "main", "m.go")
+	imp := New(&ctx, filename, []byte(files["main/m.go"]), t.Logf)
+	a, err := imp.Import("example.com/m/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := imp.Import("example.com/m/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := atomic.LoadInt32(&count); count != 1 {
+		t.Errorf("got %d loads, want 1", count)
+	}
+	va := a.Scope().Lookup("V").Type()
+	vb := b.Scope().Lookup("V").Type()
+	if !types.Identical(va, vb) {
+		t.Errorf("got distinct types %v and %v for example.com/m/c.T", va, vb)
+	}
+}
@@ -0,0 +1,209 @@
+// Package pkgsimporter implements a types.ImporterFrom on top of
+// golang.org/x/tools/go/packages, which understands modules, vendor
+// directories and build tags natively.
+package pkgsimporter
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mdempsky/gocode/internal/cache"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/tools/go/packages"
+)
+
+// loads shares the package loads in flight between importers, so
+// concurrent requests importing the same package load it only once.
+var loads singleflight.Group
+
+// errCanceled is returned to an importer that stopped waiting for a
+// load.
+var errCanceled = errors.New("pkgsimporter: canceled")
+
+// loadPackages is packages.Load, replaced in tests.
+var loadPackages = packages.Load
+
+type importer struct {
+	ctx     *cache.PackedContext
+	dir     string
+	imports []string
+	logf    func(string, ...interface{})
+	// cancel is closed to stop waiting for the loads in flight, which
+	// run on for the other importers. A nil cancel never fires.
+	cancel <-chan struct{}
+
+	// graph holds the packages of the file's imports and of all their
+	// dependencies, by import path, once they are loaded.
+	graph map[string]*types.Package
+	// pkgs holds the packages loaded apart from graph, by directory
+	// and import path.
+	pkgs map[string]*types.Package
+}
+
+// New returns an importer that loads packages as seen from the
+// directory containing filename. The imports of src, the contents of
+// filename, are loaded at once, so that they share their
+// dependencies. If src is nil, filename is read.
+func New(ctx *cache.PackedContext, filename string, src []byte, logger func(string, ...interface{})) types.ImporterFrom {
+	return &importer{
+		ctx:     ctx,
+		dir:     filepath.Dir(filename),
+		imports: fileImports(filename, src),
+		logf:    logger,
+		pkgs:    make(map[string]*types.Package),
+	}
+}
+
+// fileImports returns the import paths of the file, as far as its
+// import declarations parse.
+func fileImports(filename string, src []byte) []string {
+	// A nil []byte would be parsed as an empty file.
+	var text interface{}
+	if src != nil {
+		text = src
+	}
+	f, _ := parser.ParseFile(token.NewFileSet(), filename, text, parser.ImportsOnly)
+	if f == nil {
+		return nil
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || path == "unsafe" || path == "C" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func (i *importer) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, i.dir, 0)
+}
+
+func (i *importer) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	if srcDir == "" {
+		srcDir = i.dir
+	}
+	if srcDir == i.dir {
+		if i.graph == nil {
+			i.graph = make(map[string]*types.Package)
+			if len(i.imports) > 0 {
+				if g, err := i.loadShared(i.dir, i.imports); err == nil {
+					i.graph = g
+				}
+			}
+		}
+		if pkg := i.graph[path]; pkg != nil {
+			return pkg, nil
+		}
+	}
+
+	// The path isn't imported by the file, or the go command reports
+	// it under another path, such as a vendored one.
+	key := srcDir + "\x00" + path
+	if pkg := i.pkgs[key]; pkg != nil {
+		return pkg, nil
+	}
+	g, err := i.loadShared(srcDir, []string{path})
+	if err != nil {
+		return nil, err
+	}
+	pkg := g[path]
+	if pkg == nil {
+		return nil, fmt.Errorf("no package found for %s", path)
+	}
+	i.pkgs[key] = pkg
+	return pkg, nil
+}
+
+// loadShared returns the result of load, sharing it with the
+// importers loading the same paths concurrently. The load runs to
+// completion even if i stops waiting for it.
+func (i *importer) loadShared(srcDir string, paths []string) (map[string]*types.Package, error) {
+	ch := loads.DoChan(i.loadKey(srcDir, paths), func() (interface{}, error) {
+		return i.load(srcDir, paths)
+	})
+	select {
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Val.(map[string]*types.Package), nil
+	case <-i.cancel:
+		return nil, errCanceled
+	}
+}
+
+// loadKey identifies the result of loading paths from srcDir, which
+// depends on the build context as well.
+func (i *importer) loadKey(srcDir string, paths []string) string {
+	return strings.Join(i.env(), "\x00") + "\x00" + strings.Join(i.ctx.BuildTags, " ") + "\x00" + srcDir + "\x00" + strings.Join(paths, "\x00")
+}
+
+// load loads paths from srcDir in a single call of the go command, and
+// returns the packages of the paths and of all their dependencies, by
+// import path. A lone path also maps to its package if the go command
+// reports it under another path.
+func (i *importer) load(srcDir string, paths []string) (map[string]*types.Package, error) {
+	cfg := &packages.Config{
+		// Without syntax, the types of the packages and their
+		// dependencies are read from export data.
+		Mode: packages.NeedName | packages.NeedTypes | packages.NeedImports | packages.NeedDeps,
+		Dir:  srcDir,
+		Env:  i.env(),
+	}
+	if len(i.ctx.BuildTags) > 0 {
+		cfg.BuildFlags = []string{"-tags", strings.Join(i.ctx.BuildTags, " ")}
+	}
+	roots, err := loadPackages(cfg, paths...)
+	if err != nil {
+		i.logf("failed to load %s: %v", strings.Join(paths, " "), err)
+		return nil, err
+	}
+	g := make(map[string]*types.Package)
+	packages.Visit(roots, nil, func(pkg *packages.Package) {
+		if pkg.Types != nil {
+			g[pkg.PkgPath] = pkg.Types
+		}
+	})
+	for _, root := range roots {
+		for _, err := range root.Errors {
+			i.logf("loading %s: %v", root.PkgPath, err)
+		}
+	}
+	if len(paths) == 1 && len(roots) == 1 && roots[0].Types != nil {
+		g[paths[0]] = roots[0].Types
+	}
+	return g, nil
+}
+
+func (i *importer) env() []string {
+	cgo := "0"
+	if i.ctx.CgoEnabled {
+		cgo = "1"
+	}
+	env := append(os.Environ(),
+		"GOOS="+i.ctx.GOOS,
+		"GOARCH="+i.ctx.GOARCH,
+		"GOROOT="+i.ctx.GOROOT,
+		"GOPATH="+i.ctx.GOPATH,
+		"CGO_ENABLED="+cgo,
+	)
+	if i.ctx.GO111MODULE != "" {
+		env = append(env, "GO111MODULE="+i.ctx.GO111MODULE)
+	}
+	return env
+}
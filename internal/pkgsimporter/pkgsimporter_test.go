@@ -0,0 +1,97 @@
+package pkgsimporter_test
+
+import (
+	"go/build"
+	"go/importer"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/cache"
+	"github.com/mdempsky/gocode/internal/gbimporter"
+	"github.com/mdempsky/gocode/internal/pkgsimporter"
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+// writeModule writes files, keyed by slash-separated paths, to a
+// temporary directory, without the '@' marking the cursor.
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(strings.Replace(src, "@", "", 1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// suggestFile completes at the '@' in src, the contents of filename.
+func suggestFile(imp types.Importer, filename, src string, logf func(string, ...interface{})) []suggest.Candidate {
+	cursor := strings.IndexByte(src, '@')
+	data := []byte(strings.Replace(src, "@", "", 1))
+	cfg := suggest.Config{
+		Importer: imp,
+		Logf:     logf,
+	}
+	candidates, _ := cfg.Suggest(filename, data, cursor)
+	return candidates
+}
+
+func TestModuleCompletion(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	files := map[string]string{
+		"go.mod":     "module example.com/m\n",
+		"lib/lib.go": "package lib\n\nfunc Hello() string { return \"hello\" }\n",
+		"main.go":    "package main\n\nimport \"example.com/m/lib\"\n\nfunc main() {\n\tlib.@\n}\n",
+	}
+	dir := writeModule(t, files)
+
+	filename := filepath.Join(dir, "main.go")
+	ctx := cache.PackContext(&build.Default)
+	candidates := suggestFile(pkgsimporter.New(&ctx, filename, nil, t.Logf), filename, files["main.go"], t.Logf)
+	if len(candidates) != 1 || candidates[0].Name != "Hello" {
+		t.Errorf("got %v, want [Hello]", candidates)
+	}
+}
+
+func TestModuleTestHelperCompletion(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	// The helper package is imported by tests only, so it is never
+	// built along with the rest of the module.
+	files := map[string]string{
+		"go.mod":                        "module example.com/m\n",
+		"lib/lib.go":                    "package lib\n",
+		"internal/testutil/testutil.go": "package testutil\n\nfunc MustTempDir() string { return \"\" }\n",
+		"lib/lib_test.go":               "package lib\n\nimport (\n\t\"testing\"\n\n\t\"example.com/m/internal/testutil\"\n)\n\nfunc TestLib(t *testing.T) {\n\ttestutil.@\n}\n",
+	}
+	dir := writeModule(t, files)
+
+	filename := filepath.Join(dir, "lib", "lib_test.go")
+	ctx := cache.PackContext(&build.Default)
+	importers := map[string]types.Importer{
+		"packages": pkgsimporter.New(&ctx, filename, nil, t.Logf),
+		"source":   gbimporter.New(&ctx, filename, importer.For("source", nil), false, t.Logf),
+		"cache":    cache.NewImporter(&ctx, filename, nil, true, false, false, t.Logf),
+	}
+	for name, imp := range importers {
+		candidates := suggestFile(imp, filename, files["lib/lib_test.go"], t.Logf)
+		if len(candidates) != 1 || candidates[0].Name != "MustTempDir" {
+			t.Errorf("%s: got %v, want [MustTempDir]", name, candidates)
+		}
+	}
+}
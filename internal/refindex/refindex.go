@@ -0,0 +1,238 @@
+// Package refindex counts how many times the exported package-level
+// symbols of each package are referred to in a workspace, for ranking
+// completion candidates. The counts are kept per directory, so that a
+// refresh only parses the packages that changed, and are saved to
+// disk between runs, as a cache file.
+package refindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"hash/fnv"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mdempsky/gocode/internal/cachefile"
+	"github.com/mdempsky/gocode/internal/fswalk"
+)
+
+// An Index holds the reference counts of a workspace.
+type Index struct {
+	root string
+	file string // where the index is saved, "" if it isn't
+
+	mu     sync.Mutex
+	dirs   map[string]*dirRefs // by directory, relative to root
+	counts map[string]int      // by key, summed over dirs
+}
+
+// dirRefs holds the references made by the Go files of a directory.
+type dirRefs struct {
+	// Stamp, made of the name, size and modification time of each
+	// Go file, tells whether the directory changed since Refs were
+	// counted.
+	Stamp string         `json:"stamp"`
+	Refs  map[string]int `json:"refs"`
+}
+
+// symlinks is the policy for symbolic links met by Refresh.
+var symlinks = fswalk.Default
+
+// SetSymlinkPolicy sets whether Refresh follows symbolic links to
+// directories and Go files. It must be called before any index is
+// refreshed.
+func SetSymlinkPolicy(p fswalk.Policy) {
+	symlinks = p
+}
+
+// key returns the key of the symbol name of the package path.
+func key(path, name string) string {
+	return path + "." + name
+}
+
+// Open returns the index of the workspace in root, as last saved to
+// file. It is empty if file doesn't exist, is corrupt, which
+// quarantines it, or is "", and is only updated by Refresh.
+func Open(root, file string) *Index {
+	ix := &Index{root: root, file: file, dirs: make(map[string]*dirRefs)}
+	if file != "" {
+		if data, err := cachefile.Read(file); err == nil {
+			var saved struct {
+				Root string              `json:"root"`
+				Dirs map[string]*dirRefs `json:"dirs"`
+			}
+			if json.Unmarshal(data, &saved) == nil && saved.Root == root && saved.Dirs != nil {
+				ix.dirs = saved.Dirs
+			}
+		}
+	}
+	ix.sum()
+	return ix
+}
+
+// Count returns how many times the symbol name of the package path is
+// referred to in the workspace.
+func (ix *Index) Count(path, name string) int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.counts[key(path, name)]
+}
+
+// Refresh counts the references again in the directories that changed
+// since the last refresh, forgets those of removed directories, and
+// saves the index if anything changed. It returns the number of
+// directories whose files were parsed. Refresh must not be called
+// concurrently with itself; Count may be.
+func (ix *Index) Refresh() (int, error) {
+	ix.mu.Lock()
+	old := ix.dirs
+	ix.mu.Unlock()
+
+	dirs := make(map[string]*dirRefs)
+	scanned := 0
+	err := fswalk.WalkPackages(ix.root, symlinks, false, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == ix.root {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		files, stamp := goFiles(p)
+		if len(files) == 0 {
+			return nil
+		}
+		rel, _ := filepath.Rel(ix.root, p)
+		rel = filepath.ToSlash(rel)
+		if d := old[rel]; d != nil && d.Stamp == stamp {
+			dirs[rel] = d
+			return nil
+		}
+		dirs[rel] = &dirRefs{Stamp: stamp, Refs: countRefs(files)}
+		scanned++
+		return nil
+	})
+	if err != nil {
+		return scanned, err
+	}
+
+	ix.mu.Lock()
+	ix.dirs = dirs
+	ix.sum()
+	ix.mu.Unlock()
+	if scanned == 0 && len(dirs) == len(old) {
+		return 0, nil
+	}
+	return scanned, ix.save(dirs)
+}
+
+// sum computes counts from dirs. ix.mu must be held, or ix unshared.
+func (ix *Index) sum() {
+	ix.counts = make(map[string]int)
+	for _, d := range ix.dirs {
+		for k, n := range d.Refs {
+			ix.counts[k] += n
+		}
+	}
+}
+
+// save writes dirs to ix.file. The file is replaced atomically, so a
+// concurrent Open sees either the old or the new index, and one
+// killed halfway neither.
+func (ix *Index) save(dirs map[string]*dirRefs) error {
+	if ix.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(struct {
+		Root string              `json:"root"`
+		Dirs map[string]*dirRefs `json:"dirs"`
+	}{ix.root, dirs})
+	if err != nil {
+		return err
+	}
+	return cachefile.Write(ix.file, data)
+}
+
+// goFiles returns the Go files of dir and their stamp, which changes
+// when a file is added, removed, renamed, or is written to, even
+// within the resolution of modification times if its size changes.
+func goFiles(dir string) ([]string, string) {
+	infos, err := fswalk.ReadDir(dir, symlinks)
+	if err != nil {
+		return nil, ""
+	}
+	var files []string
+	h := fnv.New64a()
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasSuffix(name, ".go") || fswalk.Ignored(name) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", name, info.Size(), info.ModTime().UnixNano())
+	}
+	return files, fmt.Sprintf("%016x", h.Sum64())
+}
+
+// countRefs counts the qualified identifiers, such as fmt.Errorf,
+// referring to the exported members of imported packages in files.
+// Files that don't parse are counted as far as they do.
+func countRefs(files []string) map[string]int {
+	refs := make(map[string]int)
+	fset := token.NewFileSet()
+	for _, filename := range files {
+		f, _ := parser.ParseFile(fset, filename, nil, 0)
+		if f == nil {
+			continue
+		}
+		imports := make(map[string]string) // by name
+		for _, spec := range f.Imports {
+			p, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			name := importName(p)
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			imports[name] = p
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok || !sel.Sel.IsExported() {
+				return true
+			}
+			// Without type-checking, a local variable named like
+			// an import is taken for it.
+			if x, ok := sel.X.(*ast.Ident); ok {
+				if p, ok := imports[x.Name]; ok {
+					refs[key(p, sel.Sel.Name)]++
+				}
+			}
+			return true
+		})
+	}
+	return refs
+}
+
+// importName guesses the name of the package imported as p, without
+// reading it: its last element, skipping a major version suffix such
+// as /v2.
+func importName(p string) string {
+	name := path.Base(p)
+	if len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		if dir := path.Dir(p); dir != "." {
+			name = path.Base(dir)
+		}
+	}
+	return strings.TrimPrefix(name, "go-")
+}
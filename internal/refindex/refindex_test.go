@@ -0,0 +1,243 @@
+package refindex_test
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/cachefile"
+	"github.com/mdempsky/gocode/internal/fswalk"
+	"github.com/mdempsky/gocode/internal/golden"
+	"github.com/mdempsky/gocode/internal/refindex"
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+// copyDir copies the files of the tree src to dst.
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "ws")
+	copyDir(t, "testdata/ws", root)
+	file := filepath.Join(dir, "cache", "refs.json")
+
+	counts := func(ix *refindex.Index) string {
+		var s []string
+		for _, name := range []string{"Alpha", "Beta", "Gamma", "Delta", "Zeta"} {
+			s = append(s, fmt.Sprintf("%s=%d", name, ix.Count("example.com/lib", name)))
+		}
+		return strings.Join(s, " ")
+	}
+	refresh := func(ix *refindex.Index, want int) {
+		t.Helper()
+		if n, err := ix.Refresh(); err != nil || n != want {
+			t.Fatalf("Refresh: parsed %d directories, err %v; want %d", n, err, want)
+		}
+	}
+
+	// testdata and _old are ignored.
+	ix := refindex.Open(root, file)
+	refresh(ix, 2)
+	if got, want := counts(ix), "Alpha=0 Beta=1 Gamma=7 Delta=3 Zeta=2"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	refresh(ix, 0)
+
+	// The saved index is used until refreshed.
+	ix = refindex.Open(root, file)
+	if got, want := counts(ix), "Alpha=0 Beta=1 Gamma=7 Delta=3 Zeta=2"; got != want {
+		t.Errorf("reopened: got %s, want %s", got, want)
+	}
+	refresh(ix, 0)
+
+	// Only the changed directory is parsed again.
+	b := filepath.Join(root, "b", "b.go")
+	if err := ioutil.WriteFile(b, []byte("package b\n\nimport \"example.com/lib\"\n\nvar _ = lib.Alpha\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(b, future, future); err != nil {
+		t.Fatal(err)
+	}
+	refresh(ix, 1)
+	if got, want := counts(ix), "Alpha=1 Beta=0 Gamma=4 Delta=1 Zeta=0"; got != want {
+		t.Errorf("after changing b: got %s, want %s", got, want)
+	}
+
+	// So is one rewritten within the resolution of modification
+	// times, if its size changed.
+	if err := ioutil.WriteFile(b, []byte("package b\n\nimport \"example.com/lib\"\n\nvar _, _ = lib.Alpha, lib.Beta\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(b, future, future); err != nil {
+		t.Fatal(err)
+	}
+	refresh(ix, 1)
+	if got, want := counts(ix), "Alpha=1 Beta=1 Gamma=4 Delta=1 Zeta=0"; got != want {
+		t.Errorf("after rewriting b: got %s, want %s", got, want)
+	}
+
+	// The references of removed directories are forgotten.
+	if err := os.RemoveAll(filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+	refresh(ix, 0)
+	if got, want := counts(ix), "Alpha=1 Beta=1 Gamma=0 Delta=0 Zeta=0"; got != want {
+		t.Errorf("after removing a: got %s, want %s", got, want)
+	}
+	if got, want := counts(refindex.Open(root, file)), "Alpha=1 Beta=1 Gamma=0 Delta=0 Zeta=0"; got != want {
+		t.Errorf("reopened after removing a: got %s, want %s", got, want)
+	}
+}
+
+func TestRefreshSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "ws")
+	copyDir(t, "testdata/ws", root)
+	// A linked directory, and a linked file in b.
+	if err := os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "linked")); err != nil {
+		t.Skipf("can't create symbolic links: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "a", "a.go"), filepath.Join(root, "b", "linked.go")); err != nil {
+		t.Fatal(err)
+	}
+	defer refindex.SetSymlinkPolicy(fswalk.Default)
+
+	for _, test := range []struct {
+		policy fswalk.Policy
+		gamma  int
+	}{
+		{fswalk.Default, 7},
+		{fswalk.Skip, 7},
+		// The linked directory is a, which is only counted
+		// once; b/linked.go counts a.go again.
+		{fswalk.Follow, 11},
+	} {
+		refindex.SetSymlinkPolicy(test.policy)
+		ix := refindex.Open(root, "")
+		if _, err := ix.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if got := ix.Count("example.com/lib", "Gamma"); got != test.gamma {
+			t.Errorf("%v: got %d references to Gamma, want %d", test.policy, got, test.gamma)
+		}
+	}
+}
+
+func TestCorruptIndex(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "ws")
+	copyDir(t, "testdata/ws", root)
+	file := filepath.Join(dir, "cache", "refs.json")
+	defer func(orig func(string, ...interface{})) { cachefile.Logf = orig }(cachefile.Logf)
+	cachefile.Logf = t.Logf
+
+	if _, err := refindex.Open(root, file).Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), saved...)
+	flipped[len(flipped)/2] ^= 1
+	for name, data := range map[string][]byte{
+		"truncated":   saved[:len(saved)/2],
+		"bit-flipped": flipped,
+	} {
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// The corrupt index is quarantined, and rebuilt from
+		// scratch.
+		ix := refindex.Open(root, file)
+		if got := ix.Count("example.com/lib", "Gamma"); got != 0 {
+			t.Errorf("%s: counted %d references from a corrupt index", name, got)
+		}
+		if _, err := os.Stat(file + cachefile.CorruptSuffix); err != nil {
+			t.Errorf("%s: not quarantined: %v", name, err)
+		}
+		if n, err := ix.Refresh(); err != nil || n != 2 {
+			t.Errorf("%s: Refresh parsed %d directories, err %v; want 2", name, n, err)
+		}
+		if got := refindex.Open(root, file).Count("example.com/lib", "Gamma"); got != 7 {
+			t.Errorf("%s: reopened the rebuilt index with %d references, want 7", name, got)
+		}
+	}
+}
+
+// libImporter serves testdata/lib as example.com/lib.
+type libImporter struct {
+	lib *types.Package
+}
+
+func (i libImporter) Import(path string) (*types.Package, error) {
+	if path != i.lib.Path() {
+		return nil, fmt.Errorf("can't find %s", path)
+	}
+	return i.lib, nil
+}
+
+// TestRanking pins the order of candidates ranked by the references
+// in testdata/ws with various weights.
+func TestRanking(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "testdata/lib/lib.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err := new(types.Config).Check("example.com/lib", fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix := refindex.Open("testdata/ws", "")
+	if _, err := ix.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	src := "package p\n\nimport \"example.com/lib\"\n\nvar _ = lib."
+	var got bytes.Buffer
+	for _, weight := range []float64{0, 0.5, 1, 4} {
+		cfg := suggest.Config{
+			Importer:        libImporter{lib},
+			Logf:            t.Logf,
+			ReferenceCount:  ix.Count,
+			ReferenceWeight: weight,
+		}
+		candidates, _ := cfg.Suggest("", []byte(src), len(src))
+		fmt.Fprintf(&got, "# weight %v\n", weight)
+		for _, c := range candidates {
+			fmt.Fprintf(&got, "%s %s\n", c.Class, c.Name)
+		}
+	}
+
+	golden.Check(t, "testdata/ranking.golden", got.Bytes())
+}
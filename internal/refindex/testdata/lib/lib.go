@@ -0,0 +1,12 @@
+package lib
+
+func Alpha() {}
+func Beta()  {}
+func Gamma() {}
+func Delta() {}
+
+type Epsilon int
+
+var Zeta int
+
+const Eta = 0
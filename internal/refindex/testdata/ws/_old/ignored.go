@@ -0,0 +1,14 @@
+package ignored
+
+import "example.com/lib"
+
+func ignored() {
+	lib.Alpha()
+	lib.Alpha()
+	lib.Alpha()
+	lib.Alpha()
+	lib.Alpha()
+	lib.Alpha()
+	lib.Alpha()
+	lib.Alpha()
+}
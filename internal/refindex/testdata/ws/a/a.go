@@ -0,0 +1,11 @@
+package a
+
+import "example.com/lib"
+
+func a() {
+	lib.Gamma()
+	lib.Gamma()
+	lib.Gamma()
+	lib.Gamma()
+	lib.Delta()
+}
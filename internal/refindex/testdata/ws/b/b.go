@@ -0,0 +1,13 @@
+package b
+
+import l "example.com/lib"
+
+func b() int {
+	l.Gamma()
+	l.Gamma()
+	l.Gamma()
+	l.Delta()
+	l.Delta()
+	l.Beta()
+	return l.Zeta + l.Zeta
+}
@@ -0,0 +1,152 @@
+// Package sandbox confines file system reads to a set of directories.
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An FS checks and performs reads. Source files may only be read
+// within its source roots, while export data may also be read within
+// its export roots. Paths are cleaned and their symbolic links are
+// resolved before they are checked, so neither ".." nor links lead out
+// of the roots.
+type FS struct {
+	source []string
+	export []string
+}
+
+// New returns an FS whose source roots are root and goroot, and whose
+// export roots are exportRoots. Empty roots are ignored.
+func New(root, goroot string, exportRoots ...string) (*FS, error) {
+	if root == "" {
+		return nil, fmt.Errorf("sandbox: empty root")
+	}
+	fs := &FS{}
+	for _, dir := range []string{root, goroot} {
+		if dir == "" {
+			continue
+		}
+		real, err := resolve(dir)
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: %v", err)
+		}
+		fs.source = append(fs.source, real)
+	}
+	for _, dir := range exportRoots {
+		if dir == "" {
+			continue
+		}
+		// Export roots, such as the build cache, needn't exist.
+		if real, err := resolve(dir); err == nil {
+			fs.export = append(fs.export, real)
+		}
+	}
+	return fs, nil
+}
+
+// A Violation is the error for a read outside of the roots.
+type Violation struct {
+	Path string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("sandbox: %s is outside of the sandbox", v.Path)
+}
+
+// Check returns a *Violation if the source file or directory name is
+// outside of the source roots.
+func (fs *FS) Check(name string) error {
+	return fs.check(name, fs.source)
+}
+
+// CheckExport returns a *Violation if the export data file name is
+// outside of both the source and the export roots.
+func (fs *FS) CheckExport(name string) error {
+	if err := fs.check(name, fs.source); err == nil {
+		return nil
+	}
+	return fs.check(name, fs.export)
+}
+
+// ReadFile is ioutil.ReadFile of a source file.
+func (fs *FS) ReadFile(name string) ([]byte, error) {
+	if err := fs.Check(name); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(name)
+}
+
+// ReadDir is ioutil.ReadDir of a source directory.
+func (fs *FS) ReadDir(dir string) ([]os.FileInfo, error) {
+	if err := fs.Check(dir); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadDir(dir)
+}
+
+// Open is os.Open of a source file.
+func (fs *FS) Open(name string) (*os.File, error) {
+	if err := fs.Check(name); err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// IsDir reports whether dir is a source directory.
+func (fs *FS) IsDir(dir string) bool {
+	if fs.Check(dir) != nil {
+		return false
+	}
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+func (fs *FS) check(name string, roots []string) error {
+	real, err := resolve(name)
+	if err != nil {
+		return &Violation{name}
+	}
+	for _, root := range roots {
+		if within(real, root) {
+			return nil
+		}
+	}
+	return &Violation{name}
+}
+
+// resolve returns the absolute, clean path of name with its symbolic
+// links resolved. If name doesn't exist, its parent is resolved
+// instead, so that a missing file still resolves to where it would be.
+func resolve(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err == nil {
+		return real, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	dir, file := filepath.Split(abs)
+	dir = filepath.Clean(dir)
+	if dir == abs {
+		return "", err
+	}
+	real, err = resolve(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(real, file), nil
+}
+
+// within reports whether path is root or below it.
+func within(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
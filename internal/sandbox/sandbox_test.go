@@ -0,0 +1,74 @@
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapes(t *testing.T) {
+	tmp := t.TempDir()
+
+	for name, src := range map[string]string{
+		"repo/p/p.go":           "package p\n",
+		"goroot/src/fmt/fmt.go": "package fmt\n",
+		"outside/secret.go":     "package secret\n",
+		"cache/ab/cd-d":         "export data\n",
+	} {
+		name = filepath.Join(tmp, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := filepath.Join(tmp, "repo")
+	if err := os.Symlink(filepath.Join(tmp, "outside"), filepath.Join(repo, "link")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(tmp, "outside", "secret.go"), filepath.Join(repo, "p", "secret.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := New(repo, filepath.Join(tmp, "goroot"), filepath.Join(tmp, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		source bool
+		export bool
+	}{
+		{"repo/p/p.go", true, true},
+		{"repo/p/missing.go", true, true},
+		{"repo/p/../p/p.go", true, true},
+		{"goroot/src/fmt/fmt.go", true, true},
+		{"cache/ab/cd-d", false, true},
+		{"outside/secret.go", false, false},
+		{"repo/../outside/secret.go", false, false},
+		{"repo/p/../../outside/secret.go", false, false},
+		{"repo/link/secret.go", false, false},
+		{"repo/link/missing.go", false, false},
+		{"repo/p/secret.go", false, false},
+		{"repo-sibling/x.go", false, false},
+	} {
+		name := filepath.Join(tmp, filepath.FromSlash(test.name))
+		if err := fs.Check(name); (err == nil) != test.source {
+			t.Errorf("Check(%s): got %v", test.name, err)
+		}
+		if err := fs.CheckExport(name); (err == nil) != test.export {
+			t.Errorf("CheckExport(%s): got %v", test.name, err)
+		}
+	}
+
+	if _, err := fs.ReadFile(filepath.Join(repo, "p", "secret.go")); err == nil {
+		t.Errorf("read a file outside of the sandbox through a symlink")
+	} else if _, ok := err.(*Violation); !ok {
+		t.Errorf("got error %v, want a *Violation", err)
+	}
+	if _, err := fs.ReadDir(filepath.Join(repo, "link")); err == nil {
+		t.Errorf("read a directory outside of the sandbox through a symlink")
+	}
+}
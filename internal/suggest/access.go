@@ -0,0 +1,27 @@
+package suggest
+
+import "go/types"
+
+// accessible reports whether obj, a package-level object, field or
+// method, can be referred to from the package from: if it is exported,
+// predeclared, or declared in from. Packages are the same if they have
+// the same path, as a package may be type-checked more than once, such
+// as from source for its tests and from export data for its importers.
+// The package being completed is checked with an empty path, so only
+// its own objects are declared in it.
+func accessible(obj types.Object, from *types.Package) bool {
+	if obj.Exported() {
+		return true
+	}
+	pkg := obj.Pkg()
+	switch {
+	case pkg == nil:
+		// Predeclared, such as the error interface's Error.
+		return true
+	case from == nil:
+		return false
+	case pkg == from:
+		return true
+	}
+	return pkg.Path() != "" && pkg.Path() == from.Path()
+}
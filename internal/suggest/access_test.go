@@ -0,0 +1,224 @@
+package suggest_test
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+const accessSrc = `package b
+
+type T struct {
+	Exp   int
+	unexp int
+}
+
+func (T) M() {}
+func (T) m() {}
+
+var V, v int
+
+const C, c = 1, 2
+
+func F() {}
+func f() {}
+
+type t int
+`
+
+// checkPackage type-checks the package path made of srcs, importing
+// the packages of imports.
+func checkPackage(t *testing.T, path string, imports map[string]*types.Package, srcs ...string) *types.Package {
+	t.Helper()
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for i, src := range srcs {
+		f, err := parser.ParseFile(fset, fmt.Sprintf("%s%d.go", path, i), src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	conf := types.Config{Importer: mapImporter(imports)}
+	pkg, err := conf.Check(path, fset, files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+// mapImporter imports the packages of a map, and the others with the
+// default importer.
+type mapImporter map[string]*types.Package
+
+func (m mapImporter) Import(path string) (*types.Package, error) {
+	if pkg := m[path]; pkg != nil {
+		return pkg, nil
+	}
+	return importer.Default().Import(path)
+}
+
+func TestAccessible(t *testing.T) {
+	b := checkPackage(t, "b", nil, accessSrc)
+	imports := map[string]*types.Package{"b": b}
+	from := map[string]*types.Package{
+		"same package": b,
+		// b type-checked again with its internal tests.
+		"internal test": checkPackage(t, "b", nil, accessSrc, "package b\n\nfunc helper() {}\n"),
+		"external test": checkPackage(t, "b_test", imports, "package b_test\n\nimport \"b\"\n\nvar _ b.T\n"),
+		"importer":      checkPackage(t, "a", imports, "package a\n\nimport \"b\"\n\nvar _ b.T\n"),
+		// The package being completed has an empty path.
+		"completed": checkPackage(t, "", imports, "package a\n\nimport \"b\"\n\nvar _ b.T\n"),
+		"none":      nil,
+	}
+
+	named := b.Scope().Lookup("T").Type().(*types.Named)
+	st := named.Underlying().(*types.Struct)
+	method := func(name string) types.Object {
+		obj, _, _ := types.LookupFieldOrMethod(named, false, b, name)
+		return obj
+	}
+	objs := map[string]types.Object{
+		"exported type":      b.Scope().Lookup("T"),
+		"unexported type":    b.Scope().Lookup("t"),
+		"exported var":       b.Scope().Lookup("V"),
+		"unexported var":     b.Scope().Lookup("v"),
+		"exported const":     b.Scope().Lookup("C"),
+		"unexported const":   b.Scope().Lookup("c"),
+		"exported func":      b.Scope().Lookup("F"),
+		"unexported func":    b.Scope().Lookup("f"),
+		"exported field":     st.Field(0),
+		"unexported field":   st.Field(1),
+		"exported method":    method("M"),
+		"unexported method":  method("m"),
+		"builtin":            types.Universe.Lookup("len"),
+		"predeclared type":   types.Universe.Lookup("int"),
+		"predeclared method": types.Universe.Lookup("error").Type().Underlying().(*types.Interface).Method(0),
+	}
+
+	for obj, want := range map[string][]string{
+		"exported type":      {"same package", "internal test", "external test", "importer", "completed", "none"},
+		"unexported type":    {"same package", "internal test"},
+		"exported var":       {"same package", "internal test", "external test", "importer", "completed", "none"},
+		"unexported var":     {"same package", "internal test"},
+		"exported const":     {"same package", "internal test", "external test", "importer", "completed", "none"},
+		"unexported const":   {"same package", "internal test"},
+		"exported func":      {"same package", "internal test", "external test", "importer", "completed", "none"},
+		"unexported func":    {"same package", "internal test"},
+		"exported field":     {"same package", "internal test", "external test", "importer", "completed", "none"},
+		"unexported field":   {"same package", "internal test"},
+		"exported method":    {"same package", "internal test", "external test", "importer", "completed", "none"},
+		"unexported method":  {"same package", "internal test"},
+		"builtin":            {"same package", "internal test", "external test", "importer", "completed", "none"},
+		"predeclared type":   {"same package", "internal test", "external test", "importer", "completed", "none"},
+		"predeclared method": {"same package", "internal test", "external test", "importer", "completed", "none"},
+	} {
+		var got []string
+		for _, name := range []string{"same package", "internal test", "external test", "importer", "completed", "none"} {
+			if suggest.Accessible(objs[obj], from[name]) {
+				got = append(got, name)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: accessible from %q, want %q", obj, got, want)
+		}
+	}
+}
+
+func TestInaccessibleFields(t *testing.T) {
+	b := checkPackage(t, "b", nil, accessSrc)
+	cfg := suggest.Config{Importer: mapImporter{"b": b}}
+	for _, test := range []struct {
+		src  string
+		want []string
+	}{
+		// Selectors, also through embedding, and composite
+		// literal keys only propose the exported fields and
+		// methods of b.
+		{"var x b.T\n\tx.@", []string{"func M()", "var Exp int"}},
+		{"var x struct{ b.T }\n\tx.@", []string{"func M()", "var Exp int", "var T b.T"}},
+		{"_ = b.T{@}", []string{"var Exp int"}},
+		{"_ = b.@", []string{"const C untyped int", "func F()", "type T struct", "var V int"}},
+	} {
+		got, _ := suggestSource(t, cfg, "package a\n\nimport \"b\"\n\nfunc g() {\n\t"+test.src+"\n}\n")
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%q: got %q, want %q", test.src, strs, test.want)
+		}
+	}
+}
+
+const promotedSrc = `package b
+
+type inner struct {
+	Promoted int
+	hidden   int
+}
+
+func (inner) Hello()     {}
+func (*inner) PtrHello() {}
+func (inner) bye()       {}
+
+type doer interface{ Do() }
+
+type Outer struct {
+	inner
+	Own int
+}
+
+type PtrOuter struct{ *inner }
+
+type IfaceOuter struct{ doer }
+
+func NewOuter() Outer { return Outer{} }
+
+type Wrapper struct{ *Outer }
+`
+
+func TestPromotedThroughUnexported(t *testing.T) {
+	b := checkPackage(t, "b", nil, promotedSrc)
+	for _, test := range []struct {
+		hide bool
+		src  string
+		want []string
+	}{
+		// The exported fields and methods of an unexported
+		// embedded field are promoted, and selectable from other
+		// packages, but the field itself isn't.
+		{false, "var x b.Outer\n\tx.@", []string{"func Hello()", "func PtrHello()", "var Own int", "var Promoted int"}},
+		{false, "var x *b.Outer\n\tx.@", []string{"func Hello()", "func PtrHello()", "var Own int", "var Promoted int"}},
+		{false, "_ = b.Outer{}.@", []string{"func Hello()", "var Own int", "var Promoted int"}},
+		{false, "var x b.PtrOuter\n\tx.@", []string{"func Hello()", "func PtrHello()", "var Promoted int"}},
+		{false, "var x b.IfaceOuter\n\tx.@", []string{"func Do()"}},
+		{false, "var x b.Outer\n\tx.inn@", nil},
+		// Promoted fields can't be keys of composite literals.
+		{false, "_ = b.Outer{@}", []string{"var Own int"}},
+		// Unless hidden as implementation details.
+		{true, "var x b.Outer\n\tx.@", []string{"var Own int"}},
+		{true, "var x b.PtrOuter\n\tx.@", nil},
+		{true, "b.NewOuter().@", []string{"var Own int"}},
+		{true, "var x b.IfaceOuter\n\tx.@", nil},
+		// Also through exported embedded fields.
+		{true, "var x b.Wrapper\n\tx.@", []string{"var Outer *b.Outer", "var Own int"}},
+	} {
+		cfg := suggest.Config{Importer: mapImporter{"b": b}, HideUnexportedPromotions: test.hide}
+		got, _ := suggestSource(t, cfg, "package a\n\nimport \"b\"\n\nfunc g() {\n\t"+test.src+"\n}\n")
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%q (hidden %v): got %q, want %q", test.src, test.hide, strs, test.want)
+		}
+	}
+}
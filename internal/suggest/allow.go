@@ -0,0 +1,59 @@
+package suggest
+
+import (
+	"go/types"
+	"strings"
+)
+
+// allowedPath reports whether the package path is one of allow, import
+// paths, or "path/..." patterns matching path and the packages below
+// it. All paths are allowed if allow is nil.
+func allowedPath(allow []string, path string) bool {
+	if allow == nil {
+		return true
+	}
+	for _, p := range allow {
+		if p == path {
+			return true
+		}
+		if dir := strings.TrimSuffix(p, "/..."); dir != p && (path == dir || strings.HasPrefix(path, dir+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedBelow reports whether a package below the directory dir of
+// an import path is allowed, so that dir leads to it.
+func allowedBelow(allow []string, dir string) bool {
+	if allow == nil {
+		return true
+	}
+	for _, p := range allow {
+		if strings.HasPrefix(strings.TrimSuffix(p, "/..."), dir+"/") {
+			return true
+		}
+	}
+	return allowedPath(allow, dir)
+}
+
+// allowed reports whether obj may be proposed with
+// Config.AllowedPackages: if it is predeclared, declared in the package
+// being completed, or in an allowed package. The name of an import is
+// allowed if the package it imports is.
+func (b *candidateCollector) allowed(obj types.Object) bool {
+	if b.allow == nil {
+		return true
+	}
+	if pkgName, ok := obj.(*types.PkgName); ok {
+		return allowedPath(b.allow, pkgName.Imported().Path())
+	}
+	pkg := obj.Pkg()
+	switch {
+	case pkg == nil:
+		return true
+	case pkg == b.localpkg:
+		return true
+	}
+	return allowedPath(b.allow, pkg.Path())
+}
@@ -0,0 +1,102 @@
+package suggest
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"unicode"
+	"unicode/utf8"
+)
+
+// arity returns the number of parameters and results of the function
+// obj, and whether its last parameter is variadic.
+func arity(obj types.Object) (params, results int, variadic bool) {
+	if b, ok := obj.(*types.Builtin); ok {
+		return builtinArity(b.Name())
+	}
+	sig, ok := obj.Type().Underlying().(*types.Signature)
+	if !ok {
+		return 0, 0, false
+	}
+	return sig.Params().Len(), sig.Results().Len(), sig.Variadic()
+}
+
+// builtinArity is like arity for the built-in function name, whose
+// types.Builtin has no signature, so its pseudo-signature is used.
+func builtinArity(name string) (params, results int, variadic bool) {
+	x, err := parser.ParseExpr(builtinTypes[name])
+	if err != nil {
+		return 0, 0, false
+	}
+	ft, ok := x.(*ast.FuncType)
+	if !ok {
+		return 0, 0, false
+	}
+	params = ft.Params.NumFields()
+	if params > 0 {
+		last := ft.Params.List[len(ft.Params.List)-1]
+		_, variadic = last.Type.(*ast.Ellipsis)
+	}
+	if ft.Results != nil {
+		results = ft.Results.NumFields()
+	}
+	return params, results, variadic
+}
+
+// funcValueContext reports whether the identifier at the cursor is used
+// as a function value rather than called: it is already followed by
+// arguments, or it is passed for a parameter of function type.
+func (c *Config) funcValueContext(fset *token.FileSet, pos token.Pos, pkg *types.Package, data []byte, cursor int) bool {
+	// Skip the rest of the identifier.
+	rest := data[cursor:]
+	for len(rest) > 0 {
+		r, size := utf8.DecodeRune(rest)
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		rest = rest[size:]
+	}
+	rest = bytes.TrimLeft(rest, " \t")
+	if len(rest) > 0 && rest[0] == '(' {
+		return true
+	}
+
+	fn, arg, ok := deduceCallArg(data, cursor)
+	if !ok {
+		return false
+	}
+	tv, _ := types.Eval(fset, pkg, pos, fn)
+	if tv.Type == nil {
+		return false
+	}
+	sig, ok := tv.Type.Underlying().(*types.Signature)
+	if !ok {
+		return false
+	}
+	param := argType(sig, arg)
+	if param == nil {
+		return false
+	}
+	_, ok = param.Underlying().(*types.Signature)
+	return ok
+}
+
+// argType returns the type of the parameter of sig that takes the
+// argument at index arg, or nil if there is none.
+func argType(sig *types.Signature, arg int) types.Type {
+	switch n := sig.Params().Len(); {
+	case n == 0:
+		return nil
+	case arg < n-1, arg == n-1 && !sig.Variadic():
+		return sig.Params().At(arg).Type()
+	case sig.Variadic():
+		slice, ok := sig.Params().At(n - 1).Type().(*types.Slice)
+		if !ok {
+			return nil
+		}
+		return slice.Elem()
+	}
+	return nil
+}
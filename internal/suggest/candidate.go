@@ -3,35 +3,32 @@ package suggest
 import (
 	"fmt"
 	"go/ast"
+	"go/token"
 	"go/types"
+	"hash/fnv"
+	"io"
+	"math"
 	"sort"
 	"strings"
-)
 
-type Candidate struct {
-	Class    string `json:"class"`
-	PkgPath  string `json:"package"`
-	Name     string `json:"name"`
-	Type     string `json:"type"`
-	Receiver string `json:"receiver,omitempty"`
-}
+	"github.com/mdempsky/gocode/format"
+	"github.com/mdempsky/gocode/internal/lookdot"
+)
 
-func (c Candidate) Suggestion() string {
-	switch {
-	case c.Class != "func":
-		return c.Name
-	case strings.HasPrefix(c.Type, "func()"):
-		return c.Name + "()"
-	default:
-		return c.Name + "("
-	}
-}
+// Candidate is a completion candidate.
+type Candidate = format.Candidate
 
-func (c Candidate) String() string {
-	if c.Class == "func" {
-		return fmt.Sprintf("%s %s%s", c.Class, c.Name, strings.TrimPrefix(c.Type, "func"))
+// nameCandidate returns a candidate for a keyword or snippet name,
+// which is displayed, inserted and matched as is. Its ID is made of
+// the class, such as "keyword:", in place of a package path: import
+// paths can't contain colons, so it differs from the IDs of symbols
+// and of names of other classes.
+func nameCandidate(class, name string) Candidate {
+	return Candidate{
+		ID:    candidateID(class+":", "", name),
+		Class: class,
+		Name:  name,
 	}
-	return fmt.Sprintf("%s %s %s", c.Class, c.Name, c.Type)
 }
 
 type candidatesByClassAndName []Candidate
@@ -77,32 +74,200 @@ func classifyObject(obj types.Object) string {
 }
 
 type candidateCollector struct {
-	exact      []types.Object
-	badcase    []types.Object
-	imports    []*ast.ImportSpec
-	localpkg   *types.Package
-	partial    string
-	filter     objectFilter
-	builtin    bool
-	ignoreCase bool
+	exact        []types.Object
+	badcase      []types.Object
+	imports      []*ast.ImportSpec
+	localpkg     *types.Package
+	localPath    string // import path of localpkg, for candidate IDs
+	fset         *token.FileSet
+	iface        types.Type // operand type, if an interface
+	partial      string
+	filter       objectFilter
+	boost        objectFilter // if non-nil, matches are listed first
+	kinds        objectFilter // if non-nil, only matches are proposed
+	builtin      bool
+	ignoreCase   bool
+	positions    bool
+	details      bool
+	cgoInternals bool
+	callHints    bool
+	insertParens bool // false if a func value is expected
+	byPosition   bool // sort by declaration position, not class and name
+	fullPaths    bool // qualify types by import path, see Config.QualifiedTypes
+	explain      bool // see Config.Explain
+	namesOnly    bool // see Config.NamesOnly
+
+	// allow lists the packages whose symbols may be proposed, see
+	// Config.AllowedPackages.
+	allow []string
+
+	// rejections holds the symbols matching the identifier typed
+	// that aren't proposed, with explain.
+	rejections []Rejection
+
+	// unaddressable holds the methods proposed even though the
+	// operand isn't addressable.
+	unaddressable map[types.Object]bool
+
+	// implements holds how the types implementing the interface
+	// expected at the cursor do so, "value" or "pointer".
+	implements map[types.Object]string
+
+	// asserted holds how the types proposed after "x.(" implement
+	// the interface of x, "value" or "pointer".
+	asserted map[types.Object]string
+
+	// refCount and refWeight rank candidates by how often they are
+	// referred to, see Config.ReferenceCount.
+	refCount  func(path, name string) int
+	refWeight float64
+
+	// format formats the snippets that may span several lines.
+	format snippetFormat
+
+	// goVersion returns the go directive of the module of a
+	// package, with Config.GoVersions.
+	goVersion func(path string) string
+
+	// methodSpecs holds the method specifications, such as
+	// "Read(p []byte) (n int, err error)", of the interface methods
+	// proposed inside an interface literal.
+	methodSpecs map[types.Object]string
 }
 
 func (b *candidateCollector) getCandidates() []Candidate {
 	objs := b.exact
-	if objs == nil {
+	match := "prefix"
+	switch {
+	case objs == nil:
 		objs = b.badcase
+		match = "ignore-case"
+	case b.filter != nil:
+		match = "class"
+	}
+	if b.exact != nil {
+		for _, obj := range b.badcase {
+			b.reject(obj, RejectCase)
+		}
+	}
+	// Members are walked in no particular order.
+	sort.SliceStable(b.rejections, func(i, j int) bool {
+		return b.rejections[i].Name < b.rejections[j].Name
+	})
+
+	if b.byPosition {
+		objs = b.sortByPosition(objs)
 	}
 
-	var res []Candidate
+	var res, rest []Candidate
 	for _, obj := range objs {
-		res = append(res, b.asCandidate(obj))
+		boosted := b.boost != nil && b.boost(obj)
+		c := b.asCandidate(obj)
+		if b.explain {
+			c.Explain = b.explanation(c, match, boosted)
+		}
+		if boosted {
+			res = append(res, c)
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	if !b.byPosition {
+		b.sort(res)
+		b.sort(rest)
+	}
+	res = append(res, rest...)
+	if b.namesOnly {
+		// The package only ranks the candidates.
+		for i := range res {
+			res[i].PkgPath = ""
+		}
 	}
-	sort.Sort(candidatesByClassAndName(res))
 	return res
 }
 
+// sort sorts candidates by class and name, or, if reference counts
+// are known, by class, rank and name.
+func (b *candidateCollector) sort(candidates []Candidate) {
+	if b.refCount == nil {
+		sort.Sort(candidatesByClassAndName(candidates))
+		return
+	}
+	ranks := make([]int, len(candidates))
+	for i, c := range candidates {
+		_, ranks[i] = b.rank(c)
+	}
+	sort.Sort(candidatesByRank{candidates, ranks})
+}
+
+// rank returns how many times c is referred to in the workspace, and
+// its rank derived from that, if reference counts are known.
+func (b *candidateCollector) rank(c Candidate) (refs, rank int) {
+	// Only package-level symbols are counted.
+	if b.refCount == nil || c.Receiver != "" || c.PkgPath == "" {
+		return 0, 0
+	}
+	refs = b.refCount(c.PkgPath, c.Name)
+	return refs, int(b.refWeight * math.Log2(1+float64(refs)))
+}
+
+// candidatesByRank sorts candidates by class, rank, highest first, and
+// name.
+type candidatesByRank struct {
+	c    []Candidate
+	rank []int
+}
+
+func (s candidatesByRank) Len() int { return len(s.c) }
+
+func (s candidatesByRank) Swap(i, j int) {
+	s.c[i], s.c[j] = s.c[j], s.c[i]
+	s.rank[i], s.rank[j] = s.rank[j], s.rank[i]
+}
+
+func (s candidatesByRank) Less(i, j int) bool {
+	if s.c[i].Class != s.c[j].Class {
+		return s.c[i].Class < s.c[j].Class
+	}
+	if s.rank[i] != s.rank[j] {
+		return s.rank[i] > s.rank[j]
+	}
+	return s.c[i].Name < s.c[j].Name
+}
+
+// sortByPosition returns objs sorted by where they are declared in the
+// files of the local package. The positions of the objects of other
+// packages aren't known, so they follow, sorted by class and name.
+func (b *candidateCollector) sortByPosition(objs []types.Object) []types.Object {
+	objs = append([]types.Object(nil), objs...)
+	local := func(obj types.Object) bool {
+		return obj.Pkg() == b.localpkg && obj.Pos().IsValid()
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		x, y := objs[i], objs[j]
+		switch {
+		case local(x) && local(y):
+			px, py := b.fset.Position(x.Pos()), b.fset.Position(y.Pos())
+			if px.Filename != py.Filename {
+				return px.Filename < py.Filename
+			}
+			return px.Offset < py.Offset
+		case local(x) != local(y):
+			return local(x)
+		}
+		if cx, cy := classifyObject(x), classifyObject(y); cx != cy {
+			return cx < cy
+		}
+		return x.Name() < y.Name()
+	})
+	return objs
+}
+
 func (b *candidateCollector) asCandidate(obj types.Object) Candidate {
 	objClass := classifyObject(obj)
+	if b.namesOnly {
+		return b.nameOnlyCandidate(obj, objClass)
+	}
 	var typ types.Type
 	switch objClass {
 	case "const", "func", "var":
@@ -121,7 +286,7 @@ func (b *candidateCollector) asCandidate(obj types.Object) Candidate {
 		if _, isBuiltin := obj.(*types.Builtin); isBuiltin {
 			typStr = builtinTypes[obj.Name()]
 		} else if t != nil {
-			typStr = types.TypeString(t, b.qualify)
+			typStr = types.TypeString(t, b.qualifyType)
 		}
 	}
 
@@ -137,26 +302,147 @@ func (b *candidateCollector) asCandidate(obj types.Object) Candidate {
 		})
 	}
 
-	return Candidate{
+	var pos string
+	if b.positions && obj.Pos().IsValid() {
+		pos = b.fset.Position(obj.Pos()).String()
+	}
+
+	var origin string
+	if b.iface != nil {
+		if t := methodOrigin(b.iface, obj); t != nil {
+			origin = types.TypeString(t, b.qualifyType)
+		}
+	}
+
+	var detail string
+	if tn, ok := obj.(*types.TypeName); ok && b.details {
+		detail = typeDetail(tn, b.fullPaths)
+	}
+
+	// The package being completed is type-checked with an empty
+	// path, but its symbols are imported by their real path
+	// elsewhere and must keep their ID there.
+	idPath := path
+	if obj.Pkg() != nil && obj.Pkg() == b.localpkg {
+		idPath = b.localPath
+	}
+
+	c := Candidate{
+		ID:       candidateID(idPath, receiver, obj.Name()),
 		Class:    objClass,
 		PkgPath:  path,
 		Name:     obj.Name(),
 		Type:     typStr,
 		Receiver: receiver,
+		Pos:      pos,
+		Origin:   origin,
+		Detail:   detail,
+
+		Unaddressable: b.unaddressable[obj],
+		Constraint:    isConstraint(obj),
+		Const:         constValue(obj),
+	}
+	if b.goVersion != nil && obj.Pkg() != nil && obj.Pkg() != b.localpkg {
+		c.GoVersion = b.goVersion(path)
+	}
+	if objClass == "func" && (b.callHints || b.insertParens) {
+		params, results, variadic := arity(obj)
+		if b.callHints {
+			c.ArgsCount, c.ResultsCount = params, results
+			c.CallableNoArgs = params == 0 || params == 1 && variadic
+		}
+		if b.insertParens {
+			c.InsertText = obj.Name() + "($1)"
+			if params == 0 {
+				c.InsertText = obj.Name() + "()"
+			}
+		}
+	}
+	if how := b.implements[obj]; how != "" {
+		c.Implements = how
+		c.InsertText = b.implementerText(obj.(*types.TypeName), how)
+	}
+	if how := b.asserted[obj]; how != "" {
+		c.Implements = how
+		c.InsertText = b.assertedText(obj.(*types.TypeName), how)
+	}
+	if spec := b.methodSpecs[obj]; spec != "" {
+		c.InsertText = spec
+	}
+	if c.InsertText == c.Name {
+		// Such as an asserted type without a qualifier.
+		c.InsertText = ""
+	}
+	return c
+}
+
+// nameOnlyCandidate returns the candidate of obj, of class objClass,
+// with Config.NamesOnly. Its PkgPath is cleared once the candidates
+// are ranked.
+func (b *candidateCollector) nameOnlyCandidate(obj types.Object, objClass string) Candidate {
+	path := "builtin"
+	if pkg := obj.Pkg(); pkg != nil {
+		path = pkg.Path()
+	}
+	return Candidate{
+		Class:   objClass,
+		PkgPath: path,
+		Name:    obj.Name(),
 	}
 }
 
+// candidateID returns the ID of the candidate name declared in the
+// package path, with receiver type receiver if it is a method.
+func candidateID(path, receiver, name string) string {
+	h := fnv.New64a()
+	for _, s := range []string{path, receiver, name} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// methodOrigin returns the interface type, starting at iface and
+// following embedded interfaces, that explicitly declares the method
+// obj. It returns nil if obj isn't a method of iface.
+func methodOrigin(iface types.Type, obj types.Object) types.Type {
+	// An alias doesn't declare anything, the interface it denotes does.
+	iface = lookdot.Unalias(iface)
+	it, ok := iface.Underlying().(*types.Interface)
+	if !ok {
+		return nil
+	}
+	// Compare by Id rather than identity so that methods of
+	// instantiated generic interfaces are found too.
+	for i, n := 0, it.NumExplicitMethods(); i < n; i++ {
+		if it.ExplicitMethod(i).Id() == obj.Id() {
+			return iface
+		}
+	}
+	for i, n := 0, it.NumEmbeddeds(); i < n; i++ {
+		if t := methodOrigin(it.EmbeddedType(i), obj); t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// builtinTypes holds pseudo-signatures for the built-in functions,
+// written as in the documentation of packages builtin and unsafe.
 var builtinTypes = map[string]string{
 	// Universe.
-	"append":  "func(slice []Type, elems ..Type) []Type",
+	"append":  "func(slice []Type, elems ...Type) []Type",
 	"cap":     "func(v Type) int",
+	"clear":   "func(t Type)",
 	"close":   "func(c chan<- Type)",
-	"complex": "func(real FloatType, imag FloatType) ComplexType",
+	"complex": "func(r FloatType, i FloatType) ComplexType",
 	"copy":    "func(dst []Type, src []Type) int",
 	"delete":  "func(m map[Key]Type, key Key)",
 	"imag":    "func(c ComplexType) FloatType",
 	"len":     "func(v Type) int",
-	"make":    "func(Type, size IntegerType) Type",
+	"make":    "func(t Type, size ...IntegerType) Type",
+	"max":     "func(x Type, y ...Type) Type",
+	"min":     "func(x Type, y ...Type) Type",
 	"new":     "func(Type) *Type",
 	"panic":   "func(v interface{})",
 	"print":   "func(args ...Type)",
@@ -165,9 +451,14 @@ var builtinTypes = map[string]string{
 	"recover": "func() interface{}",
 
 	// Package unsafe.
-	"Alignof":  "func(x Type) uintptr",
-	"Sizeof":   "func(x Type) uintptr",
-	"Offsetof": "func(x Type) uintptr",
+	"Add":        "func(ptr Pointer, len IntegerType) Pointer",
+	"Alignof":    "func(x Type) uintptr",
+	"Offsetof":   "func(x Type) uintptr",
+	"Sizeof":     "func(x Type) uintptr",
+	"Slice":      "func(ptr *Type, len IntegerType) []Type",
+	"SliceData":  "func(slice []Type) *Type",
+	"String":     "func(ptr *byte, len IntegerType) string",
+	"StringData": "func(str string) *byte",
 }
 
 func (b *candidateCollector) qualify(pkg *types.Package) string {
@@ -197,19 +488,50 @@ func (b *candidateCollector) qualify(pkg *types.Package) string {
 	return pkg.Name()
 }
 
+// qualifyType qualifies the packages of the types of candidates, as
+// opposed to the code they insert: by import path with fullPaths, as
+// qualify does otherwise.
+func (b *candidateCollector) qualifyType(pkg *types.Package) string {
+	if b.fullPaths && pkg != b.localpkg {
+		return pkg.Path()
+	}
+	return b.qualify(pkg)
+}
+
 func (b *candidateCollector) appendObject(obj types.Object) {
-	if obj.Pkg() != b.localpkg {
-		if obj.Parent() == types.Universe {
-			if !b.builtin {
-				return
-			}
-		} else if !obj.Exported() {
-			return
+	// The blank identifier, as in padding fields, can't be referred to.
+	if obj.Name() == "_" {
+		return
+	}
+	if obj.Parent() == types.Universe && !b.builtin {
+		if b.partial != "" {
+			// Only report the builtins typed, not the
+			// whole universe.
+			b.reject(obj, RejectBuiltin)
 		}
+		return
+	}
+	if !accessible(obj, b.localpkg) {
+		b.reject(obj, RejectInaccessible)
+		return
+	}
+	if !b.allowed(obj) {
+		b.reject(obj, RejectNotAllowed)
+		return
+	}
+
+	if !b.cgoInternals && isCgoInternal(obj.Name()) {
+		b.reject(obj, RejectCgo)
+		return
 	}
 
 	// TODO(mdempsky): Reconsider this functionality.
 	if b.filter != nil && !b.filter(obj) {
+		b.reject(obj, RejectClass)
+		return
+	}
+	if b.kinds != nil && !b.kinds(obj) {
+		b.reject(obj, RejectKind)
 		return
 	}
 	if !b.ignoreCase && (b.filter != nil || strings.HasPrefix(obj.Name(), b.partial)) {
@@ -218,3 +540,16 @@ func (b *candidateCollector) appendObject(obj types.Object) {
 		b.badcase = append(b.badcase, obj)
 	}
 }
+
+// cgoPrefixes are the prefixes of the identifiers generated by cgo.
+var cgoPrefixes = []string{"_Ctype_", "_Cfunc_", "_Cvar_", "_Cmacro_", "_C2func_", "_cgo_", "_Cgo_"}
+
+// isCgoInternal reports whether name was generated by cgo.
+func isCgoInternal(name string) bool {
+	for _, prefix := range cgoPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package suggest
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+)
+
+// chainDiagnostic returns the diagnostic refusing to complete at
+// cursor if it follows a selector chain of more than c.MaxChainLinks
+// links, and "" otherwise.
+func (c *Config) chainDiagnostic(data []byte, cursor int) string {
+	if c.MaxChainLinks <= 0 {
+		return ""
+	}
+	ctx, expr, _ := deduceCursorContext(data, cursor)
+	if ctx != selectContext {
+		return ""
+	}
+	// The selector being completed is a link too.
+	if n := chainLinks(expr) + 1; n > c.MaxChainLinks {
+		c.Logf("refusing to complete a selector chain of %d links", n)
+		return fmt.Sprintf("selector chain of %d links exceeds the limit of %d; not completing", n, c.MaxChainLinks)
+	}
+	return ""
+}
+
+// chainLinks returns the number of selectors, calls, index and slice
+// expressions and type assertions of the spine of the expression expr,
+// such as 3 for "(a.b()).c", or 0 if it doesn't parse.
+func chainLinks(expr string) int {
+	x, err := parser.ParseExpr(expr)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for {
+		switch e := x.(type) {
+		case *ast.SelectorExpr:
+			x = e.X
+		case *ast.CallExpr:
+			x = e.Fun
+		case *ast.IndexExpr:
+			x = e.X
+		case *ast.SliceExpr:
+			x = e.X
+		case *ast.TypeAssertExpr:
+			x = e.X
+		case *ast.ParenExpr:
+			x = e.X
+			continue
+		case *ast.StarExpr:
+			x = e.X
+			continue
+		default:
+			return n
+		}
+		n++
+	}
+}
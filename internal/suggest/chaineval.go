@@ -0,0 +1,131 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+
+	"github.com/mdempsky/gocode/internal/lookdot"
+)
+
+// linkCache memoizes, for a single completion at pos, the types of the
+// links of a selector chain and the members walked on them, which the
+// evaluation of a deep chain would otherwise compute again for every
+// link, and the candidates again for the operand.
+type linkCache struct {
+	fset    *token.FileSet
+	pkg     *types.Package
+	pos     token.Pos
+	tvs     map[string]linkResult
+	members lookdot.Cache
+}
+
+type linkResult struct {
+	tv  types.TypeAndValue
+	err error
+}
+
+func newLinkCache(fset *token.FileSet, pkg *types.Package, pos token.Pos) *linkCache {
+	return &linkCache{fset: fset, pkg: pkg, pos: pos, tvs: make(map[string]linkResult)}
+}
+
+// eval is types.Eval of expr at the position of the completion.
+func (l *linkCache) eval(expr string) (types.TypeAndValue, error) {
+	if r, ok := l.tvs[expr]; ok {
+		return r.tv, r.err
+	}
+	tv, err := types.Eval(l.fset, l.pkg, l.pos, expr)
+	l.tvs[expr] = linkResult{tv, err}
+	return tv, err
+}
+
+// looseOperandType returns the type of the value of expr, the operand
+// of a selector at pos, if types.Eval fails on it, such as a chain of
+// calls with an argument still being typed:
+//
+//	b.WithTimeout(d).WithRetries(n#).Build().
+//
+// The result of a call on the spine of expr is then that of the func
+// called, regardless of its arguments, and the members of a result are
+// looked up on its type: the methods of an instance of a generic type,
+// such as those of a builder returning *Builder[T], are those of the
+// instance. A generic func whose type arguments would be inferred from
+// the arguments has no result. It returns nil if expr isn't a value,
+// and whether the value is addressable.
+func looseOperandType(links *linkCache, expr string) (types.Type, bool) {
+	x, err := parser.ParseExpr(expr)
+	if err != nil {
+		return nil, false
+	}
+	return looseType(links, expr, x)
+}
+
+// looseType is looseOperandType for the subexpression x of expr.
+func looseType(links *linkCache, expr string, x ast.Expr) (types.Type, bool) {
+	// The positions of x are offsets in expr, from 1.
+	tv, err := links.eval(expr[x.Pos()-1 : x.End()-1])
+	if err == nil {
+		if !tv.IsValue() {
+			return nil, false
+		}
+		return tv.Type, tv.Addressable()
+	}
+
+	switch x := x.(type) {
+	case *ast.ParenExpr:
+		return looseType(links, expr, x.X)
+
+	case *ast.CallExpr:
+		if fun, _ := links.eval(expr[x.Fun.Pos()-1 : x.Fun.End()-1]); fun.IsType() {
+			// A conversion.
+			return fun.Type, false
+		}
+		typ, _ := looseType(links, expr, x.Fun)
+		if typ == nil {
+			return nil, false
+		}
+		sig, ok := typ.Underlying().(*types.Signature)
+		if !ok || isGenericFunc(sig) || sig.Results().Len() != 1 {
+			return nil, false
+		}
+		return sig.Results().At(0).Type(), false
+
+	case *ast.SelectorExpr:
+		typ, addressable := looseType(links, expr, x.X)
+		if typ == nil {
+			return nil, false
+		}
+		switch obj, _, indirect := types.LookupFieldOrMethod(typ, true, links.pkg, x.Sel.Name); obj := obj.(type) {
+		case *types.Var:
+			return obj.Type(), addressable || indirect
+		case *types.Func:
+			return obj.Type(), false
+		}
+
+	case *ast.StarExpr:
+		if typ, _ := looseType(links, expr, x.X); typ != nil {
+			if ptr, ok := typ.Underlying().(*types.Pointer); ok {
+				return ptr.Elem(), true
+			}
+		}
+
+	case *ast.IndexExpr:
+		typ, addressable := looseType(links, expr, x.X)
+		if typ == nil {
+			return nil, false
+		}
+		if ptr, ok := typ.Underlying().(*types.Pointer); ok {
+			typ, addressable = ptr.Elem(), true
+		}
+		switch u := typ.Underlying().(type) {
+		case *types.Slice:
+			return u.Elem(), true
+		case *types.Array:
+			return u.Elem(), addressable
+		case *types.Map:
+			return u.Elem(), false
+		}
+	}
+	return nil, false
+}
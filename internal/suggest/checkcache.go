@@ -0,0 +1,111 @@
+package suggest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io"
+)
+
+// maxCheckCache bounds the number of type-checked packages kept when
+// Config.CheckCache is set. Only the last few completions are likely
+// to be repeated.
+const maxCheckCache = 10
+
+// checkKey identifies the input of a type-check: the file being
+// completed, the text parsed for it, and the other files checked with
+// it.
+type checkKey [sha256.Size]byte
+
+// checkEntry is the result of a type-check kept in cache.checks.
+type checkEntry struct {
+	fset *token.FileSet
+	pkg  *types.Package
+	file *ast.File
+
+	// redeclared holds the diagnostics of the check.
+	redeclared []string
+
+	// imports holds the packages the check imported, from srcDir,
+	// by path, with nil for those that failed. The entry is only
+	// reused while the importer returns the same packages.
+	imports map[string]*types.Package
+	srcDir  string
+}
+
+// checkKeyFor returns the key of type-checking the package of
+// filename, parsed from src, with the other files others, which must
+// be in cache.files. src has the insertions made at the cursors, which
+// decide which function bodies are trimmed, so it stands for them;
+// others are those actually checked, after the index-only files not
+// needed are left out, which depends on Config.Prefix, Outline and
+// IndexOnlyLines, and after Config.Sandbox denied any.
+func checkKeyFor(filename string, src []byte, others []string) checkKey {
+	h := sha256.New()
+	writeString := func(s string) {
+		binary.Write(h, binary.LittleEndian, int64(len(s)))
+		io.WriteString(h, s)
+	}
+	writeString(filename)
+	writeString(string(src))
+	for _, other := range others {
+		writeString(other)
+		sum := cache.files[other].sum
+		h.Write(sum[:])
+	}
+	var key checkKey
+	h.Sum(key[:0])
+	return key
+}
+
+// valid reports whether the importer imp still returns the packages
+// the check of e imported.
+func (e *checkEntry) valid(imp types.Importer) bool {
+	return importsValid(imp, e.imports, e.srcDir)
+}
+
+// importsValid reports whether the importer imp still returns imports,
+// the packages a checkImporter recorded importing from srcDir.
+func importsValid(imp types.Importer, imports map[string]*types.Package, srcDir string) bool {
+	for path, want := range imports {
+		got, _ := importFrom(imp, path, srcDir)
+		if got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// checkImporter records the packages imported through it in
+// imports, for checkEntry.valid.
+type checkImporter struct {
+	imp     types.Importer
+	imports map[string]*types.Package
+	srcDir  string
+}
+
+func (r *checkImporter) Import(path string) (*types.Package, error) {
+	return r.ImportFrom(path, "", 0)
+}
+
+func (r *checkImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	pkg, err := importFrom(r.imp, path, srcDir)
+	if err != nil {
+		r.imports[path] = nil
+	} else {
+		r.imports[path] = pkg
+	}
+	r.srcDir = srcDir
+	return pkg, err
+}
+
+// importFrom imports path from srcDir with imp, ignoring srcDir if
+// imp doesn't support it.
+func importFrom(imp types.Importer, path, srcDir string) (*types.Package, error) {
+	if from, ok := imp.(types.ImporterFrom); ok && srcDir != "" {
+		return from.ImportFrom(path, srcDir, 0)
+	}
+	return imp.Import(path)
+}
@@ -0,0 +1,116 @@
+package suggest_test
+
+import (
+	"fmt"
+	"go/importer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestCheckCache(t *testing.T) {
+	dir := writeGeneratedPackage(t, 20)
+
+	var reused bool
+	cfg := suggest.Config{
+		Importer:   importer.Default(),
+		CheckCache: true,
+		Logf: func(format string, args ...interface{}) {
+			if strings.HasPrefix(format, "reusing type-checked package") {
+				reused = true
+			}
+		},
+	}
+	filename := filepath.Join(dir, "foo.go")
+	complete := func(src string) []string {
+		reused = false
+		src, cursors := cutCursors(src)
+		candidates, _ := cfg.Suggest(filename, []byte(src), cursors[0])
+		var names []string
+		for _, c := range candidates {
+			names = append(names, c.Name)
+		}
+		return names
+	}
+
+	src := "package foo\n\nfunc f(l *Local) {\n\tl.@\n}\n"
+	for i, want := range []bool{false, true, true} {
+		if got := complete(src); len(got) != 1 || got[0] != "Generated" {
+			t.Fatalf("completion %d: got %q, want [Generated]", i, got)
+		}
+		if reused != want {
+			t.Errorf("completion %d: reused %v, want %v", i, reused, want)
+		}
+	}
+
+	// Editing the buffer or moving the cursor type-checks again.
+	complete("package foo\n\nfunc f(l *Local) {\n\tl.@\n}\n\nvar x int\n")
+	if reused {
+		t.Errorf("reused the package after an edit")
+	}
+	complete("package foo\n\nfunc f(l *Local) {\n\tl.@\n\n}\n")
+	if reused {
+		t.Errorf("reused the package after moving the cursor")
+	}
+
+	// So does changing another file of the package.
+	other := filepath.Join(dir, "local_gen.go")
+	if err := ioutil.WriteFile(other, []byte("package foo\n\nfunc (l *Local) Changed() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(other, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := complete(src); len(got) != 1 || got[0] != "Changed" {
+		t.Errorf("after changing %s: got %q, want [Changed]", other, got)
+	}
+	if reused {
+		t.Errorf("reused the package after changing %s", other)
+	}
+
+	// A different importer may return different packages.
+	cfg.Importer = importer.Default()
+	complete(src)
+	if reused {
+		t.Errorf("reused the package with another importer")
+	}
+
+	// Leaving out index-only files checks other files.
+	src = "package foo\n\nvar zzz int\n\nfunc f() {\n\tzz@\n}\n"
+	complete(src)
+	cfg.IndexOnlyLines = 100
+	complete(src)
+	if reused {
+		t.Errorf("reused the package with index-only files")
+	}
+	complete(src)
+	if !reused {
+		t.Errorf("didn't reuse the package with the same index-only files")
+	}
+}
+
+// BenchmarkCheckCache completes repeatedly at the same cursor of an
+// unchanged buffer in a package with a large file.
+func BenchmarkCheckCache(b *testing.B) {
+	dir := writeGeneratedPackage(b, 1000)
+	src, cursors := cutCursors("package foo\n\nfunc f() {\n\tvar u Used\n\tu.@\n}\n")
+
+	for _, checkCache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%v", checkCache), func(b *testing.B) {
+			cfg := suggest.Config{
+				Importer:   importer.Default(),
+				CheckCache: checkCache,
+				Logf:       func(string, ...interface{}) {},
+			}
+			for i := 0; i < b.N; i++ {
+				cfg.Suggest(filepath.Join(dir, "foo.go"), []byte(src), cursors[0])
+			}
+		})
+	}
+}
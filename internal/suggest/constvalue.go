@@ -0,0 +1,79 @@
+package suggest
+
+import (
+	"go/constant"
+	"go/types"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/mdempsky/gocode/format"
+)
+
+// maxConstValue is the maximum length, in characters, of the value
+// reported for a const candidate.
+const maxConstValue = 64
+
+// ConstValue describes the value of a const candidate.
+type ConstValue = format.ConstValue
+
+// constValue returns the value of obj if it is a constant whose value
+// is known, and nil otherwise.
+func constValue(obj types.Object) *ConstValue {
+	c, ok := obj.(*types.Const)
+	if !ok {
+		return nil
+	}
+	v := c.Val()
+	var s string
+	switch v.Kind() {
+	case constant.Bool, constant.Int:
+		s = v.ExactString()
+	case constant.String:
+		// StringVal is cheap, even for huge strings built by
+		// concatenation, unlike quoting the whole of it.
+		s = quoteTruncated(constant.StringVal(v), maxConstValue)
+	case constant.Float:
+		// Rationals such as 1.0/3 are shown as the closest
+		// float64, unless it isn't finite.
+		if f, _ := constant.Float64Val(v); !math.IsInf(f, 0) {
+			s = strconv.FormatFloat(f, 'g', -1, 64)
+		} else {
+			s = v.String()
+		}
+	case constant.Complex:
+		s = v.String()
+	default:
+		// An unknown value, such as that of an invalid constant.
+		return nil
+	}
+	if utf8.RuneCountInString(s) > maxConstValue {
+		s = string([]rune(s)[:maxConstValue])
+	}
+	typed := true
+	if b, ok := c.Type().(*types.Basic); ok && b.Info()&types.IsUntyped != 0 {
+		typed = false
+	}
+	return &ConstValue{Value: s, Typed: typed}
+}
+
+// quoteTruncated returns s quoted, cut short on a character boundary
+// if needed for the quoted string to be at most maxLen characters long.
+func quoteTruncated(s string, maxLen int) string {
+	// Each character of s takes one character quoted, at least.
+	n := 0
+	for i := range s {
+		if n == maxLen {
+			s = s[:i]
+			break
+		}
+		n++
+	}
+	q := strconv.Quote(s)
+	for utf8.RuneCountInString(q) > maxLen {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+		q = strconv.Quote(s)
+	}
+	return q
+}
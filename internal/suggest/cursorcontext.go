@@ -61,6 +61,19 @@ func (ti *tokenIterator) prev() bool {
 	return true
 }
 
+// skipPartial moves ti before the identifier or keyword being typed at
+// the cursor, which is off bytes past the start of the current token,
+// if any. It reports whether a token is left to look at.
+func (ti *tokenIterator) skipPartial(off int) bool {
+	if len(ti.tokens) == 0 {
+		return false
+	}
+	if tok := ti.token(); (tok.tok == token.IDENT || tok.tok.IsKeyword()) && off <= len(tok.String()) {
+		return ti.prev()
+	}
+	return true
+}
+
 var bracket_pairs_map = map[token.Token]token.Token{
 	token.RPAREN: token.LPAREN,
 	token.RBRACK: token.LBRACK,
@@ -202,9 +215,14 @@ loop:
 			return joinTokens(ti.tokens[:orig])
 		}
 		switch ti.token().tok {
+		case token.COMMENT:
+			// Comments may come between the links of a
+			// chain split across lines.
+			continue
 		case token.PERIOD:
-			// If the '.' is not followed by IDENT, it's invalid.
-			if prev != token.IDENT {
+			// If the '.' is not followed by IDENT, or by '(' of
+			// a type assertion, it's invalid.
+			if prev != token.IDENT && prev != token.LPAREN {
 				break loop
 			}
 		case token.IDENT:
@@ -245,8 +263,11 @@ loop:
 // expression.
 func joinTokens(tokens []tokenItem) string {
 	var buf bytes.Buffer
-	for i, tok := range tokens {
-		if i > 0 {
+	for _, tok := range tokens {
+		if tok.tok == token.COMMENT {
+			continue
+		}
+		if buf.Len() > 0 {
 			buf.WriteByte(' ')
 		}
 		buf.WriteString(tok.String())
@@ -262,6 +283,7 @@ const (
 	selectContext
 	compositeLiteralContext
 	importContext
+	typeAssertContext
 )
 
 func deduceCursorContext(file []byte, cursor int) (cursorContext, string, string) {
@@ -302,6 +324,184 @@ func deduceCursorContext(file []byte, cursor int) (cursorContext, string, string
 		// &Struct{Hello: 1, Wor#} // (# - the cursor)
 		// Let's try to find the struct type
 		return compositeLiteralContext, iter.extractLiteralType(), partial
+	case token.LPAREN:
+		// A type assertion: x.(Typ#
+		if iter.prev() && iter.token().tok == token.PERIOD {
+			return typeAssertContext, iter.extractExpr(), partial
+		}
 	}
 	return unknownContext, "", partial
 }
+
+// atDeclStart reports whether the cursor, ignoring any partial
+// identifier, is at the start of the file or right after a semicolon,
+// explicit or automatic, where a declaration may start.
+func atDeclStart(file []byte, cursor int) bool {
+	iter, off := newTokenIterator(file, cursor)
+	if !iter.skipPartial(off) {
+		return true
+	}
+	for iter.token().tok == token.COMMENT {
+		if !iter.prev() {
+			return true
+		}
+	}
+	return iter.token().tok == token.SEMICOLON
+}
+
+// afterPeriod reports whether the cursor is right after a period,
+// with no selector typed yet.
+func afterPeriod(file []byte, cursor int) bool {
+	iter, off := newTokenIterator(file, cursor)
+	return len(iter.tokens) > 0 && iter.token().tok == token.PERIOD && off == 1
+}
+
+// afterDeferOrGo reports whether the cursor is at the start of the
+// expression of a defer or go statement.
+func afterDeferOrGo(file []byte, cursor int) bool {
+	iter, off := newTokenIterator(file, cursor)
+	if len(iter.tokens) == 0 {
+		return false
+	}
+	if tok := iter.token(); tok.tok.IsKeyword() && off <= len(tok.String()) {
+		// Still typing the keyword itself.
+		return false
+	}
+	if !iter.skipPartial(off) {
+		return false
+	}
+	switch iter.token().tok {
+	case token.DEFER, token.GO:
+		return true
+	}
+	return false
+}
+
+// deduceIndexExpr reports whether the cursor is right after the '[' of
+// an index expression, and if so returns the indexed expression.
+func deduceIndexExpr(file []byte, cursor int) (string, bool) {
+	iter, off := newTokenIterator(file, cursor)
+	if !iter.skipPartial(off) {
+		return "", false
+	}
+	if iter.token().tok != token.LBRACK {
+		return "", false
+	}
+	x := iter.extractExpr()
+	return x, x != ""
+}
+
+// deduceTypeArg reports whether the cursor, ignoring any partial
+// identifier and a package qualifier, is right after the '(' of a call
+// of an identifier, as in "new(" or "make(pkg.", and if so returns the
+// identifier.
+func deduceTypeArg(file []byte, cursor int) (string, bool) {
+	iter, off := newTokenIterator(file, cursor)
+	if !iter.skipPartial(off) {
+		return "", false
+	}
+	if iter.token().tok == token.PERIOD {
+		// Skip the package qualifier.
+		if !iter.prev() || iter.token().tok != token.IDENT || !iter.prev() {
+			return "", false
+		}
+	}
+	if iter.token().tok != token.LPAREN || !iter.prev() || iter.token().tok != token.IDENT {
+		return "", false
+	}
+	return iter.token().String(), true
+}
+
+// deduceCallArg reports whether the cursor is within the arguments of
+// a function call, and if so returns the called expression and the
+// index of the argument at the cursor.
+func deduceCallArg(file []byte, cursor int) (string, int, bool) {
+	iter, off := newTokenIterator(file, cursor)
+	if !iter.skipPartial(off) {
+		return "", 0, false
+	}
+
+	arg := 0
+	for {
+		switch iter.token().tok {
+		case token.COMMA:
+			arg++
+		case token.LPAREN:
+			fn := iter.extractExpr()
+			return fn, arg, fn != ""
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			if !iter.skipToBalancedPair() {
+				return "", 0, false
+			}
+		case token.LBRACK, token.LBRACE, token.SEMICOLON:
+			return "", 0, false
+		}
+		if !iter.prev() {
+			return "", 0, false
+		}
+	}
+}
+
+// afterParamName reports whether the cursor, ignoring any partial
+// identifier, follows the name of a parameter in a list opened by '['
+// or separated by ',', as in "[T " or ", V ". Only type parameter
+// lists are opened by '[', so callers need to check for one.
+func afterParamName(file []byte, cursor int) bool {
+	iter, off := newTokenIterator(file, cursor)
+	if !iter.skipPartial(off) {
+		return false
+	}
+	if iter.token().tok != token.IDENT || !iter.prev() {
+		return false
+	}
+	switch iter.token().tok {
+	case token.LBRACK, token.COMMA:
+		return true
+	}
+	return false
+}
+
+// deduceAssignTarget reports whether the cursor is right after the '='
+// of a var declaration with a type or of an assignment to a single
+// operand, and if so returns the declared type or the operand.
+// Examples (# - the cursor):
+//   var _ io.Reader = #   // returns "io.Reader"
+//   s.w = #               // returns "s.w"
+func deduceAssignTarget(file []byte, cursor int) (string, bool) {
+	iter, off := newTokenIterator(file, cursor)
+	if !iter.skipPartial(off) {
+		return "", false
+	}
+	if iter.token().tok != token.ASSIGN || !iter.prev() {
+		return "", false
+	}
+	end := iter.pos + 1
+	for {
+		switch iter.token().tok {
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			if !iter.skipToBalancedPair() {
+				return "", false
+			}
+		case token.COMMA, token.DEFINE:
+			return "", false
+		case token.SEMICOLON, token.LBRACE, token.LPAREN, token.VAR:
+			lhs := iter.tokens[iter.pos+1 : end]
+			isVar := iter.token().tok == token.VAR
+			if iter.token().tok == token.LPAREN && iter.prev() {
+				// A var group.
+				isVar = iter.token().tok == token.VAR
+			}
+			if isVar {
+				// Skip the name being declared.
+				if len(lhs) < 2 || lhs[0].tok != token.IDENT {
+					return "", false
+				}
+				lhs = lhs[1:]
+			}
+			return joinTokens(lhs), len(lhs) > 0
+		}
+		if !iter.prev() {
+			return "", false
+		}
+	}
+}
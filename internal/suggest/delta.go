@@ -0,0 +1,78 @@
+package suggest
+
+import (
+	"encoding/json"
+
+	"github.com/mdempsky/gocode/format"
+)
+
+// Delta describes how to turn one candidate list into another.
+type Delta = format.Delta
+
+// AddedCandidate is a candidate inserted at Index of the new list.
+type AddedCandidate = format.AddedCandidate
+
+// Diff returns the Delta from old to new.
+func Diff(old, new []Candidate) Delta {
+	at := make(map[string][]int)
+	for i, c := range old {
+		k := candidateKey(c)
+		at[k] = append(at[k], i)
+	}
+
+	// Keep candidates that appear in both lists in the same
+	// relative order; everything else is removed or added.
+	kept := make([]bool, len(old))
+	var d Delta
+	last := -1
+	for i, c := range new {
+		k := candidateKey(c)
+		idx := at[k]
+		for len(idx) > 0 && idx[0] <= last {
+			idx = idx[1:]
+		}
+		if len(idx) == 0 {
+			d.Added = append(d.Added, AddedCandidate{Index: i, Candidate: c})
+			continue
+		}
+		last = idx[0]
+		at[k] = idx[1:]
+		kept[last] = true
+	}
+	for i, k := range kept {
+		if !k {
+			d.Removed = append(d.Removed, i)
+		}
+	}
+	return d
+}
+
+// ApplyDelta returns the candidate list described by applying d to old.
+func ApplyDelta(old []Candidate, d Delta) []Candidate {
+	res := make([]Candidate, 0, len(old)-len(d.Removed)+len(d.Added))
+	removed := d.Removed
+	for i, c := range old {
+		if len(removed) > 0 && removed[0] == i {
+			removed = removed[1:]
+			continue
+		}
+		res = append(res, c)
+	}
+	for _, a := range d.Added {
+		res = append(res, Candidate{})
+		copy(res[a.Index+1:], res[a.Index:])
+		res[a.Index] = a.Candidate
+	}
+	return res
+}
+
+// candidateKey identifies c by the json it is sent as, which holds
+// the values of its pointer fields, such as Const, rather than their
+// addresses.
+func candidateKey(c Candidate) string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,58 @@
+package suggest_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	c := func(name string) suggest.Candidate {
+		return suggest.Candidate{Class: "var", Name: name, Type: "int"}
+	}
+	tests := []struct {
+		old, new []suggest.Candidate
+	}{
+		{nil, nil},
+		{nil, []suggest.Candidate{c("a")}},
+		{[]suggest.Candidate{c("a"), c("ab"), c("abc")}, []suggest.Candidate{c("ab"), c("abc")}},
+		{[]suggest.Candidate{c("a"), c("b")}, []suggest.Candidate{c("b"), c("a")}},
+		{[]suggest.Candidate{c("a"), c("a"), c("b")}, []suggest.Candidate{c("a"), c("c"), c("b"), c("a")}},
+		{[]suggest.Candidate{c("x"), c("y")}, nil},
+	}
+	for _, test := range tests {
+		d := suggest.Diff(test.old, test.new)
+		got := suggest.ApplyDelta(test.old, d)
+		if len(got) == 0 && len(test.new) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.new) {
+			t.Errorf("ApplyDelta(%v, Diff(%v, %v)) = %v", test.old, test.old, test.new, got)
+		}
+	}
+
+	// Narrowing the prefix should only remove candidates.
+	d := suggest.Diff(tests[2].old, tests[2].new)
+	if len(d.Added) != 0 || !reflect.DeepEqual(d.Removed, []int{0}) {
+		t.Errorf("narrowing: got %+v", d)
+	}
+}
+
+func TestDeltaPointerFields(t *testing.T) {
+	// The same candidates, with their pointer fields allocated anew
+	// by each request, are unchanged.
+	c := func() suggest.Candidate {
+		return suggest.Candidate{
+			Class:   "const",
+			Name:    "MaxConns",
+			Type:    "int",
+			Const:   &suggest.ConstValue{Value: "8", Typed: true},
+			Explain: &suggest.Explanation{Match: "prefix"},
+		}
+	}
+	d := suggest.Diff([]suggest.Candidate{c()}, []suggest.Candidate{c()})
+	if len(d.Added) != 0 || len(d.Removed) != 0 {
+		t.Errorf("got %+v, want an empty delta", d)
+	}
+}
@@ -0,0 +1,78 @@
+package suggest
+
+import (
+	"fmt"
+	"go/types"
+	"sync"
+
+	"github.com/mdempsky/gocode/internal/lookdot"
+)
+
+// maxDetails bounds the number of cached type summaries.
+const maxDetails = 1000
+
+// details caches the summaries of type candidates, which are
+// recomputed for the same imported types on every request otherwise.
+var details = struct {
+	sync.Mutex
+	m map[detailKey]string
+}{m: make(map[detailKey]string)}
+
+type detailKey struct {
+	obj       *types.TypeName
+	fullPaths bool
+}
+
+// typeDetail returns a summary of the type declared by obj, such as
+// "struct with 2 fields". The types of other packages it mentions are
+// qualified by import path with fullPaths, and by name otherwise.
+func typeDetail(obj *types.TypeName, fullPaths bool) string {
+	details.Lock()
+	defer details.Unlock()
+	key := detailKey{obj, fullPaths}
+	if d, ok := details.m[key]; ok {
+		return d
+	}
+	if len(details.m) >= maxDetails {
+		details.m = make(map[detailKey]string)
+	}
+	d := summarizeType(obj, fullPaths)
+	details.m[key] = d
+	return d
+}
+
+func summarizeType(obj *types.TypeName, fullPaths bool) string {
+	qualify := func(pkg *types.Package) string {
+		switch {
+		case pkg == obj.Pkg():
+			return ""
+		case fullPaths:
+			return pkg.Path()
+		}
+		return pkg.Name()
+	}
+	if obj.IsAlias() {
+		return "alias for " + types.TypeString(lookdot.Unalias(obj.Type()), qualify)
+	}
+
+	var d string
+	switch t := obj.Type().Underlying().(type) {
+	case *types.Struct:
+		d = "struct with " + plural(t.NumFields(), "field")
+	case *types.Interface:
+		d = "interface with " + plural(t.NumMethods(), "method")
+	default:
+		d = types.TypeString(t, qualify)
+	}
+	if tparams := typeParams(obj.Type(), qualify); tparams != "" {
+		d = "generic " + d + " " + tparams
+	}
+	return d
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
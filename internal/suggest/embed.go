@@ -0,0 +1,107 @@
+package suggest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// embedPatternAt returns the part of the //go:embed pattern typed
+// before the cursor, without an "all:" prefix or an opening quote, if
+// the cursor is in the patterns of such a directive.
+func embedPatternAt(data []byte, cursor int) (string, bool) {
+	line := data[bytes.LastIndexByte(data[:cursor], '\n')+1 : cursor]
+	line = bytes.TrimLeft(line, " \t")
+	if !bytes.HasPrefix(line, []byte("//go:embed")) {
+		return "", false
+	}
+	line = line[len("//go:embed"):]
+	if len(line) == 0 || (line[0] != ' ' && line[0] != '\t') {
+		return "", false
+	}
+
+	// Patterns are separated by spaces, unless quoted.
+	start := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch ch := line[i]; {
+		case quote != 0:
+			if ch == quote {
+				// The cursor is past a closed quote.
+				quote, start = 0, -1
+			}
+		case ch == ' ' || ch == '\t':
+			start = i + 1
+		case (ch == '"' || ch == '`') && i == start:
+			quote, start = ch, i+1
+		}
+	}
+	if start < 0 {
+		return "", false
+	}
+	typed := strings.TrimPrefix(string(line[start:]), "all:")
+	if quote == '"' && strings.Contains(typed, `\`) {
+		// Escapes aren't worth unquoting for file names.
+		return "", false
+	}
+	return typed, true
+}
+
+// embedCandidates proposes the files and directories of the package
+// directory dir, or of the directory below it typed before the cursor,
+// whose names start with the rest of typed, for the //go:embed
+// pattern of which typed was typed. Those that can't be embedded, such
+// as symbolic links and the directories of other modules, are left
+// out, as are those whose names start with "." or "_", which patterns
+// only match when named, unless typed names them.
+func (c *Config) embedCandidates(dir, typed string, data []byte, cursor int) Result {
+	sub, prefix := "", typed
+	if i := strings.LastIndex(typed, "/"); i >= 0 {
+		sub, prefix = typed[:i+1], typed[i+1:]
+	}
+	if strings.HasPrefix(sub, "/") || strings.Contains("/"+sub, "/../") || strings.Contains("/"+sub, "/./") {
+		// Patterns can't leave the package directory.
+		return Result{}
+	}
+	dir = filepath.Join(dir, filepath.FromSlash(sub))
+
+	readDir := ioutil.ReadDir
+	if c.Sandbox != nil {
+		readDir = c.Sandbox.ReadDir
+	}
+	infos, err := readDir(dir)
+	if err != nil {
+		return Result{}
+	}
+	hidden := strings.HasPrefix(prefix, ".") || strings.HasPrefix(prefix, "_")
+	var res []Candidate
+	for _, info := range infos {
+		name := info.Name()
+		if !c.matchImportPath(name, prefix) || strings.ContainsAny(name, "\"*<>?`'|\\:") {
+			continue
+		}
+		if !hidden && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+			continue
+		}
+		cand := nameCandidate("embed", path.Join(sub, name))
+		switch {
+		case info.IsDir():
+			if _, err := c.stat(filepath.Join(dir, name, "go.mod")); err == nil {
+				// Another module.
+				continue
+			}
+			cand.Type = "dir"
+		case !info.Mode().IsRegular():
+			continue
+		}
+		res = append(res, cand)
+	}
+	if len(res) == 0 {
+		return Result{}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return Result{Candidates: res, Len: len(typed), Replace: ReplaceRange(data, cursor, len(typed))}
+}
@@ -0,0 +1,230 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// excludedImporter serves the imports of the file being completed. If
+// the file doesn't match the build constraints of c.BuildContext, such
+// as a _windows.go file edited on Linux, the package it is checked
+// with is made of the other files matching the variants of the context
+// it matches, see matchContexts, and the imports of the files left out
+// are dropped with them. The imports of the file itself still resolve:
+// one the importer fails to import, such as a Windows-only package, is
+// type-checked from the files of its directory these variants select.
+// The other imports are left to imp.
+type excludedImporter struct {
+	c        *Config
+	imp      types.Importer
+	filename string
+	data     []byte
+	paths    map[string]bool // the imports of the file
+
+	// ctxs are the variants of c.BuildContext the file matches,
+	// once matched is set.
+	ctxs    []*build.Context
+	matched bool
+}
+
+func newExcludedImporter(c *Config, imp types.Importer, filename string, data []byte, file *ast.File) *excludedImporter {
+	paths := make(map[string]bool)
+	for _, spec := range file.Imports {
+		if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+			paths[path] = true
+		}
+	}
+	return &excludedImporter{c: c, imp: imp, filename: filename, data: data, paths: paths}
+}
+
+func (i *excludedImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, "", 0)
+}
+
+func (i *excludedImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	pkg, err := importFrom(i.imp, path, srcDir)
+	if !i.paths[path] {
+		return pkg, err
+	}
+	// Importers may return an empty package for one whose files
+	// are all excluded.
+	if err == nil && pkg != nil && pkg.Scope().Len() > 0 {
+		return pkg, nil
+	}
+	if srcDir == "" {
+		srcDir = filepath.Dir(i.filename)
+	}
+	if excluded := i.importExcluded(path, srcDir); excluded != nil {
+		return excluded, nil
+	}
+	return pkg, err
+}
+
+// maxExcludedPackages bounds the number of packages kept in
+// excludedPackages.
+const maxExcludedPackages = 50
+
+// excludedPackages caches the packages type-checked by importExcluded,
+// which would be checked again on every request otherwise.
+var excludedPackages = struct {
+	sync.Mutex
+	m map[excludedKey]*excludedEntry
+}{m: make(map[excludedKey]*excludedEntry)}
+
+// excludedKey identifies a package type-checked by importExcluded: its
+// import path and the files it was checked from.
+type excludedKey struct {
+	path  string
+	files string
+}
+
+type excludedEntry struct {
+	fset  *token.FileSet
+	pkg   *types.Package
+	mtime time.Time // the latest of the files
+
+	// imports holds the packages the check imported, from srcDir,
+	// as for checkEntry.
+	imports map[string]*types.Package
+	srcDir  string
+}
+
+// importExcluded type-checks the package path, imported from srcDir,
+// from the files the variants of the context the file being completed
+// matches select, and returns nil if the file matches c.BuildContext,
+// or if they select none. The errors of the check, such as the imports
+// its trimmed bodies no longer use, are ignored.
+func (i *excludedImporter) importExcluded(path, srcDir string) *types.Package {
+	if !i.matched {
+		var variants bool
+		i.ctxs, variants = i.c.matchContexts(i.filename, i.data)
+		if !variants {
+			// The import fails in the build of the file.
+			i.ctxs = nil
+		}
+		i.matched = true
+	}
+	if i.ctxs == nil {
+		return nil
+	}
+
+	ctx := *i.c.BuildContext
+	found, err := ctx.Import(path, srcDir, build.FindOnly)
+	if err != nil {
+		return nil
+	}
+	if i.c.Sandbox != nil {
+		if err := i.c.Sandbox.Check(found.Dir); err != nil {
+			i.c.Logf("%v", err)
+			return nil
+		}
+	}
+	for _, ctx := range i.ctxs {
+		bp, err := ctx.ImportDir(found.Dir, 0)
+		if err != nil || len(bp.GoFiles)+len(bp.CgoFiles) == 0 {
+			continue
+		}
+		var files []string
+		for _, name := range append(bp.GoFiles, bp.CgoFiles...) {
+			files = append(files, filepath.Join(bp.Dir, name))
+		}
+		i.c.Logf("%s isn't built with the build constraints, importing it as built with those of %s", path, i.filename)
+		return i.check(path, files)
+	}
+	return nil
+}
+
+// check type-checks the package path from files, or returns it from
+// excludedPackages if none of them changed since.
+func (i *excludedImporter) check(path string, files []string) *types.Package {
+	var mtime time.Time
+	for _, filename := range files {
+		if i.c.Sandbox != nil {
+			if err := i.c.Sandbox.Check(filename); err != nil {
+				return nil
+			}
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return nil
+		}
+		if fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	key := excludedKey{path, strings.Join(files, "\x00")}
+
+	cache.lock.Lock()
+	fset := cache.fset
+	cache.lock.Unlock()
+	excludedPackages.Lock()
+	e := excludedPackages.m[key]
+	excludedPackages.Unlock()
+	if e != nil && e.fset == fset && e.mtime.Equal(mtime) && importsValid(i.imp, e.imports, e.srcDir) {
+		return e.pkg
+	}
+
+	i.c.Logf("type-checking %s from %d files", path, len(files))
+	var parsed []*ast.File
+	complete := true
+	cache.lock.Lock()
+	fset = cache.fset
+	for _, filename := range files {
+		var src []byte
+		var err error
+		if i.c.Sandbox != nil {
+			src, err = i.c.Sandbox.ReadFile(filename)
+		} else {
+			src, err = ioutil.ReadFile(filename)
+		}
+		if err != nil {
+			i.c.Logf("%v", err)
+			complete = false
+			continue
+		}
+		if f, _ := parser.ParseFile(fset, filename, src, 0); f != nil {
+			trimAST(f)
+			parsed = append(parsed, f)
+		}
+	}
+	cache.lock.Unlock()
+
+	record := &checkImporter{imp: i.imp, imports: make(map[string]*types.Package)}
+	cfg := types.Config{
+		Importer:    record,
+		FakeImportC: true,
+		Error:       func(err error) {},
+	}
+	pkg, _ := cfg.Check(path, fset, parsed, nil)
+	if !complete {
+		return pkg
+	}
+
+	excludedPackages.Lock()
+	// Delete random entries to keep at most maxExcludedPackages.
+	for k := range excludedPackages.m {
+		if len(excludedPackages.m) < maxExcludedPackages {
+			break
+		}
+		delete(excludedPackages.m, k)
+	}
+	excludedPackages.m[key] = &excludedEntry{
+		fset:    fset,
+		pkg:     pkg,
+		mtime:   mtime,
+		imports: record.imports,
+		srcDir:  record.srcDir,
+	}
+	excludedPackages.Unlock()
+	return pkg
+}
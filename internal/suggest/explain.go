@@ -0,0 +1,74 @@
+package suggest
+
+import (
+	"go/types"
+	"strings"
+
+	"github.com/mdempsky/gocode/format"
+)
+
+// Reasons a symbol whose name matches the identifier typed isn't
+// proposed, see Rejection.
+const (
+	RejectInaccessible  = "inaccessible"    // unexported, and of another package
+	RejectClass         = "class mismatch"  // not of the class typed, such as "func"
+	RejectCase          = "case mismatch"   // matches ignoring case only, and others match exactly
+	RejectBuiltin       = "builtin"         // predeclared, without Config.Builtin
+	RejectCgo           = "cgo internal"    // generated by cgo, without Config.CgoInternals
+	RejectUnaddressable = "unaddressable"   // a pointer method of an unaddressable value
+	RejectBudget        = "budget exceeded" // cut by Truncate
+	RejectNotAllowed    = "not allowed"     // of a package outside Config.AllowedPackages
+	RejectKind          = "kind mismatch"   // not of a kind the context takes, such as a struct type in make(
+)
+
+// maxRejections bounds the number of rejections of a Result, those
+// of the collector and those of Truncate together.
+const maxRejections = 100
+
+// Explanation tells why a candidate is proposed where it is listed. It
+// is only set with Config.Explain.
+type Explanation = format.Explanation
+
+// A Rejection is a symbol that isn't proposed, and why. Rejections
+// are only collected with Config.Explain.
+type Rejection = format.Rejection
+
+// Rejected appends to res the rejections of candidates for reason, as
+// long as res holds fewer than maxRejections.
+func Rejected(res []Rejection, candidates []Candidate, reason string) []Rejection {
+	if n := maxRejections - len(res); len(candidates) > n {
+		candidates = candidates[:max(n, 0)]
+	}
+	for _, c := range candidates {
+		res = append(res, Rejection{Name: c.Name, PkgPath: c.PkgPath, Class: c.Class, Reason: reason})
+	}
+	return res
+}
+
+// reject records that obj isn't proposed for reason, if b explains its
+// candidates and obj matches the identifier typed.
+func (b *candidateCollector) reject(obj types.Object, reason string) {
+	if !b.explain || len(b.rejections) >= maxRejections {
+		return
+	}
+	if !strings.HasPrefix(strings.ToLower(obj.Name()), strings.ToLower(b.partial)) {
+		return
+	}
+	path := "builtin"
+	if pkg := obj.Pkg(); pkg != nil {
+		path = pkg.Path()
+	}
+	b.rejections = append(b.rejections, Rejection{
+		Name:    obj.Name(),
+		PkgPath: path,
+		Class:   classifyObject(obj),
+		Reason:  reason,
+	})
+}
+
+// explanation returns the explanation of c, the candidate of an object
+// matched as match, which fits the context of the cursor if boosted.
+func (b *candidateCollector) explanation(c Candidate, match string, boosted bool) *Explanation {
+	refs, rank := b.rank(c)
+	return &Explanation{Match: match, FitsContext: boosted, References: refs, Rank: rank}
+}
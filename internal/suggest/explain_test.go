@@ -0,0 +1,138 @@
+package suggest_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestExplain(t *testing.T) {
+	const decls = `package a
+
+import "b"
+
+type V struct{}
+
+func (*V) Ptr() {}
+func (V) Val()  {}
+
+func f(m map[string]int, vs map[int]V, x b.T) {
+	var Alpha, alpha2, key string
+	var lenient int
+	_, _, _, _ = Alpha, alpha2, key, lenient
+	`
+	b := checkPackage(t, "b", nil, accessSrc)
+	cfg := suggest.Config{
+		Importer: mapImporter{"b": b},
+		Logf:     t.Logf,
+		Explain:  true,
+		ReferenceCount: func(path, name string) int {
+			if path == "b" && name == "F" {
+				return 3
+			}
+			return 0
+		},
+		ReferenceWeight: 1,
+	}
+	for _, test := range []struct {
+		src        string
+		explained  map[string]suggest.Explanation
+		rejections []suggest.Rejection
+	}{
+		{
+			src: "_ = m[@]",
+			explained: map[string]suggest.Explanation{
+				"key":     {Match: "prefix", FitsContext: true},
+				"lenient": {Match: "prefix"},
+			},
+		},
+		{
+			src:        "_ = alp@",
+			explained:  map[string]suggest.Explanation{"alpha2": {Match: "prefix"}},
+			rejections: []suggest.Rejection{{Name: "Alpha", PkgPath: "", Class: "var", Reason: suggest.RejectCase}},
+		},
+		{
+			src:        "_ = le@",
+			explained:  map[string]suggest.Explanation{"lenient": {Match: "prefix"}},
+			rejections: []suggest.Rejection{{Name: "len", PkgPath: "builtin", Class: "func", Reason: suggest.RejectBuiltin}},
+		},
+		{
+			src:       "_ = b.@",
+			explained: map[string]suggest.Explanation{"F": {Match: "prefix", References: 3, Rank: 2}, "V": {Match: "prefix"}},
+			rejections: []suggest.Rejection{
+				{Name: "c", PkgPath: "b", Class: "const", Reason: suggest.RejectInaccessible},
+				{Name: "f", PkgPath: "b", Class: "func", Reason: suggest.RejectInaccessible},
+				{Name: "t", PkgPath: "b", Class: "type", Reason: suggest.RejectInaccessible},
+				{Name: "v", PkgPath: "b", Class: "var", Reason: suggest.RejectInaccessible},
+			},
+		},
+		{
+			src:       "_ = x.@",
+			explained: map[string]suggest.Explanation{"Exp": {Match: "prefix"}, "M": {Match: "prefix"}},
+			rejections: []suggest.Rejection{
+				{Name: "m", PkgPath: "b", Class: "func", Reason: suggest.RejectInaccessible},
+				{Name: "unexp", PkgPath: "b", Class: "var", Reason: suggest.RejectInaccessible},
+			},
+		},
+		{
+			src:        "vs[0].@",
+			explained:  map[string]suggest.Explanation{"Val": {Match: "prefix"}},
+			rejections: []suggest.Rejection{{Name: "Ptr", PkgPath: "", Class: "func", Reason: suggest.RejectUnaddressable}},
+		},
+	} {
+		src, cursors := cutCursors(decls + test.src + "\n}\n")
+		res := cfg.SuggestResult("", []byte(src), cursors[0])
+		for name, want := range test.explained {
+			found := false
+			for _, c := range res.Candidates {
+				if c.Name != name {
+					continue
+				}
+				found = true
+				if c.Explain == nil || *c.Explain != want {
+					t.Errorf("%s: got explanation %+v of %s, want %+v", test.src, c.Explain, name, want)
+				}
+			}
+			if !found {
+				t.Errorf("%s: no candidate %s", test.src, name)
+			}
+		}
+		if !reflect.DeepEqual(res.Rejections, test.rejections) {
+			t.Errorf("%s: got rejections %+v, want %+v", test.src, res.Rejections, test.rejections)
+		}
+	}
+
+	// Without Explain, there are neither.
+	cfg.Explain = false
+	src, cursors := cutCursors(decls + "_ = alp@\n}\n")
+	res := cfg.SuggestResult("", []byte(src), cursors[0])
+	if len(res.Candidates) == 0 || res.Candidates[0].Explain != nil || res.Rejections != nil {
+		t.Errorf("got candidates %v and rejections %v without Explain", res.Candidates, res.Rejections)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	var candidates []suggest.Candidate
+	for i := 0; i < 150; i++ {
+		candidates = append(candidates, suggest.Candidate{Class: "var", PkgPath: "p", Name: strings.Repeat("x", i+1)})
+	}
+	got := suggest.Rejected(nil, candidates, suggest.RejectBudget)
+	if len(got) != 100 {
+		t.Fatalf("got %d rejections, want at most 100", len(got))
+	}
+	if want := (suggest.Rejection{Name: "x", PkgPath: "p", Class: "var", Reason: suggest.RejectBudget}); got[0] != want {
+		t.Errorf("got %+v, want %+v", got[0], want)
+	}
+
+	// The cap holds for the rejections already made too.
+	have := []suggest.Rejection{{Name: "y", PkgPath: "p", Class: "var", Reason: suggest.RejectInaccessible}}
+	got = suggest.Rejected(have, candidates, suggest.RejectBudget)
+	if len(got) != 100 || got[0] != have[0] {
+		t.Errorf("got %d rejections starting with %+v, want 100 starting with %+v", len(got), got[0], have[0])
+	}
+	if got = suggest.Rejected(got, candidates, suggest.RejectBudget); len(got) != 100 {
+		t.Errorf("got %d rejections once full, want 100", len(got))
+	}
+}
@@ -0,0 +1,10 @@
+package suggest
+
+// ImportRestriction exports importRestriction for tests.
+var ImportRestriction = importRestriction
+
+// Accessible exports accessible for tests.
+var Accessible = accessible
+
+// CandidateID exports candidateID for tests.
+var CandidateID = candidateID
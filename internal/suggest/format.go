@@ -0,0 +1,126 @@
+package suggest
+
+import (
+	"bytes"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// tabWidth is the width of a tab in columns, as in gofmt.
+const tabWidth = 8
+
+// snippetFormat holds the preferences formatting the text of snippets
+// that may span several lines, see Config.Indent and LineWidth.
+type snippetFormat struct {
+	indent string
+	width  int // 0 for no limit
+	line   int // the width of the rest of the cursor's line
+}
+
+// snippetFormat returns the snippet format of c for snippets replacing
+// the range r of data.
+func (c *Config) snippetFormat(data []byte, r Range) snippetFormat {
+	f := snippetFormat{indent: c.Indent, width: c.LineWidth}
+	if f.indent == "" {
+		f.indent = "\t"
+	}
+	if f.width <= 0 {
+		return f
+	}
+	start := bytes.LastIndexByte(data[:r.Start], '\n') + 1
+	end := len(data)
+	if i := bytes.IndexByte(data[r.End:], '\n'); i >= 0 {
+		end = r.End + i
+	}
+	f.line = columns(0, data[start:r.Start])
+	f.line = columns(f.line, data[r.End:end])
+	return f
+}
+
+// columns returns the column reached by writing text at column col.
+func columns(col int, text []byte) int {
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		if r == '\t' {
+			col += tabWidth - col%tabWidth
+		} else {
+			col++
+		}
+		text = text[size:]
+	}
+	return col
+}
+
+// placeholders matches the placeholders of a snippet, which insert
+// nothing.
+var placeholders = regexp.MustCompile(`\$[0-9]+`)
+
+// fits reports whether text, a snippet, fits on the cursor's line.
+func (f snippetFormat) fits(text string) bool {
+	return f.width <= 0 || f.line+columns(0, []byte(placeholders.ReplaceAllString(text, ""))) <= f.width
+}
+
+// list returns open, elems separated by ", " and close, such as
+// "T{A: $1, B: $2}", or, if that doesn't fit on the cursor's line,
+// broken into a line per element, indented and followed by a comma,
+// with the values of keyed elements aligned:
+//
+//	T{
+//		A:    $1,
+//		Long: $2,
+//	}
+//
+// The text is formatted as gofmt would. The lines after the first are
+// indented relative to the cursor's line, which editors indent them
+// to.
+func (f snippetFormat) list(open string, elems []string, close string) string {
+	text := open + strings.Join(elems, ", ") + close
+	if len(elems) == 0 || f.fits(text) {
+		return gofmtExpr(text)
+	}
+	var buf strings.Builder
+	buf.WriteString(open)
+	buf.WriteByte('\n')
+	for _, e := range elems {
+		buf.WriteString(e)
+		buf.WriteString(",\n")
+	}
+	buf.WriteString(close)
+	text = gofmtExpr(buf.String())
+	if f.indent == "\t" {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		tabs := len(line) - len(strings.TrimLeft(line, "\t"))
+		lines[i] = strings.Repeat(f.indent, tabs) + line[tabs:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// placeholderIdents matches the identifiers gofmtExpr replaces the
+// placeholders of a snippet with.
+var placeholderIdents = regexp.MustCompile(`_gocodePlaceholder([0-9]+)_`)
+
+// gofmtExpr returns text, a snippet of an expression or type, formatted
+// by go/format, or text itself if it doesn't parse. Its placeholders
+// are kept: they are made identifiers to be parsed.
+func gofmtExpr(text string) string {
+	src := placeholders.ReplaceAllStringFunc(text, func(p string) string {
+		return "_gocodePlaceholder" + p[1:] + "_"
+	})
+	fset := token.NewFileSet()
+	x, err := parser.ParseExprFrom(fset, "", src, 0)
+	if err != nil {
+		return text
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, x); err != nil {
+		return text
+	}
+	return placeholderIdents.ReplaceAllString(buf.String(), "$$$1")
+}
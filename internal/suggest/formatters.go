@@ -4,40 +4,80 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+
+	"github.com/mdempsky/gocode/format"
 )
 
-type Formatter func(w io.Writer, candidates []Candidate, num int)
+// Response is a completion response, as written by a Formatter.
+type Response = format.Response
+
+// A Formatter writes responses in some output format.
+type Formatter = format.Formatter
+
+// FormatterFunc adapts an ordinary function to a Formatter.
+type FormatterFunc = format.FormatterFunc
 
+// Formatters are the output formats by name. Use RegisterFormatter to
+// add one.
 var Formatters = map[string]Formatter{
-	"csv":              csvFormat,
-	"csv-with-package": csvFormat,
-	"emacs":            emacsFormat,
-	"godit":            goditFormat,
-	"json":             jsonFormat,
+	"csv":              FormatterFunc(csvFormat),
+	"csv-with-package": FormatterFunc(csvFormat),
+	"emacs":            FormatterFunc(emacsFormat),
+	"godit":            FormatterFunc(goditFormat),
+	"json":             FormatterFunc(jsonFormat),
 	"nice":             NiceFormat,
-	"vim":              vimFormat,
+	"vim":              FormatterFunc(vimFormat),
+}
+
+// NiceFormat is the human readable format, and the default.
+var NiceFormat Formatter = FormatterFunc(niceFormat)
+
+// RegisterFormatter makes f available as the output format name. It
+// panics if name is already registered.
+func RegisterFormatter(name string, f Formatter) {
+	if f == nil {
+		panic("suggest: RegisterFormatter formatter is nil")
+	}
+	if _, dup := Formatters[name]; dup {
+		panic("suggest: RegisterFormatter called twice for format " + name)
+	}
+	Formatters[name] = f
+}
+
+// FormatterNames returns the names of the registered formats, sorted.
+func FormatterNames() []string {
+	var names []string
+	for name := range Formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-func NiceFormat(w io.Writer, candidates []Candidate, num int) {
-	if candidates == nil {
-		fmt.Fprintf(w, "Nothing to complete.\n")
-		return
+func niceFormat(w io.Writer, res Response) error {
+	if res.Candidates == nil {
+		_, err := fmt.Fprintf(w, "Nothing to complete.\n")
+		return err
 	}
 
-	fmt.Fprintf(w, "Found %d candidates:\n", len(candidates))
-	for _, c := range candidates {
-		fmt.Fprintf(w, "  %s\n", c.String())
+	fmt.Fprintf(w, "Found %d candidates:\n", len(res.Candidates))
+	for _, c := range res.Candidates {
+		if _, err := fmt.Fprintf(w, "  %s\n", c.String()); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func vimFormat(w io.Writer, candidates []Candidate, num int) {
-	if candidates == nil {
-		fmt.Fprint(w, "[0, []]")
-		return
+func vimFormat(w io.Writer, res Response) error {
+	if res.Candidates == nil {
+		_, err := fmt.Fprint(w, "[0, []]")
+		return err
 	}
 
-	fmt.Fprintf(w, "[%d, [", num)
-	for i, c := range candidates {
+	fmt.Fprintf(w, "[%d, [", res.Len)
+	for i, c := range res.Candidates {
 		if i != 0 {
 			fmt.Fprintf(w, ", ")
 		}
@@ -46,18 +86,22 @@ func vimFormat(w io.Writer, candidates []Candidate, num int) {
 		abbr := c.String()
 		fmt.Fprintf(w, "{'word': '%s', 'abbr': '%s', 'info': '%s'}", word, abbr, abbr)
 	}
-	fmt.Fprintf(w, "]]")
+	_, err := fmt.Fprintf(w, "]]")
+	return err
 }
 
-func goditFormat(w io.Writer, candidates []Candidate, num int) {
-	fmt.Fprintf(w, "%d,,%d\n", num, len(candidates))
-	for _, c := range candidates {
-		fmt.Fprintf(w, "%s,,%s\n", c.String(), c.Suggestion())
+func goditFormat(w io.Writer, res Response) error {
+	fmt.Fprintf(w, "%d,,%d\n", res.Len, len(res.Candidates))
+	for _, c := range res.Candidates {
+		if _, err := fmt.Fprintf(w, "%s,,%s\n", c.String(), c.Suggestion()); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func emacsFormat(w io.Writer, candidates []Candidate, num int) {
-	for _, c := range candidates {
+func emacsFormat(w io.Writer, res Response) error {
+	for _, c := range res.Candidates {
 		var hint string
 		switch {
 		case c.Class == "func":
@@ -67,20 +111,57 @@ func emacsFormat(w io.Writer, candidates []Candidate, num int) {
 		default:
 			hint = c.Class + " " + c.Type
 		}
-		fmt.Fprintf(w, "%s,,%s\n", c.Name, hint)
+		if _, err := fmt.Fprintf(w, "%s,,%s\n", candidateLabel(c), hint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func csvFormat(w io.Writer, res Response) error {
+	for _, c := range res.Candidates {
+		if _, err := fmt.Fprintf(w, "%s,,%s,,%s,,%s\n", c.Class, c.Name, c.Type, c.PkgPath); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func csvFormat(w io.Writer, candidates []Candidate, num int) {
-	for _, c := range candidates {
-		fmt.Fprintf(w, "%s,,%s,,%s,,%s\n", c.Class, c.Name, c.Type, c.PkgPath)
+// Status describes a response beyond its candidates.
+type Status = format.Status
+
+// candidateLabel returns c.Label, or c.Name for a candidate made
+// without one.
+func candidateLabel(c Candidate) string {
+	if c.Label == "" {
+		return c.Name
 	}
+	return c.Label
 }
 
-func jsonFormat(w io.Writer, candidates []Candidate, num int) {
-	var x []interface{}
-	if candidates != nil {
-		x = []interface{}{num, candidates}
+// jsonFormat writes the length of the identifier, the candidates and
+// a trailing object with the format version. The candidates are null
+// if there are none, or in a diff mode response.
+func jsonFormat(w io.Writer, res Response) error {
+	candidates := res.Candidates
+	if res.Delta != nil {
+		candidates = nil
+	}
+	var replace *Range
+	if res.Replace != (Range{}) {
+		replace = &res.Replace
 	}
-	json.NewEncoder(w).Encode(x)
+	x := []interface{}{res.Len, candidates, responseInfo{
+		FormatVersion: FormatVersion,
+		Replace:       replace,
+		Generation:    res.Generation,
+		Delta:         res.Delta,
+		Truncated:     res.Truncated,
+		Partial:       res.Partial,
+		PackageDoc:    res.PackageDoc,
+		OperandValues: res.OperandValues,
+		Diagnostics:   res.Diagnostics,
+		Rejections:    res.Rejections,
+	}}
+	return json.NewEncoder(w).Encode(x)
 }
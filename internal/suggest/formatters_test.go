@@ -2,6 +2,10 @@ package suggest_test
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
 	"testing"
 
 	"github.com/mdempsky/gocode/internal/suggest"
@@ -47,12 +51,16 @@ func TestFormatters(t *testing.T) {
 		Name:    "client_status",
 		Type:    "func(cli *rpc.Client, Arg0 int) string",
 	}}
+	for i := range candidates {
+		c := &candidates[i]
+		c.Label, c.InsertText, c.FilterText = c.Name, c.Name, c.Name
+	}
 
 	var tests = [...]struct {
 		name string
 		want string
 	}{
-		{"json", `[6,[{"class":"func","package":"gocode","name":"client_auto_complete","type":"func(cli *rpc.Client, Arg0 []byte, Arg1 string, Arg2 int, Arg3 gocode_env) (c []candidate, d int)"},{"class":"func","package":"gocode","name":"client_close","type":"func(cli *rpc.Client, Arg0 int) int"},{"class":"func","package":"gocode","name":"client_cursor_type_pkg","type":"func(cli *rpc.Client, Arg0 []byte, Arg1 string, Arg2 int) (typ, pkg string)"},{"class":"func","package":"gocode","name":"client_drop_cache","type":"func(cli *rpc.Client, Arg0 int) int"},{"class":"func","package":"gocode","name":"client_highlight","type":"func(cli *rpc.Client, Arg0 []byte, Arg1 string, Arg2 gocode_env) (c []highlight_range, d int)"},{"class":"func","package":"gocode","name":"client_set","type":"func(cli *rpc.Client, Arg0, Arg1 string) string"},{"class":"func","package":"gocode","name":"client_status","type":"func(cli *rpc.Client, Arg0 int) string"}]]
+		{"json", `[6,[{"class":"func","package":"gocode","name":"client_auto_complete","type":"func(cli *rpc.Client, Arg0 []byte, Arg1 string, Arg2 int, Arg3 gocode_env) (c []candidate, d int)","label":"client_auto_complete","insert_text":"client_auto_complete","filter_text":"client_auto_complete"},{"class":"func","package":"gocode","name":"client_close","type":"func(cli *rpc.Client, Arg0 int) int","label":"client_close","insert_text":"client_close","filter_text":"client_close"},{"class":"func","package":"gocode","name":"client_cursor_type_pkg","type":"func(cli *rpc.Client, Arg0 []byte, Arg1 string, Arg2 int) (typ, pkg string)","label":"client_cursor_type_pkg","insert_text":"client_cursor_type_pkg","filter_text":"client_cursor_type_pkg"},{"class":"func","package":"gocode","name":"client_drop_cache","type":"func(cli *rpc.Client, Arg0 int) int","label":"client_drop_cache","insert_text":"client_drop_cache","filter_text":"client_drop_cache"},{"class":"func","package":"gocode","name":"client_highlight","type":"func(cli *rpc.Client, Arg0 []byte, Arg1 string, Arg2 gocode_env) (c []highlight_range, d int)","label":"client_highlight","insert_text":"client_highlight","filter_text":"client_highlight"},{"class":"func","package":"gocode","name":"client_set","type":"func(cli *rpc.Client, Arg0, Arg1 string) string","label":"client_set","insert_text":"client_set","filter_text":"client_set"},{"class":"func","package":"gocode","name":"client_status","type":"func(cli *rpc.Client, Arg0 int) string","label":"client_status","insert_text":"client_status","filter_text":"client_status"}],{"format_version":1}]
 `},
 		{"nice", `Found 7 candidates:
   func client_auto_complete(cli *rpc.Client, Arg0 []byte, Arg1 string, Arg2 int, Arg3 gocode_env) (c []candidate, d int)
@@ -95,10 +103,47 @@ func,,client_status,,func(cli *rpc.Client, Arg0 int) string,,gocode
 
 	for _, test := range tests {
 		var out bytes.Buffer
-		suggest.Formatters[test.name](&out, candidates, num)
+		if err := suggest.Formatters[test.name].Format(&out, suggest.Response{Candidates: candidates, Len: num}); err != nil {
+			t.Fatalf("Format %s: %v", test.name, err)
+		}
 
 		if got := out.String(); got != test.want {
 			t.Errorf("Format %s:\nGot:\n%q\nWant:\n%q\n", test.name, got, test.want)
 		}
 	}
 }
+
+func TestJSONFormatEmpty(t *testing.T) {
+	var out bytes.Buffer
+	if err := suggest.Formatters["json"].Format(&out, suggest.Response{}); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("[0,null,{\"format_version\":%d}]\n", suggest.FormatVersion)
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRegisterFormatter(t *testing.T) {
+	var got suggest.Response
+	suggest.RegisterFormatter("test-register", suggest.FormatterFunc(func(w io.Writer, res suggest.Response) error {
+		got = res
+		return nil
+	}))
+	defer delete(suggest.Formatters, "test-register")
+
+	res := suggest.Response{Candidates: []suggest.Candidate{{Class: "var", Name: "x"}}, Len: 1}
+	if err := suggest.Formatters["test-register"].Format(ioutil.Discard, res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, res) {
+		t.Errorf("got %+v, want %+v", got, res)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering json twice did not panic")
+		}
+	}()
+	suggest.RegisterFormatter("json", suggest.NiceFormat)
+}
@@ -0,0 +1,218 @@
+package suggest
+
+import (
+	"bytes"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"strings"
+	"unicode"
+)
+
+// funcLitPrecedents are the tokens a func literal, rather than a func
+// type, may follow.
+var funcLitPrecedents = map[token.Token]bool{
+	token.ASSIGN: true, token.DEFINE: true, token.LPAREN: true, token.COMMA: true,
+	token.COLON: true, token.LBRACE: true, token.RETURN: true, token.GO: true,
+	token.DEFER: true,
+}
+
+// funcLitSignatureTokens are the tokens a result list may be made of.
+var funcLitSignatureTokens = map[token.Token]bool{
+	token.IDENT: true, token.PERIOD: true, token.MUL: true, token.LBRACK: true,
+	token.RBRACK: true, token.LPAREN: true, token.RPAREN: true, token.COMMA: true,
+	token.FUNC: true, token.CHAN: true, token.MAP: true, token.ARROW: true,
+	token.ELLIPSIS: true, token.INT: true,
+}
+
+// openFuncLit reports whether the cursor is in the body of a func
+// literal whose signature isn't finished, on a line after it, and if
+// so returns the offset of the end of the signature's line and the
+// text finishing the signature there: ") {" if the parameter list is
+// open, as in
+//
+//	h := func(w http.ResponseWriter, r *http.Request
+//		r.#
+//
+// or " {" if only the body's brace is missing. The parser would drop
+// the body, and its parameters with it, otherwise.
+func openFuncLit(data []byte, cursor int) (int, string, bool) {
+	eol := bytes.LastIndexByte(data[:cursor], '\n')
+	if eol < 0 {
+		return 0, "", false
+	}
+
+	type tok struct {
+		tok token.Token
+		lit string
+		off int
+	}
+	var toks []tok
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), eol)
+	var s scanner.Scanner
+	s.Init(file, data[:eol], nil, 0)
+	for {
+		pos, t, lit := s.Scan()
+		if t == token.EOF {
+			break
+		}
+		toks = append(toks, tok{t, lit, file.Offset(pos)})
+	}
+
+	// open holds the open brackets, and whether each opens the
+	// parameter list of a func literal.
+	type bracket struct {
+		tok     token.Token
+		funcLit bool
+	}
+	var open []bracket
+	lastSig := -1 // the ')' ending the parameters of the last func literal
+	for i, t := range toks {
+		switch t.tok {
+		case token.LPAREN, token.LBRACK, token.LBRACE:
+			funcLit := t.tok == token.LPAREN && i >= 2 && toks[i-1].tok == token.FUNC && funcLitPrecedents[toks[i-2].tok]
+			open = append(open, bracket{t.tok, funcLit})
+		case token.RPAREN, token.RBRACK, token.RBRACE:
+			if len(open) == 0 {
+				return 0, "", false
+			}
+			if open[len(open)-1].funcLit {
+				lastSig = i
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(toks) == 0 {
+		return 0, "", false
+	}
+	last := len(toks) - 1
+	if toks[last].tok == token.SEMICOLON && toks[last].lit == "\n" {
+		// The semicolon inserted at the end of the line.
+		last--
+	}
+	if last < 0 {
+		return 0, "", false
+	}
+	end := toks[last].off + len(toks[last].lit)
+	if toks[last].lit == "" {
+		end = toks[last].off + len(toks[last].tok.String())
+	}
+	if len(open) > 0 && open[len(open)-1].funcLit {
+		return end, ") {", true
+	}
+	if lastSig < 0 || lastSig > last {
+		return 0, "", false
+	}
+	// Any results must follow the parameters on the same line.
+	depth := 0
+	for _, t := range toks[lastSig+1 : last+1] {
+		switch {
+		case !funcLitSignatureTokens[t.tok]:
+			return 0, "", false
+		case t.tok == token.LPAREN:
+			depth++
+		case t.tok == token.RPAREN:
+			depth--
+		}
+	}
+	if depth != 0 {
+		return 0, "", false
+	}
+	return end, " {", true
+}
+
+// funcLitParamsCandidate returns a snippet candidate for the parameter
+// list of a func literal of the func type typ, which is expected at
+// "func(" before the cursor, such as "w http.ResponseWriter, r
+// *http.Request" for an http.HandlerFunc. The parameters the type
+// leaves unnamed are named after their types. It returns false if typ
+// isn't a func type, or has no parameters.
+func (b *candidateCollector) funcLitParamsCandidate(typ types.Type) (Candidate, bool) {
+	sig, ok := typ.Underlying().(*types.Signature)
+	if !ok || sig.Params().Len() == 0 {
+		return Candidate{}, false
+	}
+	params := sig.Params()
+	used := make(map[string]bool)
+	var list []string
+	for i := 0; i < params.Len(); i++ {
+		p := params.At(i)
+		name := p.Name()
+		if name == "" || name == "_" || used[name] {
+			name = paramName(p.Type(), used)
+		}
+		used[name] = true
+		t := types.TypeString(p.Type(), b.qualify)
+		if sig.Variadic() && i == params.Len()-1 {
+			t = "..." + strings.TrimPrefix(t, "[]")
+		}
+		list = append(list, name+" "+t)
+	}
+	// The parameters are formatted as those of a func type.
+	text := strings.Join(list, ", ")
+	if fn := gofmtExpr("func(" + text + ")"); strings.HasPrefix(fn, "func(") && strings.HasSuffix(fn, ")") {
+		text = fn[len("func(") : len(fn)-1]
+	}
+
+	cand := nameCandidate("snippet", text)
+	cand.Type = types.TypeString(typ, b.qualifyType)
+	label := "func(" + text + ")"
+	if res := sig.Results(); res.Len() > 0 {
+		r := types.TypeString(res, b.qualify)
+		if res.Len() == 1 && res.At(0).Name() == "" {
+			r = r[1 : len(r)-1]
+		}
+		label += " " + r
+	}
+	cand.Label = gofmtExpr(label)
+	return cand, true
+}
+
+// paramName returns a name for a parameter of type t that isn't in
+// used: the initials of its type name, such as "rw" for
+// http.ResponseWriter, numbered if taken.
+func paramName(t types.Type, used map[string]bool) string {
+	for {
+		switch u := t.(type) {
+		case *types.Pointer:
+			t = u.Elem()
+			continue
+		case *types.Slice:
+			t = u.Elem()
+			continue
+		}
+		break
+	}
+	var name string
+	switch t := t.(type) {
+	case *types.Named:
+		name = t.Obj().Name()
+	case *types.Basic:
+		name = t.Name()
+	}
+	var initials []rune
+	for i, r := range name {
+		if i == 0 || unicode.IsUpper(r) {
+			initials = append(initials, unicode.ToLower(r))
+		}
+	}
+	base := string(initials)
+	switch {
+	case name == "error":
+		base = "err"
+	case name == "Context":
+		base = "ctx"
+	case base == "" || token.Lookup(base).IsKeyword():
+		base = "v"
+	}
+	if !used[base] {
+		return base
+	}
+	for i := 2; ; i++ {
+		if name := fmt.Sprintf("%s%d", base, i); !used[name] {
+			return name
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package suggest
+
+import (
+	"bytes"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// goVersions returns a func returning the go directive of the go.mod
+// of the module providing the package path, imported from srcDir, such
+// as "1.21", for Candidate.GoVersion. It returns "" for the packages of
+// the standard library and for those not in a module with a go
+// directive. Packages are looked up with c.BuildContext, once per
+// request, and go directives are cached across requests.
+func (c *Config) goVersions(srcDir string) func(path string) string {
+	byPath := make(map[string]string)
+	return func(path string) string {
+		if v, ok := byPath[path]; ok {
+			return v
+		}
+		v := ""
+		if bp, err := c.BuildContext.Import(path, srcDir, build.FindOnly); err == nil && !bp.Goroot && bp.Dir != "" {
+			v = c.moduleGoVersion(bp.Dir)
+		}
+		byPath[path] = v
+		return v
+	}
+}
+
+// maxGoDirectives bounds the number of go.mod files whose go directive
+// is cached.
+const maxGoDirectives = 1000
+
+// goDirectives caches the go directives of go.mod files by the root of
+// their module, which are otherwise read again on every request, along
+// with the modification time of the go.mod they were read from.
+var goDirectives = struct {
+	sync.Mutex
+	m map[string]goDirectiveEntry
+}{m: make(map[string]goDirectiveEntry)}
+
+type goDirectiveEntry struct {
+	mtime   time.Time
+	version string
+}
+
+// moduleGoVersion returns the go directive of the go.mod of the module
+// holding the directory dir, or "". The go.mod of a module whose
+// packages are vendored isn't that of the vendoring module, and isn't
+// at hand, so vendored packages have none. Neither do the packages of
+// GOPATH, which aren't in the module of a go.mod above GOPATH/src.
+func (c *Config) moduleGoVersion(dir string) string {
+	srcDirs := make(map[string]bool)
+	for _, root := range filepath.SplitList(c.BuildContext.GOPATH) {
+		srcDirs[filepath.Join(root, "src")] = true
+	}
+	for {
+		if filepath.Base(dir) == "vendor" {
+			return ""
+		}
+		fi, err := c.stat(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			return c.cachedGoDirective(dir, fi.ModTime())
+		}
+		if !os.IsNotExist(err) || srcDirs[dir] {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// cachedGoDirective returns the go directive of the go.mod of the
+// module rooted at root, modified at mtime, from goDirectives if it
+// didn't change since.
+func (c *Config) cachedGoDirective(root string, mtime time.Time) string {
+	goDirectives.Lock()
+	e, ok := goDirectives.m[root]
+	goDirectives.Unlock()
+	if ok && e.mtime.Equal(mtime) {
+		return e.version
+	}
+	data, err := c.readFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	e = goDirectiveEntry{mtime, goDirective(data)}
+
+	goDirectives.Lock()
+	defer goDirectives.Unlock()
+	if len(goDirectives.m) >= maxGoDirectives {
+		goDirectives.m = make(map[string]goDirectiveEntry)
+	}
+	goDirectives.m[root] = e
+	return e.version
+}
+
+// localImportPath returns the import path of the package in the
+// directory dir, for the IDs of its candidates: the one found in GOPATH
+// by c.BuildContext, or else the path of the module holding dir joined
+// with the directory's path within it. It returns "" if dir is in
+// neither.
+func (c *Config) localImportPath(dir string) string {
+	if c.BuildContext != nil {
+		if bp, err := c.BuildContext.ImportDir(dir, build.FindOnly); err == nil && bp.ImportPath != "." {
+			return bp.ImportPath
+		}
+	}
+	for root := dir; ; {
+		data, err := c.readFile(filepath.Join(root, "go.mod"))
+		if err == nil {
+			mod := moduleDirective(data)
+			rel, err := filepath.Rel(root, dir)
+			if mod == "" || err != nil {
+				return ""
+			}
+			return path.Join(mod, filepath.ToSlash(rel))
+		}
+		if !os.IsNotExist(err) {
+			return ""
+		}
+		parent := filepath.Dir(root)
+		if parent == root {
+			return ""
+		}
+		root = parent
+	}
+}
+
+// stat is os.Stat of the file name, checked by c.Sandbox if set.
+func (c *Config) stat(name string) (os.FileInfo, error) {
+	if c.Sandbox != nil {
+		if err := c.Sandbox.Check(name); err != nil {
+			return nil, err
+		}
+	}
+	return os.Stat(name)
+}
+
+// readFile reads the file name, through c.Sandbox if set.
+func (c *Config) readFile(name string) ([]byte, error) {
+	if c.Sandbox != nil {
+		return c.Sandbox.ReadFile(name)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// moduleDirective returns the module path of the go.mod file data, or
+// "" if it has none.
+func moduleDirective(data []byte) string {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if i := bytes.Index(line, []byte("//")); i >= 0 {
+			line = line[:i]
+		}
+		if f := strings.Fields(string(line)); len(f) == 2 && f[0] == "module" {
+			return strings.Trim(f[1], "\"")
+		}
+	}
+	return ""
+}
+
+// goDirective returns the version of the go directive of the go.mod
+// file data, such as "1.21", or "" if it has none.
+func goDirective(data []byte) string {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if i := bytes.Index(line, []byte("//")); i >= 0 {
+			line = line[:i]
+		}
+		if f := strings.Fields(string(line)); len(f) == 2 && f[0] == "go" {
+			return f[1]
+		}
+	}
+	return ""
+}
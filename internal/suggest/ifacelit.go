@@ -0,0 +1,165 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// interfaceElemAt returns the innermost interface type literal of file
+// in which an element, a method or an embedded interface, starts at
+// pos, possibly with its first identifier partially typed. It returns
+// nil if pos is elsewhere, such as in the signature of a method.
+func interfaceElemAt(file *ast.File, pos token.Pos) *ast.InterfaceType {
+	var lit *ast.InterfaceType
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil || pos < n.Pos() || n.End() < pos {
+			return false
+		}
+		if it, ok := n.(*ast.InterfaceType); ok && it.Methods != nil &&
+			it.Methods.Opening < pos && pos <= it.Methods.Closing {
+			lit = it
+		}
+		return true
+	})
+	if lit == nil {
+		return nil
+	}
+	for _, f := range lit.Methods.List {
+		if pos < f.Pos() || f.End() < pos {
+			continue
+		}
+		if id, ok := f.Type.(*ast.Ident); !ok || len(f.Names) != 0 || id.End() != pos {
+			return nil
+		}
+	}
+	return lit
+}
+
+// interfaceKinds returns the filter of the candidates at pos within
+// an element of an interface literal of file that doesn't start it:
+// the interfaces of a package, to embed, after its name, or the types
+// and packages in the signature of a method. It returns nil if pos is
+// elsewhere.
+func interfaceKinds(file *ast.File, pos token.Pos) objectFilter {
+	var kinds objectFilter
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil || pos < n.Pos() || n.End() < pos {
+			return false
+		}
+		it, ok := n.(*ast.InterfaceType)
+		if !ok || it.Methods == nil || pos <= it.Methods.Opening || it.Methods.Closing < pos {
+			return true
+		}
+		kinds = nil
+		for _, f := range it.Methods.List {
+			if pos < f.Pos() || f.End() < pos {
+				continue
+			}
+			if len(f.Names) > 0 && f.Type.Pos() <= pos {
+				kinds = isTypeOrPackage
+			} else if sel, ok := f.Type.(*ast.SelectorExpr); ok && len(f.Names) == 0 && sel.Sel.Pos() <= pos {
+				kinds = isInterface
+			}
+		}
+		return true
+	})
+	return kinds
+}
+
+// isTypeOrPackage reports whether obj is a type, or a package that
+// may declare one.
+func isTypeOrPackage(obj types.Object) bool {
+	switch obj.(type) {
+	case *types.TypeName, *types.PkgName:
+		return true
+	}
+	return false
+}
+
+// isInterface reports whether obj is an interface type.
+func isInterface(obj types.Object) bool {
+	tn, ok := obj.(*types.TypeName)
+	return ok && types.IsInterface(tn.Type())
+}
+
+// interfaceElemCandidates proposes what may start an element of the
+// interface literal lit: the interfaces and packages in scope, to
+// embed, and the methods of the interfaces declared in the package or
+// the packages it imports, to declare. Their InsertText is the method
+// specification, such as "Read(p []byte) (n int, err error)". Methods
+// lit already declares are left out, and so are values and the types
+// that aren't interfaces.
+func (c *Config) interfaceElemCandidates(lit *ast.InterfaceType, scope *types.Scope, pos token.Pos, b *candidateCollector) {
+	declared := make(map[string]bool)
+	for _, f := range lit.Methods.List {
+		for _, name := range f.Names {
+			declared[name.Name] = true
+		}
+	}
+	b.kinds = func(obj types.Object) bool {
+		if _, ok := obj.(*types.PkgName); ok {
+			return true
+		}
+		return isInterface(obj) || b.methodSpecs[obj] != ""
+	}
+
+	var ifaces []*types.TypeName
+	addIface := func(obj types.Object) {
+		if isInterface(obj) {
+			ifaces = append(ifaces, obj.(*types.TypeName))
+		}
+	}
+	var imported []*types.Package
+	seen := make(map[string]bool)
+	for s := scope; s != nil; s = s.Parent() {
+		for _, name := range s.Names() {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			_, obj := s.LookupParent(name, pos)
+			switch obj := obj.(type) {
+			case *types.TypeName:
+				b.appendObject(obj)
+				if obj.Parent() != types.Universe || b.builtin {
+					addIface(obj)
+				}
+			case *types.PkgName:
+				b.appendObject(obj)
+				imported = append(imported, obj.Imported())
+			}
+		}
+	}
+	for _, pkg := range imported {
+		for _, name := range pkg.Scope().Names() {
+			if obj := pkg.Scope().Lookup(name); accessible(obj, b.localpkg) {
+				addIface(obj)
+			}
+		}
+	}
+
+	// Propose each method specification once, as declared by the
+	// first interface found with it.
+	specs := make(map[string]bool)
+	for _, tn := range ifaces {
+		it := tn.Type().Underlying().(*types.Interface)
+		for i, n := 0, it.NumMethods(); i < n; i++ {
+			m := it.Method(i)
+			if declared[m.Name()] {
+				continue
+			}
+			spec := m.Name() + strings.TrimPrefix(types.TypeString(m.Type(), b.qualify), "func")
+			if specs[spec] {
+				continue
+			}
+			specs[spec] = true
+			if b.methodSpecs == nil {
+				b.methodSpecs = make(map[types.Object]string)
+			}
+			b.methodSpecs[m] = spec
+			b.appendObject(m)
+		}
+	}
+}
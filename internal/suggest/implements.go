@@ -0,0 +1,117 @@
+package suggest
+
+import (
+	"go/token"
+	"go/types"
+)
+
+// maxImplementerPackages bounds the number of imported packages
+// searched for types implementing an expected interface.
+const maxImplementerPackages = 50
+
+// expectedInterface returns the interface type of the value expected
+// at the cursor, see expectedType. It returns nil if no interface with
+// methods is expected.
+func (c *Config) expectedInterface(fset *token.FileSet, pos token.Pos, pkg *types.Package, data []byte, cursor int) *types.Interface {
+	typ := c.expectedType(fset, pos, pkg, data, cursor)
+	if typ == nil {
+		return nil
+	}
+	iface, ok := typ.Underlying().(*types.Interface)
+	if !ok || iface.NumMethods() == 0 || !iface.IsMethodSet() {
+		return nil
+	}
+	return iface
+}
+
+// expectedType returns the type of the value expected at the cursor:
+// the type of a var being initialized, of the left-hand side of an
+// assignment, or of the parameter of a call argument, or nil.
+func (c *Config) expectedType(fset *token.FileSet, pos token.Pos, pkg *types.Package, data []byte, cursor int) types.Type {
+	var typ types.Type
+	if fn, arg, ok := deduceCallArg(data, cursor); ok {
+		tv, _ := types.Eval(fset, pkg, pos, fn)
+		switch {
+		case tv.Type == nil:
+		case tv.IsType():
+			// A conversion.
+			if arg == 0 {
+				typ = tv.Type
+			}
+		default:
+			if sig, ok := tv.Type.Underlying().(*types.Signature); ok {
+				typ = argType(sig, arg)
+			}
+		}
+	} else if x, ok := deduceAssignTarget(data, cursor); ok {
+		tv, _ := types.Eval(fset, pkg, pos, x)
+		typ = tv.Type
+	}
+	return typ
+}
+
+// implementerCandidates adds to b the exported named types of the
+// packages imported by pkg that implement iface, and records in b
+// which types of pkg and of those packages implement it, as values or
+// only as pointers. Implementers are listed first.
+func (c *Config) implementerCandidates(iface *types.Interface, pkg *types.Package, b *candidateCollector) {
+	imports := pkg.Imports()
+	if len(imports) > maxImplementerPackages {
+		imports = imports[:maxImplementerPackages]
+	}
+	b.implements = make(map[types.Object]string)
+	for _, p := range append([]*types.Package{pkg}, imports...) {
+		scope := p.Scope()
+		for _, name := range scope.Names() {
+			tn, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok || tn.IsAlias() || !accessible(tn, pkg) {
+				continue
+			}
+			named, ok := tn.Type().(*types.Named)
+			if !ok || named.TypeParams().Len() > 0 || types.IsInterface(named) {
+				continue
+			}
+			switch {
+			case types.Implements(named, iface):
+				b.implements[tn] = "value"
+			case types.Implements(types.NewPointer(named), iface):
+				b.implements[tn] = "pointer"
+			default:
+				continue
+			}
+			if p != pkg {
+				// Those of pkg are in scope already.
+				b.appendObject(tn)
+			}
+		}
+	}
+	if len(b.implements) == 0 {
+		return
+	}
+	boost := b.boost
+	b.boost = func(obj types.Object) bool {
+		return b.implements[obj] != "" || boost != nil && boost(obj)
+	}
+}
+
+// implementerText returns the expression that makes a value of tn
+// implementing an interface: a composite literal for a struct type,
+// prefixed with '&' if only the pointer implements it, and otherwise
+// a conversion or a call to new.
+func (b *candidateCollector) implementerText(tn *types.TypeName, how string) string {
+	name := tn.Name()
+	if q := b.qualify(tn.Pkg()); q != "" {
+		name = q + "." + name
+	}
+	_, isStruct := tn.Type().Underlying().(*types.Struct)
+	switch {
+	case isStruct && how == "pointer":
+		return "&" + name + "{}"
+	case isStruct:
+		return name + "{}"
+	case how == "pointer":
+		return "new(" + name + ")"
+	default:
+		return name + "($1)"
+	}
+}
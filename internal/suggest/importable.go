@@ -0,0 +1,88 @@
+package suggest
+
+import (
+	"go/build"
+	"path/filepath"
+	"strings"
+)
+
+// importRestriction returns why the go command refuses to let a file
+// in the directory from import the package with import path path, in
+// the directory dir, and package name name, or "" if it allows it.
+// dir and name may be empty if they aren't known, in which case the
+// rules that need them aren't applied.
+//
+// The rules are those of the go command:
+//   - a package below an internal directory may only be imported from
+//     within the tree rooted at the parent of that directory, so the
+//     internal packages of the standard library are only importable by
+//     the standard library, and those of another module not at all;
+//   - a vendored package is imported by its path below the vendor
+//     directory, never by a path naming it;
+//   - package main is a program, and a package named x_test an
+//     external test package, neither of which can be imported.
+//
+// Packages only meant for tests, such as net/http/httptest, are
+// ordinary packages as far as the go command is concerned.
+func importRestriction(from, path, dir, name string) string {
+	switch {
+	case name == "main":
+		return "is a program, not an importable package"
+	case strings.HasSuffix(name, "_test"):
+		return "is an external test package, not an importable package"
+	case hasElem(path, "vendor"):
+		return "names a vendor directory; vendored packages are imported by their path below it"
+	}
+	if i, ok := findInternal(path); ok && dir != "" {
+		// The part of dir matching the path from the internal
+		// element on is left off to get the parent directory.
+		parent := filepath.Clean(strings.TrimSuffix(filepath.Clean(dir), filepath.FromSlash(strings.TrimPrefix(path[i:], "/"))))
+		if !inDir(from, parent) {
+			return "is an internal package, only importable from within " + parent
+		}
+	}
+	return ""
+}
+
+// findInternal returns the index of the last internal element of the
+// import path path, or of the slash before it.
+func findInternal(path string) (int, bool) {
+	switch {
+	case strings.HasSuffix(path, "/internal"):
+		return len(path) - len("/internal"), true
+	case strings.Contains(path, "/internal/"):
+		return strings.LastIndex(path, "/internal/"), true
+	case path == "internal", strings.HasPrefix(path, "internal/"):
+		return 0, true
+	}
+	return 0, false
+}
+
+// hasElem reports whether the slash-separated path has an element elem.
+func hasElem(path, elem string) bool {
+	for _, e := range strings.Split(path, "/") {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// inDir reports whether the directory dir is root or below it.
+func inDir(dir, root string) bool {
+	dir, root = filepath.Clean(dir), filepath.Clean(root)
+	return dir == root || strings.HasPrefix(dir, root+string(filepath.Separator))
+}
+
+// stdDir returns the directory of the standard library package path,
+// in the GOROOT of c.ImportPaths, if set, or of build.Default.
+func (c *Config) stdDir(path string) string {
+	goroot := build.Default.GOROOT
+	if c.ImportPaths != nil {
+		goroot = c.ImportPaths.GOROOT
+	}
+	if goroot == "" {
+		return ""
+	}
+	return filepath.Join(goroot, "src", filepath.FromSlash(path))
+}
@@ -0,0 +1,97 @@
+package suggest_test
+
+import (
+	"go/build"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestImportRestriction(t *testing.T) {
+	root := filepath.FromSlash("/gopath/src")
+	goroot := filepath.FromSlash("/goroot/src")
+	dir := func(root, path string) string { return filepath.Join(root, filepath.FromSlash(path)) }
+	tests := []struct {
+		rule       string
+		from, path string
+		dir, name  string
+		allowed    bool
+	}{
+		{"internal, same tree", dir(root, "example.com/m/cmd/tool"), "example.com/m/internal/util", dir(root, "example.com/m/internal/util"), "util", true},
+		{"internal, parent", dir(root, "example.com/m"), "example.com/m/internal", dir(root, "example.com/m/internal"), "internal", true},
+		{"internal, other tree", dir(root, "example.com/m/cmd/tool"), "example.com/other/internal/priv", dir(root, "example.com/other/internal/priv"), "priv", false},
+		{"internal, sibling prefix", dir(root, "example.com/mm"), "example.com/m/internal/util", dir(root, "example.com/m/internal/util"), "util", false},
+		{"internal, last element decides", dir(root, "example.com/m/internal/a"), "example.com/m/internal/a/internal/b", dir(root, "example.com/m/internal/a/internal/b"), "b", true},
+		{"internal, standard library", dir(root, "example.com/m"), "internal/poll", dir(goroot, "internal/poll"), "poll", false},
+		{"internal, within the standard library", dir(goroot, "os"), "internal/poll", dir(goroot, "internal/poll"), "poll", true},
+		{"internal, unknown dir", dir(root, "example.com/m"), "example.com/other/internal/priv", "", "priv", true},
+		{"vendor", dir(root, "example.com/m"), "example.com/m/vendor/example.com/dep", dir(root, "example.com/m/vendor/example.com/dep"), "dep", false},
+		{"vendor, standard library", dir(root, "example.com/m"), "vendor/golang.org/x/net/http2/hpack", dir(goroot, "vendor/golang.org/x/net/http2/hpack"), "", false},
+		{"test-only package", dir(root, "example.com/m"), "net/http/httptest", dir(goroot, "net/http/httptest"), "httptest", true},
+		{"external test package", dir(root, "example.com/m"), "example.com/other", dir(root, "example.com/other"), "other_test", false},
+		{"main package", dir(root, "example.com/m"), "example.com/m/cmd/tool", dir(root, "example.com/m/cmd/tool"), "main", false},
+		{"unknown name", dir(root, "example.com/m"), "example.com/other", dir(root, "example.com/other"), "", true},
+	}
+	for _, test := range tests {
+		why := suggest.ImportRestriction(test.from, test.path, test.dir, test.name)
+		if allowed := why == ""; allowed != test.allowed {
+			t.Errorf("%s: %s from %s: allowed %v (%q), want %v", test.rule, test.path, test.from, allowed, why, test.allowed)
+		}
+	}
+}
+
+func TestImportPathRestrictions(t *testing.T) {
+	gopath := writeFiles(t, map[string]string{
+		"src/example.com/m/cmd/tool/main.go":        "package main\n",
+		"src/example.com/m/internal/util/util.go":   "package util\n",
+		"src/example.com/other/internal/priv/p.go":  "package priv\n",
+		"src/example.com/other/lib/lib.go":          "package lib\n",
+		"src/example.com/other/xonly/xonly_test.go": "package xonly_test\n",
+	})
+	ctx := build.Default
+	ctx.GOROOT = filepath.Join(gopath, "goroot") // no standard library
+	ctx.GOPATH = gopath
+	filename := filepath.Join(gopath, "src", "example.com", "m", "cmd", "tool", "main.go")
+
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{`import "example.com/m/internal/@"`, []string{"example.com/m/internal/util (importable)"}},
+		{`import "example.com/other/@"`, []string{"example.com/other/lib (importable)", "example.com/other/xonly"}},
+	}
+	for _, test := range tests {
+		src, cursors := cutCursors("package main\n\n" + test.src + "\n")
+		cfg := suggest.Config{ImportPaths: &ctx, Importer: noImporter{}, Logf: t.Logf}
+		got, _ := cfg.Suggest(filename, []byte(src), cursors[0])
+		var strs []string
+		for _, c := range got {
+			s := c.Name
+			if c.Importable {
+				s += " (importable)"
+			}
+			strs = append(strs, s)
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%s: got %q, want %q", test.src, strs, test.want)
+		}
+	}
+}
+
+func TestUnimportedPackageRestrictions(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"httptest.New@", true},
+		{"hpack.New@", false}, // vendored in the standard library
+	}
+	for _, test := range tests {
+		got, _ := suggestSource(t, suggest.Config{UnimportedPackages: true}, "package p\n\nfunc f() {\n\t"+test.src+"\n}\n")
+		if proposed := len(got) > 0; proposed != test.want {
+			t.Errorf("%s: proposed %v, want %v", test.src, proposed, test.want)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/build"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/mdempsky/gocode/internal/fswalk"
+)
+
+// importPathAt returns the path of the import spec of file that
+// contains pos between its quotes, or nil. The closing quote may be
+// missing while the path is typed.
+func importPathAt(file *ast.File, pos token.Pos) *ast.BasicLit {
+	for _, spec := range file.Imports {
+		lit := spec.Path
+		if lit == nil || lit.Value == "" {
+			continue
+		}
+		end := lit.End()
+		if len(lit.Value) > 1 && lit.Value[len(lit.Value)-1] == lit.Value[0] {
+			end--
+		}
+		if lit.Pos() < pos && pos <= end {
+			return lit
+		}
+	}
+	return nil
+}
+
+// importPathCandidates proposes the directories below the source
+// directories of c.ImportPaths, and below the module holding the file,
+// whose import path starts with the part of lit before the cursor, one
+// path element at a time: after "net/", "net/http" but not
+// "net/http/httptest". Directories the file may not import from, by
+// importRestriction, are left out. A package whose name is taken by
+// another import of file, which type-checks as pkg, is proposed with an
+// alias, see importAlias.
+func (c *Config) importPathCandidates(fset *token.FileSet, file *ast.File, lit *ast.BasicLit, pkg *types.Package, data []byte, cursor int) Result {
+	start := fset.Position(lit.Pos()).Offset + 1
+	if start > cursor {
+		return Result{}
+	}
+	typed := string(data[start:cursor])
+	dir, prefix := "", typed
+	if i := strings.LastIndex(typed, "/"); i >= 0 {
+		dir, prefix = typed[:i+1], typed[i+1:]
+	}
+
+	from := filepath.Dir(fset.Position(lit.Pos()).Filename)
+	ctx := *c.ImportPaths
+	c.sandboxContext(&ctx)
+
+	importable := make(map[string]bool)
+	names := make(map[string]string)
+	// add proposes the import path p of the directory pdir, which
+	// is "" for the part of a module path above the module.
+	add := func(p, pdir string) {
+		if importRestriction(from, p, pdir, "") != "" || !allowedBelow(c.AllowedPackages, p) {
+			// Neither it nor the directories below it may
+			// be imported.
+			return
+		}
+		if pdir == "" {
+			if _, ok := importable[p]; !ok {
+				importable[p] = false
+			}
+			return
+		}
+		if !importable[p] {
+			// A directory with only tests, such as of an
+			// external x_test package, has nothing to import.
+			bp, err := ctx.ImportDir(pdir, 0)
+			importable[p] = err == nil && len(bp.GoFiles)+len(bp.CgoFiles) > 0 && importRestriction(from, p, pdir, bp.Name) == "" && allowedPath(c.AllowedPackages, p)
+			if importable[p] {
+				names[p] = bp.Name
+			}
+		}
+	}
+	for _, root := range c.importRoots(&ctx, from) {
+		sub := dir
+		if root.path != "" {
+			if rest := strings.TrimPrefix(dir, root.path+"/"); rest != dir {
+				sub = rest
+			} else if strings.HasPrefix(root.path, dir) {
+				// The module path is being typed: propose
+				// its next element.
+				elem := root.path[len(dir):]
+				if i := strings.IndexByte(elem, '/'); i >= 0 {
+					elem = elem[:i]
+				}
+				if !c.matchImportPath(elem, prefix) {
+					continue
+				}
+				if dir+elem == root.path {
+					add(root.path, root.dir)
+				} else {
+					add(dir+elem, "")
+				}
+				continue
+			} else {
+				continue
+			}
+		}
+		infos, err := c.readImportDir(&ctx, filepath.Join(root.dir, filepath.FromSlash(sub)))
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if !info.IsDir() || fswalk.Ignored(name) || name == "vendor" || !c.matchImportPath(name, prefix) {
+				continue
+			}
+			add(path.Join(dir, name), filepath.Join(root.dir, filepath.FromSlash(sub), name))
+		}
+	}
+	if len(importable) == 0 {
+		return Result{}
+	}
+
+	taken := importedNames(file, lit, pkg)
+	res := make([]Candidate, 0, len(importable))
+	for p, ok := range importable {
+		cand := nameCandidate("import", p)
+		cand.Importable = ok
+		if alias := importAlias(p, names[p], taken); alias != "" {
+			cand.Alias = alias
+			cand.Import = alias + " " + strconv.Quote(p)
+		}
+		res = append(res, cand)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return Result{Candidates: res, Len: len(typed), Replace: ReplaceRange(data, cursor, len(typed))}
+}
+
+// An importRoot is a directory holding packages: those of GOROOT and
+// GOPATH, whose import paths are their paths below dir, and that of a
+// module, whose import paths are below path.
+type importRoot struct {
+	dir  string
+	path string
+}
+
+// importRoots returns the source directories of ctx, followed, if the
+// directory from is in a module, by the module's directory and its
+// vendor directory, whose packages are imported in module mode.
+func (c *Config) importRoots(ctx *build.Context, from string) []importRoot {
+	var roots []importRoot
+	for _, dir := range ctx.SrcDirs() {
+		roots = append(roots, importRoot{dir: dir})
+	}
+	for dir := from; ; {
+		data, err := c.readFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			if mod := moduleDirective(data); mod != "" {
+				roots = append(roots, importRoot{dir, mod}, importRoot{dir: filepath.Join(dir, "vendor")})
+			}
+			return roots
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return roots
+		}
+		dir = parent
+	}
+}
+
+// dirImportPath returns the import path of the package in dir, the
+// way the cache importer finds that of the package being completed:
+// its path below a GOPATH of c.BuildContext, or below the module
+// holding it. It returns "" if it has none.
+func (c *Config) dirImportPath(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	ctx := c.BuildContext
+	if ctx == nil {
+		ctx = &build.Default
+	}
+	for _, root := range filepath.SplitList(ctx.GOPATH) {
+		rel, err := filepath.Rel(filepath.Join(root, "src"), dir)
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	for root := dir; ; {
+		if data, err := c.readFile(filepath.Join(root, "go.mod")); err == nil {
+			mod := moduleDirective(data)
+			rel, err := filepath.Rel(root, dir)
+			if mod == "" || err != nil {
+				return ""
+			}
+			return path.Join(mod, filepath.ToSlash(rel))
+		}
+		parent := filepath.Dir(root)
+		if parent == root {
+			return ""
+		}
+		root = parent
+	}
+}
+
+// maxImportDirs bounds the number of cached directory listings.
+const maxImportDirs = 1000
+
+// importDirs caches the listings of the directories below import roots,
+// which are read again on every keystroke of an import path otherwise.
+var importDirs = struct {
+	sync.Mutex
+	m map[string]importDirEntry
+}{m: make(map[string]importDirEntry)}
+
+type importDirEntry struct {
+	mtime time.Time
+	infos []os.FileInfo
+}
+
+// readImportDir lists dir with ctx. The listing is cached until the
+// modification time of dir changes, when an entry is added or removed,
+// unless dir is read through c.Sandbox, which must see every read.
+func (c *Config) readImportDir(ctx *build.Context, dir string) ([]os.FileInfo, error) {
+	if ctx.ReadDir != nil {
+		return ctx.ReadDir(dir)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	importDirs.Lock()
+	e, ok := importDirs.m[dir]
+	importDirs.Unlock()
+	if ok && e.mtime.Equal(fi.ModTime()) {
+		return e.infos, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	importDirs.Lock()
+	if len(importDirs.m) >= maxImportDirs {
+		importDirs.m = make(map[string]importDirEntry)
+	}
+	importDirs.m[dir] = importDirEntry{fi.ModTime(), infos}
+	importDirs.Unlock()
+	return infos, nil
+}
+
+// matchImportPath reports whether the path element name matches the
+// prefix typed for it.
+func (c *Config) matchImportPath(name, prefix string) bool {
+	if c.IgnoreCase {
+		return strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix))
+	}
+	return strings.HasPrefix(name, prefix)
+}
+
+// importedNames returns the names the imports of file other than the
+// one of lit bind, from the packages pkg imports, or guessed from
+// their paths if they failed to import.
+func importedNames(file *ast.File, lit *ast.BasicLit, pkg *types.Package) map[string]bool {
+	byPath := make(map[string]string)
+	if pkg != nil {
+		for _, imp := range pkg.Imports() {
+			// go/types makes up an empty package, named
+			// after the last path element, for an import
+			// that fails.
+			if imp.Scope().Len() > 0 {
+				byPath[imp.Path()] = imp.Name()
+			}
+		}
+	}
+	taken := make(map[string]bool)
+	for _, spec := range file.Imports {
+		if spec.Path == lit {
+			continue
+		}
+		if spec.Name != nil {
+			if spec.Name.Name != "_" && spec.Name.Name != "." {
+				taken[spec.Name.Name] = true
+			}
+			continue
+		}
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if name := byPath[p]; name != "" {
+			taken[name] = true
+		} else {
+			taken[guessPackageName(p)] = true
+		}
+	}
+	return taken
+}
+
+// importAlias returns the alias to import the package name at path
+// with, if name is in taken, and otherwise "". The alias prefixes name
+// with the path elements before it, from the closest, until it is
+// free: "storageclient" for "cloud.google.com/go/storage/client", or
+// "gostorageclient" if that is taken too. Elements are lowercased and
+// stripped of characters not allowed in identifiers. If all of them
+// don't make it free, a number is appended.
+func importAlias(path, name string, taken map[string]bool) string {
+	if name == "" || !taken[name] {
+		return ""
+	}
+	elems := strings.Split(path, "/")
+	if last := elems[len(elems)-1]; last != name && isMajorVersion(last) {
+		elems = elems[:len(elems)-1]
+	}
+	alias := name
+	for i := len(elems) - 2; i >= 0; i-- {
+		elem := identPart(elems[i])
+		if elem == "" || unicode.IsDigit(rune(elem[0])) {
+			continue
+		}
+		alias = elem + alias
+		if !taken[alias] && token.Lookup(alias) == token.IDENT {
+			return alias
+		}
+	}
+	for n := 2; ; n++ {
+		if a := alias + strconv.Itoa(n); !taken[a] {
+			return a
+		}
+	}
+}
+
+// guessPackageName returns the likely name of the package at path: its
+// last element, or the one before a major version suffix such as "v2",
+// up to a dot and stripped of "go-".
+func guessPackageName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && isMajorVersion(name) {
+		name = elems[len(elems)-2]
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	return identPart(strings.TrimPrefix(name, "go-"))
+}
+
+// isMajorVersion reports whether the path element elem is a major
+// version suffix, such as "v2".
+func isMajorVersion(elem string) bool {
+	if len(elem) < 2 || elem[0] != 'v' {
+		return false
+	}
+	for _, r := range elem[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// identPart returns elem lowercased, without the characters that can't
+// appear in an identifier.
+func identPart(elem string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, elem)
+}
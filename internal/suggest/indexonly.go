@@ -0,0 +1,146 @@
+package suggest
+
+import (
+	"bytes"
+	"go/ast"
+	"regexp"
+	"strings"
+)
+
+// generatedHeader matches the comment marking a generated file, as
+// described at https://golang.org/s/generatedcode.
+var generatedHeader = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.$`)
+
+// index records whether the file, whose contents are src, is
+// generated, and how long it is.
+func (e *fileCacheEntry) index(src []byte) {
+	e.lines = bytes.Count(src, []byte("\n"))
+	head := src
+	if e.file != nil && e.file.Package.IsValid() {
+		if off := cache.fset.Position(e.file.Package).Offset; off <= len(src) {
+			head = src[:off]
+		}
+	}
+	e.generated = generatedHeader.Match(head)
+}
+
+// addNeededFiles returns files plus the index-only files whose
+// declarations may be needed to complete at cursors in data: those
+// declaring a package-level name that files refer to, directly or
+// through other index-only files, a method of a type declared or
+// referred to, or, unless after a period, a name matching the
+// identifier at a cursor.
+func (c *Config) addNeededFiles(files, indexOnly []*ast.File, data []byte, cursors []int) []*ast.File {
+	if c.Outline {
+		return append(files, indexOnly...)
+	}
+
+	var prefixes []string
+	for _, cursor := range cursors {
+		ctx, _, partial := deduceCursorContext(data, cursor)
+		if ctx != selectContext {
+			prefixes = append(prefixes, strings.ToLower(c.matchPrefix(partial, data, cursor)))
+		}
+	}
+
+	refs := make(map[string]bool)
+	for _, file := range files {
+		addIdents(refs, file)
+	}
+	for added := true; added; {
+		added = false
+		rest := indexOnly[:0]
+		for _, file := range indexOnly {
+			if !declaresNeeded(file, refs, prefixes) {
+				rest = append(rest, file)
+				continue
+			}
+			files = append(files, file)
+			addIdents(refs, file)
+			added = true
+		}
+		indexOnly = rest
+	}
+	if len(indexOnly) > 0 {
+		c.Logf("skipped type-checking %d index-only files", len(indexOnly))
+	}
+	return files
+}
+
+// addIdents adds the names of all identifiers in file to refs.
+func addIdents(refs map[string]bool, file *ast.File) {
+	ast.Inspect(file, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			refs[id.Name] = true
+		}
+		return true
+	})
+}
+
+// declaresNeeded reports whether file declares a package-level name
+// in refs or with one of prefixes, or a method of a type in refs.
+func declaresNeeded(file *ast.File, refs map[string]bool, prefixes []string) bool {
+	needed := func(id *ast.Ident) bool {
+		if refs[id.Name] {
+			return true
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(strings.ToLower(id.Name), prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				if needed(decl.Name) {
+					return true
+				}
+				continue
+			}
+			// Keep methods of receivers not understood.
+			if len(decl.Recv.List) > 0 {
+				if recv := receiverTypeName(decl.Recv.List[0].Type); recv == nil || refs[recv.Name] {
+					return true
+				}
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					if needed(spec.Name) {
+						return true
+					}
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						if needed(name) {
+							return true
+						}
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// receiverTypeName returns the name of the base type of a method
+// receiver type, such as T in *T or T[K], or nil if it isn't found.
+func receiverTypeName(x ast.Expr) *ast.Ident {
+	for {
+		switch t := x.(type) {
+		case *ast.Ident:
+			return t
+		case *ast.StarExpr:
+			x = t.X
+		case *ast.ParenExpr:
+			x = t.X
+		case *ast.IndexExpr:
+			x = t.X
+		default:
+			return nil
+		}
+	}
+}
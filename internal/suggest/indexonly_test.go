@@ -0,0 +1,96 @@
+package suggest_test
+
+import (
+	"fmt"
+	"go/importer"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+// writeGeneratedPackage writes package foo to a temporary directory,
+// with a generated file declaring n message types, and another
+// declaring a method of a type of local.go, and returns the directory.
+func writeGeneratedPackage(t testing.TB, n int) string {
+	var gen strings.Builder
+	gen.WriteString("// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage foo\n\nimport \"fmt\"\n\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&gen, "type Msg%d struct {\n\tName  string\n\tCount int64\n\tTags  []string\n\tNext  *Msg%d\n}\n\n", i, i)
+		fmt.Fprintf(&gen, "func (m *Msg%d) GetName() string {\n\tif m == nil {\n\t\treturn \"\"\n\t}\n\treturn m.Name\n}\n\n", i)
+		fmt.Fprintf(&gen, "func (m *Msg%d) String() string { return fmt.Sprint(m.Name, m.Count, m.Tags) }\n\n", i)
+	}
+	gen.WriteString("type Used struct{ Field int }\n\nfunc (u *Used) Method() {}\n")
+	return writeFiles(t, map[string]string{
+		"foo.pb.go":    gen.String(),
+		"local.go":     "package foo\n\ntype Local struct{}\n",
+		"local_gen.go": "// Code generated by hand. DO NOT EDIT.\n\npackage foo\n\nfunc (l *Local) Generated() {}\n" + strings.Repeat("\n", 1000),
+	})
+}
+
+func TestIndexOnly(t *testing.T) {
+	dir := writeGeneratedPackage(t, 20)
+
+	tests := []struct {
+		src     string
+		want    []string
+		skipped bool
+	}{
+		// Nothing declared in the generated file is needed.
+		{"var zzz int\n\nfunc f() {\n\tzz@\n}\n", []string{"zzz"}, true},
+		{"func f(l *Local) {\n\tl.Ge@\n}\n", []string{"Generated"}, true},
+		// A type declared in the generated file is referred to.
+		{"func f() {\n\tvar u Used\n\tu.@\n}\n", []string{"Method", "Field"}, false},
+		// The identifier may name a generated declaration.
+		{"func f() {\n\tMsg1@\n}\n", []string{"Msg1", "Msg10", "Msg11", "Msg12", "Msg13", "Msg14", "Msg15", "Msg16", "Msg17", "Msg18", "Msg19"}, false},
+		{"func f() {\n\tmsg1@\n}\n", []string{"Msg1", "Msg10", "Msg11", "Msg12", "Msg13", "Msg14", "Msg15", "Msg16", "Msg17", "Msg18", "Msg19"}, false},
+	}
+	for _, test := range tests {
+		for _, lines := range []int{0, 100} {
+			src, cursors := cutCursors("package foo\n\n" + test.src)
+			var skipped bool
+			cfg := suggest.Config{
+				Importer:       importer.Default(),
+				IndexOnlyLines: lines,
+				Logf: func(format string, args ...interface{}) {
+					if strings.HasPrefix(format, "skipped type-checking") {
+						skipped = true
+					}
+				},
+			}
+			candidates, _ := cfg.Suggest(filepath.Join(dir, "foo.go"), []byte(src), cursors[0])
+			var got []string
+			for _, c := range candidates {
+				got = append(got, c.Name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%q (index-only lines %d): got %q, want %q", test.src, lines, got, test.want)
+			}
+			if want := test.skipped && lines > 0; skipped != want {
+				t.Errorf("%q (index-only lines %d): skipped the generated file %v, want %v", test.src, lines, skipped, want)
+			}
+		}
+	}
+}
+
+// BenchmarkIndexOnly completes in a package with a generated file of
+// several megabytes that the completion doesn't need.
+func BenchmarkIndexOnly(b *testing.B) {
+	dir := writeGeneratedPackage(b, 10000)
+	src, cursors := cutCursors("package foo\n\nvar zzz int\n\nfunc f() {\n\tzz@\n}\n")
+
+	for _, lines := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("lines=%d", lines), func(b *testing.B) {
+			cfg := suggest.Config{
+				Importer:       importer.Default(),
+				IndexOnlyLines: lines,
+				Logf:           func(string, ...interface{}) {},
+			}
+			for i := 0; i < b.N; i++ {
+				cfg.Suggest(filepath.Join(dir, "foo.go"), []byte(src), cursors[0])
+			}
+		})
+	}
+}
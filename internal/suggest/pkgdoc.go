@@ -0,0 +1,53 @@
+package suggest
+
+import (
+	"bytes"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// packageDoc returns the doc summary of the package path imported by
+// filename, found with c.PackageDocs, or "" if its sources can't be
+// found or read.
+func (c *Config) packageDoc(filename, path string) string {
+	if c.PackageDocs == nil {
+		return ""
+	}
+	ctx := *c.PackageDocs
+	bp, err := ctx.Import(path, filepath.Dir(filename), build.FindOnly)
+	if err != nil {
+		c.Logf("no sources found for the doc of %s: %v", path, err)
+		return ""
+	}
+	if c.Sandbox != nil {
+		if err := c.Sandbox.Check(bp.Dir); err != nil {
+			c.Logf("%v", err)
+			return ""
+		}
+		c.sandboxContext(&ctx)
+	}
+	bp, err = ctx.ImportDir(bp.Dir, 0)
+	if err != nil {
+		c.Logf("no doc found for %s: %v", path, err)
+		return ""
+	}
+	return bp.Doc
+}
+
+// sandboxContext makes ctx read directories and files through
+// c.Sandbox, if set.
+func (c *Config) sandboxContext(ctx *build.Context) {
+	if c.Sandbox == nil {
+		return
+	}
+	ctx.ReadDir = c.Sandbox.ReadDir
+	ctx.OpenFile = func(name string) (io.ReadCloser, error) {
+		data, err := c.Sandbox.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
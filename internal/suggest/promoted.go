@@ -0,0 +1,44 @@
+package suggest
+
+import "go/types"
+
+// promotedThroughUnexported reports whether obj, a field or method
+// selected on a value or type of typ, is promoted through an embedded
+// field that is unexported and declared outside of pkg, such as the
+// methods of an unexported implementation type embedded in an exported
+// wrapper. Go lets pkg select them regardless.
+func promotedThroughUnexported(typ types.Type, pkg *types.Package, obj types.Object) bool {
+	if obj.Pkg() == nil || obj.Pkg() == pkg {
+		return false
+	}
+	_, index, _ := types.LookupFieldOrMethod(typ, true, obj.Pkg(), obj.Name())
+	for i := 0; i < len(index)-1; i++ {
+		if p, ok := typ.Underlying().(*types.Pointer); ok {
+			typ = p.Elem()
+		}
+		st, ok := typ.Underlying().(*types.Struct)
+		if !ok {
+			return false
+		}
+		f := st.Field(index[i])
+		if !accessible(f, pkg) {
+			return true
+		}
+		typ = f.Type()
+	}
+	return false
+}
+
+// hidingUnexportedPromotions returns visit, leaving out the objects
+// promotedThroughUnexported on typ if c.HideUnexportedPromotions is
+// set.
+func (c *Config) hidingUnexportedPromotions(typ types.Type, pkg *types.Package, visit func(types.Object)) func(types.Object) {
+	if !c.HideUnexportedPromotions || typ == nil {
+		return visit
+	}
+	return func(obj types.Object) {
+		if !promotedThroughUnexported(typ, pkg, obj) {
+			visit(obj)
+		}
+	}
+}
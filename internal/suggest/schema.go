@@ -0,0 +1,170 @@
+package suggest
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// FormatVersion is the version of the json output format. It must be
+// incremented whenever Candidate or the json response layout changes
+// incompatibly. Adding an omitempty field is not an incompatible change.
+const FormatVersion = 1
+
+// ResponseSchema returns a JSON Schema describing the json format's
+// response: [len, [candidates...], {"format_version": N}].
+func ResponseSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "array",
+		"items": []interface{}{
+			map[string]interface{}{"type": "integer"},
+			map[string]interface{}{
+				"type":  "array",
+				"items": SchemaFor(reflect.TypeOf(Candidate{})),
+			},
+			SchemaFor(reflect.TypeOf(responseInfo{})),
+		},
+	}
+}
+
+// responseInfo is the trailing object of a json response.
+type responseInfo struct {
+	FormatVersion int         `json:"format_version"`
+	Replace       *Range      `json:"replace,omitempty"`
+	Generation    int64       `json:"generation,omitempty"`
+	Delta         *Delta      `json:"delta,omitempty"`
+	Truncated     bool        `json:"truncated,omitempty"`
+	Partial       bool        `json:"partial,omitempty"`
+	PackageDoc    string      `json:"package_doc,omitempty"`
+	OperandValues int         `json:"operand_values,omitempty"`
+	Diagnostics   []string    `json:"diagnostics,omitempty"`
+	Rejections    []Rejection `json:"rejections,omitempty"`
+}
+
+// SchemaFor returns a JSON Schema for values of type t as encoded by
+// encoding/json. Struct property names are taken from json struct
+// tags, so the schema changes whenever the Go types do.
+func SchemaFor(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return SchemaFor(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json encodes []byte as base64.
+			return map[string]interface{}{"type": "string"}
+		}
+		return map[string]interface{}{"type": "array", "items": SchemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": SchemaFor(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		required := []string{}
+		structProperties(t, props, &required)
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"required":             required,
+			"additionalProperties": false,
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// structProperties adds the properties of the fields of the struct
+// type t to props, and the names of those that are required to
+// required. As with encoding/json, the fields of embedded structs
+// without a json name are properties of t, unless t has fields of the
+// same names.
+func structProperties(t reflect.Type, props map[string]interface{}, required *[]string) {
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts := f.Name, ""
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if i := strings.IndexByte(tag, ','); i >= 0 {
+				tag, opts = tag[:i], tag[i:]
+			}
+			if tag != "" {
+				name = tag
+			} else if isEmbeddedStruct(f) {
+				embedded = append(embedded, f)
+				continue
+			}
+		} else if isEmbeddedStruct(f) {
+			embedded = append(embedded, f)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		props[name] = SchemaFor(f.Type)
+		if !strings.Contains(opts, ",omitempty") {
+			*required = append(*required, name)
+		}
+	}
+	for _, f := range embedded {
+		inner := make(map[string]interface{})
+		var innerRequired []string
+		t := f.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		structProperties(t, inner, &innerRequired)
+		promoted := make(map[string]bool)
+		for name, schema := range inner {
+			if _, ok := props[name]; !ok {
+				props[name] = schema
+				promoted[name] = true
+			}
+		}
+		if f.Type.Kind() == reflect.Ptr {
+			// A nil pointer has no fields.
+			continue
+		}
+		for _, name := range innerRequired {
+			if promoted[name] {
+				*required = append(*required, name)
+			}
+		}
+	}
+}
+
+// isEmbeddedStruct reports whether f is an embedded struct, or pointer
+// to a struct, whose fields encoding/json encodes as those of the
+// struct embedding it.
+func isEmbeddedStruct(f reflect.StructField) bool {
+	if !f.Anonymous {
+		return false
+	}
+	t := f.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// Schema returns the versioned JSON Schema document printed by
+// "gocode schema". request describes the autocomplete request.
+func Schema(request reflect.Type) ([]byte, error) {
+	doc := map[string]interface{}{
+		"$schema":        "http://json-schema.org/draft-07/schema#",
+		"format_version": FormatVersion,
+		"definitions": map[string]interface{}{
+			"request":  SchemaFor(request),
+			"response": ResponseSchema(),
+		},
+	}
+	return json.MarshalIndent(doc, "", "\t")
+}
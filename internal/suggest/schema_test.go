@@ -0,0 +1,40 @@
+package suggest_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/golden"
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestResponseSchema(t *testing.T) {
+	got, err := json.MarshalIndent(suggest.ResponseSchema(), "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// If the schema changed incompatibly, bump FormatVersion.
+	golden.Check(t, "testdata/schema.golden", append(got, '\n'))
+}
+
+func TestSchemaEmbedded(t *testing.T) {
+	type inner struct {
+		A int    `json:"a"`
+		B string `json:"b,omitempty"`
+		C int    `json:"c"`
+	}
+	type outer struct {
+		inner
+		C string `json:"c"`
+		D bool   `json:"d"`
+	}
+	got, err := json.Marshal(suggest.SchemaFor(reflect.TypeOf(outer{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"additionalProperties":false,"properties":{"a":{"type":"integer"},"b":{"type":"string"},"c":{"type":"string"},"d":{"type":"boolean"}},"required":["c","d","a"],"type":"object"}`
+	if string(got) != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
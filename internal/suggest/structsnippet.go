@@ -0,0 +1,60 @@
+package suggest
+
+import (
+	"fmt"
+	"go/types"
+	"strings"
+)
+
+// structLiteralCandidate returns a snippet candidate for a composite
+// literal of the struct type typ, which is expected at the cursor,
+// listing its fields with a placeholder for each: T{A: $1, B: $2}, or
+// &T{...} if typ is a pointer to T, broken over several lines if it
+// doesn't fit on the cursor's line. The fields that aren't accessible
+// are left out. It returns false if typ isn't a named struct type, or
+// a pointer to one, if its package isn't allowed, or if the snippet
+// doesn't match the identifier typed.
+func (b *candidateCollector) structLiteralCandidate(typ types.Type) (Candidate, bool) {
+	var amp string
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ, amp = ptr.Elem(), "&"
+	}
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return Candidate{}, false
+	}
+	s, ok := named.Underlying().(*types.Struct)
+	if !ok {
+		return Candidate{}, false
+	}
+	name := types.TypeString(named, b.qualify)
+	if !b.allowed(named.Obj()) || !b.matchText(name) {
+		return Candidate{}, false
+	}
+
+	var fields, elems []string
+	for i := 0; i < s.NumFields(); i++ {
+		f := s.Field(i)
+		if !accessible(f, b.localpkg) {
+			continue
+		}
+		fields = append(fields, f.Name())
+		elems = append(elems, fmt.Sprintf("%s: $%d", f.Name(), len(elems)+1))
+	}
+
+	cand := nameCandidate("snippet", amp+name+"{}")
+	cand.Type = types.TypeString(named, b.qualifyType)
+	cand.PkgPath = named.Obj().Pkg().Path()
+	cand.Label = amp + name + "{" + strings.Join(fields, ", ") + "}"
+	cand.InsertText = b.format.list(amp+name+"{", elems, "}")
+	cand.FilterText = name
+	return cand, true
+}
+
+// matchText reports whether text starts with the identifier typed.
+func (b *candidateCollector) matchText(text string) bool {
+	if b.ignoreCase {
+		return strings.HasPrefix(strings.ToLower(text), strings.ToLower(b.partial))
+	}
+	return strings.HasPrefix(text, b.partial)
+}
@@ -2,20 +2,29 @@ package suggest
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"go/ast"
+	"go/build"
+	"go/build/constraint"
 	"go/parser"
 	"go/scanner"
 	"go/token"
 	"go/types"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/mdempsky/gocode/internal/lookdot"
+	"github.com/mdempsky/gocode/format"
+	"github.com/mdempsky/gocode/internal/sandbox"
 )
 
 type Config struct {
@@ -24,72 +33,519 @@ type Config struct {
 	Builtin            bool
 	IgnoreCase         bool
 	UnimportedPackages bool
+
+	// TypeHints completes the members of an interface-typed
+	// variable with those of the type it is asserted to later in
+	// the function, listed after the interface's own methods.
+	TypeHints bool
+
+	// Details sets the Detail of type candidates to a summary of
+	// the type, such as "struct with 2 fields".
+	Details bool
+
+	// CgoInternals includes the identifiers generated by cgo, such
+	// as _Ctype_int, which are left out by default.
+	CgoInternals bool
+
+	// Skeletons adds function skeletons, such as func main, to the
+	// keywords proposed where a top-level declaration may start.
+	Skeletons bool
+
+	// Snippets proposes, where a value of a named struct type is
+	// expected, a snippet candidate listed first: a composite literal
+	// of the type with a placeholder for each field.
+	Snippets bool
+
+	// QualifiedTypes qualifies the types of other packages in the
+	// Type, Origin and Detail of candidates by their import path,
+	// such as "github.com/foo/bar.Type", rather than by package name.
+	// The text candidates insert is still qualified by name.
+	QualifiedTypes bool
+
+	// Explain sets the Explain of the candidates of symbols, and the
+	// Rejections of the Result, for debugging ranking and filtering.
+	Explain bool
+
+	// CallHints sets the ArgsCount, ResultsCount and CallableNoArgs
+	// of func candidates.
+	CallHints bool
+
+	// AllowedPackages, if non-nil, restricts the candidates to the
+	// symbols declared in the package being completed, predeclared
+	// ones, and those of these packages, given by import path or as
+	// "path/..." for path and the packages below it. The names of the
+	// imports of other packages, and the other import paths, aren't
+	// proposed either.
+	AllowedPackages []string
+
+	// NamesOnly only sets the Class and Name of candidates,
+	// for clients that fetch the rest lazily: types, positions,
+	// details and the other fields requested are left out, and so
+	// are snippets and the PackageDoc of the Result.
+	NamesOnly bool
+
+	// Indent and LineWidth format the snippets that may span
+	// several lines, such as struct literals: one that would make
+	// the cursor's line wider than LineWidth columns, if positive,
+	// with tabs 8 columns wide, is broken into several lines,
+	// indented by Indent, a tab if empty, relative to the cursor's
+	// line. By default, snippets aren't broken.
+	Indent    string
+	LineWidth int
+
+	// HideUnexportedPromotions leaves out, after a selector, the
+	// fields and methods of the types of other packages promoted
+	// through their unexported embedded fields, which Go lets the
+	// package select, as implementation details. The unexported
+	// fields themselves are never proposed.
+	HideUnexportedPromotions bool
+
+	// EmbedPatterns proposes, in the patterns of a //go:embed
+	// directive, the files and directories of the package directory
+	// matching the path typed.
+	EmbedPatterns bool
+
+	// GoVersions sets the GoVersion of the candidates of other
+	// packages to the go directive of their module, found with
+	// BuildContext, for editors warning about APIs that may need a
+	// newer Go than the project's.
+	GoVersions bool
+
+	// MaxChainLinks, if positive, is the number of links, selectors,
+	// calls and index expressions, of a selector chain beyond which
+	// the members of its last link aren't proposed: the Result only
+	// holds a diagnostic rather than a type-check of the chain.
+	MaxChainLinks int
+
+	// InsertParens sets the InsertText of func candidates to a call,
+	// "f()" or "f($1)", unless the cursor is where a func value is
+	// expected.
+	InsertParens bool
+
+	// Prefix, if non-empty, replaces the identifier before the
+	// cursor as the text candidates must start with. It is ignored
+	// unless the text before the cursor ends with it. The length of
+	// the text to replace is still that of the identifier.
+	Prefix string
+
+	// MarkUnaddressable proposes the methods with pointer receivers
+	// of a value that isn't addressable, such as a map element,
+	// marked as Unaddressable. They are left out otherwise.
+	MarkUnaddressable bool
+
+	// Implementers proposes, where a value of an interface type is
+	// expected, the named types of the package and its imports that
+	// implement it, first, with Implements and InsertText set.
+	Implementers bool
+
+	// Outline makes Suggest return every package-level declaration
+	// of the file's package, with positions, regardless of cursor.
+	Outline bool
+
+	// SortByPosition sorts candidates declared in the package by
+	// where they are declared, rather than by class and name.
+	SortByPosition bool
+
+	// ReferenceCount, if non-nil, returns how many times the
+	// package-level symbol name of the package path is referred to
+	// in the workspace. Within their class, candidates are then
+	// ranked by the integer part of ReferenceWeight times the
+	// base-2 logarithm of one plus their count, and by name for
+	// equal ranks. A ReferenceWeight of 0 disables the ranking.
+	ReferenceCount  func(path, name string) int
+	ReferenceWeight float64
+
+	// IndexOnlyLines, if positive, makes the other files of the
+	// package that are generated, with a "Code generated ... DO NOT
+	// EDIT." header, and longer than this many lines index-only:
+	// they are only type-checked if a candidate may be declared in
+	// them, that is, if the identifier at the cursor is a prefix of
+	// one of their package-level names, or the rest of the package
+	// refers to them.
+	IndexOnlyLines int
+
+	// Sandbox, if non-nil, confines the reads of the other files of
+	// the package. Files outside of it are left out.
+	Sandbox *sandbox.FS
+
+	// PackageDocs, if non-nil, is used to find the sources of the
+	// package whose members are proposed after "pkg.", to set the
+	// PackageDoc of the Result.
+	PackageDocs *build.Context
+
+	// CheckCache reuses the type-checked package of the previous
+	// completions that checked the same files: the same contents of
+	// the file, with the same cursors, and the same other files of
+	// the package, as long as the Importer returns the same packages
+	// for its imports. It pays off with an Importer that keeps the
+	// packages it imports across requests.
+	CheckCache bool
+
+	// BuildContext, if non-nil, selects the other files of the
+	// package that are type-checked with the file being completed:
+	// those matching its build constraints. Files it selects that
+	// declare another package are reported in the Diagnostics. It
+	// isn't applied if the file being completed doesn't match it.
+	BuildContext *build.Context
+
+	// ImportPaths, if non-nil, is used to propose the import paths of
+	// the directories in its GOROOT and GOPATH, and in the module
+	// holding the file and its vendor directory, when completing the
+	// path of an import spec. The module cache isn't searched.
+	ImportPaths *build.Context
 }
 
 var cache = struct {
-	lock  sync.Mutex
-	files map[string]fileCacheEntry
-	fset  *token.FileSet
+	lock   sync.Mutex
+	files  map[string]fileCacheEntry
+	fset   *token.FileSet
+	checks map[checkKey]*checkEntry
 }{
-	files: make(map[string]fileCacheEntry),
-	fset:  token.NewFileSet(),
+	files:  make(map[string]fileCacheEntry),
+	fset:   token.NewFileSet(),
+	checks: make(map[checkKey]*checkEntry),
 }
 
 type fileCacheEntry struct {
 	file  *ast.File
 	mtime time.Time
+	sum   [sha256.Size]byte
+
+	// lines and generated tell whether the file may be index-only,
+	// see Config.IndexOnlyLines.
+	lines     int
+	generated bool
 }
 
 // Suggest returns a list of suggestion candidates and the length of
 // the text that should be replaced, if any.
 func (c *Config) Suggest(filename string, data []byte, cursor int) ([]Candidate, int) {
+	res := c.SuggestResult(filename, data, cursor)
+	return res.Candidates, res.Len
+}
+
+// SuggestResult is like Suggest, but returns a Result, which also
+// holds the doc summary of the package whose members are proposed.
+func (c *Config) SuggestResult(filename string, data []byte, cursor int) Result {
 	if cursor < 0 {
-		return nil, 0
+		return Result{}
+	}
+	if diag := c.chainDiagnostic(data, cursor); diag != "" {
+		return Result{Diagnostics: []string{diag}}
 	}
 
-	fset, pos, pkg, imports := c.analyzePackage(filename, data, cursor)
+	fset, pos, pkg, file, diags := c.analyzePackage(filename, data, []int{cursor})
 	if pkg == nil {
 		c.Logf("no package found for %s", filename)
-		return nil, 0
+		return Result{}
+	}
+	res := c.suggestAt(fset, pos[0], pkg, file, data, cursor)
+	res.Diagnostics = append(append(diags, importDiagnostics(pkg, file)...), res.Diagnostics...)
+	return res
+}
+
+// importDiagnostics reports the imports of file that pkg can't have,
+// but that type-checking went along with: those of main packages,
+// which are programs. Their exported members are still proposed.
+func importDiagnostics(pkg *types.Package, file *ast.File) []string {
+	var diags []string
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		for _, imp := range pkg.Imports() {
+			if imp.Path() != path {
+				continue
+			}
+			if why := importRestriction("", path, "", imp.Name()); why != "" {
+				diags = append(diags, fmt.Sprintf("import %q %s", path, why))
+			}
+		}
+	}
+	return diags
+}
+
+// An importCycle is an import error reporting an import cycle, such
+// as a cache.ImportCycleError.
+type importCycle interface {
+	error
+	ImportCycle() []string
+}
+
+// cycleImporter imports with imp, and keeps the import cycles it
+// reports as diagnostics. The type checker only keeps the messages of
+// import errors.
+type cycleImporter struct {
+	imp   types.Importer
+	diags []string
+}
+
+func (i *cycleImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, "", 0)
+}
+
+func (i *cycleImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	pkg, err := importFrom(i.imp, path, srcDir)
+	if cycle, ok := err.(importCycle); ok {
+		i.diags = append(i.diags, cycle.Error())
+	}
+	return pkg, err
+}
+
+// MaxCursors is the maximum number of cursors accepted by SuggestMulti.
+const MaxCursors = 64
+
+// Result holds the candidates for one cursor of SuggestMulti. Err is
+// non-empty if completion failed at that cursor.
+type Result struct {
+	Candidates []Candidate
+	Len        int
+	Err        string
+
+	// Replace is the range of the identifier the candidates
+	// replace, also when the cursor is within it.
+	Replace Range
+
+	// PackageDoc is the doc summary of the package whose members
+	// are proposed, if Config.PackageDocs is set.
+	PackageDoc string
+
+	// Diagnostics describe problems of the file that completion
+	// works around, such as imports of main packages, or files of
+	// another package in its directory.
+	Diagnostics []string
+
+	// Rejections are the symbols matching the identifier being
+	// completed that aren't proposed, with Config.Explain.
+	Rejections []Rejection
+
+	// OperandValues is the number of values of the call whose
+	// members are proposed, if it has several, such as
+	// strconv.Atoi(s). The candidates are then the members of its
+	// first result, and a diagnostic says so.
+	OperandValues int
+
+	// Truncated reports whether the candidates were cut short by
+	// Truncate.
+	Truncated bool
+}
+
+// SuggestMulti is like Suggest, but returns a Result for each of
+// cursors. The package is parsed and type-checked only once, and a
+// failure at one cursor doesn't affect the others.
+func (c *Config) SuggestMulti(filename string, data []byte, cursors []int) []Result {
+	res := make([]Result, len(cursors))
+	if len(cursors) > MaxCursors {
+		for i := range res {
+			res[i].Err = fmt.Sprintf("too many cursors (%d > %d)", len(cursors), MaxCursors)
+		}
+		return res
+	}
+
+	var valid []int
+	for i, cursor := range cursors {
+		if cursor < 0 || cursor > len(data) {
+			res[i].Err = fmt.Sprintf("invalid cursor %d", cursor)
+			continue
+		}
+		if diag := c.chainDiagnostic(data, cursor); diag != "" {
+			res[i].Diagnostics = []string{diag}
+			continue
+		}
+		valid = append(valid, cursor)
+	}
+	if len(valid) == 0 {
+		return res
+	}
+
+	fset, pos, pkg, file, diags := c.analyzePackage(filename, data, valid)
+	if pkg == nil {
+		c.Logf("no package found for %s", filename)
+	}
+	for i, cursor := range cursors {
+		if res[i].Err != "" || res[i].Diagnostics != nil {
+			// Invalid, or refused.
+			continue
+		}
+		if pkg == nil {
+			res[i].Err = "no package found"
+			continue
+		}
+		res[i] = c.safeSuggestAt(fset, pos[0], pkg, file, data, cursor)
+		res[i].Diagnostics = append(append(diags[:len(diags):len(diags)], importDiagnostics(pkg, file)...), res[i].Diagnostics...)
+		pos = pos[1:]
+	}
+	return res
+}
+
+func (c *Config) safeSuggestAt(fset *token.FileSet, pos token.Pos, pkg *types.Package, file *ast.File, data []byte, cursor int) (res Result) {
+	defer func() {
+		if err := recover(); err != nil {
+			res = Result{Err: fmt.Sprintf("panic: %v", err)}
+		}
+	}()
+	return c.suggestAt(fset, pos, pkg, file, data, cursor)
+}
+
+func (c *Config) suggestAt(fset *token.FileSet, pos token.Pos, pkg *types.Package, file *ast.File, data []byte, cursor int) Result {
+	localPath := c.localImportPath(filepath.Dir(fset.Position(file.Package).Filename))
+	if c.Outline {
+		b := candidateCollector{
+			localpkg:   pkg,
+			localPath:  localPath,
+			imports:    file.Imports,
+			fset:       fset,
+			positions:  true,
+			byPosition: c.SortByPosition,
+			fullPaths:  c.QualifiedTypes,
+			namesOnly:  c.NamesOnly,
+			allow:      c.AllowedPackages,
+		}
+		c.outlineCandidates(pkg, &b)
+		return Result{Candidates: b.getCandidates()}
 	}
 	scope := pkg.Scope().Innermost(pos)
 
 	ctx, expr, partial := deduceCursorContext(data, cursor)
+	match := c.matchPrefix(partial, data, cursor)
 	b := candidateCollector{
-		localpkg:   pkg,
-		imports:    imports,
-		partial:    partial,
-		filter:     objectFilters[partial],
-		builtin:    ctx != selectContext && c.Builtin,
-		ignoreCase: c.IgnoreCase,
+		localpkg:     pkg,
+		localPath:    localPath,
+		imports:      file.Imports,
+		partial:      match,
+		filter:       objectFilters[match],
+		builtin:      ctx != selectContext && c.Builtin,
+		ignoreCase:   c.IgnoreCase,
+		details:      c.Details,
+		cgoInternals: c.CgoInternals,
+		callHints:    c.CallHints,
+		fset:         fset,
+		byPosition:   c.SortByPosition,
+		fullPaths:    c.QualifiedTypes,
+		explain:      c.Explain,
+		namesOnly:    c.NamesOnly,
+		allow:        c.AllowedPackages,
+	}
+	if c.ReferenceCount != nil && c.ReferenceWeight > 0 {
+		b.refCount, b.refWeight = c.ReferenceCount, c.ReferenceWeight
+	}
+	b.format = c.snippetFormat(data, ReplaceRange(data, cursor, len(partial)))
+	if c.GoVersions && c.BuildContext != nil {
+		b.goVersion = c.goVersions(filepath.Dir(fset.Position(file.Package).Filename))
+	}
+	if c.InsertParens {
+		b.insertParens = !c.funcValueContext(fset, pos, pkg, data, cursor)
+	}
+	if ctx != selectContext {
+		b.boost = c.contextBoost(fset, pos, pkg, file, data, cursor)
+	}
+	b.kinds = typeArgKinds(scope, pos, data, cursor)
+	if b.kinds == nil {
+		b.kinds = interfaceKinds(file, pos)
 	}
+	if ctx == unknownContext && atDeclStart(data, cursor) && afterPackageClause(file, pos) {
+		// Only a declaration can start here.
+		res := c.declCandidates(fset, pkg, file, match)
+		if len(res) == 0 {
+			return Result{}
+		}
+		return Result{Candidates: res, Len: len(partial), Replace: ReplaceRange(data, cursor, len(partial))}
+	}
+	var doc string
+	var addImport string // the import spec the candidates need
+	var snippets []Candidate
+	var diags []string
+	var values int // of a multi-valued operand
+	links := newLinkCache(fset, pkg, pos)
 	switch ctx {
 	case emptyResultsContext:
+		if typed, ok := embedPatternAt(data, cursor); ok && c.EmbedPatterns {
+			return c.embedCandidates(filepath.Dir(fset.Position(file.Package).Filename), typed, data, cursor)
+		}
+		if lit := importPathAt(file, pos); lit != nil && c.ImportPaths != nil {
+			return c.importPathCandidates(fset, file, lit, pkg, data, cursor)
+		}
 		// don't show results in certain cases
-		return nil, 0
+		return Result{}
 
 	case selectContext:
-		tv, _ := types.Eval(fset, pkg, pos, expr)
-		if lookdot.Walk(&tv, b.appendObject) {
+		tv, _ := links.eval(expr)
+		if tuple, ok := tv.Type.(*types.Tuple); ok && tv.IsValue() {
+			// A call with several results can't be an
+			// operand, but completing its first result,
+			// such as the value of a (T, error) call,
+			// beats proposing nothing.
+			values = tuple.Len()
+			first := tuple.At(0).Type()
+			call := expr
+			if e, err := parser.ParseExpr(expr); err == nil {
+				call = types.ExprString(e)
+			}
+			diags = append(diags, fmt.Sprintf("%s has %d values; completing the members of the first, of type %s", call, values, types.TypeString(first, b.qualify)))
+			if types.IsInterface(first) {
+				b.iface = first
+			}
+			links.members.WalkValue(first, false, c.hidingUnexportedPromotions(first, pkg, b.appendObject))
+			break
+		}
+		if tv.Type == nil {
+			if typ, addressable := looseOperandType(links, expr); typ != nil {
+				if types.IsInterface(typ) {
+					b.iface = typ
+				}
+				links.members.WalkValue(typ, addressable, c.hidingUnexportedPromotions(typ, pkg, b.appendObject))
+				break
+			}
+		}
+		if tv.Type != nil && types.IsInterface(tv.Type) {
+			b.iface = tv.Type
+		}
+		if b.iface != nil && c.TypeHints {
+			if hint := assertedType(fset, pkg, file, pos, expr); hint != nil {
+				c.hintedCandidates(links, &tv, hint, &b)
+				break
+			}
+		}
+		if links.members.Walk(&tv, c.hidingUnexportedPromotions(tv.Type, pkg, b.appendObject)) {
+			if c.MarkUnaddressable || c.Explain {
+				c.unaddressableMethods(links, &tv, &b)
+			}
 			break
 		}
 
+		// The innermost binding of expr decides, so a variable
+		// shadowing a package name hides the package's members.
 		_, obj := scope.LookupParent(expr, pos)
 		if pkgName, isPkg := obj.(*types.PkgName); isPkg {
 			c.packageCandidates(pkgName.Imported(), &b)
+			if !c.NamesOnly {
+				doc = c.packageDoc(fset.Position(file.Package).Filename, pkgName.Imported().Path())
+			}
 			break
 		}
-		if !c.UnimportedPackages {
-			return nil, 0
+		if obj != nil || !c.UnimportedPackages {
+			return Result{}
 		}
-		pkg := c.resolveKnownPackageIdent(expr)
+		pkg := c.resolveKnownPackageIdent(expr, filepath.Dir(fset.Position(file.Package).Filename))
 		if pkg == nil {
-			return nil, 0
+			return Result{}
 		}
 		c.packageCandidates(pkg, &b)
+		// expr isn't bound in the file, so the package can be
+		// imported under its name.
+		addImport = strconv.Quote(pkg.Path())
+
+	case typeAssertContext:
+		tv, _ := links.eval(expr)
+		if tv.Type != nil && !types.IsInterface(tv.Type) {
+			// Only interface values can be asserted.
+			return Result{}
+		}
+		c.typeAssertCandidates(tv.Type, pkg, scope, pos, &b)
 
 	case compositeLiteralContext:
-		tv, _ := types.Eval(fset, pkg, pos, expr)
+		tv, _ := links.eval(expr)
 		if tv.IsType() {
 			if _, isStruct := tv.Type.Underlying().(*types.Struct); isStruct {
 				c.fieldNameCandidates(tv.Type, &b)
@@ -98,17 +554,142 @@ func (c *Config) Suggest(filename string, data []byte, cursor int) ([]Candidate,
 		}
 		fallthrough
 	case unknownContext:
+		if lit := interfaceElemAt(file, pos); lit != nil {
+			c.interfaceElemCandidates(lit, scope, pos, &b)
+			break
+		}
 		c.scopeCandidates(scope, pos, &b)
+		if c.Implementers {
+			if iface := c.expectedInterface(fset, pos, pkg, data, cursor); iface != nil {
+				c.implementerCandidates(iface, pkg, &b)
+			}
+		}
+		if c.Snippets && !c.NamesOnly {
+			if typ := c.expectedType(fset, pos, pkg, data, cursor); typ != nil {
+				if cand, ok := b.structLiteralCandidate(typ); ok {
+					snippets = append(snippets, cand)
+				}
+			}
+			if lit := cursor - len("func("); lit >= 0 && string(data[lit:cursor]) == "func(" {
+				if typ := c.expectedType(fset, pos, pkg, data, lit); typ != nil {
+					if cand, ok := b.funcLitParamsCandidate(typ); ok {
+						snippets = append(snippets, cand)
+					}
+				}
+			}
+		}
 	}
 
-	res := b.getCandidates()
+	res := append(snippets, b.getCandidates()...)
 	if len(res) == 0 {
-		return nil, 0
+		return Result{Rejections: b.rejections, Diagnostics: diags, OperandValues: values}
+	}
+	for i := range res {
+		res[i].Import = addImport
+	}
+	return Result{
+		Candidates:    res,
+		Len:           len(partial),
+		Replace:       ReplaceRange(data, cursor, len(partial)),
+		PackageDoc:    doc,
+		Diagnostics:   diags,
+		Rejections:    b.rejections,
+		OperandValues: values,
+	}
+}
+
+// matchPrefix returns the text candidates at cursor must start with:
+// c.Prefix if the text before cursor ends with it, and otherwise the
+// identifier partial extracted from the buffer.
+func (c *Config) matchPrefix(partial string, data []byte, cursor int) string {
+	if c.Prefix == "" {
+		return partial
+	}
+	if !bytes.HasSuffix(data[:cursor], []byte(c.Prefix)) {
+		c.Logf("prefix %q doesn't precede the cursor, using %q", c.Prefix, partial)
+		return partial
+	}
+	return c.Prefix
+}
+
+// Range is a range of byte offsets in the buffer, End excluded.
+type Range = format.Range
+
+// ReplaceRange returns the range of the identifier at cursor whose
+// first num bytes precede the cursor. A candidate replaces all of it,
+// including the part after the cursor.
+func ReplaceRange(data []byte, cursor, num int) Range {
+	end := cursor
+	for end < len(data) {
+		r, size := utf8.DecodeRune(data[end:])
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		end += size
+	}
+	return Range{Start: cursor - num, End: end}
+}
+
+// declKeywords are the keywords that start a top-level declaration.
+var declKeywords = []string{"const", "func", "import", "type", "var"}
+
+// declCandidates returns the keywords, and optionally the function
+// skeletons, that can start the first declaration of file.
+func (c *Config) declCandidates(fset *token.FileSet, pkg *types.Package, file *ast.File, partial string) []Candidate {
+	match := func(s string) bool {
+		if c.IgnoreCase {
+			return strings.HasPrefix(strings.ToLower(s), strings.ToLower(partial))
+		}
+		return strings.HasPrefix(s, partial)
+	}
+
+	var res []Candidate
+	for _, kw := range declKeywords {
+		if match(kw) {
+			res = append(res, nameCandidate("keyword", kw))
+		}
+	}
+
+	if c.Skeletons {
+		var skeleton string
+		switch {
+		case strings.HasSuffix(fset.Position(file.Package).Filename, "_test.go"):
+			skeleton = "func TestXxx(t *testing.T) {}"
+		case pkg.Name() == "main" && pkg.Scope().Lookup("main") == nil:
+			skeleton = "func main() {}"
+		}
+		if skeleton != "" && match(skeleton) {
+			res = append(res, nameCandidate("snippet", skeleton))
+		}
+	}
+	return res
+}
+
+// afterPackageClause reports whether pos follows the package clause
+// of file with no declaration in between, but the one being typed.
+func afterPackageClause(file *ast.File, pos token.Pos) bool {
+	if pos <= file.Name.End() {
+		return false
+	}
+	for _, decl := range file.Decls {
+		if _, bad := decl.(*ast.BadDecl); bad {
+			// Likely the declaration being typed.
+			continue
+		}
+		if decl.Pos() < pos {
+			return false
+		}
 	}
-	return res, len(partial)
+	return true
 }
 
 func (c *Config) parseOtherFile(filename string) *ast.File {
+	return c.otherFile(filename).file
+}
+
+// otherFile returns the cache entry of another file of the package,
+// parsing the file again if it changed.
+func (c *Config) otherFile(filename string) fileCacheEntry {
 	entry := cache.files[filename]
 
 	fi, err := os.Stat(filename)
@@ -118,27 +699,44 @@ func (c *Config) parseOtherFile(filename string) *ast.File {
 	}
 
 	if entry.mtime != fi.ModTime() {
-		file, err := parser.ParseFile(cache.fset, filename, nil, 0)
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			panic(err)
+		}
+		file, err := parser.ParseFile(cache.fset, filename, src, 0)
 		if err != nil {
 			c.logParseError(fmt.Sprintf("Error parsing %q", filename), err)
 		}
-		trimAST(file, token.NoPos)
+		trimAST(file)
 
-		entry = fileCacheEntry{file, fi.ModTime()}
+		entry = fileCacheEntry{file: file, mtime: fi.ModTime(), sum: sha256.Sum256(src)}
+		entry.index(src)
 		cache.files[filename] = entry
 	}
 
-	return entry.file
+	return entry
 }
 
-func (c *Config) analyzePackage(filename string, data []byte, cursor int) (*token.FileSet, token.Pos, *types.Package, []*ast.ImportSpec) {
+// analyzePackage parses and type-checks the package containing
+// filename, whose contents are data. It returns the position of each
+// of cursors, which must be valid offsets in data, the trimmed AST of
+// the file, and the diagnostics of findOtherPackageFiles.
+func (c *Config) analyzePackage(filename string, data []byte, cursors []int) (*token.FileSet, []token.Pos, *types.Package, *ast.File, []string) {
+	// The cache is only locked while parsing, so that a request
+	// waiting for slow imports doesn't hold up others.
 	cache.lock.Lock()
-	defer cache.lock.Unlock()
+	locked := true
+	defer func() {
+		if locked {
+			cache.lock.Unlock()
+		}
+	}()
 
 	// Reset every 1GB of files so fset doesn't overflow.
 	if cache.fset.Base() >= 1e9 {
 		cache.fset = token.NewFileSet()
 		cache.files = make(map[string]fileCacheEntry)
+		cache.checks = make(map[checkKey]*checkEntry)
 	}
 
 	// Delete random files to keep the cache at most 100 entries.
@@ -152,7 +750,47 @@ func (c *Config) analyzePackage(filename string, data []byte, cursor int) (*toke
 	// If we're in trailing white space at the end of a scope,
 	// sometimes go/types doesn't recognize that variables should
 	// still be in scope there.
-	filesemi := bytes.Join([][]byte{data[:cursor], []byte(";"), data[cursor:]}, nil)
+	var semis []int
+	for _, cursor := range cursors {
+		i := sort.SearchInts(semis, cursor)
+		if i == len(semis) || semis[i] != cursor {
+			semis = append(semis[:i], append([]int{cursor}, semis[i:]...)...)
+		}
+	}
+	type insertion struct {
+		off  int
+		text string
+	}
+	var inserts []insertion
+	for _, semi := range semis {
+		if off, text, ok := openFuncLit(data, semi); ok {
+			inserts = append(inserts, insertion{off, text})
+		}
+		text := ";"
+		if afterDeferOrGo(data, semi) || afterPeriod(data, semi) {
+			// "go ;" and "x.;" make the parser drop the rest
+			// of the block, so complete them.
+			text = "_;"
+		}
+		inserts = append(inserts, insertion{semi, text})
+	}
+	sort.SliceStable(inserts, func(i, j int) bool { return inserts[i].off < inserts[j].off })
+	var filesemi []byte
+	shift := make(map[int]int)
+	prev := 0
+	for i, in := range inserts {
+		if i > 0 && in == inserts[i-1] {
+			// The signature of the same func literal.
+			continue
+		}
+		filesemi = append(filesemi, data[prev:in.off]...)
+		if _, ok := shift[in.off]; !ok {
+			shift[in.off] = len(filesemi) - in.off
+		}
+		filesemi = append(filesemi, in.text...)
+		prev = in.off
+	}
+	filesemi = append(filesemi, data[prev:]...)
 
 	fileAST, err := parser.ParseFile(cache.fset, filename, filesemi, parser.AllErrors)
 	if err != nil {
@@ -160,34 +798,147 @@ func (c *Config) analyzePackage(filename string, data []byte, cursor int) (*toke
 	}
 	astPos := fileAST.Pos()
 	if astPos == 0 {
-		return nil, token.NoPos, nil, nil
+		return nil, nil, nil, nil, nil
 	}
-	pos := cache.fset.File(astPos).Pos(cursor)
-	trimAST(fileAST, pos)
+	tokFile := cache.fset.File(astPos)
+	pos := make([]token.Pos, len(cursors))
+	for i, cursor := range cursors {
+		// Account for the text inserted before cursor.
+		pos[i] = tokFile.Pos(cursor + shift[cursor])
+	}
+	trimAST(fileAST, pos...)
 
 	files := []*ast.File{fileAST}
-	for _, otherName := range c.findOtherPackageFiles(filename, fileAST.Name.Name) {
-		files = append(files, c.parseOtherFile(otherName))
+	var indexOnly []*ast.File
+	otherNames, diags := c.findOtherPackageFiles(filename, fileAST.Name.Name, data)
+	for _, otherName := range otherNames {
+		entry := c.otherFile(otherName)
+		if c.IndexOnlyLines > 0 && entry.generated && entry.lines > c.IndexOnlyLines {
+			indexOnly = append(indexOnly, entry.file)
+			continue
+		}
+		files = append(files, entry.file)
+	}
+	if len(indexOnly) > 0 {
+		files = c.addNeededFiles(files, indexOnly, data, cursors)
+	}
+
+	var imp types.Importer = c.Importer
+	if subject := xtestSubject(filename, fileAST.Name.Name); subject != "" {
+		imp = &xtestImporter{c: c, filename: filename, subject: subject, path: c.dirImportPath(filepath.Dir(filename))}
+	}
+	if c.BuildContext != nil {
+		imp = newExcludedImporter(c, imp, filename, data, fileAST)
+	}
+
+	var key checkKey
+	var cached *checkEntry
+	if c.CheckCache {
+		var checked []string
+		for _, f := range files[1:] {
+			checked = append(checked, cache.fset.File(f.Pos()).Name())
+		}
+		key = checkKeyFor(filename, filesemi, checked)
+		cached = cache.checks[key]
+	}
+
+	// A token.FileSet is safe for concurrent use, but cache.fset
+	// may be replaced once unlocked.
+	fset := cache.fset
+	cache.lock.Unlock()
+	locked = false
+
+	if cached != nil && cached.valid(imp) {
+		c.Logf("reusing type-checked package of %s", filename)
+		// The file was parsed from the same text, so the
+		// cursors are at the same offsets in it.
+		cachedFile := cached.fset.File(cached.file.Pos())
+		for i, cursor := range cursors {
+			pos[i] = cachedFile.Pos(cursor + shift[cursor])
+		}
+		return cached.fset, pos, cached.pkg, cached.file, append(diags, cached.redeclared...)
 	}
 
+	cycles := &cycleImporter{imp: imp}
+	imp = cycles
+	var record *checkImporter
+	if c.CheckCache {
+		record = &checkImporter{imp: imp, imports: make(map[string]*types.Package)}
+		imp = record
+	}
+	// The declarations of other files conflicting with earlier
+	// ones, such as those of files for other builds, are left out
+	// of the package, so they are reported.
+	var redeclared []string
 	cfg := types.Config{
-		Importer: c.Importer,
-		Error:    func(err error) {},
+		Importer: imp,
+		Error: func(err error) {
+			terr, ok := err.(types.Error)
+			if !ok || !strings.HasSuffix(terr.Msg, " redeclared in this block") {
+				return
+			}
+			if p := fset.Position(terr.Pos); p.Filename != filename {
+				redeclared = append(redeclared, fmt.Sprintf("%s:%d:%d: %s", filepath.Base(p.Filename), p.Line, p.Column, terr.Msg))
+			}
+		},
+	}
+	pkg, _ := cfg.Check("", fset, files, nil)
+	diags = append(diags, cycles.diags...)
+	diags = append(diags, redeclared...)
+
+	// The imports across a cycle are missing, and must be tried
+	// again once it is broken.
+	if c.CheckCache && cycles.diags == nil {
+		cache.lock.Lock()
+		if cache.fset == fset {
+			// Delete random entries to keep at most
+			// maxCheckCache.
+			for k := range cache.checks {
+				if len(cache.checks) < maxCheckCache {
+					break
+				}
+				delete(cache.checks, k)
+			}
+			cache.checks[key] = &checkEntry{
+				fset:       fset,
+				pkg:        pkg,
+				file:       fileAST,
+				redeclared: redeclared,
+				imports:    record.imports,
+				srcDir:     record.srcDir,
+			}
+		}
+		cache.lock.Unlock()
 	}
-	pkg, _ := cfg.Check("", cache.fset, files, nil)
 
-	return cache.fset, pos, pkg, fileAST.Imports
+	return fset, pos, pkg, fileAST, diags
 }
 
 // trimAST clears any part of the AST not relevant to type checking
-// expressions at pos.
-func trimAST(file *ast.File, pos token.Pos) {
+// expressions at any of pos.
+func trimAST(file *ast.File, pos ...token.Pos) {
 	ast.Inspect(file, func(n ast.Node) bool {
 		if n == nil {
 			return false
 		}
-		if pos < n.Pos() || pos >= n.End() {
+		switch n.(type) {
+		case *ast.FuncDecl, *ast.BlockStmt, *ast.CaseClause, *ast.CommClause, *ast.CompositeLit, *ast.TypeSwitchStmt:
+		default:
+			// Only the extents of the nodes trimmed are
+			// needed: that of a selector chain is computed
+			// through all of its links, which is quadratic
+			// in deep chains.
+			return true
+		}
+		if !containsAny(n, pos) {
 			switch n := n.(type) {
+			case *ast.TypeSwitchStmt:
+				// Keep the types of the cases, which
+				// assertedType uses as hints.
+				for _, clause := range n.Body.List {
+					clause.(*ast.CaseClause).Body = nil
+				}
+				return false
 			case *ast.FuncDecl:
 				n.Body = nil
 			case *ast.BlockStmt:
@@ -209,6 +960,15 @@ func trimAST(file *ast.File, pos token.Pos) {
 	})
 }
 
+func containsAny(n ast.Node, pos []token.Pos) bool {
+	for _, p := range pos {
+		if n.Pos() <= p && p < n.End() {
+			return true
+		}
+	}
+	return false
+}
+
 func isEllipsisArray(n ast.Expr) bool {
 	at, ok := n.(*ast.ArrayType)
 	if !ok {
@@ -225,8 +985,338 @@ func (c *Config) fieldNameCandidates(typ types.Type, b *candidateCollector) {
 	}
 }
 
+// contextBoost returns a filter matching the candidates that fit the
+// syntactic context of the cursor best, or nil.
+func (c *Config) contextBoost(fset *token.FileSet, pos token.Pos, pkg *types.Package, file *ast.File, data []byte, cursor int) objectFilter {
+	if afterDeferOrGo(data, cursor) {
+		return isCallable
+	}
+	if afterParamName(data, cursor) && inTypeParams(file, pos) {
+		return isConstraint
+	}
+	if boost := c.indexBoost(fset, pos, pkg, data, cursor); boost != nil {
+		return boost
+	}
+	return c.spreadBoost(fset, pos, pkg, data, cursor)
+}
+
+// indexBoost returns a filter matching the candidates that can index
+// the expression indexed at the cursor: those assignable to the key
+// type of a map, or integers for other indexable types. It returns nil
+// if the cursor isn't at an index.
+func (c *Config) indexBoost(fset *token.FileSet, pos token.Pos, pkg *types.Package, data []byte, cursor int) objectFilter {
+	x, ok := deduceIndexExpr(data, cursor)
+	if !ok {
+		return nil
+	}
+	tv, _ := types.Eval(fset, pkg, pos, x)
+	if tv.Type == nil || !tv.IsValue() {
+		return nil
+	}
+	typ := tv.Type.Underlying()
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ = ptr.Elem().Underlying()
+	}
+	var fits func(types.Type) bool
+	switch typ := typ.(type) {
+	case *types.Map:
+		fits = func(t types.Type) bool { return types.AssignableTo(t, typ.Key()) }
+	case *types.Slice, *types.Array:
+		fits = isInteger
+	case *types.Basic:
+		if typ.Info()&types.IsString == 0 {
+			return nil
+		}
+		fits = isInteger
+	default:
+		return nil
+	}
+	return func(obj types.Object) bool {
+		switch obj.(type) {
+		case *types.Var, *types.Const:
+			return fits(obj.Type())
+		}
+		return false
+	}
+}
+
+// typeArgKinds returns a filter matching the candidates that can be
+// the first argument of a call of the builtin new or make at the
+// cursor: types for new, and slice, map and channel types for make,
+// along with the packages that may qualify them. It returns nil
+// elsewhere.
+func typeArgKinds(scope *types.Scope, pos token.Pos, data []byte, cursor int) objectFilter {
+	fn, ok := deduceTypeArg(data, cursor)
+	if !ok || scope == nil {
+		return nil
+	}
+	if _, obj := scope.LookupParent(fn, pos); obj == nil || obj.Parent() != types.Universe {
+		// Not the builtin, which may be shadowed.
+		return nil
+	}
+	switch fn {
+	case "new":
+		return isTypeOrPackage
+	case "make":
+		return isMakeable
+	}
+	return nil
+}
+
+// isMakeable reports whether obj is a type make can make, a slice, map
+// or channel type, or a package that may declare one. Type parameters
+// are assumed to be constrained to such types.
+func isMakeable(obj types.Object) bool {
+	switch obj := obj.(type) {
+	case *types.PkgName:
+		return true
+	case *types.TypeName:
+		if _, ok := obj.Type().(*types.TypeParam); ok {
+			return true
+		}
+		switch obj.Type().Underlying().(type) {
+		case *types.Slice, *types.Map, *types.Chan:
+			return true
+		}
+	}
+	return false
+}
+
+// isInteger reports whether t is an integer type.
+func isInteger(t types.Type) bool {
+	basic, ok := t.Underlying().(*types.Basic)
+	return ok && basic.Info()&types.IsInteger != 0
+}
+
+// isCallable reports whether obj can be called.
+func isCallable(obj types.Object) bool {
+	switch obj.(type) {
+	case *types.Func, *types.Builtin:
+		return true
+	case *types.Var:
+		_, ok := obj.Type().Underlying().(*types.Signature)
+		return ok
+	}
+	return false
+}
+
+// isConstraint reports whether obj is a type that can constrain a
+// type parameter, i.e. an interface type.
+func isConstraint(obj types.Object) bool {
+	tn, ok := obj.(*types.TypeName)
+	if !ok {
+		return false
+	}
+	if _, ok := tn.Type().(*types.TypeParam); ok {
+		return false
+	}
+	return types.IsInterface(tn.Type())
+}
+
+// inTypeParams reports whether pos is within the type parameter list
+// of a function or type declaration.
+func inTypeParams(file *ast.File, pos token.Pos) bool {
+	found := false
+	ast.Inspect(file, func(n ast.Node) bool {
+		if found || n == nil || pos < n.Pos() || pos > n.End() {
+			return false
+		}
+		var list *ast.FieldList
+		switch n := n.(type) {
+		case *ast.FuncType:
+			list = n.TypeParams
+		case *ast.TypeSpec:
+			list = n.TypeParams
+		}
+		if list != nil && list.Opening < pos && pos <= list.Closing {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// spreadBoost returns a filter matching candidates that can be passed
+// to the variadic parameter of a call at the cursor, or nil if the
+// cursor isn't at one of its arguments. At the first variadic argument,
+// those are the slices that can be passed as "x...". A spread must be
+// the only variadic argument, so after the first, they are the
+// candidates assignable to the element type.
+func (c *Config) spreadBoost(fset *token.FileSet, pos token.Pos, pkg *types.Package, data []byte, cursor int) objectFilter {
+	fn, arg, ok := deduceCallArg(data, cursor)
+	if !ok {
+		return nil
+	}
+	tv, _ := types.Eval(fset, pkg, pos, fn)
+	if tv.Type == nil {
+		return nil
+	}
+	sig, ok := tv.Type.Underlying().(*types.Signature)
+	if !ok || !sig.Variadic() || arg < sig.Params().Len()-1 {
+		return nil
+	}
+	last := sig.Params().Len() - 1
+	want := sig.Params().At(last).Type()
+	if arg > last {
+		want = want.Underlying().(*types.Slice).Elem()
+	}
+	return func(obj types.Object) bool {
+		_, isVar := obj.(*types.Var)
+		return isVar && types.AssignableTo(obj.Type(), want)
+	}
+}
+
+// unaddressableMethods adds to b the methods with pointer receivers
+// that the value tv lacks only because it isn't addressable, marked as
+// such, or only rejects them without c.MarkUnaddressable.
+func (c *Config) unaddressableMethods(links *linkCache, tv *types.TypeAndValue, b *candidateCollector) {
+	if !tv.IsValue() || tv.Addressable() {
+		return
+	}
+	own := make(map[string]bool)
+	links.members.Walk(tv, func(obj types.Object) {
+		own[obj.Id()] = true
+	})
+	b.unaddressable = make(map[types.Object]bool)
+	links.members.WalkValue(tv.Type, true, func(obj types.Object) {
+		switch {
+		case own[obj.Id()]:
+		case c.HideUnexportedPromotions && promotedThroughUnexported(tv.Type, b.localpkg, obj):
+		case !c.MarkUnaddressable:
+			b.reject(obj, RejectUnaddressable)
+		default:
+			b.unaddressable[obj] = true
+			b.appendObject(obj)
+		}
+	})
+}
+
+// hintedCandidates adds the members of the interface value tv to b,
+// followed by those of the hinted type that tv lacks.
+func (c *Config) hintedCandidates(links *linkCache, tv *types.TypeAndValue, hint types.Type, b *candidateCollector) {
+	own := make(map[string]bool)
+	links.members.Walk(tv, func(obj types.Object) {
+		own[obj.Id()] = true
+		b.appendObject(obj)
+	})
+	links.members.WalkValue(hint, false, func(obj types.Object) {
+		if !own[obj.Id()] {
+			b.appendObject(obj)
+		}
+	})
+	b.boost = func(obj types.Object) bool { return own[obj.Id()] }
+}
+
+// assertedType returns the type that the variable named expr is
+// first asserted to after pos, in the function enclosing pos, or nil.
+// In a type switch on the variable, that is the first type of its
+// cases other than nil.
+func assertedType(fset *token.FileSet, pkg *types.Package, file *ast.File, pos token.Pos, expr string) types.Type {
+	body := enclosingFuncBody(file, pos)
+	if body == nil {
+		return nil
+	}
+	_, obj := pkg.Scope().Innermost(pos).LookupParent(expr, pos)
+	if obj == nil {
+		return nil
+	}
+	// isVar reports whether x is the variable.
+	isVar := func(x ast.Expr) bool {
+		id, ok := x.(*ast.Ident)
+		if !ok || id.Name != expr {
+			return false
+		}
+		_, other := pkg.Scope().Innermost(id.Pos()).LookupParent(id.Name, id.Pos())
+		return other == obj
+	}
+	// evalType sets hint to the type denoted by x, at pos.
+	var hint types.Type
+	evalType := func(pos token.Pos, x ast.Expr) {
+		if tv, err := types.Eval(fset, pkg, pos, types.ExprString(x)); err == nil && tv.IsType() {
+			hint = tv.Type
+		}
+	}
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		if hint != nil || n == nil || n.End() <= pos {
+			return false
+		}
+		if n.Pos() <= pos {
+			return true
+		}
+		switch n := n.(type) {
+		case *ast.TypeAssertExpr:
+			if n.Type != nil && isVar(n.X) {
+				evalType(n.Pos(), n.Type)
+			}
+		case *ast.TypeSwitchStmt:
+			var guard ast.Expr
+			switch s := n.Assign.(type) {
+			case *ast.AssignStmt:
+				guard = s.Rhs[0]
+			case *ast.ExprStmt:
+				guard = s.X
+			}
+			if ta, ok := guard.(*ast.TypeAssertExpr); !ok || !isVar(ta.X) {
+				return true
+			}
+			for _, clause := range n.Body.List {
+				for _, x := range clause.(*ast.CaseClause).List {
+					if id, ok := x.(*ast.Ident); ok && id.Name == "nil" {
+						continue
+					}
+					evalType(n.Pos(), x)
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return hint
+}
+
+// enclosingFuncBody returns the body of the innermost function
+// declaration or literal of file that contains pos.
+func enclosingFuncBody(file *ast.File, pos token.Pos) *ast.BlockStmt {
+	var body *ast.BlockStmt
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil || pos < n.Pos() || n.End() <= pos {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			if n.Body != nil {
+				body = n.Body
+			}
+		case *ast.FuncLit:
+			body = n.Body
+		}
+		return true
+	})
+	return body
+}
+
+// outlineCandidates adds all package-level declarations of pkg,
+// including methods, to b.
+func (c *Config) outlineCandidates(pkg *types.Package, b *candidateCollector) {
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		obj := scope.Lookup(name)
+		b.appendObject(obj)
+		if named, ok := obj.Type().(*types.Named); ok && named.Obj() == obj {
+			for i, n := 0, named.NumMethods(); i < n; i++ {
+				b.appendObject(named.Method(i))
+			}
+		}
+	}
+}
+
 func (c *Config) packageCandidates(pkg *types.Package, b *candidateCollector) {
-	c.scopeCandidates(pkg.Scope(), token.NoPos, b)
+	// Not the universe, which can't be selected from pkg.
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		b.appendObject(scope.Lookup(name))
+	}
 }
 
 func (c *Config) scopeCandidates(scope *types.Scope, pos token.Pos, b *candidateCollector) {
@@ -260,21 +1350,30 @@ func (c *Config) logParseError(intro string, err error) {
 	}
 }
 
-func (c *Config) findOtherPackageFiles(filename, pkgName string) []string {
+// findOtherPackageFiles returns the other files of the package
+// pkgName in the directory of filename, whose contents are data, or
+// nil to read it. If c.BuildContext is set, only those matching the
+// contexts of matchContexts are returned, and the diagnostics report
+// the files matching them that declare another package.
+func (c *Config) findOtherPackageFiles(filename, pkgName string, data []byte) (files, diags []string) {
 	if filename == "" {
-		return nil
+		return nil, nil
 	}
 
 	dir, file := filepath.Split(filename)
+	if c.Sandbox != nil {
+		if err := c.Sandbox.Check(dir); err != nil {
+			c.Logf("%v", err)
+			return nil, nil
+		}
+	}
 	dents, err := ioutil.ReadDir(dir)
 	if err != nil {
 		panic(err)
 	}
 	isTestFile := strings.HasSuffix(file, "_test.go")
+	ctxs, _ := c.matchContexts(filename, data)
 
-	// TODO(mdempsky): Use go/build.(*Context).MatchFile or
-	// something to properly handle build tags?
-	var out []string
 	for _, dent := range dents {
 		name := dent.Name()
 		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
@@ -288,20 +1387,262 @@ func (c *Config) findOtherPackageFiles(filename, pkgName string) []string {
 		}
 
 		abspath := filepath.Join(dir, name)
-		if pkgNameFor(abspath) == pkgName {
-			out = append(out, abspath)
+		if c.Sandbox != nil {
+			if err := c.Sandbox.Check(abspath); err != nil {
+				c.Logf("%v", err)
+				continue
+			}
+		}
+		if ctxs != nil && !matchAny(ctxs, dir, name) {
+			continue
+		}
+		switch other := pkgNameFor(abspath); {
+		case other == pkgName:
+			files = append(files, abspath)
+		case ctxs != nil && other != "" && !isTestVariant(pkgName, other):
+			// Both files are built, so the directory
+			// can't be a package.
+			diags = append(diags, fmt.Sprintf("found packages %s (%s) and %s (%s) in %s; completing in package %s", pkgName, file, other, name, filepath.Clean(dir), pkgName))
+		}
+	}
+
+	return files, diags
+}
+
+// matchContexts returns the build contexts selecting the other files of
+// the package of filename, whose contents are data, or nil to read it:
+// c.BuildContext if filename matches it, and otherwise the variants of
+// it with the fewest tags of filename's //go:build line, or of its
+// _GOOS or _GOARCH suffix, changed that it matches, as when editing the
+// files for another GOOS, and variants is set. It returns nil to select
+// them all: if c.BuildContext is nil, or if no variant matches.
+func (c *Config) matchContexts(filename string, data []byte) (ctxs []*build.Context, variants bool) {
+	if c.BuildContext == nil {
+		return nil, false
+	}
+	ctx := *c.BuildContext
+	c.sandboxContext(&ctx)
+	if data == nil {
+		data, _ = c.readFile(filename)
+	}
+	dir, file := filepath.Split(filename)
+	matches := func(ctx *build.Context) bool {
+		open := ctx.OpenFile
+		if data != nil {
+			ctx.OpenFile = func(name string) (io.ReadCloser, error) {
+				if name == filename {
+					return ioutil.NopCloser(bytes.NewReader(data)), nil
+				}
+				if open != nil {
+					return open(name)
+				}
+				return os.Open(name)
+			}
+		}
+		ok, err := ctx.MatchFile(dir, file)
+		ctx.OpenFile = open
+		return err == nil && ok
+	}
+	if matches(&ctx) {
+		return []*build.Context{&ctx}, false
+	}
+
+	var found []*build.Context
+	fewest := -1
+	tags := append(buildLineTags(data), nameTags(ctx, file)...)
+	for _, v := range tagVariants(&ctx, tags) {
+		if fewest >= 0 && v.changed > fewest || !matches(v.ctx) {
+			continue
+		}
+		if v.changed != fewest {
+			fewest, found = v.changed, nil
+		}
+		found = append(found, v.ctx)
+	}
+	if found == nil {
+		c.Logf("%s doesn't match the build constraints, not applying them to the package", filename)
+		return nil, false
+	}
+	c.Logf("%s doesn't match the build constraints, applying them with its tags changed", filename)
+	return found, true
+}
+
+// nameTags returns the GOOS and GOARCH of the _GOOS, _GOARCH or
+// _GOOS_GOARCH suffix of the Go file name, if ctx excludes the file
+// for its name alone.
+func nameTags(ctx build.Context, name string) []string {
+	ctx.OpenFile = func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("package p\n")), nil
+	}
+	if ok, err := ctx.MatchFile(".", name); err != nil || ok {
+		return nil
+	}
+	elems := strings.Split(strings.TrimSuffix(strings.TrimSuffix(name, ".go"), "_test"), "_")
+	if len(elems) > 3 {
+		elems = elems[len(elems)-3:]
+	}
+	return elems[1:]
+}
+
+// maxVariantTags bounds the number of tags of a //go:build line
+// changed by tagVariants, which makes 5^n variants.
+const maxVariantTags = 4
+
+// A tagVariant is a variant of a build context, with changed tags of a
+// //go:build line changed.
+type tagVariant struct {
+	ctx     *build.Context
+	changed int
+}
+
+// tagVariants returns the variants of ctx with each of tags left alone,
+// added to or removed from its BuildTags, or made its GOOS or GOARCH.
+func tagVariants(ctx *build.Context, tags []string) []tagVariant {
+	if len(tags) > maxVariantTags {
+		tags = tags[:maxVariantTags]
+	}
+	variants := []tagVariant{{ctx, 0}}
+	for _, tag := range tags {
+		next := make([]tagVariant, 0, 5*len(variants))
+		for _, v := range variants {
+			on, off, goos, goarch := *v.ctx, *v.ctx, *v.ctx, *v.ctx
+			on.BuildTags = append(withoutTag(v.ctx.BuildTags, tag), tag)
+			off.BuildTags = withoutTag(v.ctx.BuildTags, tag)
+			off.ReleaseTags = withoutTag(v.ctx.ReleaseTags, tag)
+			goos.GOOS = tag
+			goarch.GOARCH = tag
+			next = append(next, v,
+				tagVariant{&on, v.changed + 1},
+				tagVariant{&off, v.changed + 1},
+				tagVariant{&goos, v.changed + 1},
+				tagVariant{&goarch, v.changed + 1})
 		}
+		variants = next
 	}
+	return variants[1:]
+}
 
-	return out
+// withoutTag returns a copy of tags without tag.
+func withoutTag(tags []string, tag string) []string {
+	var res []string
+	for _, t := range tags {
+		if t != tag {
+			res = append(res, t)
+		}
+	}
+	return res
 }
 
-func (c *Config) resolveKnownPackageIdent(pkgName string) *types.Package {
-	pkgName, ok := knownPackageIdents[pkgName]
+// buildLineTags returns the tags of the //go:build line of the Go
+// source src, in order of appearance.
+func buildLineTags(src []byte) []string {
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if !constraint.IsGoBuild(line) {
+			continue
+		}
+		expr, err := constraint.Parse(line)
+		if err != nil {
+			return nil
+		}
+		var tags []string
+		seen := make(map[string]bool)
+		// Eval observes every tag, whatever it returns.
+		expr.Eval(func(tag string) bool {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+			return false
+		})
+		return tags
+	}
+	return nil
+}
+
+// matchAny reports whether the file name in dir matches any of ctxs.
+func matchAny(ctxs []*build.Context, dir, name string) bool {
+	for _, ctx := range ctxs {
+		if ok, err := ctx.MatchFile(dir, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isTestVariant reports whether the packages named a and b may share a
+// directory as a package and its external test package.
+func isTestVariant(a, b string) bool {
+	return a+"_test" == b || b+"_test" == a
+}
+
+// xtestSubject returns the name of the package under test if filename
+// belongs to an external test package (package foo_test), and "" otherwise.
+func xtestSubject(filename, pkgName string) string {
+	if !strings.HasSuffix(filename, "_test.go") || !strings.HasSuffix(pkgName, "_test") {
+		return ""
+	}
+	return strings.TrimSuffix(pkgName, "_test")
+}
+
+// xtestImporter serves imports for an external test package. The
+// package under test is type-checked from source together with its
+// internal _test.go files, like the go tool's test variant, so that
+// symbols exported only for testing (export_test.go) are visible and
+// stale or missing export data for the subject doesn't matter.
+type xtestImporter struct {
+	c        *Config
+	filename string
+	subject  string
+	path     string // the import path of the package under test, or ""
+	pkg      *types.Package
+}
+
+func (i *xtestImporter) Import(path string) (*types.Package, error) {
+	if i.pkg != nil && i.pkg.Path() == path {
+		return i.pkg, nil
+	}
+	if i.path == "" || path != i.path {
+		return i.c.Importer.Import(path)
+	}
+
+	var files []*ast.File
+	cache.lock.Lock()
+	fset := cache.fset
+	names, _ := i.c.findOtherPackageFiles(i.filename, i.subject, nil)
+	for _, name := range names {
+		files = append(files, i.c.parseOtherFile(name))
+	}
+	cache.lock.Unlock()
+	if len(files) == 0 {
+		return i.c.Importer.Import(path)
+	}
+
+	cfg := types.Config{
+		Importer: i.c.Importer,
+		Error:    func(err error) {},
+	}
+	pkg, _ := cfg.Check(path, fset, files, nil)
+	i.pkg = pkg
+	return pkg, nil
+}
+
+// resolveKnownPackageIdent returns the standard library package
+// usually imported as pkgName, if a file in the directory from may
+// import it.
+func (c *Config) resolveKnownPackageIdent(pkgName, from string) *types.Package {
+	path, ok := knownPackageIdents[pkgName]
 	if !ok {
 		return nil
 	}
-	pkg, _ := c.Importer.Import(pkgName)
+	if why := importRestriction(from, path, c.stdDir(path), ""); why != "" {
+		c.Logf("not proposing %s: it %s", path, why)
+		return nil
+	}
+	pkg, _ := c.Importer.Import(path)
 	return pkg
 }
 
@@ -4,14 +4,25 @@ import (
 	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
 	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/mdempsky/gocode/internal/cache"
+	"github.com/mdempsky/gocode/internal/golden"
 	"github.com/mdempsky/gocode/internal/suggest"
 )
 
@@ -50,12 +61,19 @@ func testRegress(t *testing.T, testDir string) {
 		return
 	}
 
-	filename := filepath.Join(testDir, "test.go.in")
-	data, err := ioutil.ReadFile(filename)
+	// The input file is normally test.go.in, but tests may use
+	// another name (e.g., x_test.go.in) when the file name matters.
+	inputs, err := filepath.Glob(filepath.Join(testDir, "*.go.in"))
+	if err != nil || len(inputs) != 1 {
+		t.Errorf("want exactly one .go.in file, got %v (err: %v)", inputs, err)
+		return
+	}
+	data, err := ioutil.ReadFile(inputs[0])
 	if err != nil {
 		t.Errorf("ReadFile failed: %v", err)
 		return
 	}
+	filename := strings.TrimSuffix(inputs[0], ".in")
 
 	cursor := bytes.IndexByte(data, '@')
 	if cursor < 0 {
@@ -84,12 +102,22 @@ func testRegress(t *testing.T, testDir string) {
 	candidates, prefixLen := cfg.Suggest(filename, data, cursor)
 
 	var out bytes.Buffer
-	suggest.NiceFormat(&out, candidates, prefixLen)
+	suggest.NiceFormat.Format(&out, suggest.Response{Candidates: candidates, Len: prefixLen})
 	want, _ := ioutil.ReadFile(filepath.Join(testDir, "out.expected"))
 	if got := out.Bytes(); !bytes.Equal(got, want) {
 		t.Errorf("%s:\nGot:\n%s\nWant:\n%s\n", testDir, got, want)
 		return
 	}
+
+	// Fields the nice format leaves out are checked against the json
+	// format, if expected.
+	if want, err := ioutil.ReadFile(filepath.Join(testDir, "out.json.expected")); err == nil {
+		out.Reset()
+		suggest.Formatters["json"].Format(&out, suggest.Response{Candidates: candidates, Len: prefixLen})
+		if got := out.Bytes(); !bytes.Equal(got, want) {
+			t.Errorf("%s:\nGot json:\n%s\nWant:\n%s\n", testDir, got, want)
+		}
+	}
 }
 
 func contains(haystack []string, needle string) bool {
@@ -100,3 +128,2210 @@ func contains(haystack []string, needle string) bool {
 	}
 	return false
 }
+
+func TestSuggestMulti(t *testing.T) {
+	src := `package p
+
+func f() {
+	var alpha int
+	al@
+}
+
+func g() {
+	var beta string
+	be@
+}
+`
+	src, cursors := cutCursors(src)
+	cursors = append(cursors, len(src)+1) // invalid
+
+	cfg := suggest.Config{
+		Importer: importer.Default(),
+		Logf:     t.Logf,
+	}
+	results := cfg.SuggestMulti("", []byte(src), cursors)
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, want := range []string{"var alpha int", "var beta string"} {
+		r := results[i]
+		if r.Err != "" || len(r.Candidates) != 1 || r.Candidates[0].String() != want || r.Len != 2 {
+			t.Errorf("result %d: got %+v, want %q", i, r, want)
+		}
+	}
+	if results[2].Err == "" {
+		t.Errorf("invalid cursor: got no error")
+	}
+}
+
+// cutCursors removes each '@' from src and returns the resulting
+// source and the offsets where they were.
+func cutCursors(src string) (string, []int) {
+	var cursors []int
+	for {
+		i := strings.IndexByte(src, '@')
+		if i < 0 {
+			return src, cursors
+		}
+		cursors = append(cursors, i)
+		src = src[:i] + src[i+1:]
+	}
+}
+
+// suggestSource runs cfg.Suggest on src, which must contain a single
+// '@' marking the cursor.
+func suggestSource(t *testing.T, cfg suggest.Config, src string) ([]suggest.Candidate, int) {
+	t.Helper()
+	src, cursors := cutCursors(src)
+	if len(cursors) != 1 {
+		t.Fatalf("want one cursor, got %d", len(cursors))
+	}
+	if cfg.Importer == nil {
+		cfg.Importer = importer.Default()
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = t.Logf
+	}
+	return cfg.Suggest("", []byte(src), cursors[0])
+}
+
+// writeFiles returns a temporary directory containing the given files,
+// keyed by slash-separated paths relative to it.
+func writeFiles(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMethodOrigin(t *testing.T) {
+	const src = `package p
+
+import "io"
+
+type Getter[T any] interface {
+	Get() T
+}
+
+type Closer interface {
+	io.Closer
+	Getter[int]
+	Flush() error
+}
+
+func f(c Closer) {
+	c.@
+}
+`
+	candidates, _ := suggestSource(t, suggest.Config{}, src)
+	want := map[string]string{
+		"Close": "io.Closer",
+		"Get":   "Getter[int]",
+		"Flush": "Closer",
+	}
+	if len(candidates) != len(want) {
+		t.Fatalf("got %d candidates, want %d: %v", len(candidates), len(want), candidates)
+	}
+	for _, c := range candidates {
+		if got := c.Origin; got != want[c.Name] {
+			t.Errorf("%s: got origin %q, want %q", c.Name, got, want[c.Name])
+		}
+	}
+}
+
+func TestBuiltinSignatures(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"package p\n\nfunc f() { appen@ }\n", "func append(slice []Type, elems ...Type) []Type"},
+		{"package p\n\nfunc f() { mak@ }\n", "func make(t Type, size ...IntegerType) Type"},
+	}
+	for _, test := range tests {
+		candidates, _ := suggestSource(t, suggest.Config{Builtin: true}, test.src)
+		if len(candidates) != 1 {
+			t.Errorf("got %v, want one candidate", candidates)
+			continue
+		}
+		if got := candidates[0].String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestTypeDetails(t *testing.T) {
+	const src = `package p
+
+import "bytes"
+
+type Point struct{ X, Y int }
+
+type Shape interface {
+	Area() float64
+}
+
+type Handler func(int) error
+
+type Buffer = bytes.Buffer
+
+type Pair[K comparable, V any] struct {
+	Key K
+	Val V
+}
+
+type Lone struct{ x int }
+
+var _ struct {
+	f @
+}
+`
+	candidates, _ := suggestSource(t, suggest.Config{Details: true}, src)
+	want := map[string]string{
+		"Point":   "struct with 2 fields",
+		"Shape":   "interface with 1 method",
+		"Handler": "func(int) error",
+		"Buffer":  "alias for bytes.Buffer",
+		"Pair":    "generic struct with 2 fields [K comparable, V any]",
+		"Lone":    "struct with 1 field",
+	}
+	got := make(map[string]string)
+	for _, c := range candidates {
+		if c.Class == "type" {
+			got[c.Name] = c.Detail
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got details %v, want %v", got, want)
+	}
+}
+
+func TestCgoInternals(t *testing.T) {
+	const src = `package p
+
+type _Ctype_int int32
+
+var _cgo_runtime_cgocall func()
+
+func _Cfunc_puts() {}
+
+var _count int
+
+func f() {
+	_@
+}
+`
+	names := func(candidates []suggest.Candidate) []string {
+		var res []string
+		for _, c := range candidates {
+			res = append(res, c.Name)
+		}
+		return res
+	}
+
+	candidates, _ := suggestSource(t, suggest.Config{}, src)
+	if got, want := names(candidates), []string{"_count"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("by default: got %v, want %v", got, want)
+	}
+
+	candidates, _ = suggestSource(t, suggest.Config{CgoInternals: true}, src)
+	if got, want := names(candidates), []string{"_Cfunc_puts", "_Ctype_int", "_cgo_runtime_cgocall", "_count"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with CgoInternals: got %v, want %v", got, want)
+	}
+}
+
+// gomegaImporter serves a stand-in for github.com/onsi/gomega, whose
+// exported functions test files commonly dot-import.
+type gomegaImporter struct {
+	gomega *types.Package
+}
+
+func newGomegaImporter(t *testing.T) gomegaImporter {
+	t.Helper()
+	const src = `package gomega
+
+func Expect(actual interface{}) {}
+
+func Eventually(actual interface{}) {}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "gomega.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := new(types.Config).Check("github.com/onsi/gomega", fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gomegaImporter{pkg}
+}
+
+func (i gomegaImporter) Import(path string) (*types.Package, error) {
+	if path == i.gomega.Path() {
+		return i.gomega, nil
+	}
+	return importer.Default().Import(path)
+}
+
+func TestTestDotImports(t *testing.T) {
+	// A sibling test file dot-imports gomega too, which must not
+	// make its names visible in the other files of the package.
+	dir := writeFiles(t, map[string]string{
+		"foo.go":         "package foo\n\nfunc Foo() {}\n",
+		"suite_test.go":  "package foo\n\nimport . \"github.com/onsi/gomega\"\n\nvar _ = Expect\n",
+		"xsuite_test.go": "package foo_test\n\nimport . \"github.com/onsi/gomega\"\n\nvar _ = Expect\n",
+	})
+
+	tests := []struct {
+		filename, src string
+		want          []string
+	}{
+		// Internal test package.
+		{"foo_test.go", "package foo\n\nimport . \"github.com/onsi/gomega\"\n\nfunc TestFoo() {\n\tE@\n}\n", []string{"Eventually", "Expect"}},
+		{"foo_test.go", "package foo\n\nimport . \"github.com/onsi/gomega\"\n\nvar _ = E@\n", []string{"Eventually", "Expect"}},
+		{"foo_test.go", "package foo\n\nfunc TestFoo() {\n\tE@\n}\n", nil},
+
+		// External test package.
+		{"foo_x_test.go", "package foo_test\n\nimport . \"github.com/onsi/gomega\"\n\nfunc TestFoo() {\n\tE@\n}\n", []string{"Eventually", "Expect"}},
+		{"foo_x_test.go", "package foo_test\n\nfunc TestFoo() {\n\tE@\n}\n", nil},
+
+		// Package under test.
+		{"bar.go", "package foo\n\nfunc Bar() {\n\tE@\n}\n", nil},
+	}
+	imp := newGomegaImporter(t)
+	for _, test := range tests {
+		src, cursors := cutCursors(test.src)
+		cfg := suggest.Config{Importer: imp, Logf: t.Logf}
+		candidates, _ := cfg.Suggest(filepath.Join(dir, test.filename), []byte(src), cursors[0])
+		var got []string
+		for _, c := range candidates {
+			got = append(got, c.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %q: got %v, want %v", test.filename, test.src, got, test.want)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	const src = `package p
+
+var xyb1, b1, b2 int
+
+func f() {
+	_ = xyb@
+}
+`
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"xyb1"}},
+		{"b", []string{"b1", "b2"}},
+		{"yb", nil},
+		// Prefixes that don't precede the cursor are ignored.
+		{"q", []string{"xyb1"}},
+		{"xyb1", []string{"xyb1"}},
+	}
+	for _, test := range tests {
+		candidates, n := suggestSource(t, suggest.Config{Prefix: test.prefix}, src)
+		var got []string
+		for _, c := range candidates {
+			got = append(got, c.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("prefix %q: got %v, want %v", test.prefix, got, test.want)
+		}
+		if len(got) > 0 && n != len("xyb") {
+			t.Errorf("prefix %q: got length %d, want %d", test.prefix, n, len("xyb"))
+		}
+	}
+}
+
+func TestAddressability(t *testing.T) {
+	const decls = `package p
+
+type Conn struct{ id int }
+
+func (c *Conn) Close() error { return nil }
+
+func (c Conn) ID() int { return c.id }
+
+type Pool struct{ conn Conn }
+
+func newConn() Conn { return Conn{} }
+
+func f(c Conn, pc *Conn, pool Pool, pools map[string]Pool, conns []Conn, m map[string]Conn, arr [1]Conn) {
+	%s
+}
+`
+	tests := []struct {
+		operand     string
+		addressable bool
+	}{
+		{"c", true},
+		{"pc", true},
+		{"(*pc)", true},
+		{"pool.conn", true},
+		{"conns[0]", true},
+		{"arr[0]", true},
+		{"m[\"k\"]", false},
+		{"pools[\"k\"].conn", false},
+		{"newConn()", false},
+		{"Conn{}", false},
+	}
+	for _, test := range tests {
+		src := fmt.Sprintf(decls, test.operand+".@")
+		for _, mark := range []bool{false, true} {
+			candidates, _ := suggestSource(t, suggest.Config{MarkUnaddressable: mark}, src)
+			got := make(map[string]bool)
+			for _, c := range candidates {
+				got[c.Name] = c.Unaddressable
+			}
+			unaddressable, ok := got["Close"]
+			switch {
+			case test.addressable && (!ok || unaddressable):
+				t.Errorf("%s (mark %v): got Close %v, unaddressable %v; want a callable Close", test.operand, mark, ok, unaddressable)
+			case !test.addressable && !mark && ok:
+				t.Errorf("%s: got Close, want none", test.operand)
+			case !test.addressable && mark && (!ok || !unaddressable):
+				t.Errorf("%s (mark): got Close %v, unaddressable %v; want Close marked unaddressable", test.operand, ok, unaddressable)
+			}
+			if _, ok := got["ID"]; !ok || got["ID"] {
+				t.Errorf("%s (mark %v): want ID, callable", test.operand, mark)
+			}
+		}
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	const decls = `package p
+
+type Number interface{ ~int | ~float64 }
+type NumBox struct{}
+type NumSlice []int
+
+`
+	for _, test := range []struct {
+		src  string
+		want []string
+	}{
+		{"func Sum[T Num@]() {}", []string{"Number", "NumBox", "NumSlice"}},
+		{"type Pair[K comparable, V Num@] struct{}", []string{"Number", "NumBox", "NumSlice"}},
+		{"func Max[T @]() {}", []string{"Number", "Max", "NumBox", "NumSlice"}},
+		{"var x Num@", []string{"NumBox", "NumSlice", "Number"}},
+	} {
+		got, _ := suggestSource(t, suggest.Config{}, decls+test.src+"\n")
+		var names []string
+		for _, c := range got {
+			names = append(names, c.Name)
+			if want := c.Name == "Number"; c.Constraint != want {
+				t.Errorf("%s: got %s with Constraint %v, want %v", test.src, c.Name, c.Constraint, want)
+			}
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s: got %v, want %v", test.src, names, test.want)
+		}
+	}
+}
+
+func TestNewMakeArgs(t *testing.T) {
+	const decls = `package p
+
+import "bytes"
+
+type Ints []int
+type Index map[string]int
+type Events chan string
+type Point struct{ X, Y int }
+type Reader interface{ Read() }
+
+var Items Ints
+
+func Init() {}
+
+`
+	all := []string{"func Init()", "package bytes ", "type Events chan string", "type Index map[string]int", "type Ints []int", "type Point struct", "type Reader interface", "var Items Ints"}
+	for _, test := range []struct {
+		src  string
+		want []string
+	}{
+		{"var _ = make(@", []string{"package bytes ", "type Events chan string", "type Index map[string]int", "type Ints []int"}},
+		{"var _ = make(I@", []string{"type Index map[string]int", "type Ints []int"}},
+		{"var _ = make(P@", nil},
+		{"var _ = new(@", []string{"package bytes ", "type Events chan string", "type Index map[string]int", "type Ints []int", "type Point struct", "type Reader interface"}},
+		{"var _ = new(I@", []string{"type Index map[string]int", "type Ints []int"}},
+		{"var _ = new(bytes.B@", []string{"type Buffer struct"}},
+		{"var _ = make(bytes.B@", nil},
+		// Only the first argument is a type.
+		{"var _ = make(Ints, @", all},
+		{"var _ = make(map[string]@", all},
+		// Shadowed, new and make are other funcs.
+		{"func f(make func(int)) { make(@) }", []string{"func Init()", "func f(make func(int))", "package bytes ", "type Events chan string", "type Index map[string]int", "type Ints []int", "type Point struct", "type Reader interface", "var Items Ints", "var make func(int)"}},
+		{"func g[S ~[]int]() { _ = make(S@) }", []string{"type S interface"}},
+	} {
+		got, _ := suggestSource(t, suggest.Config{}, decls+test.src+"\n")
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%s: got %q, want %q", test.src, strs, test.want)
+		}
+	}
+
+	// Explain reports the types left out.
+	cfg := suggest.Config{Importer: importer.Default(), Logf: t.Logf, Explain: true}
+	src, cursors := cutCursors(decls + "var _ = make(P@\n")
+	var kinds []suggest.Rejection
+	for _, r := range cfg.SuggestResult("", []byte(src), cursors[0]).Rejections {
+		if r.Reason == suggest.RejectKind {
+			kinds = append(kinds, r)
+		}
+	}
+	if want := []suggest.Rejection{{Name: "Point", Class: "type", Reason: suggest.RejectKind}}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("make(P: got rejections %v, want %v", kinds, want)
+	}
+}
+
+func TestConstValue(t *testing.T) {
+	const src = `package p
+
+const (
+	KB = 1 << (10 * (iota + 1))
+	MB
+	GB
+)
+
+type Color string
+
+const Red Color = "red"
+
+const Third = 1.0 / 3
+
+const Huge = 1 << 300
+
+const Long = "0123456789012345678901234567890123456789012345678901234567890123456789"
+
+const Wide = "éééééééééééééééééééééééééééééééééééééééééééééééééééééééééééééééééééééééé"
+
+const Escaped = "\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n"
+
+const Invalid = undefined
+
+var NotConst = 1
+
+func f() {
+	_ = @
+}
+`
+	got, _ := suggestSource(t, suggest.Config{}, src)
+	want := map[string]*suggest.ConstValue{
+		"KB":       {Value: "1024", Typed: false},
+		"MB":       {Value: "1048576", Typed: false},
+		"GB":       {Value: "1073741824", Typed: false},
+		"Red":      {Value: `"red"`, Typed: true},
+		"Third":    {Value: "0.3333333333333333", Typed: false},
+		"Huge":     {Value: "2037035976334486086268445688409378161051468393665936250636140449", Typed: false},
+		"Long":     {Value: `"01234567890123456789012345678901234567890123456789012345678901"`, Typed: false},
+		"Wide":     {Value: `"` + strings.Repeat("é", 62) + `"`, Typed: false},
+		"Escaped":  {Value: `"` + strings.Repeat(`\n`, 31) + `"`, Typed: false},
+		"Invalid":  nil,
+		"NotConst": nil,
+	}
+	for _, c := range got {
+		w, ok := want[c.Name]
+		if !ok {
+			continue
+		}
+		delete(want, c.Name)
+		if !reflect.DeepEqual(c.Const, w) {
+			t.Errorf("%s: got %+v, want %+v", c.Name, c.Const, w)
+		}
+	}
+	for name := range want {
+		t.Errorf("no candidate %s", name)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	const decls = `package p
+
+import (
+	"image"
+	"io"
+)
+
+type MyWriter = io.Writer
+type Wrapper = MyWriter
+type MyPoint = image.Point
+
+func f(w MyWriter, ww Wrapper, p MyPoint, m map[io.Writer]int, n int) {
+	`
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"w.@", []string{"func Write(p []byte) (n int, err error)"}},
+		{"ww.@", []string{"func Write(p []byte) (n int, err error)"}},
+		{"p.@", []string{
+			"func Add(q image.Point) image.Point",
+			"func Div(k int) image.Point",
+			"func Eq(q image.Point) bool",
+			"func In(r image.Rectangle) bool",
+			"func Mod(r image.Rectangle) image.Point",
+			"func Mul(k int) image.Point",
+			"func String() string",
+			"func Sub(q image.Point) image.Point",
+			"var X int",
+			"var Y int",
+		}},
+		// MyWriter is identical to io.Writer, so w fits the key.
+		{"m[@", []string{"var w MyWriter", "var ww Wrapper"}},
+	}
+	for _, test := range tests {
+		got, _ := suggestSource(t, suggest.Config{}, decls+test.src+"\n}\n")
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+			if c.Name == "Write" && c.Origin != "io.Writer" {
+				t.Errorf("%s: got origin %q, want io.Writer", test.src, c.Origin)
+			}
+		}
+		if len(strs) > len(test.want) {
+			strs = strs[:len(test.want)]
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%s: got %q, want %q", test.src, strs, test.want)
+		}
+	}
+}
+
+func TestImplementers(t *testing.T) {
+	const decls = `package p
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// Locked only has the methods of sync.Mutex through a pointer.
+type Locked struct {
+	sync.Mutex
+	s string
+}
+
+func (l *Locked) Read(p []byte) (int, error) { return 0, io.EOF }
+
+type Bytes []byte
+
+func (b Bytes) Read(p []byte) (int, error) { return 0, io.EOF }
+
+type Plain struct{}
+
+var r io.Reader
+
+func use(r io.Reader, l ...sync.Locker) {}
+
+func f() {
+	_ = strings.NewReader
+	`
+	type impl struct{ how, text string }
+	tests := []struct {
+		src  string
+		want map[string]impl
+	}{
+		{"var _ io.Reader = @", map[string]impl{
+			"Bytes":         {"value", "Bytes($1)"},
+			"Locked":        {"pointer", "&Locked{}"},
+			"LimitedReader": {"pointer", "&io.LimitedReader{}"},
+			"PipeReader":    {"pointer", "&io.PipeReader{}"},
+			"SectionReader": {"pointer", "&io.SectionReader{}"},
+			"Reader":        {"pointer", "&strings.Reader{}"},
+		}},
+		{"r = L@", map[string]impl{
+			"Locked":        {"pointer", "&Locked{}"},
+			"LimitedReader": {"pointer", "&io.LimitedReader{}"},
+		}},
+		{"use(nil, @", map[string]impl{
+			"Locked":  {"pointer", "&Locked{}"},
+			"Mutex":   {"pointer", "&sync.Mutex{}"},
+			"RWMutex": {"pointer", "&sync.RWMutex{}"},
+		}},
+		{"var l sync.Locker = sync.@", nil},
+		{"var _ any = @", nil},
+	}
+	for _, test := range tests {
+		got, _ := suggestSource(t, suggest.Config{Implementers: true}, decls+test.src+"\n}\n")
+		impls := make(map[string]impl)
+		for i, c := range got {
+			if c.Implements == "" {
+				continue
+			}
+			if i > 0 && got[i-1].Implements == "" {
+				t.Errorf("%s: implementer %s listed after %s", test.src, c.Name, got[i-1].Name)
+			}
+			impls[c.Name] = impl{c.Implements, c.InsertText}
+		}
+		if len(impls) == 0 {
+			impls = nil
+		}
+		if !reflect.DeepEqual(impls, test.want) {
+			t.Errorf("%s: got %v, want %v", test.src, impls, test.want)
+		}
+	}
+}
+
+func TestPackageDoc(t *testing.T) {
+	const decls = `package p
+
+import "fmt"
+
+type T struct{ X int }
+
+func f(t T) {
+	`
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"fmt.@", "Package fmt implements formatted I/O with functions analogous to C's printf and scanf."},
+		{"fmt.Pr@", "Package fmt implements formatted I/O with functions analogous to C's printf and scanf."},
+		{"t.@", ""},
+	}
+	for _, test := range tests {
+		src, cursors := cutCursors(decls + test.src + "\n}\n")
+		cfg := suggest.Config{
+			Importer:    importer.Default(),
+			Logf:        t.Logf,
+			PackageDocs: &build.Default,
+		}
+		res := cfg.SuggestResult("", []byte(src), cursors[0])
+		if len(res.Candidates) == 0 {
+			t.Errorf("%s: no candidates", test.src)
+		}
+		if res.PackageDoc != test.want {
+			t.Errorf("%s: got doc %q, want %q", test.src, res.PackageDoc, test.want)
+		}
+	}
+}
+
+func TestCandidateID(t *testing.T) {
+	const src = `package p
+
+import "bytes"
+
+type A struct{}
+
+func (A) String() string { return "" }
+
+type B struct{}
+
+func (*B) String() string { return "" }
+
+func f(a A, b *B, buf *bytes.Buffer) {
+	%s
+}
+`
+	ids := func(prefix, expr string) map[string]string {
+		got, _ := suggestSource(t, suggest.Config{}, prefix+fmt.Sprintf(src, expr))
+		res := make(map[string]string)
+		for _, c := range got {
+			if c.ID == "" {
+				t.Errorf("%s: no ID for %s", expr, c.Name)
+			}
+			res[c.Name] = c.ID
+		}
+		return res
+	}
+	for _, expr := range []string{"a.@", "b.@", "buf.@", "@"} {
+		// Shift every position in the second run.
+		first, second := ids("", expr), ids("// Package p.\n\n", expr)
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("%s: ids changed between runs: %v, then %v", expr, first, second)
+		}
+	}
+	if a, b := ids("", "a.@")["String"], ids("", "b.@")["String"]; a == b {
+		t.Errorf("A.String and B.String share ID %s", a)
+	}
+	if a, buf := ids("", "a.@")["String"], ids("", "buf.@")["String"]; a == buf {
+		t.Errorf("A.String and bytes.Buffer.String share ID %s", a)
+	}
+}
+
+func TestLocalCandidateID(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"go.mod":   "module example.com/m // comment\n\ngo 1.21\n",
+		"p/p.go":   "package p\n\nfunc Local() {}\n",
+		"p/use.go": "package p\n\nfunc f() {\n\tLoc@\n}\n",
+	})
+	src, cursors := cutCursors("package p\n\nfunc f() {\n\tLoc@\n}\n")
+	cfg := suggest.Config{Importer: importer.Default(), Logf: t.Logf}
+	got, _ := cfg.Suggest(filepath.Join(dir, "p", "use.go"), []byte(src), cursors[0])
+	if len(got) != 1 {
+		t.Fatalf("got %v, want Local", got)
+	}
+	if want := suggest.CandidateID("example.com/m/p", "", "Local"); got[0].ID != want {
+		t.Errorf("got ID %s, want %s as when imported", got[0].ID, want)
+	}
+
+	got, _ = suggestSource(t, suggest.Config{}, "package p\n\nfunc f() {\n\tfu@\n}\n")
+	for _, c := range got {
+		if c.Name == "func" && c.ID == suggest.CandidateID("", "", "func") {
+			t.Errorf("keyword func has the ID of a symbol func of the package \"\"")
+		}
+	}
+}
+
+func TestShadowedPackage(t *testing.T) {
+	const decls = `package p
+
+import "fmt"
+
+var _ = fmt.Sprint
+
+func f() {
+	`
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"fmt := 3\n\tfmt.@", nil},
+		{"fmt := undefined()\n\tfmt.@", nil},
+		{"var fmt struct{ X undefined }\n\tfmt.@", []string{"var X invalid type"}},
+		{"fmt := struct{ Println int }{}\n\tfmt.@", []string{"var Println int"}},
+		{"{\n\t\tfmt := 3\n\t\t_ = fmt\n\t}\n\tfmt.Printl@", []string{"func Println(a ...any) (n int, err error)"}},
+	}
+	for _, test := range tests {
+		for _, unimported := range []bool{false, true} {
+			got, _ := suggestSource(t, suggest.Config{UnimportedPackages: unimported}, decls+test.src+"\n}\n")
+			var strs []string
+			for _, c := range got {
+				strs = append(strs, c.String())
+			}
+			if !reflect.DeepEqual(strs, test.want) {
+				t.Errorf("%q (unimported packages %v): got %q, want %q", test.src, unimported, strs, test.want)
+			}
+		}
+	}
+}
+
+func TestOutlinePositions(t *testing.T) {
+	const src = `package p
+
+const Max = 10
+
+var counter int
+
+type Point struct {
+	X, Y int
+}
+
+func (p *Point) Move(dx int) {}
+
+func helper() {
+	x := 1
+	x@
+}
+`
+	got, n := suggestSource(t, suggest.Config{Outline: true}, src)
+
+	// Positions are reported in the json format, as line:column in
+	// the file, which is unnamed here.
+	var out bytes.Buffer
+	suggest.Formatters["json"].Format(&out, suggest.Response{Candidates: got, Len: n})
+	var resp []json.RawMessage
+	var candidates []struct {
+		Name string `json:"name"`
+		Pos  string `json:"pos"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil || len(resp) < 2 {
+		t.Fatalf("bad json %s: %v", out.Bytes(), err)
+	}
+	if err := json.Unmarshal(resp[1], &candidates); err != nil {
+		t.Fatal(err)
+	}
+	pos := make(map[string]string)
+	for _, c := range candidates {
+		pos[c.Name] = c.Pos
+	}
+	want := map[string]string{
+		"Max":     "3:7",
+		"counter": "5:5",
+		"Point":   "7:6",
+		"Move":    "11:17",
+		"helper":  "13:6",
+	}
+	if !reflect.DeepEqual(pos, want) {
+		t.Errorf("got positions %v, want %v", pos, want)
+	}
+}
+
+func TestSortByPosition(t *testing.T) {
+	const src = `package p
+
+var zebra int
+
+func beta() {}
+
+type alpha struct{}
+
+const (
+	mid = 1
+	low = 2
+)
+
+func (alpha) method() {}
+
+func gamma() {
+	@
+}
+`
+	want := []string{"zebra", "beta", "alpha", "mid", "low", "method", "gamma"}
+	got, _ := suggestSource(t, suggest.Config{Outline: true, SortByPosition: true}, src)
+	var names []string
+	for _, c := range got {
+		names = append(names, c.Name)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("outline: got %v, want %v", names, want)
+	}
+
+	// Declarations of the package come first, in source order.
+	got, _ = suggestSource(t, suggest.Config{SortByPosition: true, Builtin: true}, strings.Replace(src, "@", "l@", 1))
+	names = nil
+	for _, c := range got {
+		names = append(names, c.Name)
+	}
+	if want := []string{"low", "len"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("completion: got %v, want %v", names, want)
+	}
+}
+
+func TestInterfaceLiteral(t *testing.T) {
+	const decls = `package p
+
+import "io"
+
+type Resetter interface {
+	Reset()
+}
+
+type Record struct{}
+
+var Reused int
+
+func Recycle() {}
+
+`
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		// Interfaces to embed and method specifications, no values
+		// and no other types.
+		{"type RW interface {\n\tio.Writer\n\tRe@\n}", []string{
+			"func Read(p []byte) (n int, err error)",
+			"func ReadAt(p []byte, off int64) (n int, err error)",
+			"func ReadByte() (byte, error)",
+			"func ReadFrom(r io.Reader) (n int64, err error)",
+			"func ReadRune() (r rune, size int, err error)",
+			"func Reset()",
+			"type Resetter interface",
+		}},
+		// Methods already declared are left out.
+		{"type R interface {\n\tRead(p []byte) (n int, err error)\n\tRea@\n}", []string{
+			"func ReadAt(p []byte, off int64) (n int, err error)",
+			"func ReadByte() (byte, error)",
+			"func ReadFrom(r io.Reader) (n int64, err error)",
+			"func ReadRune() (r rune, size int, err error)",
+		}},
+		// The interfaces of a package, to embed, without its
+		// funcs, such as io.WriteString.
+		{"type W interface {\n\tio.Write@\n}", []string{
+			"type WriteCloser interface",
+			"type WriteSeeker interface",
+			"type Writer interface",
+			"type WriterAt interface",
+			"type WriterTo interface",
+		}},
+		// In a method signature, only types.
+		{"type R interface {\n\tRun(Re@)\n}", []string{
+			"type Record struct",
+			"type Resetter interface",
+		}},
+		{"type R interface {\n\tRun(r Re@) error\n}", []string{
+			"type Record struct",
+			"type Resetter interface",
+		}},
+	}
+	for _, test := range tests {
+		got, _ := suggestSource(t, suggest.Config{}, decls+test.src+"\n")
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+			if c.Receiver != "" && c.InsertText != c.Name+strings.TrimPrefix(c.Type, "func") {
+				t.Errorf("%q: %s has insert text %q", test.src, c.Name, c.InsertText)
+			}
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%q: got %q, want %q", test.src, strs, test.want)
+		}
+	}
+}
+
+func TestReplaceRange(t *testing.T) {
+	const src = `package p
+
+import "fmt"
+
+func f() {
+	fmt.%s
+}
+`
+	tests := []struct {
+		ident      string
+		start, end string // the text before the range and before its end
+	}{
+		// At the end of the identifier.
+		{"Print@", "fmt.", "fmt.Print"},
+		// Within the identifier, whose rest is replaced too.
+		{"Pri@ntln", "fmt.", "fmt.Println"},
+		{"@Println", "fmt.", "fmt.Println"},
+	}
+	for _, test := range tests {
+		data, cursors := cutCursors(fmt.Sprintf(src, test.ident))
+		cfg := suggest.Config{Importer: importer.Default(), Logf: t.Logf}
+		res := cfg.SuggestResult("", []byte(data), cursors[0])
+		if len(res.Candidates) == 0 {
+			t.Fatalf("%s: no candidates", test.ident)
+		}
+		want := suggest.Range{
+			Start: strings.Index(data, test.start) + len(test.start),
+			End:   strings.Index(data, test.end) + len(test.end),
+		}
+		if res.Replace != want {
+			t.Errorf("%s: got range %+v, want %+v", test.ident, res.Replace, want)
+		}
+		if got := res.Replace.Start + res.Len; got != cursors[0] {
+			t.Errorf("%s: range starts %d bytes before the cursor, want Len %d", test.ident, cursors[0]-res.Replace.Start, res.Len)
+		}
+	}
+}
+
+func TestBlankIdentifier(t *testing.T) {
+	const decls = `package p
+
+type S struct {
+	_    int
+	_foo int
+	X    int
+}
+
+var _foo, _Bar, x int
+
+func g() (int, error) { return 0, nil }
+
+func f() {
+	`
+	all := []string{"f", "g", "S", "_Bar", "_foo", "x"}
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		// A typed _ matches underscore-prefixed names literally.
+		{"_@", []string{"_Bar", "_foo"}},
+		{"_f@", []string{"_foo"}},
+		// _ itself is never proposed.
+		{"var s S\n\ts.@", []string{"X", "_foo"}},
+		{"var s S\n\ts._@", []string{"_foo"}},
+		{"_ = S{@}", []string{"X", "_foo"}},
+		{"_ = S{_@}", []string{"_foo"}},
+		// Assigning to _ doesn't affect the expression.
+		{"_, err := @", all},
+		{"_, err := g@", []string{"g"}},
+		{"_ = @", all},
+	}
+	for _, test := range tests {
+		for _, ignoreCase := range []bool{false, true} {
+			got, _ := suggestSource(t, suggest.Config{IgnoreCase: ignoreCase}, decls+test.src+"\n}\n")
+			var names []string
+			for _, c := range got {
+				names = append(names, c.Name)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("%q (ignore case %v): got %q, want %q", test.src, ignoreCase, names, test.want)
+			}
+		}
+	}
+}
+
+func TestMainPackageImport(t *testing.T) {
+	gopath := writeFiles(t, map[string]string{
+		"src/example.com/cmd/tool/tool.go": "package main\n\nfunc Helper() {}\n\nfunc main() {}\n",
+		"src/example.com/app/app.go":       "package main\n",
+	})
+	filename := filepath.Join(gopath, "src", "example.com", "app", "main.go")
+
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+	ctx := cache.PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GO111MODULE = "off"
+
+	// Without a name, the import would declare main.
+	src, cursors := cutCursors(`package main
+
+import tool "example.com/cmd/tool"
+
+func main() {
+	tool.@
+	@
+}
+`)
+	cfg := suggest.Config{
+		Importer: cache.NewImporter(&ctx, filename, nil, true, true, false, t.Logf),
+		Logf:     t.Logf,
+	}
+	want := []string{`import "example.com/cmd/tool" is a program, not an importable package`}
+	res := cfg.SuggestResult(filename, []byte(src), cursors[0])
+	if len(res.Candidates) != 1 || res.Candidates[0].Name != "Helper" {
+		t.Errorf("got candidates %v, want Helper", res.Candidates)
+	}
+	if !reflect.DeepEqual(res.Diagnostics, want) {
+		t.Errorf("got diagnostics %q, want %q", res.Diagnostics, want)
+	}
+	for i, r := range cfg.SuggestMulti(filename, []byte(src), cursors) {
+		if r.Err != "" || len(r.Candidates) == 0 {
+			t.Errorf("cursor %d: got error %q and %d candidates", i, r.Err, len(r.Candidates))
+		}
+		if !reflect.DeepEqual(r.Diagnostics, want) {
+			t.Errorf("cursor %d: got diagnostics %q, want %q", i, r.Diagnostics, want)
+		}
+	}
+
+	var out bytes.Buffer
+	suggest.Formatters["json"].Format(&out, suggest.Response{Candidates: res.Candidates, Len: res.Len, Diagnostics: res.Diagnostics})
+	if !strings.Contains(out.String(), `"diagnostics":["import \"example.com/cmd/tool\" is a program, not an importable package"]`) {
+		t.Errorf("json response lacks diagnostics: %s", out.String())
+	}
+}
+
+func TestCandidateTexts(t *testing.T) {
+	const decls = `package p
+
+import (
+	"io"
+	"strings"
+)
+
+type T struct{ Field int }
+
+func Run(n int) {}
+
+func Reset() {}
+
+var Reused int
+
+func f(t T) {
+	`
+	tests := []struct {
+		kind string
+		cfg  suggest.Config
+		src  string
+		name string
+	}{
+		{"var", suggest.Config{}, decls + "_ = Reu@\n}\n", "Reused"},
+		{"func", suggest.Config{}, decls + "Ru@\n}\n", "Run"},
+		{"func with args", suggest.Config{InsertParens: true}, decls + "Ru@\n}\n", "Run"},
+		{"func without args", suggest.Config{InsertParens: true}, decls + "Rese@\n}\n", "Reset"},
+		{"func value", suggest.Config{InsertParens: true}, decls + "Ru@()\n}\n", "Run"},
+		{"field", suggest.Config{}, decls + "_ = t.F@\n}\n", "Field"},
+		{"package", suggest.Config{}, decls + "_ = strin@\n}\n", "strings"},
+		{"implementer", suggest.Config{Implementers: true}, decls + "var _ io.Reader = @\n}\n", "Reader"},
+		{"method spec", suggest.Config{}, decls + "}\n\ntype R interface {\n\tio.Writer\n\tReadB@\n}\n", "ReadByte"},
+		{"keyword", suggest.Config{}, "package p\n\nfu@\n", "func"},
+		{"snippet", suggest.Config{Skeletons: true}, "package main\n\nfu@\n", "func main() {}"},
+	}
+	var buf bytes.Buffer
+	for _, test := range tests {
+		got, _ := suggestSource(t, test.cfg, test.src)
+		var c *suggest.Candidate
+		for i := range got {
+			if got[i].Name == test.name {
+				c = &got[i]
+			}
+		}
+		if c == nil {
+			t.Errorf("%s: no candidate %q", test.kind, test.name)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s:\n\tlabel %q\n\tinsert_text %q\n\tfilter_text %q\n\tsuggestion %q\n",
+			test.kind, c.Label, c.InsertText, c.FilterText, c.Suggestion())
+	}
+	got := buf.Bytes()
+
+	golden.Check(t, "testdata/texts.golden", got)
+}
+
+func TestImportPaths(t *testing.T) {
+	gopath := writeFiles(t, map[string]string{
+		"src/example.com/lib/lib.go":       "package lib\n",
+		"src/example.com/lib/sub/sub.go":   "package sub\n",
+		"src/example.com/tool/main.go":     "package main\n\nfunc main() {}\n",
+		"src/example.com/empty/README":     "no Go files\n",
+		"src/example.com/testdata/data.go": "package data\n",
+	})
+	ctx := build.Default
+	ctx.GOROOT = filepath.Join(gopath, "goroot") // no standard library
+	ctx.GOPATH = gopath
+
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"import \"example.com/@\"", []string{
+			"import example.com/empty ",
+			"import example.com/lib (importable)",
+			"import example.com/tool ",
+		}},
+		{"import (\n\t\"example.com/l@\"\n)", []string{
+			"import example.com/lib (importable)",
+		}},
+		// The closing quote may be missing.
+		{"import \"example.com/lib/@\n", []string{
+			"import example.com/lib/sub (importable)",
+		}},
+		{"import \"example.com/lib\"@", nil},
+	}
+	for _, test := range tests {
+		cfg := suggest.Config{ImportPaths: &ctx}
+		got, n := suggestSource(t, cfg, "package p\n\n"+test.src+"\n")
+		var strs []string
+		for _, c := range got {
+			s := c.String()
+			if c.Importable {
+				s += "(importable)"
+			}
+			strs = append(strs, s)
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%q: got %q, want %q", test.src, strs, test.want)
+		}
+		before := test.src[:strings.Index(test.src, "@")]
+		if typed := before[strings.LastIndex(before, "\"")+1:]; len(got) > 0 && n != len(typed) {
+			t.Errorf("%q: got length %d, want %d", test.src, n, len(typed))
+		}
+	}
+}
+
+func TestModuleImportPaths(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"m/go.mod":                      "module example.com/m\n\ngo 1.21\n",
+		"m/app/app.go":                  "package app\n",
+		"m/lib/lib.go":                  "package lib\n",
+		"m/vendor/other.org/dep/dep.go": "package dep\n",
+	})
+	ctx := build.Default
+	ctx.GOROOT = filepath.Join(root, "goroot") // no standard library
+	ctx.GOPATH = filepath.Join(root, "gopath")
+	filename := filepath.Join(root, "m", "app", "app.go")
+
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"import \"ex@\"", []string{"import example.com "}},
+		{"import \"example.com/@\"", []string{"import example.com/m "}},
+		{"import \"example.com/m/@\"", []string{
+			"import example.com/m/app (importable)",
+			"import example.com/m/lib (importable)",
+		}},
+		{"import \"other.org/@\"", []string{"import other.org/dep (importable)"}},
+	}
+	for _, test := range tests {
+		src, cursors := cutCursors("package app\n\n" + test.src + "\n")
+		cfg := suggest.Config{ImportPaths: &ctx, Importer: importer.Default(), Logf: t.Logf}
+		got, _ := cfg.Suggest(filename, []byte(src), cursors[0])
+		var strs []string
+		for _, c := range got {
+			s := c.String()
+			if c.Importable {
+				s += "(importable)"
+			}
+			strs = append(strs, s)
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%q: got %q, want %q", test.src, strs, test.want)
+		}
+	}
+
+	// A listing is read again once the directory changes.
+	src, cursors := cutCursors("package app\n\nimport \"example.com/m/@\"\n")
+	if err := os.MkdirAll(filepath.Join(root, "m", "util"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := suggest.Config{ImportPaths: &ctx, Importer: importer.Default(), Logf: t.Logf}
+	got, _ := cfg.Suggest(filename, []byte(src), cursors[0])
+	if len(got) != 3 || got[2].Name != "example.com/m/util" {
+		t.Errorf("after adding util: got %v", got)
+	}
+}
+
+func TestEmbedPatterns(t *testing.T) {
+	// The package directory, testdata/embed, has static/, templates/,
+	// .env, _draft.txt, and tools/, which holds another module.
+	filename := filepath.Join("testdata", "embed", "embed.go")
+
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"//go:embed @", []string{"embed static dir", "embed templates dir"}},
+		{"//go:embed st@", []string{"embed static dir"}},
+		{"//go:embed static/@", []string{"embed static/css dir", "embed static/index.html "}},
+		{"//go:embed static/css/@\n", []string{"embed static/css/site.css "}},
+		{"//go:embed templates static/i@", []string{"embed static/index.html "}},
+		{"//go:embed all:t@", []string{"embed templates dir"}},
+		{"//go:embed \"te@", []string{"embed templates dir"}},
+		{"//go:embed `static/@`", []string{"embed static/css dir", "embed static/index.html "}},
+		// Names starting with "." or "_" are proposed once typed.
+		{"//go:embed .@", []string{"embed .env "}},
+		{"//go:embed _@", []string{"embed _draft.txt "}},
+		{"//go:embed \"static\"@", nil},
+		{"//go:embed ../@", nil},
+		{"//go:embed@", nil},
+		{"// go:embed @", nil},
+	}
+	for _, test := range tests {
+		src, cursors := cutCursors("package p\n\nimport _ \"embed\"\n\n" + test.src + "\nvar files string\n")
+		cfg := suggest.Config{EmbedPatterns: true, Importer: importer.Default(), Logf: t.Logf}
+		got, n := cfg.Suggest(filename, []byte(src), cursors[0])
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%q: got %q, want %q", test.src, strs, test.want)
+		}
+		before := test.src[:strings.Index(test.src, "@")]
+		typed := strings.TrimPrefix(before[strings.LastIndexAny(before, " \"`")+1:], "all:")
+		if len(got) > 0 && n != len(typed) {
+			t.Errorf("%q: got length %d, want %d", test.src, n, len(typed))
+		}
+
+		// Without the flag, nothing is proposed.
+		cfg.EmbedPatterns = false
+		if got, _ := cfg.Suggest(filename, []byte(src), cursors[0]); len(got) > 0 {
+			t.Errorf("%q: without EmbedPatterns, got %v", test.src, got)
+		}
+	}
+}
+
+func TestImportAliases(t *testing.T) {
+	files := make(map[string]string)
+	for _, dir := range []string{"a.com/storage/client", "b.com/storage/client", "c.com/storage/client", "d.com/x/client/v2", "e.com/other"} {
+		pkgName := "client"
+		if strings.HasSuffix(dir, "other") {
+			pkgName = "other"
+		}
+		files["src/"+dir+"/pkg.go"] = "package " + pkgName + "\n"
+	}
+	gopath := writeFiles(t, files)
+	ctx := build.Default
+	ctx.GOROOT = filepath.Join(gopath, "goroot") // no standard library
+	ctx.GOPATH = gopath
+
+	tests := []struct {
+		imports string
+		path    string
+		want    string
+	}{
+		// The import being typed doesn't collide with itself.
+		{"", "a.com/storage/cl", ""},
+		{"", "e.com/o", ""},
+		{"\"a.com/storage/client\"", "e.com/o", ""},
+		{"\"a.com/storage/client\"", "b.com/storage/cl", `storageclient "b.com/storage/client"`},
+		// Aliases and guessed names of other imports are taken too.
+		{"client \"e.com/other\"", "b.com/storage/cl", `storageclient "b.com/storage/client"`},
+		{"\"a.com/storage/client\"\n\tstorageclient \"b.com/storage/client\"", "c.com/storage/cl", `ccomstorageclient "c.com/storage/client"`},
+		{"\"a.com/storage/client\"\n\tstorageclient \"b.com/storage/client\"\n\tccomstorageclient \"e.com/other\"", "c.com/storage/cl", `ccomstorageclient2 "c.com/storage/client"`},
+		// The major version isn't part of the name.
+		{"\"a.com/storage/client\"", "d.com/x/client/v", `xclient "d.com/x/client/v2"`},
+		{"\"d.com/x/client/v2\"", "a.com/storage/cl", `storageclient "a.com/storage/client"`},
+	}
+	for _, test := range tests {
+		src := "package p\n\nimport (\n\t" + test.imports + "\n\t\"" + test.path + "@\"\n)\n"
+		got, _ := suggestSource(t, suggest.Config{ImportPaths: &ctx}, src)
+		if len(got) != 1 {
+			t.Errorf("%q: got %d candidates, want 1", src, len(got))
+			continue
+		}
+		if got[0].Import != test.want {
+			t.Errorf("%q: got import %q, want %q", src, got[0].Import, test.want)
+		}
+		var alias string
+		if i := strings.IndexByte(test.want, ' '); i >= 0 {
+			alias = test.want[:i]
+		}
+		if got[0].Alias != alias {
+			t.Errorf("%q: got alias %q, want %q", src, got[0].Alias, alias)
+		}
+	}
+
+	// The members of an unimported package tell how to import it.
+	got, _ := suggestSource(t, suggest.Config{UnimportedPackages: true}, "package p\n\nfunc f() {\n\tstrings.Title@\n}\n")
+	if len(got) == 0 {
+		t.Fatal("no members of unimported strings")
+	}
+	for _, c := range got {
+		if c.Import != `"strings"` {
+			t.Errorf("%s: got import %q, want %q", c.Name, c.Import, `"strings"`)
+		}
+	}
+}
+
+func TestStructLiteralSnippet(t *testing.T) {
+	const decls = `package p
+
+import (
+	"image"
+	"net/url"
+)
+
+type Point struct {
+	X, Y int
+	tag  string
+}
+
+func f() {
+	var p Point
+	var u *url.Userinfo
+	var l image.Point
+	var n int
+	_, _, _, _ = p, u, l, n
+	`
+	tests := []struct {
+		src   string
+		label string
+		text  string
+	}{
+		{"p = @", "Point{X, Y, tag}", "Point{X: $1, Y: $2, tag: $3}"},
+		{"p = Po@", "Point{X, Y, tag}", "Point{X: $1, Y: $2, tag: $3}"},
+		{"l = @", "image.Point{X, Y}", "image.Point{X: $1, Y: $2}"},
+		// Unexported fields of other packages are left out.
+		{"u = @", "&url.Userinfo{}", "&url.Userinfo{}"},
+		{"p = x@", "", ""},
+		{"n = @", "", ""},
+	}
+	for _, test := range tests {
+		for _, snippets := range []bool{false, true} {
+			got, _ := suggestSource(t, suggest.Config{Snippets: snippets}, decls+test.src+"\n}\n")
+			var label, text string
+			if len(got) > 0 && got[0].Class == "snippet" {
+				label, text = got[0].Label, got[0].InsertText
+			}
+			if !snippets {
+				if label != "" {
+					t.Errorf("%q: got snippet %q without -snippets", test.src, label)
+				}
+				continue
+			}
+			if label != test.label || text != test.text {
+				t.Errorf("%q: got snippet %q inserting %q, want %q inserting %q", test.src, label, text, test.label, test.text)
+			}
+		}
+	}
+}
+
+func TestBuildTagSplit(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.go":        "//go:build tagA\n\npackage foo\n\nfunc VariantA() {}\n\nfunc Variant() int { return 0 }\n",
+		"b.go":        "//go:build !tagA\n\npackage foo\n\nfunc VariantB() {}\n\nfunc Variant() string { return \"\" }\n",
+		"gen.go":      "//go:build ignore\n\npackage main\n\nfunc VariantGen() {}\n",
+		"bad.go":      "package bar\n\nfunc VariantBad() {}\n",
+		"foo_test.go": "package foo_test\n\nfunc VariantTest() {}\n",
+	})
+	ctx := build.Default
+	ctx.BuildTags = []string{"tagA"}
+	conflict := "found packages foo (foo.go) and bar (bad.go) in " + dir + "; completing in package foo"
+
+	tests := []struct {
+		ctx   *build.Context
+		src   string
+		want  []string
+		diags []string
+	}{
+		{&ctx, "package foo\n\nfunc f() {\n\tVar@\n}\n", []string{"func Variant() int", "func VariantA()"}, []string{conflict}},
+		// The file isn't built with tagA, so neither is a.go.
+		{&ctx, "//go:build !tagA\n\npackage foo\n\nfunc f() {\n\tVar@\n}\n", []string{"func Variant() string", "func VariantB()"}, []string{conflict}},
+		// The other tags stay as they are.
+		{&ctx, "//go:build tagB\n\npackage foo\n\nfunc f() {\n\tVar@\n}\n", []string{"func Variant() int", "func VariantA()"}, []string{conflict}},
+		{nil, "package foo\n\nfunc f() {\n\tVar@\n}\n", []string{"func Variant() int", "func VariantA()", "func VariantB()"}, []string{"b.go:7:6: Variant redeclared in this block"}},
+	}
+	for _, test := range tests {
+		src, cursors := cutCursors(test.src)
+		cfg := suggest.Config{
+			Importer:     importer.Default(),
+			BuildContext: test.ctx,
+			Logf:         t.Logf,
+		}
+		res := cfg.SuggestResult(filepath.Join(dir, "foo.go"), []byte(src), cursors[0])
+		var got []string
+		for _, c := range res.Candidates {
+			got = append(got, c.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q (context %v): got %q, want %q", test.src, test.ctx != nil, got, test.want)
+		}
+		if !reflect.DeepEqual(res.Diagnostics, test.diags) {
+			t.Errorf("%q (context %v): got diagnostics %q, want %q", test.src, test.ctx != nil, res.Diagnostics, test.diags)
+		}
+	}
+}
+
+func TestTypeAssertion(t *testing.T) {
+	const decls = `package p
+
+import (
+	"io"
+	"strings"
+)
+
+type Buf struct{}
+
+func (b *Buf) Read(p []byte) (int, error) { return 0, io.EOF }
+
+type Bytes []byte
+
+func (b Bytes) Read(p []byte) (int, error) { return 0, io.EOF }
+
+type Other struct{}
+
+type Closer interface{ Close() error }
+
+var _ = strings.NewReader
+
+func f(r io.Reader, v interface{}, n int) {
+	`
+	type cand struct{ str, insert string }
+	tests := []struct {
+		src  string
+		want []cand
+	}{
+		// Implementers first, types that can't implement io.Reader left out.
+		{"_ = r.(@", []cand{
+			{"type Buf struct", "*Buf"},
+			{"type Bytes []byte", "Bytes"},
+			{"type LimitedReader struct", "*io.LimitedReader"},
+			{"type PipeReader struct", "*io.PipeReader"},
+			{"type Reader struct", "*strings.Reader"},
+			{"type SectionReader struct", "*io.SectionReader"},
+			{"package io ", "io"},
+			{"package strings ", "strings"},
+			{"type Closer interface", "Closer"},
+		}},
+		{"_ = r.(B@", []cand{
+			{"type Buf struct", "*Buf"},
+			{"type Bytes []byte", "Bytes"},
+		}},
+		// Any type for an empty interface.
+		{"_ = v.(@)", []cand{
+			{"package io ", "io"},
+			{"package strings ", "strings"},
+			{"type Buf struct", "Buf"},
+			{"type Bytes []byte", "Bytes"},
+			{"type Closer interface", "Closer"},
+			{"type Other struct", "Other"},
+		}},
+		// Not an interface.
+		{"_ = n.(@", nil},
+	}
+	for _, test := range tests {
+		got, _ := suggestSource(t, suggest.Config{}, decls+test.src+"\n}\n")
+		var cands []cand
+		for _, c := range got {
+			cands = append(cands, cand{c.String(), c.Suggestion()})
+		}
+		if !reflect.DeepEqual(cands, test.want) {
+			t.Errorf("%s: got %q, want %q", test.src, cands, test.want)
+		}
+	}
+}
+
+func TestQualifiedTypes(t *testing.T) {
+	const decls = `package p
+
+import (
+	"image"
+	stdhttp "net/http"
+)
+
+type Local struct{}
+
+func f(c *stdhttp.Client, l Local) {
+	var p image.Point
+	_ = p
+	`
+	tests := []struct {
+		src       string
+		name      string
+		typ, qtyp string
+		insert    string
+	}{
+		{"c.D@", "Do", "func(req *stdhttp.Request) (*stdhttp.Response, error)", "func(req *net/http.Request) (*net/http.Response, error)", ""},
+		{"_ = l@", "l", "Local", "Local", ""},
+		{"var _ image.Rectangle = image.Rect(0, 0, 1, 1).A@", "Add", "func(p image.Point) image.Rectangle", "func(p image.Point) image.Rectangle", ""},
+		{"_ = image.Z@", "ZP", "image.Point", "image.Point", ""},
+		// The text inserted is still qualified by name.
+		{"p = @", "image.Point{}", "image.Point", "image.Point", "image.Point{X: $1, Y: $2}"},
+	}
+	for _, test := range tests {
+		for _, qualified := range []bool{false, true} {
+			want := test.typ
+			if qualified {
+				want = test.qtyp
+			}
+			got, _ := suggestSource(t, suggest.Config{QualifiedTypes: qualified, Snippets: true}, decls+test.src+"\n}\n")
+			found := false
+			for _, c := range got {
+				if c.Name != test.name {
+					continue
+				}
+				found = true
+				if c.Type != want {
+					t.Errorf("%s (qualified %v): got type %q, want %q", test.src, qualified, c.Type, want)
+				}
+				if test.insert != "" && c.InsertText != test.insert {
+					t.Errorf("%s (qualified %v): got insert text %q, want %q", test.src, qualified, c.InsertText, test.insert)
+				}
+			}
+			if !found {
+				t.Errorf("%s (qualified %v): no candidate %s in %v", test.src, qualified, test.name, got)
+			}
+		}
+	}
+}
+
+func TestMultiValueOperand(t *testing.T) {
+	const decls = `package p
+
+import (
+	"net/url"
+	"strconv"
+)
+
+type T struct{ F int }
+
+func (T) M() {}
+
+func three() (T, int, error) { return T{}, 0, nil }
+
+func f(s string, m map[string]T, x interface{}, ch chan T) {
+	`
+	tests := []struct {
+		src    string
+		want   []string
+		values int
+		diag   string
+	}{
+		{"strconv.Atoi(s).@", nil, 2, "strconv.Atoi(s) has 2 values; completing the members of the first, of type int"},
+		{"url.Parse(s).Hostn@", []string{"func Hostname() string"}, 2, "url.Parse(s) has 2 values; completing the members of the first, of type *url.URL"},
+		{"three().@", []string{"func M()", "var F int"}, 3, "three() has 3 values; completing the members of the first, of type T"},
+		// The comma-ok forms are single-valued as operands.
+		{"m[s].@", []string{"func M()", "var F int"}, 0, ""},
+		{"x.(T).@", []string{"func M()", "var F int"}, 0, ""},
+		{"(<-ch).@", []string{"func M()", "var F int"}, 0, ""},
+	}
+	cfg := suggest.Config{Importer: importer.Default(), Logf: t.Logf}
+	for _, test := range tests {
+		src, cursors := cutCursors(decls + test.src + "\n}\n")
+		res := cfg.SuggestResult("", []byte(src), cursors[0])
+		var got []string
+		for _, c := range res.Candidates {
+			got = append(got, c.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got candidates %q, want %q", test.src, got, test.want)
+		}
+		if res.OperandValues != test.values {
+			t.Errorf("%s: got %d operand values, want %d", test.src, res.OperandValues, test.values)
+		}
+		var diag string
+		if len(res.Diagnostics) > 0 {
+			diag = res.Diagnostics[len(res.Diagnostics)-1]
+		}
+		if diag != test.diag {
+			t.Errorf("%s: got diagnostic %q, want %q", test.src, diag, test.diag)
+		}
+	}
+}
+
+func TestIncompleteFuncLit(t *testing.T) {
+	const decls = `package p
+
+import (
+	"net/http"
+	"sort"
+)
+
+func f(s []int) {
+	`
+	tests := []struct {
+		src  string
+		want string // the first candidate
+	}{
+		// The parameters are in scope in the body, also without
+		// the end of the parameter list or the brace.
+		{"var h http.HandlerFunc = func(w http.ResponseWriter, req *http.Request) {\n\t\tre@", "var req *http.Request"},
+		{"var h http.HandlerFunc = func(w http.ResponseWriter, req *http.Request\n\t\tre@", "var req *http.Request"},
+		{"var h http.HandlerFunc = func(w http.ResponseWriter, req *http.Request)\n\t\tre@", "var req *http.Request"},
+		{"sort.Slice(s, func(i, j int) bool\n\t\treturn s[i] < s[j@", "var j int"},
+		{"h := func(\n\t\tw http.ResponseWriter,\n\t\treq *http.Request\n\t\tre@", "var req *http.Request"},
+		// A func type, not a literal.
+		{"var g func(int)\n\tg@", "var g func(int)"},
+		// The parameters expected after "func(".
+		{"var h http.HandlerFunc = func(@", "snippet func(rw http.ResponseWriter, r *http.Request) http.HandlerFunc"},
+		{"http.HandleFunc(\"/\", func(@", "snippet func(rw http.ResponseWriter, r *http.Request) func(http.ResponseWriter, *http.Request)"},
+		{"sort.Slice(s, func(@", "snippet func(i int, j int) bool func(i int, j int) bool"},
+	}
+	for _, test := range tests {
+		got, _ := suggestSource(t, suggest.Config{Snippets: true}, decls+test.src+"\n}\n")
+		if len(got) == 0 {
+			t.Errorf("%s: no candidates, want %s", test.src, test.want)
+			continue
+		}
+		if s := got[0].String(); s != test.want {
+			t.Errorf("%s: got %q first, want %q", test.src, s, test.want)
+		}
+		if c := got[0]; c.Class == "snippet" && "func("+c.Suggestion()+")" != c.Label[:len(c.Suggestion())+6] {
+			t.Errorf("%s: got insert text %q for %q", test.src, c.Suggestion(), c.Label)
+		}
+	}
+
+	// At the top level, too.
+	const src = "package p\n\nimport \"net/http\"\n\nvar h http.HandlerFunc = func(w http.ResponseWriter, req *http.Request\n\tre@\n}\n"
+	got, _ := suggestSource(t, suggest.Config{}, src)
+	if len(got) == 0 || got[0].Name != "req" {
+		t.Errorf("top level: got %v, want req", got)
+	}
+}
+
+const namesOnlySrc = `package p
+
+import "net/http"
+
+type T struct{ A int }
+
+func (T) M(x int) int { return x }
+
+const K = 1
+
+func f() {
+	var t T
+	t.@
+	var r *http.Request
+	r.@
+	_ = K@
+	_ = T@
+}
+`
+
+func TestNamesOnly(t *testing.T) {
+	src, cursors := cutCursors(namesOnlySrc)
+	cfg := suggest.Config{
+		Importer:       importer.Default(),
+		Logf:           t.Logf,
+		NamesOnly:      true,
+		Details:        true,
+		CallHints:      true,
+		InsertParens:   true,
+		QualifiedTypes: true,
+		Snippets:       true,
+	}
+	for i, res := range cfg.SuggestMulti("", []byte(src), cursors) {
+		cursor := cursors[i]
+		if len(res.Candidates) == 0 {
+			t.Errorf("%d: no candidates", cursor)
+		}
+		for _, c := range res.Candidates {
+			got, err := json.Marshal(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf(`{"class":%q,"name":%q}`, c.Class, c.Name)
+			if c.Class == "" || string(got) != want {
+				t.Errorf("%d: got %s, want %s", cursor, got, want)
+			}
+		}
+	}
+}
+
+// BenchmarkNamesOnly completes the members of a type and a package
+// with every detail of the candidates requested, with and without
+// NamesOnly.
+func BenchmarkNamesOnly(b *testing.B) {
+	src, cursors := cutCursors(namesOnlySrc)
+	imp := importer.Default()
+	for _, namesOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("names-only=%v", namesOnly), func(b *testing.B) {
+			cfg := suggest.Config{
+				Importer:       imp,
+				Logf:           func(string, ...interface{}) {},
+				NamesOnly:      namesOnly,
+				Details:        true,
+				CallHints:      true,
+				InsertParens:   true,
+				QualifiedTypes: true,
+				CheckCache:     true,
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cfg.SuggestMulti("", []byte(src), cursors)
+			}
+		})
+	}
+}
+
+func TestTagExcludedImports(t *testing.T) {
+	gopath := writeFiles(t, map[string]string{
+		// A package that only builds on Windows.
+		"src/winonly/w_windows.go": "package winonly\n\nimport \"os\"\n\nfunc Handle() *os.File { return nil }\n",
+		"src/winonly/w_plan9.go":   "package winonly\n\nfunc Plan9() {}\n",
+		"src/winonly/gen.go":       "//go:build ignore\n\npackage main\n\nfunc Generate() {}\n",
+		"src/winonly/w_test.go":    "package winonly\n\nfunc HandleTest() {}\n",
+		// The other files of the package being completed, each
+		// importing packages the other can't.
+		"src/app/app_other.go":   "//go:build !windows\n\npackage app\n\nimport \"does/not/exist\"\n\nvar _ = exist.X\n",
+		"src/app/app_windows.go": "package app\n\nimport \"winonly\"\n\nvar _ = winonly.Handle\n",
+	})
+	dir := filepath.Join(gopath, "src", "app")
+
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+	pctx := cache.PackContext(&build.Default)
+	pctx.GOOS = "linux"
+	pctx.GOPATH = gopath
+	pctx.GO111MODULE = "off"
+	ctx := cache.BuildContext(&pctx, dir)
+
+	var checks int
+	logf := func(format string, args ...interface{}) {
+		if strings.HasPrefix(format, "type-checking ") {
+			checks++
+		}
+		t.Logf(format, args...)
+	}
+	complete := func(name, src string, ctx *build.Context) ([]string, []string) {
+		t.Helper()
+		filename := filepath.Join(dir, name)
+		src, cursors := cutCursors(src)
+		cfg := suggest.Config{
+			Importer:     cache.NewImporter(&pctx, filename, nil, true, false, false, t.Logf),
+			BuildContext: ctx,
+			Logf:         logf,
+		}
+		res := cfg.SuggestResult(filename, []byte(src), cursors[0])
+		var got []string
+		for _, c := range res.Candidates {
+			got = append(got, c.String())
+		}
+		return got, res.Diagnostics
+	}
+
+	// The file being completed is built on Windows only, as is
+	// winonly, which it imports: it is imported as built there.
+	const winSrc = "package app\n\nimport \"winonly\"\n\nfunc f() {\n\twinonly.@\n}\n"
+	want := []string{"func Handle() *os.File"}
+	if got, _ := complete("app_windows.go", winSrc, ctx); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// The package is checked once, until its files change.
+	if got, _ := complete("app_windows.go", winSrc, ctx); !reflect.DeepEqual(got, want) || checks != 1 {
+		t.Errorf("got %q after %d checks, want %q after 1", got, checks, want)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(gopath, "src", "winonly", "w_windows.go"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := complete("app_windows.go", winSrc, ctx); !reflect.DeepEqual(got, want) || checks != 2 {
+		t.Errorf("got %q after %d checks, want %q after 2", got, checks, want)
+	}
+
+	// The imports it shares with the other files still resolve while
+	// those of app_other.go are dropped with it, and the imports the
+	// trimmed bodies don't use aren't reported.
+	got, diags := complete("app_windows.go", "package app\n\nimport (\n\t\"strings\"\n\t\"winonly\"\n)\n\nfunc f() {\n\tstrings.TrimSp@\n}\n", ctx)
+	if want := []string{"func TrimSpace(s string) string"}; !reflect.DeepEqual(got, want) || diags != nil {
+		t.Errorf("got %q and diagnostics %q, want %q and none", got, diags, want)
+	}
+
+	// A file built on Linux can't import winonly, nor can any file
+	// without a build context.
+	for _, test := range []struct {
+		name string
+		ctx  *build.Context
+	}{
+		{"app.go", ctx},
+		{"app_windows.go", nil},
+	} {
+		if got, _ := complete(test.name, winSrc, test.ctx); got != nil {
+			t.Errorf("%s (context %v): got %q, want none", test.name, test.ctx != nil, got)
+		}
+	}
+}
+
+func TestAllowedPackages(t *testing.T) {
+	const decls = `package p
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+)
+
+type T struct{ strings.Builder }
+
+var local int
+
+func f() {
+	var t T
+	_, _, _, _ = t, bytes.MinRead, url.Parse, strings.Repeat
+	`
+	allow := []string{"strings", "net/..."}
+	tests := []struct {
+		allow []string
+		src   string
+		want  []string
+	}{
+		{allow, "_ = strings.Buil@", []string{"type Builder struct"}},
+		{allow, "_ = url.Parse@", []string{"func Parse(rawURL string) (*url.URL, error)", "func ParseQuery(query string) (url.Values, error)", "func ParseRequestURI(rawURL string) (*url.URL, error)"}},
+		{allow, "_ = bytes.Buf@", nil},
+		// Also the names of the imports of other packages.
+		{allow, "_ = by@", nil},
+		{allow, "_ = str@", []string{"package strings "}},
+		// The package being completed, and what it promotes from
+		// an allowed package.
+		{allow, "_ = lo@", []string{"var local int"}},
+		{allow, "t.WriteS@", []string{"func WriteString(s string) (int, error)"}},
+		{nil, "_ = bytes.Buf@", []string{"type Buffer struct"}},
+	}
+	for _, test := range tests {
+		got, _ := suggestSource(t, suggest.Config{AllowedPackages: test.allow}, decls+test.src+"\n}\n")
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%q (allowed %q): got %q, want %q", test.src, test.allow, strs, test.want)
+		}
+	}
+
+	src, cursors := cutCursors(decls + "_ = bytes.Buf@\n}\n")
+	cfg := suggest.Config{Importer: importer.Default(), AllowedPackages: allow, Explain: true}
+	res := cfg.SuggestResult("", []byte(src), cursors[0])
+	want := []suggest.Rejection{{Name: "Buffer", PkgPath: "bytes", Class: "type", Reason: suggest.RejectNotAllowed}}
+	if !reflect.DeepEqual(res.Rejections, want) {
+		t.Errorf("got rejections %+v, want %+v", res.Rejections, want)
+	}
+}
+
+const chainDecls = `package p
+
+type A struct{ B *B }
+
+func (a A) M() *B { return a.B }
+
+type B struct{ C C }
+
+func (b *B) Get() *B { return b }
+
+type C struct{ Value int }
+
+func fn() *B { return nil }
+
+type Node struct {
+	Node *Node
+	Value int
+}
+
+func (n *Node) Next() *Node { return n }
+
+func f(a A, n *Node) {
+	`
+
+func TestParenthesizedChain(t *testing.T) {
+	want := []string{"var Value int"}
+	for _, src := range []string{
+		"_ = a.M().C.@",
+		"_ = (a.M()).C.@",
+		"_ = ((a.M())).C.@",
+		"_ = (*a.M()).C.@",
+		"_ = (a.B).Get().C.@",
+		"_ = (fn()).Get().C.@",
+		"_ = (a.M()).\n\t\tC.@",
+		"_ = (a.M()). // the C field\n\t\tC.@",
+		"_ = (a.M()).\n\t\t/* the C field */ C.V@",
+	} {
+		got, _ := suggestSource(t, suggest.Config{}, chainDecls+src+"\n}\n")
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+		}
+		if !reflect.DeepEqual(strs, want) {
+			t.Errorf("%q: got %q, want %q", src, strs, want)
+		}
+	}
+}
+
+func TestMaxChainLinks(t *testing.T) {
+	// 3*10 links, and the selector being completed.
+	src, cursors := cutCursors(chainDecls + "_ = n" + strings.Repeat(".Next().Node", 10) + ".@\n}\n")
+	cfg := suggest.Config{Importer: importer.Default(), Logf: t.Logf, MaxChainLinks: 31}
+	if res := cfg.SuggestResult("", []byte(src), cursors[0]); len(res.Candidates) == 0 || len(res.Diagnostics) != 0 {
+		t.Errorf("at the limit: got %d candidates, diagnostics %q", len(res.Candidates), res.Diagnostics)
+	}
+
+	cfg.MaxChainLinks = 30
+	res := cfg.SuggestResult("", []byte(src), cursors[0])
+	want := []string{"selector chain of 31 links exceeds the limit of 30; not completing"}
+	if len(res.Candidates) != 0 || !reflect.DeepEqual(res.Diagnostics, want) {
+		t.Errorf("beyond the limit: got %d candidates, diagnostics %q, want %q", len(res.Candidates), res.Diagnostics, want)
+	}
+	multi := cfg.SuggestMulti("", []byte(src), cursors)
+	if len(multi[0].Candidates) != 0 || !reflect.DeepEqual(multi[0].Diagnostics, want) || multi[0].Err != "" {
+		t.Errorf("SuggestMulti beyond the limit: got %+v", multi[0])
+	}
+}
+
+func BenchmarkDeepChain(b *testing.B) {
+	imp := importer.Default()
+	for _, links := range []int{10, 100, 1000} {
+		src, cursors := cutCursors(chainDecls + "_ = n" + strings.Repeat(".Next().Node", links/3) + ".@\n}\n")
+		b.Run(fmt.Sprint(links), func(b *testing.B) {
+			cfg := suggest.Config{
+				Importer:          imp,
+				Logf:              func(string, ...interface{}) {},
+				InsertParens:      true,
+				Implementers:      true,
+				Snippets:          true,
+				TypeHints:         true,
+				MarkUnaddressable: true,
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cfg.SuggestResult("", []byte(src), cursors[0])
+			}
+		})
+	}
+}
+
+func TestGoVersions(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	const depSrc = "package dep\n\nfunc Seq() {}\n"
+	const appSrc = "package app\n\nimport (\n\t\"example.com/dep\"\n\t\"strings\"\n)\n\nvar _ = strings.TrimSpace\n\nfunc Local() {}\n\nfunc f() {\n\t"
+	dir := writeFiles(t, map[string]string{
+		"dep/go.mod": "module example.com/dep\n\ngo 1.21 // for range-over-int\n",
+		"dep/dep.go": depSrc,
+		"app/go.mod": "module example.com/app\n\ngo 1.18\n\nrequire example.com/dep v0.0.0\n\nreplace example.com/dep => ../dep\n",
+		"app/app.go": appSrc + "}\n",
+	})
+	ctx := build.Default
+	cache.SetBuildDir(&ctx, filepath.Join(dir, "app"))
+	imp := mapImporter{"example.com/dep": checkPackage(t, "example.com/dep", nil, depSrc)}
+
+	for _, test := range []struct {
+		src  string
+		want string
+	}{
+		{"dep.S@", "1.21"},
+		// The standard library, and the package being completed,
+		// have none.
+		{"strings.TrimSp@", ""},
+		{"Loc@", ""},
+	} {
+		src, cursors := cutCursors(appSrc + test.src + "\n}\n")
+		cfg := suggest.Config{Importer: imp, Logf: t.Logf, BuildContext: &ctx, GoVersions: true}
+		got, _ := cfg.Suggest(filepath.Join(dir, "app", "app.go"), []byte(src), cursors[0])
+		if len(got) != 1 || got[0].GoVersion != test.want {
+			t.Errorf("%s: got %+v, want one candidate of Go version %q", test.src, got, test.want)
+		}
+	}
+
+	// The go directive is read again once the go.mod changes.
+	gomod := filepath.Join(dir, "dep", "go.mod")
+	if err := ioutil.WriteFile(gomod, []byte("module example.com/dep\n\ngo 1.22\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(gomod, later, later); err != nil {
+		t.Fatal(err)
+	}
+	src, cursors := cutCursors(appSrc + "dep.S@\n}\n")
+	cfg := suggest.Config{Importer: imp, Logf: t.Logf, BuildContext: &ctx, GoVersions: true}
+	if got, _ := cfg.Suggest(filepath.Join(dir, "app", "app.go"), []byte(src), cursors[0]); len(got) != 1 || got[0].GoVersion != "1.22" {
+		t.Errorf("after editing go.mod: got %+v, want one candidate of Go version 1.22", got)
+	}
+}
+
+func TestGoVersionsGOPATH(t *testing.T) {
+	// A go.mod above GOPATH/src doesn't make its packages part of
+	// a module.
+	const depSrc = "package dep\n\nfunc Seq() {}\n"
+	dir := writeFiles(t, map[string]string{
+		"go.mod":                            "module example.com/all\n\ngo 1.21\n",
+		"gopath/src/example.com/dep/dep.go": depSrc,
+		"gopath/src/example.com/app/app.go": "package app\n",
+	})
+	gopath := filepath.Join(dir, "gopath")
+	appDir := filepath.Join(gopath, "src", "example.com", "app")
+
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+	pctx := cache.PackContext(&build.Default)
+	pctx.GOPATH = gopath
+	pctx.GO111MODULE = "off"
+	ctx := cache.BuildContext(&pctx, appDir)
+
+	imp := mapImporter{"example.com/dep": checkPackage(t, "example.com/dep", nil, depSrc)}
+	src, cursors := cutCursors("package app\n\nimport \"example.com/dep\"\n\nfunc f() {\n\tdep.S@\n}\n")
+	cfg := suggest.Config{Importer: imp, Logf: t.Logf, BuildContext: ctx, GoVersions: true}
+	if got, _ := cfg.Suggest(filepath.Join(appDir, "app.go"), []byte(src), cursors[0]); len(got) != 1 || got[0].GoVersion != "" {
+		t.Errorf("got %+v, want one candidate without a Go version", got)
+	}
+}
+
+func TestSnippetFormat(t *testing.T) {
+	const decls = `package p
+
+type Server struct {
+	Addr, Network string
+	MaxConns      int
+	hidden        bool
+}
+
+type Point struct{ X, Y int }
+
+func f() {
+	`
+	tests := []struct {
+		kind string
+		src  string
+		name string
+	}{
+		{"struct literal", "var s Server = @\n}\n", "Server{}"},
+		{"pointer struct literal", "var s *Server\n\ts = @\n}\n", "&Server{}"},
+		{"nested struct literal", "if true {\n\t\tif true {\n\t\t\tvar s *Server\n\t\t\ts = @\n\t\t}\n\t}\n}\n", "&Server{}"},
+		{"struct literal before a comment", "var p Point\n\tp = @ // the origin, until the user clicks\n}\n", "Point{}"},
+		{"short struct literal", "var p Point = @\n}\n", "Point{}"},
+		{"func literal parameters", "var g func(int, ...string) (n int, err error)\n\tg = func(@\n}\n", "i int, s ...string"},
+	}
+	prefs := []struct {
+		indent string
+		width  int
+	}{
+		{"", 40},
+		{"  ", 60},
+	}
+	var buf bytes.Buffer
+	for _, pref := range prefs {
+		for _, test := range tests {
+			cfg := suggest.Config{Snippets: true, Indent: pref.indent, LineWidth: pref.width}
+			got, _ := suggestSource(t, cfg, decls+test.src)
+			var c *suggest.Candidate
+			for i := range got {
+				if got[i].Class == "snippet" && got[i].Name == test.name {
+					c = &got[i]
+				}
+			}
+			if c == nil {
+				t.Errorf("%s (indent %q, width %d): no candidate %q", test.kind, pref.indent, pref.width, test.name)
+				continue
+			}
+			text := c.InsertText
+			if text == "" {
+				text = c.Name
+			}
+			fmt.Fprintf(&buf, "%s (indent %q, width %d):\n%s\nlabel: %s\n", test.kind, pref.indent, pref.width, text, c.Label)
+		}
+	}
+	got := buf.Bytes()
+
+	golden.Check(t, "testdata/snippets.golden", got)
+}
+
+func TestBuilderChains(t *testing.T) {
+	const decls = `package p
+
+import "sync/atomic"
+
+type Config struct{ Timeout, Retries int }
+
+func (c *Config) WithTimeout(n int) *Config { return c }
+func (c *Config) WithRetries(n int) *Config { return c }
+
+type Builder[T any] struct{ Value T }
+
+func (b *Builder[T]) With(v T) *Builder[T] { return b }
+func (b *Builder[T]) Build() T                { return b.Value }
+
+func NewBuilder[T any]() *Builder[T] { return nil }
+
+func From[T any](v T) *Builder[T] { return nil }
+
+type Opts[T any] struct{ *Builder[T] }
+
+func f(cfg *Config, b *Builder[Config], o Opts[Config]) {
+	`
+	config := []string{"func WithRetries(n int) *Config", "func WithTimeout(n int) *Config", "var Retries int", "var Timeout int"}
+	builder := []string{"func Build() Config", "func With(v Config) *Builder[Config]", "var Value Config"}
+	// Build returns a Config value, which isn't addressable.
+	built := []string{"var Retries int", "var Timeout int"}
+	for _, test := range []struct {
+		src  string
+		want []string
+	}{
+		// A non-generic builder.
+		{"cfg.WithTimeout(5).WithRetries(3).@", config},
+		{"cfg.WithTimeout(5).\n\t\tWithRetries(3).@", config},
+		// A generic one, instantiated by the operand type, by type
+		// arguments, through embedding, or by inference. go/types
+		// keeps the instantiation through the results of chained
+		// calls, so these only guard against regressions.
+		{"b.With(Config{}).With(Config{}).@", builder},
+		{"b.With(Config{}).With(Config{}).Build().@", built},
+		{"b.With(Config{}).Value.@", config},
+		{"NewBuilder[Config]().With(Config{}).@", builder},
+		{"NewBuilder[*Config]().With(nil).Build().@", config},
+		{"o.With(Config{}).Build().@", built},
+		{"From(Config{}).With(Config{}).@", builder},
+		{"var p atomic.Pointer[Config]\n\tp.Load().@", config},
+		// Arguments that don't type-check yet don't break the
+		// chain, but can't instantiate a generic func.
+		{"cfg.WithTimeout(missing).@", config},
+		{"b.With(missing).@", builder},
+		{"b.With(missing).With(Config{}).Build().@", built},
+		{"NewBuilder[Config]().With(Config{Timeout: missing}).@", builder},
+		{"(*b.With(missing)).Value.@", config},
+		{"From(missing).With(Config{}).@", nil},
+	} {
+		got, _ := suggestSource(t, suggest.Config{}, decls+test.src+"\n}\n")
+		var strs []string
+		for _, c := range got {
+			strs = append(strs, c.String())
+		}
+		if !reflect.DeepEqual(strs, test.want) {
+			t.Errorf("%q: got %q, want %q", test.src, strs, test.want)
+		}
+	}
+}
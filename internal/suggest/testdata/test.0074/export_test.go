@@ -0,0 +1,4 @@
+package subj
+
+// Exposed for the external test package.
+var Unexported = unexported
@@ -0,0 +1,5 @@
+package subj
+
+func Exported() int { return unexported() }
+
+func unexported() int { return 42 }
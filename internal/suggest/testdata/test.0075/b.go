@@ -0,0 +1,3 @@
+package outline
+
+var fromOtherFile = helper
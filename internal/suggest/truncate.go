@@ -0,0 +1,28 @@
+package suggest
+
+import "encoding/json"
+
+// Truncate returns the longest prefix of candidates, which are listed
+// best first, that takes at most maxBytes as a json array, and whether
+// any candidates were dropped. If maxBytes is zero or less, candidates
+// are returned as is.
+func Truncate(candidates []Candidate, maxBytes int) ([]Candidate, bool) {
+	if maxBytes <= 0 {
+		return candidates, false
+	}
+	size := len("[]")
+	for i, c := range candidates {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return candidates[:i], true
+		}
+		size += len(b)
+		if i > 0 {
+			size += len(",")
+		}
+		if size > maxBytes {
+			return candidates[:i], true
+		}
+	}
+	return candidates, false
+}
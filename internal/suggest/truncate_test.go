@@ -0,0 +1,58 @@
+package suggest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestTruncate(t *testing.T) {
+	var candidates []suggest.Candidate
+	for i := 0; i < 1000; i++ {
+		candidates = append(candidates, suggest.Candidate{
+			Class: "func",
+			Name:  fmt.Sprintf("f%d", i),
+			Type:  "func(ctx context.Context, req *Request, opts ...Option) (*Response, error)",
+		})
+	}
+	const max = 10000
+
+	got, truncated := suggest.Truncate(candidates, max)
+	if !truncated {
+		t.Fatalf("got %d candidates, not truncated", len(got))
+	}
+	if len(got) == 0 || !reflect.DeepEqual(got, candidates[:len(got)]) {
+		t.Fatalf("got %d candidates, want a non-empty prefix of the input", len(got))
+	}
+	b, _ := json.Marshal(got)
+	if len(b) > max {
+		t.Errorf("got %d bytes, want at most %d", len(b), max)
+	}
+	if b, _ := json.Marshal(candidates[:len(got)+1]); len(b) <= max {
+		t.Errorf("one more candidate takes only %d bytes, want more than %d", len(b), max)
+	}
+
+	var out bytes.Buffer
+	suggest.Formatters["json"].Format(&out, suggest.Response{Candidates: got, Len: 1, Status: suggest.Status{Truncated: true}})
+	var resp []json.RawMessage
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil || len(resp) != 3 {
+		t.Fatalf("got response %s, err %v", out.Bytes(), err)
+	}
+	var info struct {
+		Truncated bool `json:"truncated"`
+	}
+	if err := json.Unmarshal(resp[2], &info); err != nil || !info.Truncated {
+		t.Errorf("got trailing object %s, want truncated set", resp[2])
+	}
+
+	if got, truncated := suggest.Truncate(candidates[:3], max); truncated || len(got) != 3 {
+		t.Errorf("small response: got %d candidates, truncated %v", len(got), truncated)
+	}
+	if got, truncated := suggest.Truncate(candidates, 0); truncated || len(got) != len(candidates) {
+		t.Errorf("no limit: got %d candidates, truncated %v", len(got), truncated)
+	}
+}
@@ -0,0 +1,100 @@
+package suggest
+
+import (
+	"go/token"
+	"go/types"
+)
+
+// typeAssertCandidates proposes, after "x.(", the types x of type typ
+// may be asserted to, and the packages in scope, which may declare
+// them. If typ is an interface with methods, concrete types that don't
+// implement it are left out, as the assertion couldn't succeed, and
+// those that do are listed first, also from the packages imported by
+// pkg. Their InsertText is the asserted type, a pointer if only the
+// pointer implements the interface.
+func (c *Config) typeAssertCandidates(typ types.Type, pkg *types.Package, scope *types.Scope, pos token.Pos, b *candidateCollector) {
+	var iface *types.Interface
+	if typ != nil {
+		if it, ok := typ.Underlying().(*types.Interface); ok && it.NumMethods() > 0 && it.IsMethodSet() {
+			iface = it
+		}
+	}
+	b.asserted = make(map[types.Object]string)
+	// implements reports whether the assertion to the type of tn
+	// may succeed, recording how it implements iface.
+	implements := func(tn *types.TypeName) bool {
+		if iface == nil || types.IsInterface(tn.Type()) {
+			return true
+		}
+		named, ok := tn.Type().(*types.Named)
+		if !ok || named.TypeParams().Len() > 0 {
+			// Generic types are instantiated first; keep them.
+			return ok
+		}
+		switch {
+		case types.Implements(named, iface):
+			b.asserted[tn] = "value"
+		case types.Implements(types.NewPointer(named), iface):
+			b.asserted[tn] = "pointer"
+		default:
+			return false
+		}
+		return true
+	}
+
+	seen := make(map[string]bool)
+	for s := scope; s != nil; s = s.Parent() {
+		for _, name := range s.Names() {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			_, obj := s.LookupParent(name, pos)
+			switch obj := obj.(type) {
+			case *types.TypeName:
+				if implements(obj) {
+					b.appendObject(obj)
+				}
+			case *types.PkgName:
+				b.appendObject(obj)
+			}
+		}
+	}
+	if iface == nil {
+		return
+	}
+
+	imports := pkg.Imports()
+	if len(imports) > maxImplementerPackages {
+		imports = imports[:maxImplementerPackages]
+	}
+	for _, p := range imports {
+		for _, name := range p.Scope().Names() {
+			tn, ok := p.Scope().Lookup(name).(*types.TypeName)
+			if !ok || !accessible(tn, pkg) || tn.IsAlias() || types.IsInterface(tn.Type()) {
+				continue
+			}
+			if implements(tn) && b.asserted[tn] != "" {
+				b.appendObject(tn)
+			}
+		}
+	}
+	boost := b.boost
+	b.boost = func(obj types.Object) bool {
+		return b.asserted[obj] != "" || boost != nil && boost(obj)
+	}
+}
+
+// assertedText returns the type tn asserted to, qualified by its
+// package name, with a '*' if only the pointer implements the
+// interface.
+func (b *candidateCollector) assertedText(tn *types.TypeName, how string) string {
+	name := tn.Name()
+	if q := b.qualify(tn.Pkg()); q != "" {
+		name = q + "." + name
+	}
+	if how == "pointer" {
+		return "*" + name
+	}
+	return name
+}
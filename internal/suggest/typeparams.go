@@ -0,0 +1,34 @@
+package suggest
+
+import (
+	"bytes"
+	"go/types"
+)
+
+// typeParams returns the type parameter list of typ, such as
+// "[K comparable, V any]", or "" if typ isn't generic.
+func typeParams(typ types.Type, qualify types.Qualifier) string {
+	named, ok := typ.(*types.Named)
+	if !ok || named.TypeParams().Len() == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i := 0; i < named.TypeParams().Len(); i++ {
+		tp := named.TypeParams().At(i)
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(tp.Obj().Name())
+		buf.WriteByte(' ')
+		buf.WriteString(types.TypeString(tp.Constraint(), qualify))
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+// isGenericFunc reports whether sig is the signature of a generic func
+// that isn't instantiated.
+func isGenericFunc(sig *types.Signature) bool {
+	return sig.TypeParams().Len() > 0
+}
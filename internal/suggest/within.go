@@ -0,0 +1,35 @@
+package suggest
+
+import "time"
+
+// Within runs full and partial concurrently. It returns the results of
+// full if they are ready within timeout, and otherwise those of
+// partial, with isPartial set. In that case full keeps running in the
+// background, so that whatever it caches is available to the next
+// request.
+func Within(timeout time.Duration, full, partial func() []Result) (res []Result, isPartial bool) {
+	// Buffered, so that the goroutines never block on results
+	// that are no longer wanted.
+	fullc := make(chan []Result, 1)
+	partialc := make(chan []Result, 1)
+	go func() {
+		fullc <- full()
+	}()
+	go func() {
+		partialc <- partial()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-fullc:
+		return res, false
+	case <-timer.C:
+	}
+	select {
+	case res := <-fullc:
+		return res, false
+	case res := <-partialc:
+		return res, true
+	}
+}
@@ -0,0 +1,74 @@
+package suggest_test
+
+import (
+	"errors"
+	"go/types"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+// slowImporter imports nothing, after a delay.
+type slowImporter struct{ delay time.Duration }
+
+func (s slowImporter) Import(path string) (*types.Package, error) {
+	time.Sleep(s.delay)
+	return nil, errors.New("not found")
+}
+
+// noImporter fails immediately.
+type noImporter struct{}
+
+func (noImporter) Import(path string) (*types.Package, error) {
+	return nil, errors.New("not cached")
+}
+
+func TestWithin(t *testing.T) {
+	const (
+		deadline  = 100 * time.Millisecond
+		tolerance = 50 * time.Millisecond
+	)
+	src := []byte("package p\n\nimport \"slow\"\n\nvar _ = slow.X\n\nfunc localFunc() {}\n\nfunc f() {\n\tloc\n}\n")
+	cursor := len("package p\n\nimport \"slow\"\n\nvar _ = slow.X\n\nfunc localFunc() {}\n\nfunc f() {\n\tloc")
+	suggestWith := func(imp types.Importer) func() []suggest.Result {
+		return func() []suggest.Result {
+			cfg := suggest.Config{Importer: imp, Logf: func(string, ...interface{}) {}}
+			return []suggest.Result{cfg.SuggestResult("", src, cursor)}
+		}
+	}
+
+	done := make(chan bool)
+	full := suggestWith(slowImporter{time.Second})
+	start := time.Now()
+	res, partial := suggest.Within(deadline, func() []suggest.Result {
+		defer close(done)
+		return full()
+	}, suggestWith(noImporter{}))
+	got := res[0].Candidates
+	if elapsed := time.Since(start); elapsed > deadline+tolerance {
+		t.Errorf("slow import: returned after %v, want at most %v", elapsed, deadline+tolerance)
+	}
+	if !partial {
+		t.Errorf("slow import: result not partial")
+	}
+	if len(got) != 1 || got[0].Name != "localFunc" {
+		t.Errorf("slow import: got %v, want localFunc", got)
+	}
+	select {
+	case <-done:
+		t.Errorf("full completion finished before the slow import")
+	default:
+	}
+	<-done // the full completion still runs to the end
+
+	start = time.Now()
+	res, partial = suggest.Within(deadline, suggestWith(slowImporter{0}), suggestWith(slowImporter{time.Second}))
+	got = res[0].Candidates
+	if elapsed := time.Since(start); elapsed > deadline {
+		t.Errorf("fast import: returned after %v, want before the deadline", elapsed)
+	}
+	if partial || len(got) != 1 {
+		t.Errorf("fast import: got %v, partial %v", got, partial)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/cache"
+	"github.com/mdempsky/gocode/internal/refindex"
+)
+
+// refIndexInterval is how often the server refreshes the reference
+// index of -ref-index.
+const refIndexInterval = time.Minute
+
+// openRefIndex opens the reference index of the workspace named by
+// -ref-index, as saved in the user's cache directory, or returns nil
+// if there is none.
+func openRefIndex() *refindex.Index {
+	if *g_ref_index == "" {
+		return nil
+	}
+	root, err := filepath.Abs(*g_ref_index)
+	if err != nil {
+		log.Printf("ref index: %v", err)
+		return nil
+	}
+	if fs := cache.Sandbox(); fs != nil {
+		if err := fs.Check(root); err != nil {
+			log.Printf("ref index: %v", err)
+			return nil
+		}
+	}
+	return refindex.Open(root, refIndexPath(root))
+}
+
+// refIndexPath returns the file the reference index of root is saved
+// to, or "" if there is no cache directory.
+func refIndexPath(root string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	h := fnv.New64a()
+	io.WriteString(h, root)
+	return filepath.Join(dir, "gocode", fmt.Sprintf("refs-%016x.json", h.Sum64()))
+}
+
+// refIndexMu is held while the reference index is refreshed, and
+// saved, so that the daemon doesn't exit halfway.
+var refIndexMu sync.Mutex
+
+// refreshRefIndex refreshes ix every refIndexInterval, forever.
+func refreshRefIndex(ix *refindex.Index) {
+	for {
+		refIndexMu.Lock()
+		n, err := ix.Refresh()
+		refIndexMu.Unlock()
+		if err != nil {
+			log.Printf("ref index: %v", err)
+		} else if *g_debug && n > 0 {
+			log.Printf("ref index: counted the references of %d changed directories", n)
+		}
+		time.Sleep(refIndexInterval)
+	}
+}
@@ -2,23 +2,46 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"errors"
 	"go/build"
 	"go/importer"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mdempsky/gocode/internal/cache"
+	"github.com/mdempsky/gocode/internal/cachefile"
+	"github.com/mdempsky/gocode/internal/fswalk"
 	"github.com/mdempsky/gocode/internal/gbimporter"
+	"github.com/mdempsky/gocode/internal/goenv"
+	"github.com/mdempsky/gocode/internal/logdedup"
+	"github.com/mdempsky/gocode/internal/pkgsimporter"
+	"github.com/mdempsky/gocode/internal/refindex"
+	"github.com/mdempsky/gocode/internal/sandbox"
 	"github.com/mdempsky/gocode/internal/suggest"
 )
 
 func doServer(cache bool) {
+	setMaxInstalls(*g_install_concurrency)
+	setSymlinkPolicy(symlinkPolicy())
+	if *g_sandbox_root != "" {
+		useSandbox(*g_sandbox_root)
+	}
+	goEnv.TTL = *g_go_env_ttl
+	cachefile.Logf = serverLog.Logf
+	gbimporter.Logf = serverLog.Logf
+
 	addr := *g_addr
 	if *g_sock == "unix" {
 		addr = getSocketPath()
@@ -28,62 +51,266 @@ func doServer(cache bool) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := ioutil.WriteFile(getDaemonPidPath(), []byte(strconv.Itoa(os.Getpid())+"\n"), 0600); err != nil {
+		log.Printf("writing pid: %v", err)
+	}
+
+	if cache && *g_cache_max_bytes > 0 {
+		limitCache(*g_cache_max_bytes)
+	}
+	if cache && *g_preload != "" {
+		preload(*g_preload)
+	}
 
 	sigs := make(chan os.Signal)
 	signal.Notify(sigs, os.Interrupt)
 	go func() {
 		<-sigs
-		exitServer()
+		exitServer(0)
 	}()
 
-	if err = rpc.Register(&Server{
+	refs := openRefIndex()
+	if refs != nil {
+		go refreshRefIndex(refs)
+	}
+
+	srv := &Server{
 		cache: cache,
-	}); err != nil {
+		refs:  refs,
+		lis:   lis,
+	}
+	if *g_exit_when_replaced {
+		if w := newBinaryWatch(get_executable_filename(), binaryRecheck); w != nil {
+			srv.watchBinary(w)
+		}
+	}
+	if err = rpc.Register(srv); err != nil {
 		log.Fatal(err)
 	}
 	rpc.Accept(lis)
+	if srv.binary != nil && srv.binary.Replaced() {
+		// exitReplaced closed the listener, and exits once the
+		// requests in flight are served.
+		select {}
+	}
+}
+
+// setSymlinkPolicy sets the policy for symbolic links met by the
+// importers and the reference index.
+func setSymlinkPolicy(p fswalk.Policy) {
+	gbimporter.SetSymlinkPolicy(p)
+	cache.SetSymlinkPolicy(p)
+	refindex.SetSymlinkPolicy(p)
+}
+
+// setMaxInstalls bounds the go commands building packages, go install
+// and those exporting the standard library, to n at once.
+func setMaxInstalls(n int) {
+	gbimporter.SetMaxInstalls(n)
+	cache.Throttle = gbimporter.AcquireSlot
+}
+
+// limitCache bounds the estimated memory taken by the packages the
+// cache importer keeps to n bytes.
+func limitCache(n int64) {
+	cache.SetMaxBytes(n)
+}
+
+// preload imports the packages listed in file, one import path per
+// line, into the cache and pins them there. Blank lines and lines
+// starting with '#' are ignored.
+func preload(file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("preload: %v", err)
+		return
+	}
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			paths = append(paths, line)
+		}
+	}
+	ctx := cache.PackContext(&build.Default)
+	fillContext(&ctx)
+	errs := cache.Preload(&ctx, file, paths, *g_fallback_to_source, func(s string, args ...interface{}) {
+		if *g_debug {
+			serverLog.Logf("preload: "+s, args...)
+		}
+	})
+	for _, err := range errs {
+		log.Print(err)
+	}
 }
 
-func exitServer() {
+// useSandbox confines the reads of the server to root, GOROOT, and
+// the export data in the build and module caches and that written by
+// warm-std.
+func useSandbox(root string) {
+	goroot := build.Default.GOROOT
+	if goroot == "" {
+		goroot = goEnv.Get("GOROOT")
+	}
+	exportRoots := []string{goEnv.Get("GOCACHE"), goEnv.Get("GOMODCACHE")}
+	if root := stdExportRoot(); root != "" {
+		exportRoots = append(exportRoots, root)
+	}
+	for _, dir := range filepath.SplitList(goEnv.Get("GOPATH")) {
+		exportRoots = append(exportRoots, filepath.Join(dir, "pkg"))
+	}
+	fs, err := sandbox.New(root, goroot, exportRoots...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache.SetSandbox(fs)
+}
+
+// exitServer removes the socket and pid files of the daemon, and exits
+// with status code.
+func exitServer(code int) {
 	if *g_sock == "unix" {
 		_ = os.Remove(getSocketPath())
 	}
-	os.Exit(0)
+	_ = os.Remove(getDaemonPidPath())
+	os.Exit(code)
 }
 
+// serverLog throttles the messages of the daemon, and debug messages,
+// that repeat on every request, such as import failures for a missing
+// dependency.
+var serverLog = logdedup.New(log.Printf, time.Minute)
+
+// goEnv caches "go env", which fills in the parts of a request's build
+// context that the client couldn't determine.
+var goEnv = goenv.New(time.Minute)
+
 type Server struct {
 	cache bool
+	refs  *refindex.Index // nil without -ref-index
+
+	mu   sync.Mutex
+	last lastResponse // for diff mode
+
+	// background holds the completions of suggestWithin, which may
+	// continue past the requests that started them.
+	background sync.WaitGroup
+
+	// binary, if set, reports the replacement of the executable,
+	// upon which the daemon closes lis and exits once the requests
+	// it holds in requests are served.
+	binary   *binaryWatch
+	lis      net.Listener
+	requests sync.RWMutex
+	exitOnce sync.Once
+}
+
+type lastResponse struct {
+	generation int64
+	filename   string
+	start      int
+	candidates []suggest.Candidate
 }
 
 type AutoCompleteRequest struct {
-	Filename           string
-	Data               []byte
-	Cursor             int
-	Context            cache.PackedContext
-	Source             bool
-	Builtin            bool
-	IgnoreCase         bool
-	UnimportedPackages bool
-	FallbackToSource   bool
+	Filename                 string
+	Data                     []byte
+	Cursor                   int
+	Context                  cache.PackedContext
+	Source                   bool
+	Builtin                  bool
+	IgnoreCase               bool
+	UnimportedPackages       bool
+	FallbackToSource         bool
+	Outline                  bool
+	Skeletons                bool
+	TypeHints                bool
+	Details                  bool
+	CgoInternals             bool
+	Snippets                 bool
+	QualifiedTypes           bool
+	Indent                   string
+	LineWidth                int
+	Explain                  bool
+	NamesOnly                bool
+	GoVersions               bool
+	HideUnexportedPromotions bool
+	EmbedPatterns            bool
+	AllowedPackages          []string
+	CallHints                bool
+	InsertParens             bool
+	Prefix                   string
+	MarkUnaddressable        bool
+	Implementers             bool
+	PackageDoc               bool
+	SortByPosition           bool
+	IndexOnlyLines           int
+	MaxChainLinks            int
+	CheckCache               bool
+	ReferenceWeight          float64
+	Loader                   string
+	Refresh                  bool
+	NoGb                     bool
+
+	// MaxResponseBytes, if positive, limits the size of the candidate
+	// list as json. Only the best candidates that fit are returned.
+	MaxResponseBytes int
+
+	// Deadline, if positive, bounds how long the request waits for
+	// imports. If they take longer, the reply holds the candidates
+	// computable without them and Partial is set.
+	Deadline time.Duration
+
+	// ExportDirs lists directories searched for export data before
+	// the standard locations. It is only used by the cache importer.
+	ExportDirs []string
+
+	// Diff requests diff mode. If Generation matches the previous
+	// response and the identifier being completed starts at the
+	// same offset, the reply holds a Delta against that response.
+	Diff       bool
+	Generation int64
+
+	// Cursors, if non-empty, requests completion at each of
+	// these offsets instead of at Cursor. The results are
+	// returned in AutoCompleteReply.Results.
+	Cursors []int
 }
 
 type AutoCompleteReply struct {
 	Candidates []suggest.Candidate
 	Len        int
+	Replace    suggest.Range
+	Results    []suggest.Result
+	Generation int64
+	Delta      *suggest.Delta
+	Truncated  bool // the candidates were cut to MaxResponseBytes
+	Partial    bool // the candidates were computed before Deadline
+
+	// PackageDoc is the doc summary of the package whose members
+	// are proposed, if requested.
+	PackageDoc string
+
+	// Diagnostics describe problems of the file that completion
+	// works around.
+	Diagnostics []string
+
+	// Rejections are the symbols matching the identifier being
+	// completed that aren't proposed, if Explain is requested.
+	Rejections []suggest.Rejection
+
+	// OperandValues is the number of values of a multi-valued
+	// operand, whose first value's members are proposed.
+	OperandValues int
 }
 
 func (s *Server) AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply) error {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Printf("panic: %s\n\n", err)
-			debug.PrintStack()
-
-			res.Candidates = []suggest.Candidate{
-				{Class: "PANIC", Name: "PANIC", Type: "PANIC"},
-			}
-		}
-	}()
-	if *g_debug {
+	defer s.begin()()
+	defer recoverCompletion(func() { res.Candidates = panicCandidates() })
+	if *g_debug && len(req.Cursors) > 0 {
+		log.Printf("Got autocompletion request for '%s'\n", req.Filename)
+		log.Printf("Cursors at: %v\n", req.Cursors)
+	} else if *g_debug {
 		var buf bytes.Buffer
 		log.Printf("Got autocompletion request for '%s'\n", req.Filename)
 		log.Printf("Cursor at: %d\n", req.Cursor)
@@ -95,40 +322,97 @@ func (s *Server) AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply)
 		log.Println("-------------------------------------------------------")
 	}
 	now := time.Now()
+	orig := req.Filename
+	req.Filename = canonicalFilename(orig)
+	spelling := newPathSpelling(orig, req.Filename)
+	logf := func(string, ...interface{}) {}
+	if *g_debug {
+		logf = serverLog.Logf
+	}
 	cfg := suggest.Config{
-		Builtin:            req.Builtin,
-		IgnoreCase:         req.IgnoreCase,
-		UnimportedPackages: req.UnimportedPackages,
-		Logf:               func(string, ...interface{}) {},
+		Builtin:                  req.Builtin,
+		IgnoreCase:               req.IgnoreCase,
+		UnimportedPackages:       req.UnimportedPackages,
+		Outline:                  req.Outline,
+		Skeletons:                req.Skeletons,
+		TypeHints:                req.TypeHints,
+		Details:                  req.Details,
+		CgoInternals:             req.CgoInternals,
+		Snippets:                 req.Snippets,
+		QualifiedTypes:           req.QualifiedTypes,
+		Indent:                   req.Indent,
+		LineWidth:                req.LineWidth,
+		Explain:                  req.Explain,
+		NamesOnly:                req.NamesOnly,
+		GoVersions:               req.GoVersions,
+		EmbedPatterns:            req.EmbedPatterns,
+		AllowedPackages:          req.AllowedPackages,
+		CallHints:                req.CallHints,
+		InsertParens:             req.InsertParens,
+		Prefix:                   req.Prefix,
+		MarkUnaddressable:        req.MarkUnaddressable,
+		HideUnexportedPromotions: req.HideUnexportedPromotions,
+		Implementers:             req.Implementers,
+		SortByPosition:           req.SortByPosition,
+		IndexOnlyLines:           req.IndexOnlyLines,
+		MaxChainLinks:            req.MaxChainLinks,
+		CheckCache:               req.CheckCache,
+		Sandbox:                  cache.Sandbox(),
+		Logf:                     logf,
 	}
-	cfg.Logf = func(string, ...interface{}) {}
-	if *g_debug {
-		cfg.Logf = log.Printf
+	fillContext(&req.Context)
+	if s.refs != nil && req.ReferenceWeight > 0 {
+		cfg.ReferenceCount, cfg.ReferenceWeight = s.refs.Count, req.ReferenceWeight
 	}
-	// TODO(rstambler): Figure out why this happens sometimes.
-	if req.Context.GOPATH == "" || req.Context.GOROOT == "" {
-		req.Context = cache.PackContext(&build.Default)
+	cfg.ImportPaths = cache.BuildContext(&req.Context, filepath.Dir(req.Filename))
+	cfg.BuildContext = cfg.ImportPaths
+	if req.PackageDoc {
+		cfg.PackageDocs = cfg.ImportPaths
 	}
-	if req.Source {
-		cfg.Importer = gbimporter.New(&req.Context, req.Filename, importer.For("source", nil), func(s string, args ...interface{}) {
-			cfg.Logf("source: "+s, args...)
-		})
-	} else if s.cache {
-		cache.Mu.Lock()
-		defer cache.Mu.Unlock()
-		cfg.Importer = cache.NewImporter(&req.Context, req.Filename, req.FallbackToSource, func(s string, args ...interface{}) {
-			cfg.Logf("cache: "+s, args...)
+
+	if len(req.Cursors) > 0 {
+		if req.Deadline > 0 {
+			res.Results, res.Partial = s.suggestWithin(cfg, req, func(cfg *suggest.Config) []suggest.Result {
+				return cfg.SuggestMulti(req.Filename, req.Data, req.Cursors)
+			})
+		} else {
+			defer s.useImporter(&cfg, req)()
+			res.Results = cfg.SuggestMulti(req.Filename, req.Data, req.Cursors)
+		}
+		for i := range res.Results {
+			r := &res.Results[i]
+			spelling.restoreResult(r)
+			r.Truncated = truncate(r, req)
+		}
+		if *g_debug {
+			log.Printf("Elapsed duration: %v\n", time.Since(now))
+			log.Println("=======================================================")
+		}
+		return nil
+	}
+
+	var r suggest.Result
+	if req.Deadline > 0 {
+		var rs []suggest.Result
+		rs, res.Partial = s.suggestWithin(cfg, req, func(cfg *suggest.Config) []suggest.Result {
+			return []suggest.Result{cfg.SuggestResult(req.Filename, req.Data, req.Cursor)}
 		})
+		r = rs[0]
 	} else {
-		cfg.Importer = gbimporter.New(&req.Context, req.Filename, importer.Default(), func(s string, args ...interface{}) {
-			cfg.Logf("gbimporter: "+s, args...)
-		})
+		defer s.useImporter(&cfg, req)()
+		r = cfg.SuggestResult(req.Filename, req.Data, req.Cursor)
 	}
-
-	candidates, d := cfg.Suggest(req.Filename, req.Data, req.Cursor)
+	spelling.restoreResult(&r)
+	res.Truncated = truncate(&r, req)
+	candidates, d := r.Candidates, r.Len
+	res.PackageDoc, res.Diagnostics, res.Rejections = r.PackageDoc, r.Diagnostics, r.Rejections
+	res.OperandValues = r.OperandValues
 	elapsed := time.Since(now)
 	if *g_debug {
 		log.Printf("Elapsed duration: %v\n", elapsed)
+		if res.Partial {
+			log.Printf("Deadline exceeded, partial response\n")
+		}
 		log.Printf("Offset: %d\n", res.Len)
 		log.Printf("Number of candidates found: %d\n", len(candidates))
 		log.Printf("Candidates are:\n")
@@ -138,6 +422,313 @@ func (s *Server) AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply)
 		log.Println("=======================================================")
 	}
 	res.Candidates, res.Len = candidates, d
+	if candidates != nil {
+		res.Replace = suggest.ReplaceRange(req.Data, req.Cursor, d)
+	}
+	if req.Diff {
+		s.diff(req, res)
+	}
+	return nil
+}
+
+// truncate cuts the candidates of r to req.MaxResponseBytes, and
+// reports whether any were left out. Those are explained as rejected
+// if req.Explain is set.
+func truncate(r *suggest.Result, req *AutoCompleteRequest) bool {
+	all := r.Candidates
+	var truncated bool
+	r.Candidates, truncated = suggest.Truncate(all, req.MaxResponseBytes)
+	if req.Explain {
+		r.Rejections = suggest.Rejected(r.Rejections, all[len(r.Candidates):], suggest.RejectBudget)
+	}
+	return truncated
+}
+
+// useImporter sets the importer of cfg as requested by req. The
+// returned function must be called once cfg is no longer used.
+func (s *Server) useImporter(cfg *suggest.Config, req *AutoCompleteRequest) (done func()) {
+	// In a sandbox, only the cache importer confines its reads.
+	sandboxed := cache.Sandbox() != nil
+	if req.Loader == "packages" && !sandboxed {
+		cfg.Importer = pkgsimporter.New(&req.Context, req.Filename, req.Data, func(s string, args ...interface{}) {
+			cfg.Logf("packages: "+s, args...)
+		})
+	} else if req.Source && !sandboxed {
+		cfg.Importer = gbimporter.New(&req.Context, req.Filename, importer.For("source", nil), req.NoGb, func(s string, args ...interface{}) {
+			cfg.Logf("source: "+s, args...)
+		})
+	} else if s.cache || sandboxed {
+		cache.Mu.Lock()
+		imp := cache.NewImporter(&req.Context, req.Filename, withStdExportDir(&req.Context, req.ExportDirs), req.FallbackToSource, req.Refresh, req.NoGb, func(s string, args ...interface{}) {
+			cfg.Logf("cache: "+s, args...)
+		})
+		imp.Overlay(req.Filename, req.Data)
+		cfg.Importer = imp
+		return cache.Mu.Unlock
+	} else {
+		cfg.Importer = gbimporter.New(&req.Context, req.Filename, importer.Default(), req.NoGb, func(s string, args ...interface{}) {
+			cfg.Logf("gbimporter: "+s, args...)
+		})
+	}
+	return func() {}
+}
+
+// suggestWithin returns the results of complete with cfg, using the
+// importer requested by req, but gives up waiting for imports after
+// req.Deadline. The results are then computed from the packages that
+// the cache importer holds only, and the full completion continues in
+// the background, so that the caches are warm for the next request.
+// The cache importer is locked as usual, so background completions
+// don't race with later requests. The package doc and diagnostics are
+// only returned by a full completion.
+func (s *Server) suggestWithin(cfg suggest.Config, req *AutoCompleteRequest, complete func(*suggest.Config) []suggest.Result) ([]suggest.Result, bool) {
+	s.background.Add(1)
+	full := func() (res []suggest.Result) {
+		defer s.background.Done()
+		// It may outlive the request, whose recover can't
+		// catch its panics.
+		defer recoverCompletion(func() {
+			n := len(req.Cursors)
+			if n == 0 {
+				n = 1
+			}
+			res = make([]suggest.Result, n)
+			for i := range res {
+				res[i].Candidates = panicCandidates()
+			}
+		})
+		cfg := cfg
+		defer s.useImporter(&cfg, req)()
+		return complete(&cfg)
+	}
+	partial := func() []suggest.Result {
+		cfg := cfg
+		cfg.Importer = cache.NewCachedImporter(&req.Context, req.Filename)
+		res := complete(&cfg)
+		for i, r := range res {
+			res[i] = suggest.Result{Candidates: r.Candidates, Len: r.Len, Replace: r.Replace, Err: r.Err}
+		}
+		return res
+	}
+	return suggest.Within(req.Deadline, full, partial)
+}
+
+// recoverCompletion, deferred, recovers from a panic of a completion,
+// which it logs before calling fail.
+func recoverCompletion(fail func()) {
+	if err := recover(); err != nil {
+		log.Printf("panic: %s\n\n%s", err, debug.Stack())
+		fail()
+	}
+}
+
+// panicCandidates are the candidates of a completion that panicked.
+func panicCandidates() []suggest.Candidate {
+	return []suggest.Candidate{
+		{Class: "PANIC", Name: "PANIC", Type: "PANIC"},
+	}
+}
+
+// diff records res as the latest response and, if req echoes the
+// generation of the previous response for the same identifier,
+// replaces res.Candidates with a Delta against it.
+func (s *Server) diff(req *AutoCompleteRequest, res *AutoCompleteReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.last
+	if prev.generation == 0 {
+		// Avoid matching tokens handed out by a previous daemon.
+		prev.generation = time.Now().UnixNano()
+	}
+	start := req.Cursor - res.Len
+	s.last = lastResponse{prev.generation + 1, req.Filename, start, res.Candidates}
+	res.Generation = s.last.generation
+
+	if req.Generation == prev.generation && req.Filename == prev.filename && start == prev.start {
+		delta := suggest.Diff(prev.candidates, res.Candidates)
+		res.Candidates, res.Delta = nil, &delta
+	}
+}
+
+type ImportsRequest struct {
+	Filename   string
+	Data       []byte // if nil, Filename is read
+	Context    cache.PackedContext
+	ExportDirs []string
+	NoGb       bool
+}
+
+type ImportStatus struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Err    string `json:"error,omitempty"`
+
+	// SrcDir is the -extra-src-dirs mapping the package is imported
+	// through, as prefix=dir, if any.
+	SrcDir string `json:"src_dir,omitempty"`
+
+	// Fresh marks, in the reply to a Warm request with Std set, a
+	// package whose export data was already up to date.
+	Fresh bool `json:"fresh,omitempty"`
+}
+
+type ImportsReply struct {
+	Filename string         `json:"file"`
+	Imports  []ImportStatus `json:"imports"`
+}
+
+// Imports reports how the cache importer would resolve each import of
+// a file, without importing anything.
+func (s *Server) Imports(req *ImportsRequest, res *ImportsReply) error {
+	defer s.begin()()
+	if !s.cache {
+		return errors.New("imports requires a server started with -cache")
+	}
+	paths, err := fileImports(req.Filename, req.Data)
+	if err != nil {
+		return err
+	}
+
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+	filename := canonicalFilename(req.Filename)
+	imp := s.cacheImporter(&req.Context, filename, req.ExportDirs, false, req.NoGb)
+	res.Filename = req.Filename
+	for _, path := range paths {
+		st := ImportStatus{Path: path, Status: imp.Status(path, filepath.Dir(filename))}
+		if m, _, ok := cache.LookupSrcDir(req.Context.ExtraSrcDirs, path); ok {
+			st.SrcDir = m.String()
+		}
+		res.Imports = append(res.Imports, st)
+	}
+	return nil
+}
+
+type WarmRequest struct {
+	Filename         string
+	Paths            []string
+	Context          cache.PackedContext
+	ExportDirs       []string
+	NoGb             bool
+	FallbackToSource bool
+
+	// Std says that Paths are standard library packages, whose
+	// export data is first written to the user cache directory,
+	// unless it is up to date, for this and later requests.
+	Std bool
+}
+
+// Warm imports each of the paths imported by a file into the cache,
+// and reports their status afterwards.
+func (s *Server) Warm(req *WarmRequest, res *ImportsReply) error {
+	defer s.begin()()
+	if !s.cache {
+		return errors.New("warm requires a server started with -cache")
+	}
+	var fresh map[string]bool
+	if req.Std {
+		fillContext(&req.Context)
+		dir := stdExportDir(&req.Context)
+		if dir == "" {
+			return errors.New("warm: no user cache directory for the export data of the standard library")
+		}
+		var err error
+		if fresh, err = cache.ExportStd(&req.Context, dir, req.Paths); err != nil {
+			return err
+		}
+	}
+
+	cache.Mu.Lock()
+	defer cache.Mu.Unlock()
+	filename := canonicalFilename(req.Filename)
+	imp := s.cacheImporter(&req.Context, filename, req.ExportDirs, req.FallbackToSource, req.NoGb)
+	res.Filename = req.Filename
+	srcDir := filepath.Dir(filename)
+	for _, path := range req.Paths {
+		st := ImportStatus{Path: path, Fresh: fresh[path]}
+		if _, err := imp.ImportFrom(path, srcDir, 0); err != nil {
+			st.Err = err.Error()
+		}
+		st.Status = imp.Status(path, srcDir)
+		res.Imports = append(res.Imports, st)
+	}
+	return nil
+}
+
+func (s *Server) cacheImporter(ctx *cache.PackedContext, filename string, exportDirs []string, fallbackToSource, noGb bool) cache.Importer {
+	fillContext(ctx)
+	return cache.NewImporter(ctx, filename, withStdExportDir(ctx, exportDirs), fallbackToSource, false, noGb, func(s string, args ...interface{}) {
+		if *g_debug {
+			serverLog.Logf("cache: "+s, args...)
+		}
+	})
+}
+
+// fillContext completes a build context sent by a client.
+func fillContext(ctx *cache.PackedContext) {
+	// TODO(rstambler): Figure out why this happens sometimes.
+	if ctx.GOPATH == "" || ctx.GOROOT == "" {
+		dirs := ctx.ExtraSrcDirs
+		*ctx = cache.PackContext(&build.Default)
+		ctx.ExtraSrcDirs = dirs
+	}
+	// A gocode built with -trimpath doesn't know its GOROOT.
+	if ctx.GOROOT == "" {
+		ctx.GOROOT = goEnv.Get("GOROOT")
+	}
+	if ctx.GOPATH == "" {
+		ctx.GOPATH = goEnv.Get("GOPATH")
+	}
+}
+
+// fileImports returns the import paths of a Go file, whose contents
+// are data if non-nil.
+func fileImports(filename string, data []byte) ([]string, error) {
+	var src interface{}
+	if data != nil {
+		src = data
+	} else if fs := cache.Sandbox(); fs != nil {
+		if err := fs.Check(filename); err != nil {
+			return nil, err
+		}
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.ImportsOnly)
+	if f == nil {
+		return nil, err
+	}
+	var paths []string
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || path == "C" {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+type StatsRequest struct{}
+type StatsReply struct {
+	Installs gbimporter.InstallStats
+
+	// ExportDataMismatch is set once the cache importer found
+	// export data written by a newer Go than gocode was built with.
+	ExportDataMismatch *cache.VersionMismatch `json:",omitempty"`
+}
+
+func (s *Server) Stats(req *StatsRequest, res *StatsReply) error {
+	res.Installs = gbimporter.Stats()
+	res.ExportDataMismatch = cache.ExportDataMismatch()
+	return nil
+}
+
+type ReloadRequest struct{}
+type ReloadReply struct{}
+
+// Reload drops the cached "go env", e.g. after switching toolchains.
+func (s *Server) Reload(req *ReloadRequest, res *ReloadReply) error {
+	goEnv.Invalidate()
 	return nil
 }
 
@@ -147,7 +738,7 @@ type ExitReply struct{}
 func (s *Server) Exit(req *ExitRequest, res *ExitReply) error {
 	go func() {
 		time.Sleep(time.Second)
-		exitServer()
+		exitServer(0)
 	}()
 	return nil
 }
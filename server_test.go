@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/cache"
+	"github.com/mdempsky/gocode/internal/golden"
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestSchema(t *testing.T) {
+	got, err := suggest.Schema(reflect.TypeOf(AutoCompleteRequest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	// If the request changed incompatibly, bump suggest.FormatVersion.
+	golden.Check(t, "testdata/schema.golden", got)
+}
+
+// autoComplete sends a request for completion at the '@' in src, as
+// the file p.go in a temporary directory, to s.
+func autoComplete(t *testing.T, s *Server, src string, req AutoCompleteRequest) AutoCompleteReply {
+	t.Helper()
+	req.Cursor = strings.IndexByte(src, '@')
+	if req.Cursor < 0 {
+		t.Fatal("missing @")
+	}
+	req.Data = []byte(src[:req.Cursor] + src[req.Cursor+1:])
+	if req.Filename == "" {
+		req.Filename = filepath.Join(t.TempDir(), "p.go")
+	}
+	req.Context = packContext(filepath.Dir(req.Filename))
+	var res AutoCompleteReply
+	if err := s.AutoComplete(&req, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestDiffRoundTrip(t *testing.T) {
+	const src = `package p
+
+var (
+	alpha, alphabet, alpine, beta int
+)
+
+func f() {
+	al@
+}
+`
+	s := &Server{}
+	req := AutoCompleteRequest{Filename: filepath.Join(t.TempDir(), "p.go"), Diff: true}
+	first := autoComplete(t, s, src, req)
+	if first.Generation == 0 || first.Delta != nil || len(first.Candidates) != 3 {
+		t.Fatalf("first response: generation %d, delta %v, %d candidates", first.Generation, first.Delta, len(first.Candidates))
+	}
+
+	// The cursor advances in the same identifier.
+	req.Generation = first.Generation
+	second := autoComplete(t, s, strings.Replace(src, "al@", "alp@", 1), req)
+	if second.Delta == nil || second.Candidates != nil {
+		t.Fatalf("second response: no delta, %d candidates", len(second.Candidates))
+	}
+	var names []string
+	for _, c := range suggest.ApplyDelta(first.Candidates, *second.Delta) {
+		names = append(names, c.Name)
+	}
+	if want := []string{"alpha", "alphabet", "alpine"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("after applying the delta: got %v, want %v", names, want)
+	}
+
+	// A stale generation gets a full response.
+	third := autoComplete(t, s, strings.Replace(src, "al@", "alpi@", 1), req)
+	if third.Delta != nil || len(third.Candidates) != 1 || third.Candidates[0].Name != "alpine" {
+		t.Errorf("stale generation: got delta %v, candidates %v", third.Delta, third.Candidates)
+	}
+	if third.Generation <= second.Generation {
+		t.Errorf("generation went from %d to %d", second.Generation, third.Generation)
+	}
+}
+
+func TestCursorsTruncated(t *testing.T) {
+	const src = `package p
+
+var alpha, alphabet, alpine int
+
+func f() {
+	al@
+	al@
+}
+`
+	req := AutoCompleteRequest{
+		Filename: filepath.Join(t.TempDir(), "p.go"),
+		Data:     []byte(strings.Replace(src, "@", "", -1)),
+		Context:  packContext(t.TempDir()),
+	}
+	for i, n := 0, 0; i < len(src); i++ {
+		if src[i] == '@' {
+			req.Cursors = append(req.Cursors, i-n)
+			n++
+		}
+	}
+	complete := func() []suggest.Result {
+		t.Helper()
+		var res AutoCompleteReply
+		if err := (&Server{}).AutoComplete(&req, &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Results) != len(req.Cursors) {
+			t.Fatalf("got %d results, want %d", len(res.Results), len(req.Cursors))
+		}
+		return res.Results
+	}
+
+	full := complete()
+	b, err := json.Marshal(full[0].Candidates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for the best candidate only.
+	req.MaxResponseBytes = len("[]") + len(b)
+	for i, r := range complete() {
+		if !r.Truncated || len(r.Candidates) != 1 {
+			t.Errorf("cursor %d: got %d candidates, truncated %v; want 1, truncated", req.Cursors[i], len(r.Candidates), r.Truncated)
+		}
+	}
+}
+
+func TestCursorsDeadline(t *testing.T) {
+	const src = `package p
+
+import "strings"
+
+func f() {
+	strings.HasP@
+	strings.HasS@
+}
+`
+	req := AutoCompleteRequest{
+		Filename: filepath.Join(t.TempDir(), "p.go"),
+		Data:     []byte(strings.Replace(src, "@", "", -1)),
+		Context:  packContext(t.TempDir()),
+	}
+	for i, n := 0, 0; i < len(src); i++ {
+		if src[i] == '@' {
+			req.Cursors = append(req.Cursors, i-n)
+			n++
+		}
+	}
+	s := &Server{cache: true}
+	complete := func() AutoCompleteReply {
+		t.Helper()
+		var res AutoCompleteReply
+		if err := s.AutoComplete(&req, &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Results) != len(req.Cursors) {
+			t.Fatalf("got %d results, want %d", len(res.Results), len(req.Cursors))
+		}
+		return res
+	}
+	// Cache strings.
+	complete()
+
+	// Another request holds the cache importer past the deadline.
+	cache.Mu.Lock()
+	req.Deadline = 50 * time.Millisecond
+	start := time.Now()
+	res := complete()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %v", elapsed)
+	}
+	cache.Mu.Unlock()
+	s.background.Wait()
+	if !res.Partial {
+		t.Error("not partial")
+	}
+	for i, want := range []string{"HasPrefix", "HasSuffix"} {
+		if c := res.Results[i].Candidates; len(c) != 1 || c[0].Name != want {
+			t.Errorf("cursor %d: got %v, want %s from the cached package", req.Cursors[i], c, want)
+		}
+	}
+}
+
+func TestImportCycleDiagnostic(t *testing.T) {
+	// b was just edited to import a, which imports b.
+	gopath := t.TempDir()
+	const src = "package b\n\nimport \"a\"\n\nvar B = 1\n\nvar _ = a.A\n\nfunc Local() {}\n\nfunc f() {\n\tLo@\n}\n"
+	for name, src := range map[string]string{
+		"a/a.go": "package a\n\nimport \"b\"\n\nvar A = b.B\n",
+		"b/b.go": strings.Replace(src, "@", "", 1),
+	} {
+		filename := filepath.Join(gopath, "src", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := AutoCompleteRequest{
+		Filename:         filepath.Join(gopath, "src", "b", "b.go"),
+		Cursor:           strings.IndexByte(src, '@'),
+		Data:             []byte(strings.Replace(src, "@", "", 1)),
+		Context:          packContext(gopath),
+		FallbackToSource: true,
+	}
+	req.Context.GOPATH = gopath
+	req.Context.GO111MODULE = "off"
+	var res AutoCompleteReply
+	if err := (&Server{cache: true}).AutoComplete(&req, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Candidates) != 1 || res.Candidates[0].Name != "Local" {
+		t.Errorf("got candidates %v, want Local", res.Candidates)
+	}
+	want := []string{"import cycle not allowed: a -> b -> a"}
+	if !reflect.DeepEqual(res.Diagnostics, want) {
+		t.Errorf("got diagnostics %q, want %q", res.Diagnostics, want)
+	}
+}
@@ -0,0 +1,30 @@
+// Command formatplugin is an example formatter plugin. Build it with
+//
+//	go build -buildmode=plugin -o formatplugin.so ./testdata/formatplugin
+//
+// using the same toolchain and module versions as gocode, and use it
+// with gocode -f=plugin:formatplugin.so. It writes one candidate per
+// line, as name<TAB>class. Plugins built in other modules import
+// github.com/mdempsky/gocode/format the same way.
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mdempsky/gocode/format"
+)
+
+// Formatter is the formatter gocode loads.
+var Formatter = format.FormatterFunc(write)
+
+func write(w io.Writer, res format.Response) error {
+	for _, c := range res.Candidates {
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", c.Name, c.Class); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {}
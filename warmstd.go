@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/build"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mdempsky/gocode/internal/cache"
+)
+
+// warmStdBatch is the number of packages warm-std sends per Warm
+// request, which is how often it reports progress.
+const warmStdBatch = 20
+
+// userCacheDir is os.UserCacheDir, replaced by tests.
+var userCacheDir = os.UserCacheDir
+
+// stdExportRoot returns the directory below which the export data of
+// the standard library written by warm-std is kept, or "" if there is
+// no cache directory.
+func stdExportRoot() string {
+	dir, err := userCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gocode", "std")
+}
+
+// stdExportDir returns the directory holding the export data of the
+// standard library of ctx, one per GOROOT and target, or "" if there
+// is no cache directory.
+func stdExportDir(ctx *cache.PackedContext) string {
+	root := stdExportRoot()
+	if root == "" {
+		return ""
+	}
+	h := fnv.New64a()
+	io.WriteString(h, ctx.GOROOT)
+	return filepath.Join(root, fmt.Sprintf("%016x", h.Sum64()), ctx.GOOS+"_"+ctx.GOARCH)
+}
+
+// withStdExportDir returns dirs followed by the export directory of
+// the standard library of ctx, if warm-std wrote one. Its files are
+// verified as they are imported, which passes over the export data a
+// killed daemon left corrupt: those packages are imported from source,
+// until warm-std runs again.
+func withStdExportDir(ctx *cache.PackedContext, dirs []string) []string {
+	dir := stdExportDir(ctx)
+	if dir == "" {
+		return dirs
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return dirs
+	}
+	cache.VerifyExports(dir)
+	return append(dirs[:len(dirs):len(dirs)], dir)
+}
+
+// cmdWarmStd imports the whole standard library for a target into the
+// cache, writing its export data to the user cache directory first,
+// so that later completions for the target don't wait for it. Packages
+// whose export data is already up to date are skipped. It reports
+// progress on stderr and a summary on stdout.
+func cmdWarmStd(c *daemon) {
+	fs := flag.NewFlagSet("warm-std", flag.ExitOnError)
+	goos := fs.String("goos", build.Default.GOOS, "target operating system")
+	goarch := fs.String("goarch", build.Default.GOARCH, "target architecture")
+	fs.Parse(flag.Args()[1:])
+	if fs.NArg() != 0 {
+		log.Fatal("usage: gocode warm-std [-goos <os>] [-goarch <arch>]")
+	}
+
+	ctx := cache.PackContext(&build.Default)
+	if (*goos != ctx.GOOS || *goarch != ctx.GOARCH) && os.Getenv("CGO_ENABLED") == "" {
+		// Like the go command, don't use cgo when cross-compiling
+		// unless asked to: there is usually no C cross-compiler.
+		ctx.CgoEnabled = false
+	}
+	ctx.GOOS, ctx.GOARCH = *goos, *goarch
+	fillContext(&ctx)
+	paths, err := cache.StdPackages(ctx.GOROOT)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The file doesn't need to exist: only its directory matters,
+	// and it must not be in GOROOT, whose packages aren't imported
+	// from export data.
+	cwd, _ := os.Getwd()
+	filename := filepath.Join(cwd, "warm-std.go")
+
+	var exported, fresh, failed int
+	for start := 0; start < len(paths); start += warmStdBatch {
+		end := start + warmStdBatch
+		if end > len(paths) {
+			end = len(paths)
+		}
+		req := WarmRequest{
+			Filename:   filename,
+			Paths:      paths[start:end],
+			Context:    ctx,
+			ExportDirs: exportDirs(),
+			NoGb:       true,
+			Std:        true,
+		}
+		var res ImportsReply
+		if err := callServer(c, "Warm", &req, &res); err != nil {
+			log.Fatal(err)
+		}
+		for _, imp := range res.Imports {
+			switch {
+			case imp.Err != "":
+				failed++
+				if *g_debug {
+					log.Printf("%s: %s", imp.Path, imp.Err)
+				}
+			case imp.Fresh:
+				fresh++
+			default:
+				exported++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "\rwarm-std: %d/%d packages", end, len(paths))
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Printf("%s/%s: %d packages imported, %d already up to date, %d failed\n", ctx.GOOS, ctx.GOARCH, exported, fresh, failed)
+}
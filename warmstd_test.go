@@ -0,0 +1,149 @@
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdempsky/gocode/internal/cache"
+	"github.com/mdempsky/gocode/internal/cachefile"
+)
+
+func TestWarmStd(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	if testing.Short() {
+		t.Skip("builds export data of standard library packages")
+	}
+	dir := t.TempDir()
+	defer func(orig func() (string, error)) { userCacheDir = orig }(userCacheDir)
+	userCacheDir = func() (string, error) { return dir, nil }
+
+	paths := []string{"errors", "unicode/utf8", "strings"}
+	ctx := cache.PackContext(&build.Default)
+	fillContext(&ctx)
+	s := Server{cache: true}
+	warm := func() ImportsReply {
+		req := WarmRequest{
+			Filename: filepath.Join(dir, "warm-std.go"),
+			Paths:    paths,
+			Context:  ctx,
+			NoGb:     true,
+			Std:      true,
+		}
+		var res ImportsReply
+		if err := s.Warm(&req, &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// The go command takes a slot of go install.
+	defer func(orig func() func()) { cache.Throttle = orig }(cache.Throttle)
+	throttled := 0
+	cache.Throttle = func() func() {
+		throttled++
+		return func() {}
+	}
+
+	res := warm()
+	if throttled != 1 {
+		t.Errorf("first run: took %d slots, want 1", throttled)
+	}
+	exportDir := stdExportDir(&ctx)
+	for i, imp := range res.Imports {
+		if imp.Path != paths[i] || imp.Err != "" || imp.Fresh {
+			t.Errorf("first run: got %+v for %s", imp, paths[i])
+		}
+		if _, err := os.Stat(filepath.Join(exportDir, filepath.FromSlash(paths[i])+".a")); err != nil {
+			t.Errorf("no export data on disk: %v", err)
+		}
+	}
+
+	// Nothing is rebuilt the second time.
+	res = warm()
+	if throttled != 1 {
+		t.Errorf("second run: took a slot")
+	}
+	for i, imp := range res.Imports {
+		if imp.Err != "" || !imp.Fresh {
+			t.Errorf("second run: got %+v for %s", imp, paths[i])
+		}
+	}
+	if imp := s.cacheImporter(&ctx, filepath.Join(dir, "x.go"), nil, false, true); imp.Status("strings", dir) == cache.StatusSource {
+		t.Errorf("strings has no export data after warm-std")
+	}
+
+	// Export data torn by a killed daemon is quarantined, and
+	// rebuilt by the next run.
+	defer func(orig func(string, ...interface{})) { cachefile.Logf = orig }(cachefile.Logf)
+	cachefile.Logf = t.Logf
+	truncate := func(filename string) {
+		t.Helper()
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, data[:len(data)/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	utf8 := filepath.Join(exportDir, "unicode", "utf8.a")
+	truncate(utf8)
+	imp := s.cacheImporter(&ctx, filepath.Join(dir, "x.go"), nil, false, true)
+	imp.Status("unicode/utf8", dir)
+	if _, err := os.Stat(utf8 + cachefile.CorruptSuffix); err != nil {
+		t.Errorf("unicode/utf8 wasn't quarantined: %v", err)
+	}
+	truncate(filepath.Join(exportDir, "strings.a"))
+	// errors has no checksum, as if written by an older gocode: it
+	// is rebuilt without being quarantined.
+	errorsSum := filepath.Join(exportDir, "errors.a"+cachefile.SumSuffix)
+	if err := os.Remove(errorsSum); err != nil {
+		t.Fatal(err)
+	}
+	res = warm()
+	for i, imp := range res.Imports {
+		// strings is found corrupt by warm-std itself.
+		if imp.Err != "" || imp.Fresh {
+			t.Errorf("after corrupting: got %+v for %s, want rebuilt", imp, paths[i])
+		}
+	}
+	if _, err := os.Stat(errorsSum); err != nil {
+		t.Errorf("errors wasn't rebuilt with a checksum: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(exportDir, "errors.a"+cachefile.CorruptSuffix)); !os.IsNotExist(err) {
+		t.Errorf("errors was quarantined: %v", err)
+	}
+	for _, path := range paths {
+		if err := cachefile.VerifySum(filepath.Join(exportDir, filepath.FromSlash(path)+".a")); err != nil {
+			t.Errorf("%s after rebuilding: %v", path, err)
+		}
+	}
+}
+
+func TestStdPackages(t *testing.T) {
+	paths, err := cache.StdPackages(build.Default.GOROOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	has := make(map[string]bool)
+	for _, p := range paths {
+		has[p] = true
+	}
+	for p, want := range map[string]bool{
+		"fmt":                                 true,
+		"net/http/httptest":                   true,
+		"internal/poll":                       false,
+		"cmd/go":                              false,
+		"vendor/golang.org/x/net/http2/hpack": false,
+	} {
+		if has[p] != want {
+			t.Errorf("std package %s listed: %v, want %v", p, has[p], want)
+		}
+	}
+}